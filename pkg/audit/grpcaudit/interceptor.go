@@ -0,0 +1,370 @@
+// Package grpcaudit publishes audit events for gRPC calls, with the audit.Payload model of the HTTP middleware.
+package grpcaudit
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"net"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/formancehq/go-libs/v5/pkg/audit"
+	"github.com/formancehq/go-libs/v5/pkg/audit/httpaudit"
+	"github.com/formancehq/go-libs/v5/pkg/authn/jwt"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+// GRPCOption configures gRPC-specific audit behavior.
+type GRPCOption func(*grpcOptions)
+
+type grpcOptions struct {
+	enabled             bool
+	sensitiveMethods    map[string]struct{}
+	eventPublisher      auditEventPublisher
+	handledHeaderSecret string
+	maxBodyBytes        int
+	redactor            *httpaudit.Redactor
+}
+
+// WithSensitiveMethods sets the methods for which request and response messages should not be captured.
+// Methods are full method names, "/package.Service/Method", or services, "/package.Service/", to match all their methods.
+func WithSensitiveMethods(methods ...string) GRPCOption {
+	return func(o *grpcOptions) {
+		for _, method := range methods {
+			o.sensitiveMethods[method] = struct{}{}
+		}
+	}
+}
+
+// WithRedactor redacts the captured messages and metadata with the rules of the redactor, before publishing the audit events.
+// A message cut by the redaction, see httpaudit.Redactor.RedactBody, is flagged as truncated.
+// The routes of the rules are matched against the full method names, so "/package.Service" matches all the methods of the service.
+func WithRedactor(redactor *httpaudit.Redactor) GRPCOption {
+	return func(o *grpcOptions) {
+		o.redactor = redactor
+	}
+}
+
+// WithMaxBodyBytes caps how many bytes of the rendered request and response messages are stored in the audit event,
+// see httpaudit.WithMaxBodyBytes. A value <= 0 keeps the default cap (httpaudit.DefaultMaxCapturedBodyBytes).
+func WithMaxBodyBytes(maxBytes int) GRPCOption {
+	return func(o *grpcOptions) {
+		if maxBytes > 0 {
+			o.maxBodyBytes = maxBytes
+		}
+	}
+}
+
+// WithEnabled enables or disables gRPC audit event capture and publication.
+func WithEnabled(enabled bool) GRPCOption {
+	return func(o *grpcOptions) {
+		o.enabled = enabled
+	}
+}
+
+// WithHandledHeaderSecret sets the shared secret required to honor the audit.HandledHeader metadata,
+// see httpaudit.WithHandledHeaderSecret.
+func WithHandledHeaderSecret(secret string) GRPCOption {
+	return func(o *grpcOptions) {
+		o.handledHeaderSecret = secret
+	}
+}
+
+// WithConfig configures gRPC audit event capture from audit.Config.
+func WithConfig(config audit.Config) GRPCOption {
+	return func(o *grpcOptions) {
+		WithEnabled(config.Enabled)(o)
+		WithHandledHeaderSecret(config.HandledHeaderSecret)(o)
+	}
+}
+
+// WithAsyncPublisher publishes the audit events through a caller-managed httpaudit.AsyncPublisher,
+// which can be shared with the HTTP middleware.
+// Callers should close the publisher during shutdown to drain queued audit events.
+func WithAsyncPublisher(publisher *httpaudit.AsyncPublisher) GRPCOption {
+	return func(o *grpcOptions) {
+		if publisher != nil {
+			o.eventPublisher = publisher
+		}
+	}
+}
+
+type auditEventPublisher interface {
+	Publish(ctx context.Context, payload audit.Payload)
+}
+
+type syncAuditEventPublisher struct {
+	publisher message.Publisher
+	topicName string
+	appName   string
+}
+
+func (p syncAuditEventPublisher) Publish(ctx context.Context, payload audit.Payload) {
+	audit.PublishEvent(ctx, p.publisher, p.topicName, p.appName, payload)
+}
+
+type auditor struct {
+	options      *grpcOptions
+	auditOptions *audit.Options
+	publisher    auditEventPublisher
+}
+
+func newAuditor(publisher message.Publisher, topicName string, appName string, opts []audit.Option, grpcOpts ...GRPCOption) *auditor {
+	o := &grpcOptions{
+		sensitiveMethods: make(map[string]struct{}),
+		maxBodyBytes:     httpaudit.DefaultMaxCapturedBodyBytes,
+	}
+	for _, opt := range grpcOpts {
+		opt(o)
+	}
+
+	ret := &auditor{
+		options:      o,
+		auditOptions: audit.NewOptions(opts...),
+	}
+	if o.enabled {
+		if o.handledHeaderSecret == "" {
+			logging.Infof(
+				"WARNING: audit interceptor configured without a handled-header secret: any client sending the %s metadata can bypass the audit trail; configure WithHandledHeaderSecret (flag --%s)",
+				audit.HandledHeader, audit.AuditHandledHeaderSecretFlag,
+			)
+		}
+		ret.publisher = syncAuditEventPublisher{
+			publisher: publisher,
+			topicName: topicName,
+			appName:   appName,
+		}
+		if o.eventPublisher != nil {
+			ret.publisher = o.eventPublisher
+		}
+	}
+	return ret
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor publishing an audit event for each unary call.
+func UnaryServerInterceptor(publisher message.Publisher, topicName string, appName string, opts []audit.Option, grpcOpts ...GRPCOption) grpc.UnaryServerInterceptor {
+	a := newAuditor(publisher, topicName, appName, opts, grpcOpts...)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if a.skip(ctx) {
+			return handler(ctx, req)
+		}
+
+		sensitive := a.isSensitiveMethod(info.FullMethod)
+		request := newCapture(a.options.maxBodyBytes, !sensitive)
+		request.add(req)
+
+		resp, err := handler(ctx, req)
+
+		response := newCapture(a.options.maxBodyBytes, !sensitive)
+		if err == nil {
+			response.add(resp)
+		}
+		a.publish(ctx, info.FullMethod, request, response, err)
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor publishing an audit event for each streaming call, once it ends.
+// The messages of the streams are captured up to the cap, see WithMaxBodyBytes.
+func StreamServerInterceptor(publisher message.Publisher, topicName string, appName string, opts []audit.Option, grpcOpts ...GRPCOption) grpc.StreamServerInterceptor {
+	a := newAuditor(publisher, topicName, appName, opts, grpcOpts...)
+
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := stream.Context()
+		if a.skip(ctx) {
+			return handler(srv, stream)
+		}
+
+		sensitive := a.isSensitiveMethod(info.FullMethod)
+		wrapped := &serverStreamWrapper{
+			ServerStream: stream,
+			request:      newCapture(a.options.maxBodyBytes, !sensitive),
+			response:     newCapture(a.options.maxBodyBytes, !sensitive),
+		}
+
+		err := handler(srv, wrapped)
+		a.publish(ctx, info.FullMethod, wrapped.request, wrapped.response, err)
+
+		return err
+	}
+}
+
+// skip reports whether the call must not be audited, because audit is disabled or an upstream trusted hop already handled it
+func (a *auditor) skip(ctx context.Context) bool {
+	if !a.options.enabled {
+		return true
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get(audit.HandledHeader) {
+		if value == "" {
+			continue
+		}
+		if a.options.handledHeaderSecret == "" ||
+			subtle.ConstantTimeCompare([]byte(value), []byte(a.options.handledHeaderSecret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *auditor) isSensitiveMethod(fullMethod string) bool {
+	for method := range a.options.sensitiveMethods {
+		if fullMethod == method || (strings.HasSuffix(method, "/") && strings.HasPrefix(fullMethod, method)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *auditor) publish(ctx context.Context, fullMethod string, request, response *capture, err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	st := status.Convert(err)
+
+	requestMetadata := cloneMetadataWithout(md, "authorization", "cookie", audit.HandledHeader)
+	a.options.redactor.RedactHeaders(fullMethod, requestMetadata)
+
+	// A body cut by the redaction is flagged as truncated
+	requestBody, requestCut := a.options.redactor.RedactBody(fullMethod, request.buf.Bytes())
+	responseBody, responseCut := a.options.redactor.RedactBody(fullMethod, response.buf.Bytes())
+
+	a.publisher.Publish(ctx, audit.Payload{
+		ID:      audit.NewPayloadID(),
+		TraceID: audit.ExtractTraceID(ctx),
+		Actor:   a.extractActor(ctx, md),
+		GRPC: &audit.GRPC{
+			Request: audit.GRPCRequest{
+				Method:        fullMethod,
+				Metadata:      requestMetadata,
+				Body:          string(requestBody),
+				BodyTruncated: request.truncated || requestCut,
+			},
+			Response: audit.GRPCResponse{
+				StatusCode:    st.Code().String(),
+				StatusMessage: st.Message(),
+				Body:          string(responseBody),
+				BodyTruncated: response.truncated || responseCut,
+			},
+		},
+	})
+}
+
+func (a *auditor) extractActor(ctx context.Context, md metadata.MD) (actor audit.Actor) {
+	actor.OrganizationID = a.auditOptions.OrganizationID
+	actor.StackID = a.auditOptions.StackID
+	actor.IPAddress = extractIPAddress(ctx, md)
+
+	if a.auditOptions.KeySets != nil {
+		authorization := ""
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+		claims, tokenValidationError := jwt.ClaimsFromAuthorizationHeader(ctx, authorization, a.auditOptions.KeySets)
+		actor.Claims = claims
+		actor.TokenValidationError = audit.FormatTokenError(tokenValidationError)
+	}
+
+	return actor
+}
+
+// extractIPAddress extracts the client IP address of a call.
+// Priority: x-forwarded-for > x-real-ip > peer address.
+func extractIPAddress(ctx context.Context, md metadata.MD) string {
+	if values := md.Get("x-forwarded-for"); len(values) > 0 && values[0] != "" {
+		return strings.TrimSpace(strings.Split(values[0], ",")[0])
+	}
+	if values := md.Get("x-real-ip"); len(values) > 0 && values[0] != "" {
+		return values[0]
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	ip, _, _ := net.SplitHostPort(p.Addr.String())
+	if ip != "" {
+		return ip
+	}
+	return p.Addr.String()
+}
+
+func cloneMetadataWithout(md metadata.MD, names ...string) map[string][]string {
+	clone := md.Copy()
+	for _, name := range names {
+		// Metadata keys are lowercase
+		delete(clone, strings.ToLower(name))
+	}
+	return clone
+}
+
+// capture renders the messages of a call as protojson, one per line, up to maxBytes
+type capture struct {
+	buf       bytes.Buffer
+	maxBytes  int
+	enabled   bool
+	truncated bool
+}
+
+func newCapture(maxBytes int, enabled bool) *capture {
+	return &capture{
+		maxBytes: maxBytes,
+		enabled:  enabled,
+	}
+}
+
+func (c *capture) add(msg any) {
+	if !c.enabled || c.truncated {
+		return
+	}
+	protoMsg, ok := msg.(proto.Message)
+	if !ok {
+		return
+	}
+
+	data, err := protojson.Marshal(protoMsg)
+	if err != nil {
+		return
+	}
+	if c.buf.Len() > 0 {
+		data = append([]byte{'\n'}, data...)
+	}
+
+	remaining := c.maxBytes - c.buf.Len()
+	if len(data) > remaining {
+		c.buf.Write(data[:max(remaining, 0)])
+		c.truncated = true
+		return
+	}
+	c.buf.Write(data)
+}
+
+type serverStreamWrapper struct {
+	grpc.ServerStream
+	request  *capture
+	response *capture
+}
+
+func (s *serverStreamWrapper) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.request.add(m)
+	return nil
+}
+
+func (s *serverStreamWrapper) SendMsg(m any) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.response.add(m)
+	return nil
+}
@@ -0,0 +1,258 @@
+package grpcaudit
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/formancehq/go-libs/v5/pkg/audit"
+	"github.com/formancehq/go-libs/v5/pkg/audit/httpaudit"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+const topic = "audit-events"
+
+func newHealthClient(t *testing.T, pub message.Publisher, opts ...GRPCOption) grpc_health_v1.HealthClient {
+	t.Helper()
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("ledger", grpc_health_v1.HealthCheckResponse_SERVING)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(pub, topic, "test-app", []audit.Option{audit.WithStackID("stack")}, opts...)),
+		grpc.StreamInterceptor(StreamServerInterceptor(pub, topic, "test-app", []audit.Option{audit.WithStackID("stack")}, opts...)),
+	)
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return grpc_health_v1.NewHealthClient(conn)
+}
+
+func readPayloads(t *testing.T, pub interface {
+	AllMessages() map[string][]*message.Message
+}) []audit.Payload {
+	t.Helper()
+
+	ret := make([]audit.Payload, 0)
+	for _, msg := range pub.AllMessages()[topic] {
+		event := struct {
+			Type    string        `json:"type"`
+			Payload audit.Payload `json:"payload"`
+		}{}
+		require.NoError(t, json.Unmarshal(msg.Payload, &event))
+		require.Equal(t, audit.EventTypeAudit, event.Type)
+		ret = append(ret, event.Payload)
+	}
+	return ret
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true))
+
+	ctx := metadata.AppendToOutgoingContext(logging.TestingContext(),
+		"authorization", "Bearer secret",
+		"x-forwarded-for", "10.0.0.1, 10.0.0.2",
+		"x-request-id", "1",
+	)
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	payloads := readPayloads(t, pub)
+	require.Len(t, payloads, 2)
+
+	payload := payloads[0]
+	require.NotNil(t, payload.GRPC)
+	assert.NotEmpty(t, payload.ID)
+	assert.Equal(t, "stack", payload.Actor.StackID)
+	assert.Equal(t, "10.0.0.1", payload.Actor.IPAddress)
+	assert.Equal(t, grpc_health_v1.Health_Check_FullMethodName, payload.GRPC.Request.Method)
+	assert.Equal(t, []string{"1"}, payload.GRPC.Request.Metadata["x-request-id"])
+	assert.NotContains(t, payload.GRPC.Request.Metadata, "authorization")
+	assert.JSONEq(t, `{"service": "ledger"}`, payload.GRPC.Request.Body)
+	assert.Equal(t, codes.OK.String(), payload.GRPC.Response.StatusCode)
+	assert.JSONEq(t, `{"status": "SERVING"}`, payload.GRPC.Response.Body)
+
+	payload = payloads[1]
+	assert.Equal(t, codes.NotFound.String(), payload.GRPC.Response.StatusCode)
+	assert.NotEmpty(t, payload.GRPC.Response.StatusMessage)
+	assert.Empty(t, payload.GRPC.Response.Body)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true))
+
+	ctx, cancel := context.WithCancel(logging.TestingContext())
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	cancel()
+
+	require.Eventually(t, func() bool {
+		return len(pub.AllMessages()[topic]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	payload := readPayloads(t, pub)[0]
+	assert.Equal(t, grpc_health_v1.Health_Watch_FullMethodName, payload.GRPC.Request.Method)
+	assert.JSONEq(t, `{"service": "ledger"}`, payload.GRPC.Request.Body)
+	assert.JSONEq(t, `{"status": "SERVING"}`, payload.GRPC.Response.Body)
+	assert.Equal(t, codes.Canceled.String(), payload.GRPC.Response.StatusCode)
+}
+
+func TestInterceptorDisabledByDefault(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub)
+
+	_, err := client.Check(logging.TestingContext(), &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+	require.Empty(t, pub.AllMessages()[topic])
+}
+
+func TestInterceptorSensitiveMethods(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true), WithSensitiveMethods("/grpc.health.v1.Health/"))
+
+	_, err := client.Check(logging.TestingContext(), &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+
+	payloads := readPayloads(t, pub)
+	require.Len(t, payloads, 1)
+	assert.Empty(t, payloads[0].GRPC.Request.Body)
+	assert.Empty(t, payloads[0].GRPC.Response.Body)
+	assert.Equal(t, codes.OK.String(), payloads[0].GRPC.Response.StatusCode)
+}
+
+func TestInterceptorMaxBodyBytes(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true), WithMaxBodyBytes(10))
+
+	_, err := client.Check(logging.TestingContext(), &grpc_health_v1.HealthCheckRequest{Service: strings.Repeat("a", 100)})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	payloads := readPayloads(t, pub)
+	require.Len(t, payloads, 1)
+	assert.Len(t, payloads[0].GRPC.Request.Body, 10)
+	assert.True(t, payloads[0].GRPC.Request.BodyTruncated)
+}
+
+func TestInterceptorHandledHeader(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true), WithHandledHeaderSecret("secret"))
+
+	forged := metadata.AppendToOutgoingContext(logging.TestingContext(), audit.HandledHeader, "true")
+	_, err := client.Check(forged, &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+	require.Len(t, pub.AllMessages()[topic], 1)
+
+	trusted := metadata.AppendToOutgoingContext(logging.TestingContext(), audit.HandledHeader, "secret")
+	_, err = client.Check(trusted, &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+	require.Len(t, pub.AllMessages()[topic], 1)
+}
+
+func TestInterceptorAsyncPublisher(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	asyncPublisher := httpaudit.NewAsyncPublisher(pub, topic, "test-app")
+	client := newHealthClient(t, pub, WithEnabled(true), WithAsyncPublisher(asyncPublisher))
+
+	_, err := client.Check(logging.TestingContext(), &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+
+	require.NoError(t, asyncPublisher.Close(context.Background()))
+	require.Len(t, pub.AllMessages()[topic], 1)
+	require.Equal(t, uint64(1), asyncPublisher.Stats().Published)
+}
+
+func TestInterceptorRedactor(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := httpaudit.NewRedactor([]httpaudit.RedactionRule{
+		{Route: "/grpc.health.v1.Health", JSONPath: "$.service", Action: httpaudit.RedactionMask},
+		{Header: "x-api-key", Action: httpaudit.RedactionDrop},
+	})
+	require.NoError(t, err)
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true), WithRedactor(redactor))
+
+	ctx := metadata.AppendToOutgoingContext(logging.TestingContext(), "x-api-key", "secret")
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "ledger"})
+	require.NoError(t, err)
+
+	payloads := readPayloads(t, pub)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, `{"service":"***"}`, payloads[0].GRPC.Request.Body)
+	assert.JSONEq(t, `{"status": "SERVING"}`, payloads[0].GRPC.Response.Body)
+	assert.NotContains(t, payloads[0].GRPC.Request.Metadata, "x-api-key")
+}
+
+func TestInterceptorRedactorStopsAtTruncatedBody(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := httpaudit.NewRedactor([]httpaudit.RedactionRule{
+		{JSONPath: "$.service", Action: httpaudit.RedactionMask},
+	})
+	require.NoError(t, err)
+
+	pub := publish.InMemory()
+	client := newHealthClient(t, pub, WithEnabled(true), WithRedactor(redactor), WithMaxBodyBytes(20))
+
+	_, err = client.Check(logging.TestingContext(), &grpc_health_v1.HealthCheckRequest{Service: strings.Repeat("a", 100)})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	payloads := readPayloads(t, pub)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, `{"service":`, payloads[0].GRPC.Request.Body)
+	assert.True(t, payloads[0].GRPC.Request.BodyTruncated)
+}
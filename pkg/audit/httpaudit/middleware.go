@@ -29,6 +29,7 @@ type httpOptions struct {
 	handledHeaderSecret string
 	maxBodyBytes        int
 	maxQueryParamsBytes int
+	redactor            *Redactor
 }
 
 const (
@@ -45,6 +46,7 @@ const (
 )
 
 // WithSensitivePaths sets path prefixes for which request and response bodies should not be captured.
+// To only hide some fields of the bodies, see WithRedactor.
 func WithSensitivePaths(paths ...string) HTTPOption {
 	return func(o *httpOptions) {
 		for _, p := range paths {
@@ -212,6 +214,7 @@ func Middleware(publisher message.Publisher, topicName string, appName string, o
 			}
 
 			requestHeaders := cloneHeaderWithout(r.Header, "Authorization", "Cookie", audit.HandledHeader)
+			ho.redactor.RedactHeaders(r.URL.Path, requestHeaders)
 
 			r.Header.Set(audit.HandledHeader, handledHeaderValue)
 
@@ -232,10 +235,15 @@ func Middleware(publisher message.Publisher, topicName string, appName string, o
 			responseBody := ""
 			responseBodyTruncated := false
 			if !sensitivePath {
-				responseBody = rww.body.String()
-				responseBodyTruncated = rww.bodyTruncated
+				redacted, cut := ho.redactor.RedactBody(r.URL.Path, rww.body.Bytes())
+				responseBody = string(redacted)
+				responseBodyTruncated = rww.bodyTruncated || cut
 			}
 			responseHeaders := cloneHeaderWithout(rww.Header(), "Set-Cookie")
+			ho.redactor.RedactHeaders(r.URL.Path, responseHeaders)
+
+			requestBody, cut := ho.redactor.RedactBody(r.URL.Path, body)
+			requestBodyTruncated = requestBodyTruncated || cut
 
 			actor := audit.ExtractClaims(r, auditOpts)
 
@@ -251,7 +259,7 @@ func Middleware(publisher message.Publisher, topicName string, appName string, o
 						QueryParamsTruncated: queryParamsTruncated,
 						Host:                 r.Host,
 						Header:               requestHeaders,
-						Body:                 string(body),
+						Body:                 string(requestBody),
 						BodyTruncated:        requestBodyTruncated,
 					},
 					Response: audit.HTTPResponse{
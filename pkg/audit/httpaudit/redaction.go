@@ -0,0 +1,440 @@
+package httpaudit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RedactionAction tells how a redaction rule hides the values it selects.
+type RedactionAction string
+
+const (
+	// RedactionMask replaces the values with RedactedValue.
+	RedactionMask RedactionAction = "mask"
+	// RedactionHash replaces the values with "hmac-sha256:" followed by their hex encoded HMAC-SHA256,
+	// keyed by WithRedactionHashKey, so that equal values can still be correlated across audit events.
+	RedactionHash RedactionAction = "hash"
+	// RedactionDrop removes the values, with their field name for object fields.
+	RedactionDrop RedactionAction = "drop"
+)
+
+// RedactedValue replaces the values masked by a RedactionMask rule.
+const RedactedValue = "***"
+
+// RedactionRule selects values of the captured bodies or headers which must not be published as is.
+// Exactly one of JSONPath and Header must be set.
+type RedactionRule struct {
+	// Route is the path prefix of the requests the rule applies to, matched like WithSensitivePaths.
+	// The rule applies to all requests when empty.
+	Route string
+	// JSONPath selects values of the JSON request and response bodies, like "$.account.iban",
+	// "$.cards[*].number" or "**.password".
+	// "*" matches any field or array element, "[*]" any array element and "**" any number of fields and array elements.
+	// Field names containing dots can be quoted, like "$['account.iban']".
+	JSONPath string
+	// Header selects a request or response header, case-insensitively.
+	Header string
+	Action RedactionAction
+}
+
+// RedactorOption configures a Redactor.
+type RedactorOption func(*Redactor)
+
+// WithRedactionHashKey sets the key of the HMAC used by RedactionHash rules, which require it.
+// Without a secret key, short values like card numbers could be recovered from their hash by brute force.
+func WithRedactionHashKey(key []byte) RedactorOption {
+	return func(r *Redactor) {
+		r.hashKey = key
+	}
+}
+
+// Redactor applies redaction rules to the captured bodies and headers, before they are published.
+// The bodies are redacted once captured, so only their first WithMaxBodyBytes bytes:
+// the rest is never part of the audit events.
+// A nil Redactor does not redact anything.
+type Redactor struct {
+	rules   []redactionRule
+	hashKey []byte
+}
+
+type redactionRule struct {
+	RedactionRule
+	jsonPath []jsonPathSegment
+}
+
+// NewRedactor validates the rules and creates a Redactor applying them.
+// When several rules select a value, the first one applies.
+// RedactionHash rules require a key set with WithRedactionHashKey.
+func NewRedactor(rules []RedactionRule, opts ...RedactorOption) (*Redactor, error) {
+	ret := &Redactor{
+		rules: make([]redactionRule, 0, len(rules)),
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	for i, rule := range rules {
+		switch rule.Action {
+		case RedactionMask, RedactionHash, RedactionDrop:
+		default:
+			return nil, fmt.Errorf("redaction rule %d: invalid action '%s'", i, rule.Action)
+		}
+		if (rule.JSONPath == "") == (rule.Header == "") {
+			return nil, fmt.Errorf("redaction rule %d: exactly one of JSON path and header must be set", i)
+		}
+		if rule.Action == RedactionHash && len(ret.hashKey) == 0 {
+			return nil, fmt.Errorf("redaction rule %d: hash rules require a key, see WithRedactionHashKey", i)
+		}
+
+		compiled := redactionRule{RedactionRule: rule}
+		if rule.JSONPath != "" {
+			jsonPath, err := parseJSONPath(rule.JSONPath)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %d: %w", i, err)
+			}
+			compiled.jsonPath = jsonPath
+		}
+		ret.rules = append(ret.rules, compiled)
+	}
+
+	return ret, nil
+}
+
+// WithRedactor redacts the captured bodies and headers with the rules of the redactor, before publishing the audit events.
+// A body cut by the redaction, see Redactor.RedactBody, is flagged as truncated.
+func WithRedactor(redactor *Redactor) HTTPOption {
+	return func(o *httpOptions) {
+		o.redactor = redactor
+	}
+}
+
+// RedactHeaders redacts in place the headers of a request to route.
+func (r *Redactor) RedactHeaders(route string, headers map[string][]string) {
+	if r == nil {
+		return
+	}
+
+	for name, values := range headers {
+		for _, rule := range r.rules {
+			if rule.Header == "" || !strings.EqualFold(rule.Header, name) || !rule.appliesTo(route) {
+				continue
+			}
+			if rule.Action == RedactionDrop {
+				delete(headers, name)
+				break
+			}
+			redacted := make([]string, 0, len(values))
+			for _, value := range values {
+				redacted = append(redacted, r.redactString(rule.Action, value))
+			}
+			headers[name] = redacted
+			break
+		}
+	}
+}
+
+// RedactBody redacts a body of a request to route, made of JSON values separated by whitespace.
+// The body is returned as is when no JSON path rule applies to the route.
+// Otherwise, its values are streamed through the rules and written compacted, one per line.
+// As the values to redact cannot be located past invalid JSON, notably the end of truncated bodies,
+// the redacted body stops there, and RedactBody reports it was cut.
+func (r *Redactor) RedactBody(route string, body []byte) ([]byte, bool) {
+	if r == nil || len(body) == 0 {
+		return body, false
+	}
+
+	rules := make([]redactionRule, 0)
+	for _, rule := range r.rules {
+		if rule.jsonPath != nil && rule.appliesTo(route) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return body, false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	w := &bodyRedactor{
+		redactor: r,
+		rules:    rules,
+		decoder:  decoder,
+		out:      bytes.NewBuffer(make([]byte, 0, len(body))),
+	}
+	for first := true; decoder.More(); first = false {
+		if !first {
+			w.out.WriteByte('\n')
+		}
+		if err := w.redactValue(nil); err != nil {
+			return w.out.Bytes(), true
+		}
+	}
+
+	return w.out.Bytes(), false
+}
+
+func (r redactionRule) appliesTo(route string) bool {
+	return r.Route == "" || pathMatchesPrefix(route, r.Route)
+}
+
+func (r *Redactor) redactString(action RedactionAction, value string) string {
+	if action == RedactionHash {
+		h := hmac.New(sha256.New, r.hashKey)
+		h.Write([]byte(value))
+		return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	return RedactedValue
+}
+
+// bodyRedactor copies the tokens of a JSON body to out, replacing the values selected by the rules
+type bodyRedactor struct {
+	redactor *Redactor
+	rules    []redactionRule
+	decoder  *json.Decoder
+	out      *bytes.Buffer
+}
+
+func (b *bodyRedactor) match(path []jsonPathElement) *redactionRule {
+	for i := range b.rules {
+		if matchJSONPath(b.rules[i].jsonPath, path) {
+			return &b.rules[i]
+		}
+	}
+	return nil
+}
+
+// redactValue copies the next value of the decoder, located at path
+func (b *bodyRedactor) redactValue(path []jsonPathElement) error {
+	if rule := b.match(path); rule != nil {
+		return b.replaceValue(rule.Action)
+	}
+
+	token, err := b.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		b.out.WriteByte('{')
+		first := true
+		for b.decoder.More() {
+			token, err := b.decoder.Token()
+			if err != nil {
+				return err
+			}
+			key, ok := token.(string)
+			if !ok {
+				return errors.New("expected object key")
+			}
+
+			child := append(path[:len(path):len(path)], jsonPathElement{key: key, index: -1})
+			if rule := b.match(child); rule != nil && rule.Action == RedactionDrop {
+				if err := b.skipValue(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !first {
+				b.out.WriteByte(',')
+			}
+			first = false
+			if err := b.writeToken(key); err != nil {
+				return err
+			}
+			b.out.WriteByte(':')
+			if err := b.redactValue(child); err != nil {
+				return err
+			}
+		}
+		if _, err := b.decoder.Token(); err != nil {
+			return err
+		}
+		b.out.WriteByte('}')
+	case json.Delim('['):
+		b.out.WriteByte('[')
+		first := true
+		for index := 0; b.decoder.More(); index++ {
+			child := append(path[:len(path):len(path)], jsonPathElement{index: index})
+			if rule := b.match(child); rule != nil && rule.Action == RedactionDrop {
+				if err := b.skipValue(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !first {
+				b.out.WriteByte(',')
+			}
+			first = false
+			if err := b.redactValue(child); err != nil {
+				return err
+			}
+		}
+		if _, err := b.decoder.Token(); err != nil {
+			return err
+		}
+		b.out.WriteByte(']')
+	default:
+		return b.writeToken(token)
+	}
+
+	return nil
+}
+
+// replaceValue consumes the next value of the decoder and writes its replacement
+func (b *bodyRedactor) replaceValue(action RedactionAction) error {
+	var raw json.RawMessage
+	if err := b.decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if action == RedactionDrop {
+		// Only the root value can be dropped here, fields and elements are dropped by their container
+		return nil
+	}
+
+	value := string(raw)
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		value = s
+	} else {
+		compacted := bytes.NewBuffer(nil)
+		if err := json.Compact(compacted, raw); err == nil {
+			value = compacted.String()
+		}
+	}
+
+	return b.writeToken(b.redactor.redactString(action, value))
+}
+
+func (b *bodyRedactor) skipValue() error {
+	var raw json.RawMessage
+	return b.decoder.Decode(&raw)
+}
+
+func (b *bodyRedactor) writeToken(token json.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	b.out.Write(data)
+	return nil
+}
+
+// jsonPathElement is a field name, or an array index when index >= 0
+type jsonPathElement struct {
+	key   string
+	index int
+}
+
+type jsonPathSegmentKind int
+
+const (
+	jsonPathKey jsonPathSegmentKind = iota
+	jsonPathIndex
+	jsonPathAnyIndex
+	jsonPathWildcard
+	jsonPathRecursive
+)
+
+type jsonPathSegment struct {
+	kind  jsonPathSegmentKind
+	key   string
+	index int
+}
+
+func (s jsonPathSegment) matches(element jsonPathElement) bool {
+	switch s.kind {
+	case jsonPathKey:
+		return element.index < 0 && element.key == s.key
+	case jsonPathIndex:
+		return element.index == s.index
+	case jsonPathAnyIndex:
+		return element.index >= 0
+	default:
+		return true
+	}
+}
+
+func matchJSONPath(pattern []jsonPathSegment, path []jsonPathElement) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0].kind == jsonPathRecursive {
+		for i := 0; i <= len(path); i++ {
+			if matchJSONPath(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || !pattern[0].matches(path[0]) {
+		return false
+	}
+	return matchJSONPath(pattern[1:], path[1:])
+}
+
+// parseJSONPath parses paths like "$.a.b", "$.a[0]", "$.a[*].b", "$['a.b']", "a.*" or "**.b"
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		rest = "." + path
+	}
+
+	ret := make([]jsonPathSegment, 0)
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+
+			switch name {
+			case "":
+				return nil, fmt.Errorf("invalid JSON path '%s': empty field name", path)
+			case "*":
+				ret = append(ret, jsonPathSegment{kind: jsonPathWildcard})
+			case "**":
+				ret = append(ret, jsonPathSegment{kind: jsonPathRecursive})
+			default:
+				ret = append(ret, jsonPathSegment{kind: jsonPathKey, key: name})
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path '%s': unclosed bracket", path)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+
+			switch {
+			case selector == "*":
+				ret = append(ret, jsonPathSegment{kind: jsonPathAnyIndex})
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				ret = append(ret, jsonPathSegment{kind: jsonPathKey, key: selector[1 : len(selector)-1]})
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid JSON path '%s': invalid selector '[%s]'", path, selector)
+				}
+				ret = append(ret, jsonPathSegment{kind: jsonPathIndex, index: index})
+			}
+		default:
+			return nil, fmt.Errorf("invalid JSON path '%s': unexpected '%c'", path, rest[0])
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,270 @@
+package httpaudit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/audit"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+var hashKey = []byte("key")
+
+func hmacHex(value string) string {
+	h := hmac.New(sha256.New, hashKey)
+	h.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func redactBody(redactor *Redactor, route string, body []byte) string {
+	ret, _ := redactor.RedactBody(route, body)
+	return string(ret)
+}
+
+func TestRedactor_RedactBody(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"account": {"iban": "FR7630006000011234567890189", "name": "Jane"}, "cards": [{"number": "4111111111111111", "cvc": 123}], "password": "p", "nested": {"password": {"a": 1}}}`
+
+	type testCase struct {
+		name     string
+		rule     RedactionRule
+		expected string
+	}
+	for _, tc := range []testCase{
+		{
+			name:     "mask field",
+			rule:     RedactionRule{JSONPath: "$.account.iban", Action: RedactionMask},
+			expected: `{"account":{"iban":"***","name":"Jane"},"cards":[{"number":"4111111111111111","cvc":123}],"password":"p","nested":{"password":{"a":1}}}`,
+		},
+		{
+			name:     "hash array elements",
+			rule:     RedactionRule{JSONPath: "$.cards[*].number", Action: RedactionHash},
+			expected: `{"account":{"iban":"FR7630006000011234567890189","name":"Jane"},"cards":[{"number":"` + hmacHex("4111111111111111") + `","cvc":123}],"password":"p","nested":{"password":{"a":1}}}`,
+		},
+		{
+			name:     "drop recursively",
+			rule:     RedactionRule{JSONPath: "**.password", Action: RedactionDrop},
+			expected: `{"account":{"iban":"FR7630006000011234567890189","name":"Jane"},"cards":[{"number":"4111111111111111","cvc":123}],"nested":{}}`,
+		},
+		{
+			name:     "mask wildcard",
+			rule:     RedactionRule{JSONPath: "$.cards[0].*", Action: RedactionMask},
+			expected: `{"account":{"iban":"FR7630006000011234567890189","name":"Jane"},"cards":[{"number":"***","cvc":"***"}],"password":"p","nested":{"password":{"a":1}}}`,
+		},
+		{
+			name:     "drop array element",
+			rule:     RedactionRule{JSONPath: "$.cards[0]", Action: RedactionDrop},
+			expected: `{"account":{"iban":"FR7630006000011234567890189","name":"Jane"},"cards":[],"password":"p","nested":{"password":{"a":1}}}`,
+		},
+		{
+			name:     "other route",
+			rule:     RedactionRule{Route: "/other", JSONPath: "$.password", Action: RedactionMask},
+			expected: body,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			redactor, err := NewRedactor([]RedactionRule{tc.rule}, WithRedactionHashKey(hashKey))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, redactBody(redactor, "/accounts", []byte(body)))
+		})
+	}
+}
+
+func TestRedactor_RedactBodyStopsAtInvalidJSON(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := NewRedactor([]RedactionRule{{JSONPath: "$.secret", Action: RedactionMask}})
+	require.NoError(t, err)
+
+	// A truncated body must not leak the beginning of the redacted value
+	redacted, cut := redactor.RedactBody("/", []byte(`{"id": 1, "secret": "abcd`))
+	require.Equal(t, `{"id":1,"secret":`, string(redacted))
+	require.True(t, cut)
+
+	redacted, cut = redactor.RedactBody("/", []byte(`secret=abcd`))
+	require.Empty(t, string(redacted))
+	require.True(t, cut)
+
+	redacted, cut = redactor.RedactBody("/", []byte(`{"secret": "a"} {"secret": "b"}`))
+	require.Equal(t, "{\"secret\":\"***\"}\n{\"secret\":\"***\"}", string(redacted))
+	require.False(t, cut)
+}
+
+func TestRedactor_HashKey(t *testing.T) {
+	t.Parallel()
+
+	rules := []RedactionRule{{JSONPath: "$.secret", Action: RedactionHash}}
+	_, err := NewRedactor(rules)
+	require.Error(t, err, "hash rules require a key")
+
+	redactor, err := NewRedactor(rules, WithRedactionHashKey(hashKey))
+	require.NoError(t, err)
+	require.Equal(t, `{"secret":"`+hmacHex("a")+`"}`, redactBody(redactor, "/", []byte(`{"secret": "a"}`)))
+
+	otherRedactor, err := NewRedactor(rules, WithRedactionHashKey([]byte("other key")))
+	require.NoError(t, err)
+	require.NotEqual(t, redactBody(redactor, "/", []byte(`{"secret": "a"}`)), redactBody(otherRedactor, "/", []byte(`{"secret": "a"}`)))
+}
+
+func TestRedactor_RedactHeaders(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := NewRedactor([]RedactionRule{
+		{Header: "X-Api-Key", Action: RedactionMask},
+		{Header: "x-signature", Action: RedactionHash},
+		{Header: "X-Internal", Action: RedactionDrop},
+		{Route: "/other", Header: "X-Request-Id", Action: RedactionDrop},
+	}, WithRedactionHashKey(hashKey))
+	require.NoError(t, err)
+
+	headers := http.Header{
+		"X-Api-Key":    {"key"},
+		"X-Signature":  {"signature"},
+		"X-Internal":   {"value"},
+		"X-Request-Id": {"1"},
+	}
+	redactor.RedactHeaders("/accounts", headers)
+	require.Equal(t, http.Header{
+		"X-Api-Key":    {RedactedValue},
+		"X-Signature":  {hmacHex("signature")},
+		"X-Request-Id": {"1"},
+	}, headers)
+}
+
+func TestNewRedactor_InvalidRules(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []RedactionRule{
+		{JSONPath: "$.a", Action: "encrypt"},
+		{Action: RedactionMask},
+		{JSONPath: "$.a", Header: "X-A", Action: RedactionMask},
+		{JSONPath: "$..a", Action: RedactionMask},
+		{JSONPath: "$.a[", Action: RedactionMask},
+		{JSONPath: "$.a[-1]", Action: RedactionMask},
+		{JSONPath: "$a", Action: RedactionMask},
+	} {
+		_, err := NewRedactor([]RedactionRule{rule})
+		require.Error(t, err, "rule %+v", rule)
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	t.Parallel()
+
+	segments, err := parseJSONPath("$['account.iban'][2].*.**")
+	require.NoError(t, err)
+	require.Equal(t, []jsonPathSegment{
+		{kind: jsonPathKey, key: "account.iban"},
+		{kind: jsonPathIndex, index: 2},
+		{kind: jsonPathWildcard},
+		{kind: jsonPathRecursive},
+	}, segments)
+
+	segments, err = parseJSONPath("**.password")
+	require.NoError(t, err)
+	require.Equal(t, []jsonPathSegment{
+		{kind: jsonPathRecursive},
+		{kind: jsonPathKey, key: "password"},
+	}, segments)
+}
+
+func TestMiddleware_Redactor(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	topic := "audit-events"
+
+	redactor, err := NewRedactor([]RedactionRule{
+		{Route: "/api/accounts", JSONPath: "$.iban", Action: RedactionMask},
+		{JSONPath: "**.password", Action: RedactionDrop},
+		{Header: "X-Api-Key", Action: RedactionMask},
+	})
+	require.NoError(t, err)
+
+	handler := Middleware(pub, topic, "test-app", nil, WithEnabled(true), WithRedactor(redactor))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Api-Key", "response-key")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id": "1", "iban": "FR7630006000011234567890189"}`))
+		}),
+	)
+
+	req := httptest.NewRequest("POST", "/api/accounts/1", strings.NewReader(`{"iban": "FR7630006000011234567890189", "owner": {"password": "secret"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", "request-key")
+	req = req.WithContext(logging.TestingContext())
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, `{"id": "1", "iban": "FR7630006000011234567890189"}`, rr.Body.String())
+	require.Equal(t, "response-key", rr.Header().Get("X-Api-Key"))
+
+	messages := pub.AllMessages()[topic]
+	require.Len(t, messages, 1)
+
+	var event publish.EventMessage
+	require.NoError(t, json.Unmarshal(messages[0].Payload, &event))
+
+	payloadBytes, _ := json.Marshal(event.Payload)
+	var payload audit.Payload
+	require.NoError(t, json.Unmarshal(payloadBytes, &payload))
+
+	assert.Equal(t, `{"iban":"***","owner":{}}`, payload.HTTP.Request.Body)
+	assert.Equal(t, `{"id":"1","iban":"***"}`, payload.HTTP.Response.Body)
+	assert.Equal(t, []string{RedactedValue}, payload.HTTP.Request.Header["X-Api-Key"])
+	assert.Equal(t, []string{RedactedValue}, payload.HTTP.Response.Headers["X-Api-Key"])
+	assert.NotContains(t, string(messages[0].Payload), "FR7630006000011234567890189")
+	assert.NotContains(t, string(messages[0].Payload), "secret")
+	assert.NotContains(t, string(messages[0].Payload), "request-key")
+}
+
+func TestMiddleware_RedactorFlagsCutBodies(t *testing.T) {
+	t.Parallel()
+
+	pub := publish.InMemory()
+	topic := "audit-events"
+
+	redactor, err := NewRedactor([]RedactionRule{{JSONPath: "$.secret", Action: RedactionMask}})
+	require.NoError(t, err)
+
+	handler := Middleware(pub, topic, "test-app", nil, WithEnabled(true), WithRedactor(redactor))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"id": "1"}`))
+		}),
+	)
+
+	// Not a JSON body, so the redaction drops it
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`secret=abcd`))
+	req = req.WithContext(logging.TestingContext())
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	messages := pub.AllMessages()[topic]
+	require.Len(t, messages, 1)
+
+	var event publish.EventMessage
+	require.NoError(t, json.Unmarshal(messages[0].Payload, &event))
+
+	payloadBytes, _ := json.Marshal(event.Payload)
+	var payload audit.Payload
+	require.NoError(t, json.Unmarshal(payloadBytes, &payload))
+
+	require.Empty(t, payload.HTTP.Request.Body)
+	require.True(t, payload.HTTP.Request.BodyTruncated)
+	require.Equal(t, `{"id":"1"}`, payload.HTTP.Response.Body)
+	require.False(t, payload.HTTP.Response.BodyTruncated)
+}
@@ -28,7 +28,9 @@ type Payload struct {
 	ID      string `json:"id"`
 	TraceID string `json:"trace_id"`
 	Actor   Actor  `json:"actor"`
-	HTTP    HTTP   `json:"http"`
+	HTTP    HTTP   `json:"http,omitzero"`
+	// GRPC is set instead of HTTP for the calls audited by the grpcaudit interceptors
+	GRPC *GRPC `json:"grpc,omitempty"`
 }
 
 type Actor struct {
@@ -61,3 +63,25 @@ type HTTPResponse struct {
 	Body          string      `json:"body,omitempty"`
 	BodyTruncated bool        `json:"body_truncated,omitempty"`
 }
+
+type GRPC struct {
+	Request  GRPCRequest  `json:"request"`
+	Response GRPCResponse `json:"response"`
+}
+
+type GRPCRequest struct {
+	// Method is the full method name, "/package.Service/Method"
+	Method   string              `json:"method"`
+	Metadata map[string][]string `json:"metadata"`
+	// Body holds the request messages rendered as protojson, one per line for client streams
+	Body          string `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+type GRPCResponse struct {
+	StatusCode    string `json:"status_code"`
+	StatusMessage string `json:"status_message,omitempty"`
+	// Body holds the response messages rendered as protojson, one per line for server streams
+	Body          string `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
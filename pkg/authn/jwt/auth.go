@@ -1,6 +1,7 @@
 package jwt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -78,7 +79,12 @@ var (
 )
 
 func ClaimsFromRequest(r *http.Request, keySets map[string]oidc.KeySet) (*oidc.AccessTokenClaims, error) {
-	authHeader := r.Header.Get("authorization")
+	return ClaimsFromAuthorizationHeader(r.Context(), r.Header.Get("authorization"), keySets)
+}
+
+// ClaimsFromAuthorizationHeader validates the bearer token of an authorization header value,
+// for transports other than HTTP, like gRPC metadata.
+func ClaimsFromAuthorizationHeader(ctx context.Context, authHeader string, keySets map[string]oidc.KeySet) (*oidc.AccessTokenClaims, error) {
 	if authHeader == "" {
 		return nil, ErrNoAuthorizationHeader
 	}
@@ -115,7 +121,7 @@ func ClaimsFromRequest(r *http.Request, keySets map[string]oidc.KeySet) (*oidc.A
 	}
 
 	if _, err = oidc.CheckSignature(
-		r.Context(),
+		ctx,
 		decrypted,
 		payload,
 		[]string{}, // Default to RS256
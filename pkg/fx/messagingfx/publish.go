@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	wHttp "github.com/ThreeDotsLabs/watermill-http/v2/pkg/http"
 	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
 	wNats "github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -31,8 +33,13 @@ import (
 
 	"github.com/formancehq/go-libs/v5/pkg/cloud/aws/iam"
 	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/amqp"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/batch"
 	circuitbreaker "github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit"
 	circuitstorage "github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/outbox"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/routing"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/schemaregistry"
 	topicmapper "github.com/formancehq/go-libs/v5/pkg/messaging/publish/topicmap"
 	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
 	"github.com/formancehq/go-libs/v5/pkg/service"
@@ -65,6 +72,20 @@ func GoChannelModule() fx.Option {
 	)
 }
 
+// publisherBinding provides the publisher of a backend as the message.Publisher
+func publisherBinding[T message.Publisher]() fx.Option {
+	return fx.Provide(func(publisher T) message.Publisher {
+		return publisher
+	})
+}
+
+// subscriberBinding provides the subscriber of a backend as the message.Subscriber
+func subscriberBinding[T message.Subscriber]() fx.Option {
+	return fx.Provide(func(subscriber T) message.Subscriber {
+		return subscriber
+	})
+}
+
 func Module(topics map[string]string) fx.Option {
 	options := fx.Options(
 		defaultLoggingModule(),
@@ -97,8 +118,17 @@ func Module(topics map[string]string) fx.Option {
 			})
 			return nil
 		}),
-		fx.Provide(func(publisher message.Publisher) *topicmapper.TopicMapperPublisherDecorator {
-			return topicmapper.NewPublisherDecorator(publisher, topics)
+		fx.Provide(func(params struct {
+			fx.In
+
+			Publisher message.Publisher
+			Batching  *batch.PublisherDecorator `optional:"true"`
+		}) *topicmapper.TopicMapperPublisherDecorator {
+			// The batching decorator, if any, wraps the message.Publisher of the container
+			if params.Batching != nil {
+				return topicmapper.NewPublisherDecorator(params.Batching, topics)
+			}
+			return topicmapper.NewPublisherDecorator(params.Publisher, topics)
 		}),
 	)
 	return options
@@ -116,10 +146,18 @@ func ProvideSaramaOption(options ...publish.SaramaOption) fx.Option {
 }
 
 func KafkaModule(clientId string, consumerGroup string, brokers ...string) fx.Option {
+	return fx.Options(
+		kafkaModule(clientId, consumerGroup, brokers...),
+		publisherBinding[*kafka.Publisher](),
+		subscriberBinding[*kafka.Subscriber](),
+	)
+}
+
+func kafkaModule(clientId string, consumerGroup string, brokers ...string) fx.Option {
 	return fx.Options(
 		fx.Supply(publish.ClientID(clientId)),
 		fx.Supply(sarama.V1_0_0_0),
-		fx.Supply(fx.Annotate(kafka.DefaultMarshaler{}, fx.As(new(kafka.Marshaler)))),
+		fx.Supply(fx.Annotate(publish.NewKafkaPartitionKeyMarshaler(kafka.DefaultMarshaler{}), fx.As(new(kafka.Marshaler)))),
 		fx.Supply(fx.Annotate(kafka.DefaultMarshaler{}, fx.As(new(kafka.Unmarshaler)))),
 		fx.Provide(fx.Annotate(publish.NewSaramaConfig, fx.ParamTags(``, ``, `group:"saramaOptions"`))),
 		fx.Provide(func(lc fx.Lifecycle, logger watermill.LoggerAdapter, marshaller kafka.Marshaler, config *sarama.Config) (*kafka.Publisher, error) {
@@ -146,16 +184,40 @@ func KafkaModule(clientId string, consumerGroup string, brokers ...string) fx.Op
 			})
 			return ret, nil
 		}),
-		fx.Provide(func(kafkaPublisher *kafka.Publisher) message.Publisher {
-			return kafkaPublisher
+	)
+}
+
+// KafkaSchemaRegistryModule registers the schemas of the kafka messages in a schema registry, see schemaregistry.Marshaler.
+// The schemas are resolved by the schemaregistry.SchemaResolver of the container if any,
+// otherwise all messages use the schema of publish.EventMessage.
+func KafkaSchemaRegistryModule(client schemaregistry.Client) fx.Option {
+	return fx.Options(
+		fx.Decorate(func(marshaler kafka.Marshaler, params struct {
+			fx.In
+
+			Resolver schemaregistry.SchemaResolver `optional:"true"`
+		}) kafka.Marshaler {
+			resolver := params.Resolver
+			if resolver == nil {
+				resolver = schemaregistry.StaticSchema(schemaregistry.EventMessageSchema())
+			}
+			return schemaregistry.NewMarshaler(marshaler, client, resolver)
 		}),
-		fx.Provide(func(kafkaSubscriber *kafka.Subscriber) message.Subscriber {
-			return kafkaSubscriber
+		fx.Decorate(func(unmarshaler kafka.Unmarshaler) kafka.Unmarshaler {
+			return schemaregistry.NewUnmarshaler(unmarshaler, client)
 		}),
 	)
 }
 
 func NatsModule(url, group string, autoProvision bool, natsOptions ...nats.Option) fx.Option {
+	return fx.Options(
+		natsModule(url, group, autoProvision, natsOptions...),
+		publisherBinding[*wNats.Publisher](),
+		natsSubscriberBinding(),
+	)
+}
+
+func natsModule(url, group string, autoProvision bool, natsOptions ...nats.Option) fx.Option {
 	jetStreamConfig := wNats.JetStreamConfig{
 		AutoProvision:    autoProvision,
 		SubscribeOptions: []nats.SubOpt{nats.ManualAck()},
@@ -201,33 +263,62 @@ func NatsModule(url, group string, autoProvision bool, natsOptions ...nats.Optio
 				NakDelay:          wNats.NewStaticDelay(time.Second),
 			}
 		}),
-		fx.Provide(func(publisher *wNats.Publisher) message.Publisher {
-			return publisher
+	)
+}
+
+// NatsPartitionedSubjectsModule publishes the messages on a subject per partition key, see publish.NatsPartitionedSubjectMarshaler.
+// Concurrent subscribers would process the messages of a partition key out of order, so the subscribers count is set to 1.
+func NatsPartitionedSubjectsModule() fx.Option {
+	return fx.Options(
+		fx.Decorate(func(config wNats.PublisherConfig) wNats.PublisherConfig {
+			config.Marshaler = &publish.NatsPartitionedSubjectMarshaler{}
+			config.SubjectCalculator = publish.NatsPartitionedSubjectCalculator
+			return config
 		}),
-		fx.Provide(func(subscriber *wNats.Subscriber, lc fx.Lifecycle) message.Subscriber {
-			lc.Append(fx.Hook{
-				OnStop: func(ctx context.Context) error {
-					return subscriber.Close()
-				},
-			})
-			return subscriber
+		fx.Decorate(func(config wNats.SubscriberConfig) wNats.SubscriberConfig {
+			config.Unmarshaler = &publish.NatsPartitionedSubjectMarshaler{}
+			config.SubjectCalculator = publish.NatsPartitionedSubjectCalculator
+			config.SubscribersCount = 1
+			return config
 		}),
 	)
 }
 
+func natsSubscriberBinding() fx.Option {
+	return fx.Provide(func(subscriber *wNats.Subscriber, lc fx.Lifecycle) message.Subscriber {
+		lc.Append(fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				return subscriber.Close()
+			},
+		})
+		return subscriber
+	})
+}
+
 func HTTPModule() fx.Option {
+	return fx.Options(
+		httpModule(),
+		publisherBinding[*wHttp.Publisher](),
+	)
+}
+
+func httpModule() fx.Option {
 	return fx.Module("publish-http",
 		fx.Provide(publish.NewHTTPPublisher),
 		fx.Provide(publish.NewHTTPPublisherConfig),
 		fx.Provide(publish.DefaultHTTPMarshalMessageFunc),
 		fx.Supply(http.DefaultClient, fx.Private),
-		fx.Provide(func(p *wHttp.Publisher) message.Publisher {
-			return p
-		}),
 	)
 }
 
 func SNSModule(cmd *cobra.Command, snsEndpointOverride string) fx.Option {
+	return fx.Options(
+		snsModule(cmd, snsEndpointOverride),
+		publisherBinding[*sns.Publisher](),
+	)
+}
+
+func snsModule(cmd *cobra.Command, snsEndpointOverride string) fx.Option {
 	return fx.Options(
 		fx.Provide(
 			fx.Annotate(func(optFn func(*config.LoadOptions) error) []func(*config.LoadOptions) error {
@@ -282,13 +373,17 @@ func SNSModule(cmd *cobra.Command, snsEndpointOverride string) fx.Option {
 				return ret, nil
 			}, fx.ParamTags(``, ``, `name:"publish-sns-cfg"`, `name:"publish-sns-opts"`)),
 		),
-		fx.Provide(func(snsPublisher *sns.Publisher) message.Publisher {
-			return snsPublisher
-		}),
 	)
 }
 
 func SQSModule(cmd *cobra.Command, sqsEndpointOverride string) fx.Option {
+	return fx.Options(
+		sqsModule(cmd, sqsEndpointOverride),
+		subscriberBinding[*sqs.Subscriber](),
+	)
+}
+
+func sqsModule(cmd *cobra.Command, sqsEndpointOverride string) fx.Option {
 	return fx.Options(
 		fx.Provide(
 			fx.Annotate(func(optFn func(*config.LoadOptions) error) []func(*config.LoadOptions) error {
@@ -343,8 +438,98 @@ func SQSModule(cmd *cobra.Command, sqsEndpointOverride string) fx.Option {
 				return ret, nil
 			}, fx.ParamTags(``, ``, `name:"publish-subscriber-sqs-cfg"`, `name:"publish-subscriber-sqs-opts"`)),
 		),
-		fx.Provide(func(sqsSubscriber *sqs.Subscriber) message.Subscriber {
-			return sqsSubscriber
+	)
+}
+
+func AMQPModule(config amqp.Config) fx.Option {
+	return fx.Options(
+		amqpModule(config),
+		publisherBinding[*amqp.Publisher](),
+		subscriberBinding[*amqp.Subscriber](),
+	)
+}
+
+func amqpModule(config amqp.Config) fx.Option {
+	return fx.Options(
+		fx.Supply(config),
+		fx.Provide(func(lc fx.Lifecycle, logger watermill.LoggerAdapter, config amqp.Config) (*amqp.Publisher, error) {
+			ret, err := publish.NewAMQPPublisher(logger, config)
+			if err != nil {
+				return nil, err
+			}
+			lc.Append(fx.Hook{
+				OnStop: func(ctx context.Context) error {
+					return ret.Close()
+				},
+			})
+			return ret, nil
+		}),
+		fx.Provide(func(lc fx.Lifecycle, logger watermill.LoggerAdapter, config amqp.Config) (*amqp.Subscriber, error) {
+			ret, err := publish.NewAMQPSubscriber(logger, config)
+			if err != nil {
+				return nil, err
+			}
+			lc.Append(fx.Hook{
+				OnStop: func(ctx context.Context) error {
+					return ret.Close()
+				},
+			})
+			return ret, nil
+		}),
+	)
+}
+
+// RedisStreamModule publishes to Redis streams, and consumes them with the consumer group.
+// maxLens limits the length of the streams, which are unlimited by default.
+func RedisStreamModule(url, consumerGroup, consumer string, maxLens map[string]int64) fx.Option {
+	return fx.Options(
+		redisStreamModule(url, consumerGroup, consumer, maxLens),
+		publisherBinding[*redisstream.Publisher](),
+		subscriberBinding[*redisstream.Subscriber](),
+	)
+}
+
+func redisStreamModule(url, consumerGroup, consumer string, maxLens map[string]int64) fx.Option {
+	return fx.Options(
+		fx.Supply(redisstream.PublisherConfig{
+			Maxlens: maxLens,
+		}),
+		fx.Supply(redisstream.SubscriberConfig{
+			ConsumerGroup: consumerGroup,
+			Consumer:      consumer,
+		}),
+		// The publisher and the subscriber close their client, so they cannot share it
+		fx.Provide(func(lc fx.Lifecycle, logger watermill.LoggerAdapter, config redisstream.PublisherConfig) (*redisstream.Publisher, error) {
+			client, err := publish.NewRedisClient(url)
+			if err != nil {
+				return nil, err
+			}
+			ret, err := publish.NewRedisStreamPublisher(client, logger, config)
+			if err != nil {
+				return nil, err
+			}
+			lc.Append(fx.Hook{
+				OnStop: func(ctx context.Context) error {
+					return ret.Close()
+				},
+			})
+			return ret, nil
+		}),
+		fx.Provide(func(lc fx.Lifecycle, logger watermill.LoggerAdapter, config redisstream.SubscriberConfig) (*redisstream.Subscriber, error) {
+			client, err := publish.NewRedisClient(url)
+			if err != nil {
+				return nil, err
+			}
+			ret, err := publish.NewRedisStreamSubscriber(client, logger, config)
+			if err != nil {
+				return nil, err
+			}
+			lc.Append(fx.Hook{
+				OnStop: func(ctx context.Context) error {
+					return ret.Close()
+				},
+			})
+			return ret, nil
 		}),
 	)
 }
@@ -371,7 +556,7 @@ func CircuitBreakerStorageModule(schema string, storageLimit int, debug bool) fx
 	})
 }
 
-func CircuitBreakerModule(schema string, openIntervalDuration time.Duration, storageLimit int, debug bool) fx.Option {
+func CircuitBreakerModule(schema string, openIntervalDuration time.Duration, storageLimit int, debug bool, opts ...circuitbreaker.Option) fx.Option {
 	return fx.Options(
 		fx.Provide(func(
 			logger logging.Logger,
@@ -379,7 +564,7 @@ func CircuitBreakerModule(schema string, openIntervalDuration time.Duration, sto
 			store circuitstorage.Store,
 			lc fx.Lifecycle,
 		) *circuitbreaker.CircuitBreaker {
-			cb := circuitbreaker.NewCircuitBreaker(logger, topicMapper, store, openIntervalDuration)
+			cb := circuitbreaker.NewCircuitBreaker(logger, topicMapper, store, openIntervalDuration, opts...)
 
 			lc.Append(fx.Hook{
 				OnStart: func(ctx context.Context) error {
@@ -396,6 +581,160 @@ func CircuitBreakerModule(schema string, openIntervalDuration time.Duration, sto
 	)
 }
 
+// OutboxModule provides an *outbox.Publisher, and runs an outbox.Relay sending its messages
+// through the topic mapper.
+func OutboxModule(schema string, debug bool, relayOptions ...outbox.RelayOption) fx.Option {
+	return fx.Options(
+		fx.Provide(func(
+			connectionOptions *bunconnect.ConnectionOptions,
+			logger logging.Logger,
+			topicMapper *topicmapper.TopicMapperPublisherDecorator,
+			lc fx.Lifecycle,
+		) (*outbox.Publisher, error) {
+			hooks := make([]bun.QueryHook, 0)
+			if debug {
+				hooks = append(hooks, bundebug.NewQueryHook())
+			}
+
+			db, err := bunconnect.OpenDBWithSchema(context.Background(), *connectionOptions, schema, hooks...)
+			if err != nil {
+				return nil, err
+			}
+
+			relay := outbox.NewRelay(logger, schema, db, topicMapper, relayOptions...)
+
+			lc.Append(fx.Hook{
+				OnStart: func(ctx context.Context) error {
+					if err := outbox.Migrate(ctx, schema, db); err != nil {
+						return err
+					}
+					go relay.Run(context.WithoutCancel(ctx))
+					return nil
+				},
+				OnStop: func(ctx context.Context) error {
+					if err := relay.Close(); err != nil {
+						return err
+					}
+					return db.Close()
+				},
+			})
+
+			// The outbox replaces the message.Publisher of the container, used by code unaware of transactions
+			return outbox.NewPublisher(schema, db, outbox.WithDBFallback()), nil
+		}),
+		// Start the relay even if nothing publishes, to send messages left by a previous run
+		fx.Invoke(func(*outbox.Publisher) {}),
+	)
+}
+
+// BatchingModule batches and compresses the messages sent through the topic mapper,
+// and restores them on the subscriber side.
+// The batches wrap the message.Publisher of the container, below the topic mapper, the outbox and the circuit breaker.
+// The batches are opaque to the schema registry of KafkaSchemaRegistryModule, so both modules can't be used together.
+// The pending batches are sent on stop.
+func BatchingModule(opts ...batch.PublisherOption) fx.Option {
+	return fx.Options(
+		fx.Provide(func(lc fx.Lifecycle, publisher message.Publisher) *batch.PublisherDecorator {
+			ret := batch.NewPublisherDecorator(publisher, opts...)
+			lc.Append(fx.Hook{
+				OnStop: func(ctx context.Context) error {
+					return ret.Close()
+				},
+			})
+			return ret
+		}),
+		fx.Decorate(func(subscriber message.Subscriber, logger watermill.LoggerAdapter) message.Subscriber {
+			return batch.NewSubscriberDecorator(subscriber, batch.WithLogger(logger))
+		}),
+	)
+}
+
+func batchingOptionsFromFlags(cmd *cobra.Command) ([]batch.PublisherOption, bool) {
+	batchingEnabled, _ := cmd.Flags().GetBool(publish.PublisherBatchingEnabledFlag)
+	compressionName, _ := cmd.Flags().GetString(publish.PublisherCompressionFlag)
+
+	compression, err := batch.ParseCompression(compressionName)
+	if err != nil {
+		panic(err)
+	}
+	if !batchingEnabled && compression == batch.CompressionNone {
+		return nil, false
+	}
+
+	maxBytes, _ := cmd.Flags().GetInt(publish.PublisherBatchingMaxBytesFlag)
+	if maxBytes == 0 {
+		maxBytes = backendMaxBytes(cmd)
+	}
+
+	opts := []batch.PublisherOption{
+		batch.WithCompression(compression),
+		batch.WithMaxBytes(maxBytes),
+	}
+	if batchingEnabled {
+		maxMessages, _ := cmd.Flags().GetInt(publish.PublisherBatchingMaxMessagesFlag)
+		maxDelay, _ := cmd.Flags().GetDuration(publish.PublisherBatchingMaxDelayFlag)
+		opts = append(opts,
+			batch.WithMaxMessages(maxMessages),
+			batch.WithMaxDelay(maxDelay),
+		)
+	} else {
+		opts = append(opts, batch.WithMaxMessages(1))
+	}
+
+	return opts, true
+}
+
+// maxBytesByBackend are the size limits of the messages of the backends
+var maxBytesByBackend = map[string]int{
+	RoutingBackendHTTP:  batch.MaxBytesHTTP,
+	RoutingBackendNats:  batch.MaxBytesNATS,
+	RoutingBackendKafka: batch.MaxBytesKafka,
+	RoutingBackendSNS:   batch.MaxBytesSNS,
+	RoutingBackendAMQP:  batch.MaxBytesAMQP,
+	RoutingBackendRedis: batch.MaxBytesRedis,
+}
+
+// backendMaxBytes returns the size limit of the backend selected by the flags,
+// or the lowest limit of the backends of the routes.
+func backendMaxBytes(cmd *cobra.Command) int {
+	if routes, _ := cmd.Flags().GetStringArray(publish.PublisherRoutingFlag); len(routes) > 0 {
+		maxBytes := 0
+		for _, route := range routes {
+			parsedRoute, err := routing.ParseRoute(route)
+			if err != nil {
+				panic(err)
+			}
+			for _, backend := range parsedRoute.Backends {
+				if limit, ok := maxBytesByBackend[backend]; ok && (maxBytes == 0 || limit < maxBytes) {
+					maxBytes = limit
+				}
+			}
+		}
+		if maxBytes != 0 {
+			return maxBytes
+		}
+		return batch.MaxBytesSNS
+	}
+
+	// Same precedence as the selection of the publisher
+	for _, backend := range []struct {
+		flag string
+		name string
+	}{
+		{publish.PublisherHttpEnabledFlag, RoutingBackendHTTP},
+		{publish.PublisherNatsEnabledFlag, RoutingBackendNats},
+		{publish.PublisherSnsEnabledFlag, RoutingBackendSNS},
+		{publish.PublisherKafkaEnabledFlag, RoutingBackendKafka},
+		{publish.PublisherAMQPEnabledFlag, RoutingBackendAMQP},
+		{publish.PublisherRedisEnabledFlag, RoutingBackendRedis},
+	} {
+		if enabled, _ := cmd.Flags().GetBool(backend.flag); enabled {
+			return maxBytesByBackend[backend.name]
+		}
+	}
+	return batch.MaxBytesSNS
+}
+
 func PublishModuleFromFlags(cmd *cobra.Command, debug bool) fx.Option {
 	options := make([]fx.Option, 0)
 
@@ -413,14 +752,47 @@ func PublishModuleFromFlags(cmd *cobra.Command, debug bool) fx.Option {
 
 	options = append(options, Module(mapping))
 
+	if batchingOptions, ok := batchingOptionsFromFlags(cmd); ok {
+		if schemaRegistryEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaSchemaRegistryEnabledFlag); schemaRegistryEnabled {
+			panic(fmt.Sprintf("'%s' and '%s' can't be used with '%s'",
+				publish.PublisherBatchingEnabledFlag, publish.PublisherCompressionFlag, publish.PublisherKafkaSchemaRegistryEnabledFlag))
+		}
+		options = append(options, BatchingModule(batchingOptions...))
+	}
+
+	outboxEnabled, _ := cmd.Flags().GetBool(publish.PublisherOutboxEnabledFlag)
 	circuitBreakerEnabled, _ := cmd.Flags().GetBool(publish.PublisherCircuitBreakerEnabledFlag)
-	if circuitBreakerEnabled {
+	if outboxEnabled {
+		schema, _ := cmd.Flags().GetString(publish.PublisherOutboxSchemaFlag)
+		pollInterval, _ := cmd.Flags().GetDuration(publish.PublisherOutboxPollIntervalFlag)
+		batchSize, _ := cmd.Flags().GetInt(publish.PublisherOutboxBatchSizeFlag)
+		retention, _ := cmd.Flags().GetDuration(publish.PublisherOutboxRetentionFlag)
+
+		// The outbox already stores the messages until the broker accepts them,
+		// so it replaces the circuit breaker
+		options = append(options,
+			OutboxModule(schema, debug,
+				outbox.WithPollInterval(pollInterval),
+				outbox.WithBatchSize(batchSize),
+				outbox.WithRetention(retention),
+			),
+			fx.Decorate(func(publisher *outbox.Publisher) message.Publisher {
+				return publisher
+			}),
+		)
+	} else if circuitBreakerEnabled {
 		scheme, _ := cmd.Flags().GetString(publish.PublisherCircuitBreakerSchemaFlag)
 		intervalDuration, _ := cmd.Flags().GetDuration(publish.PublisherCircuitBreakerOpenIntervalDurationFlag)
 		storageLimit, _ := cmd.Flags().GetInt(publish.PublisherCircuitBreakerListStorageLimitFlag)
+		consecutiveFailures, _ := cmd.Flags().GetInt(publish.PublisherCircuitBreakerConsecutiveFailuresFlag)
+		failureRate, _ := cmd.Flags().GetFloat64(publish.PublisherCircuitBreakerFailureRateFlag)
+		failureRateWindow, _ := cmd.Flags().GetInt(publish.PublisherCircuitBreakerFailureRateWindowFlag)
 
 		options = append(options,
-			CircuitBreakerModule(scheme, intervalDuration, storageLimit, debug),
+			CircuitBreakerModule(scheme, intervalDuration, storageLimit, debug,
+				circuitbreaker.WithConsecutiveFailureThreshold(consecutiveFailures),
+				circuitbreaker.WithFailureRateThreshold(failureRate, failureRateWindow),
+			),
 			fx.Decorate(func(cb *circuitbreaker.CircuitBreaker) message.Publisher {
 				return cb
 			}),
@@ -433,122 +805,317 @@ func PublishModuleFromFlags(cmd *cobra.Command, debug bool) fx.Option {
 		)
 	}
 
+	if routes, _ := cmd.Flags().GetStringArray(publish.PublisherRoutingFlag); len(routes) > 0 {
+		options = append(options, routingModuleFromFlags(cmd, queueGroup, routes))
+		return fx.Options(options...)
+	}
+
 	httpEnabled, _ := cmd.Flags().GetBool(publish.PublisherHttpEnabledFlag)
 	natsEnabled, _ := cmd.Flags().GetBool(publish.PublisherNatsEnabledFlag)
 	kafkaEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaEnabledFlag)
 	sqsSubscriberEnabled, _ := cmd.Flags().GetBool(publish.SubscriberSqsEnabledFlag)
 	snsPublisherEnabled, _ := cmd.Flags().GetBool(publish.PublisherSnsEnabledFlag)
+	amqpEnabled, _ := cmd.Flags().GetBool(publish.PublisherAMQPEnabledFlag)
+	redisEnabled, _ := cmd.Flags().GetBool(publish.PublisherRedisEnabledFlag)
 
 	switch {
 	case httpEnabled:
 		options = append(options, HTTPModule())
 	case natsEnabled:
-		natsConnName := queueGroup
-		clientId, _ := cmd.Flags().GetString(publish.PublisherNatsClientIDFlag)
-		if clientId != "" {
-			natsConnName = clientId
+		options = append(options,
+			natsModuleFromFlags(cmd, queueGroup),
+			publisherBinding[*wNats.Publisher](),
+			natsSubscriberBinding(),
+		)
+	case sqsSubscriberEnabled, snsPublisherEnabled:
+		if sqsSubscriberEnabled {
+			options = append(options,
+				sqsModuleFromFlags(cmd),
+				subscriberBinding[*sqs.Subscriber](),
+			)
 		}
-		natsUrl, _ := cmd.Flags().GetString(publish.PublisherNatsURLFlag)
-		autoProvision, _ := cmd.Flags().GetBool(publish.PublisherNatsAutoProvisionFlag)
-		maxReconnect, _ := cmd.Flags().GetInt(publish.PublisherNatsMaxReconnectFlag)
-		maxReconnectWait, _ := cmd.Flags().GetDuration(publish.PublisherNatsReconnectWaitFlag)
-		nkeyFiles, _ := cmd.Flags().GetStringArray(publish.PublisherNatsNkeyFileFlag)
-
-		natsOptions := []nats.Option{
-			nats.Name(natsConnName),
-			nats.MaxReconnects(maxReconnect),
-			nats.ReconnectWait(maxReconnectWait),
+		if snsPublisherEnabled {
+			options = append(options,
+				snsModuleFromFlags(cmd),
+				publisherBinding[*sns.Publisher](),
+			)
 		}
+	case kafkaEnabled:
+		options = append(options,
+			kafkaModuleFromFlags(cmd, queueGroup),
+			publisherBinding[*kafka.Publisher](),
+			subscriberBinding[*kafka.Subscriber](),
+		)
+	case amqpEnabled:
+		options = append(options,
+			amqpModuleFromFlags(cmd, queueGroup),
+			publisherBinding[*amqp.Publisher](),
+			subscriberBinding[*amqp.Subscriber](),
+		)
+	case redisEnabled:
+		options = append(options,
+			redisStreamModuleFromFlags(cmd, queueGroup),
+			publisherBinding[*redisstream.Publisher](),
+			subscriberBinding[*redisstream.Subscriber](),
+		)
+	default:
+		options = append(options, GoChannelModule())
+	}
+	return fx.Options(options...)
+}
 
-		for _, file := range nkeyFiles {
-			option, err := nats.NkeyOptionFromSeed(file)
-			if err != nil {
-				panic(fmt.Sprintf("unable to parse nkey file '%s': %v", file, err))
-			}
-			natsOptions = append(natsOptions, option)
+// Names of the backends usable in routes
+const (
+	RoutingBackendHTTP  = "http"
+	RoutingBackendNats  = "nats"
+	RoutingBackendKafka = "kafka"
+	RoutingBackendSNS   = "sns"
+	RoutingBackendAMQP  = "amqp"
+	RoutingBackendRedis = "redis"
+)
+
+// RoutingBackend adds the publisher of type T, provided by a backend module, to the backends of the RoutingModule.
+func RoutingBackend[T message.Publisher](name string) fx.Option {
+	return fx.Provide(fx.Annotate(func(publisher T) routing.Backend {
+		return routing.Backend{
+			Name:      name,
+			Publisher: publisher,
+		}
+	}, fx.ResultTags(`group:"routingBackends"`)))
+}
+
+// RoutingModule provides a message.Publisher sending each topic to the backends of its route.
+// Backends are added with RoutingBackend, and closed by their own modules.
+// Messages retried by the outbox or the circuit breaker are only sent to the backends which failed,
+// unless they are batched by the BatchingModule, see routing.Publisher.
+func RoutingModule(routes ...routing.Route) fx.Option {
+	return fx.Provide(fx.Annotate(func(backends []routing.Backend) (message.Publisher, error) {
+		return routing.NewPublisher(backends, routes)
+	}, fx.ParamTags(`group:"routingBackends"`)))
+}
+
+// routingModuleFromFlags starts the backends used by the routes.
+// The subscriber is the one which would be used without routing: NATS, then SQS, Kafka, AMQP and Redis.
+func routingModuleFromFlags(cmd *cobra.Command, queueGroup string, routes []string) fx.Option {
+	parsedRoutes := make([]routing.Route, 0, len(routes))
+	backends := make(map[string]struct{})
+	for _, route := range routes {
+		parsedRoute, err := routing.ParseRoute(route)
+		if err != nil {
+			panic(err)
 		}
+		parsedRoutes = append(parsedRoutes, parsedRoute)
+		for _, backend := range parsedRoute.Backends {
+			backends[backend] = struct{}{}
+		}
+	}
+
+	options := []fx.Option{
+		RoutingModule(parsedRoutes...),
+	}
+	for backend := range backends {
+		switch backend {
+		case RoutingBackendHTTP:
+			options = append(options, httpModule(), RoutingBackend[*wHttp.Publisher](backend))
+		case RoutingBackendNats:
+			options = append(options, natsModuleFromFlags(cmd, queueGroup), RoutingBackend[*wNats.Publisher](backend))
+		case RoutingBackendKafka:
+			options = append(options, kafkaModuleFromFlags(cmd, queueGroup), RoutingBackend[*kafka.Publisher](backend))
+		case RoutingBackendSNS:
+			options = append(options, snsModuleFromFlags(cmd), RoutingBackend[*sns.Publisher](backend))
+		case RoutingBackendAMQP:
+			options = append(options, amqpModuleFromFlags(cmd, queueGroup), RoutingBackend[*amqp.Publisher](backend))
+		case RoutingBackendRedis:
+			options = append(options, redisStreamModuleFromFlags(cmd, queueGroup), RoutingBackend[*redisstream.Publisher](backend))
+		default:
+			panic(fmt.Sprintf("unknown routing backend '%s'", backend))
+		}
+	}
 
-		options = append(options, NatsModule(
+	_, natsUsed := backends[RoutingBackendNats]
+	_, kafkaUsed := backends[RoutingBackendKafka]
+	_, amqpUsed := backends[RoutingBackendAMQP]
+	_, redisUsed := backends[RoutingBackendRedis]
+	sqsSubscriberEnabled, _ := cmd.Flags().GetBool(publish.SubscriberSqsEnabledFlag)
+	switch {
+	case natsUsed:
+		options = append(options, natsSubscriberBinding())
+	case sqsSubscriberEnabled:
+		options = append(options, sqsModuleFromFlags(cmd), subscriberBinding[*sqs.Subscriber]())
+	case kafkaUsed:
+		options = append(options, subscriberBinding[*kafka.Subscriber]())
+	case amqpUsed:
+		options = append(options, subscriberBinding[*amqp.Subscriber]())
+	case redisUsed:
+		options = append(options, subscriberBinding[*redisstream.Subscriber]())
+	}
+
+	return fx.Options(options...)
+}
+
+func natsModuleFromFlags(cmd *cobra.Command, queueGroup string) fx.Option {
+	natsConnName := queueGroup
+	clientId, _ := cmd.Flags().GetString(publish.PublisherNatsClientIDFlag)
+	if clientId != "" {
+		natsConnName = clientId
+	}
+	natsUrl, _ := cmd.Flags().GetString(publish.PublisherNatsURLFlag)
+	autoProvision, _ := cmd.Flags().GetBool(publish.PublisherNatsAutoProvisionFlag)
+	maxReconnect, _ := cmd.Flags().GetInt(publish.PublisherNatsMaxReconnectFlag)
+	maxReconnectWait, _ := cmd.Flags().GetDuration(publish.PublisherNatsReconnectWaitFlag)
+	nkeyFiles, _ := cmd.Flags().GetStringArray(publish.PublisherNatsNkeyFileFlag)
+
+	natsOptions := []nats.Option{
+		nats.Name(natsConnName),
+		nats.MaxReconnects(maxReconnect),
+		nats.ReconnectWait(maxReconnectWait),
+	}
+
+	for _, file := range nkeyFiles {
+		option, err := nats.NkeyOptionFromSeed(file)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse nkey file '%s': %v", file, err))
+		}
+		natsOptions = append(natsOptions, option)
+	}
+
+	options := []fx.Option{
+		natsModule(
 			natsUrl,
 			queueGroup,
 			autoProvision,
 			natsOptions...,
-		))
+		),
+	}
+	if partitionSubjects, _ := cmd.Flags().GetBool(publish.PublisherNatsPartitionSubjectsFlag); partitionSubjects {
+		options = append(options, NatsPartitionedSubjectsModule())
+	}
 
-	case sqsSubscriberEnabled, snsPublisherEnabled:
-		if sqsSubscriberEnabled {
-			sqsEndpointOverride, _ := cmd.Flags().GetString(publish.SubscriberSqsEndpointOverrideFlag)
+	return fx.Options(options...)
+}
 
-			options = append(options,
-				fx.Supply(fx.Annotate(iam.LoadOptionFromFlags(cmd.Flags()), fx.ResultTags(`name:"publish-sqs-enabled"`))),
-				SQSModule(cmd, sqsEndpointOverride),
-			)
-		}
-		if snsPublisherEnabled {
-			snsEndpointOverride, _ := cmd.Flags().GetString(publish.PublisherSnsEndpointOverrideFlag)
+func sqsModuleFromFlags(cmd *cobra.Command) fx.Option {
+	sqsEndpointOverride, _ := cmd.Flags().GetString(publish.SubscriberSqsEndpointOverrideFlag)
 
-			options = append(options,
-				fx.Supply(fx.Annotate(iam.LoadOptionFromFlags(cmd.Flags()), fx.ResultTags(`name:"publish-sns-enabled"`))),
-				SNSModule(cmd, snsEndpointOverride),
-			)
+	return fx.Options(
+		fx.Supply(fx.Annotate(iam.LoadOptionFromFlags(cmd.Flags()), fx.ResultTags(`name:"publish-sqs-enabled"`))),
+		sqsModule(cmd, sqsEndpointOverride),
+	)
+}
+
+func snsModuleFromFlags(cmd *cobra.Command) fx.Option {
+	snsEndpointOverride, _ := cmd.Flags().GetString(publish.PublisherSnsEndpointOverrideFlag)
+
+	return fx.Options(
+		fx.Supply(fx.Annotate(iam.LoadOptionFromFlags(cmd.Flags()), fx.ResultTags(`name:"publish-sns-enabled"`))),
+		snsModule(cmd, snsEndpointOverride),
+	)
+}
+
+func amqpModuleFromFlags(cmd *cobra.Command, queueGroup string) fx.Option {
+	url, _ := cmd.Flags().GetString(publish.PublisherAMQPURLFlag)
+	exchangeType, _ := cmd.Flags().GetString(publish.PublisherAMQPExchangeTypeFlag)
+	prefetch, _ := cmd.Flags().GetInt(publish.PublisherAMQPPrefetchFlag)
+	requeueDelay, _ := cmd.Flags().GetDuration(publish.PublisherAMQPRequeueDelayFlag)
+
+	return amqpModule(amqp.Config{
+		URL:          url,
+		ExchangeType: exchangeType,
+		QueueGroup:   queueGroup,
+		Prefetch:     prefetch,
+		RequeueDelay: requeueDelay,
+	})
+}
+
+func redisStreamModuleFromFlags(cmd *cobra.Command, queueGroup string) fx.Option {
+	url, _ := cmd.Flags().GetString(publish.PublisherRedisURLFlag)
+	consumer, _ := cmd.Flags().GetString(publish.PublisherRedisConsumerFlag)
+	maxLenFlags, _ := cmd.Flags().GetStringSlice(publish.PublisherRedisMaxLenFlag)
+
+	maxLens := make(map[string]int64)
+	for _, maxLen := range maxLenFlags {
+		parts := strings.SplitN(maxLen, ":", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("unable to parse redis max len '%s', must be two parts, separated by a colon", maxLen))
 		}
-	case kafkaEnabled:
-		brokers, _ := cmd.Flags().GetStringSlice(publish.PublisherKafkaBrokerFlag)
+		length, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("unable to parse redis max len '%s': %v", maxLen, err))
+		}
+		maxLens[parts[0]] = length
+	}
 
-		options = append(options,
-			KafkaModule(queueGroup, queueGroup, brokers...),
-			ProvideSaramaOption(
-				publish.WithConsumerReturnErrors(),
-				publish.WithProducerReturnSuccess(),
-			),
-		)
-		if tlsEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaTLSEnabledFlag); tlsEnabled {
-			options = append(options, ProvideSaramaOption(publish.WithTLS()))
+	return redisStreamModule(url, queueGroup, consumer, maxLens)
+}
+
+func kafkaModuleFromFlags(cmd *cobra.Command, queueGroup string) fx.Option {
+	brokers, _ := cmd.Flags().GetStringSlice(publish.PublisherKafkaBrokerFlag)
+
+	options := []fx.Option{
+		kafkaModule(queueGroup, queueGroup, brokers...),
+		ProvideSaramaOption(
+			publish.WithConsumerReturnErrors(),
+			publish.WithProducerReturnSuccess(),
+		),
+	}
+	if tlsEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaTLSEnabledFlag); tlsEnabled {
+		options = append(options, ProvideSaramaOption(publish.WithTLS()))
+	}
+	if saslEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaSASLEnabledFlag); saslEnabled {
+		mechanism, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLMechanismFlag)
+		saslUsername, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLUsernameFlag)
+		saslPassword, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLPasswordFlag)
+		saslScramShaSize, _ := cmd.Flags().GetInt(publish.PublisherKafkaSASLScramSHASizeFlag)
+
+		saramaOptions := []publish.SaramaOption{
+			publish.WithSASLEnabled(),
+			publish.WithSASLMechanism(sarama.SASLMechanism(mechanism)),
+			publish.WithSASLCredentials(saslUsername, saslPassword),
+			publish.WithSASLScramClient(func() sarama.SCRAMClient {
+				var fn scram.HashGeneratorFcn
+				switch saslScramShaSize {
+				case 512:
+					fn = publish.SHA512
+				case 256:
+					fn = publish.SHA256
+				default:
+					panic("sha size not handled")
+				}
+				return &publish.XDGSCRAMClient{
+					HashGeneratorFcn: fn,
+				}
+			}),
 		}
-		if saslEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaSASLEnabledFlag); saslEnabled {
-			mechanism, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLMechanismFlag)
-			saslUsername, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLUsernameFlag)
-			saslPassword, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLPasswordFlag)
-			saslScramShaSize, _ := cmd.Flags().GetInt(publish.PublisherKafkaSASLScramSHASizeFlag)
-
-			saramaOptions := []publish.SaramaOption{
-				publish.WithSASLEnabled(),
-				publish.WithSASLMechanism(sarama.SASLMechanism(mechanism)),
-				publish.WithSASLCredentials(saslUsername, saslPassword),
-				publish.WithSASLScramClient(func() sarama.SCRAMClient {
-					var fn scram.HashGeneratorFcn
-					switch saslScramShaSize {
-					case 512:
-						fn = publish.SHA512
-					case 256:
-						fn = publish.SHA256
-					default:
-						panic("sha size not handled")
-					}
-					return &publish.XDGSCRAMClient{
-						HashGeneratorFcn: fn,
-					}
+
+		if awsEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaSASLIAMEnabledFlag); awsEnabled {
+			region, _ := cmd.Flags().GetString(iam.AWSRegionFlag)
+			roleArn, _ := cmd.Flags().GetString(iam.AWSRoleArnFlag)
+			sessionName, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLIAMSessionNameFlag)
+
+			saramaOptions = append(saramaOptions,
+				publish.WithTokenProvider(&publish.MSKAccessTokenProvider{
+					Region:      region,
+					RoleArn:     roleArn,
+					SessionName: sessionName,
 				}),
-			}
+			)
+		}
 
-			if awsEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaSASLIAMEnabledFlag); awsEnabled {
-				region, _ := cmd.Flags().GetString(iam.AWSRegionFlag)
-				roleArn, _ := cmd.Flags().GetString(iam.AWSRoleArnFlag)
-				sessionName, _ := cmd.Flags().GetString(publish.PublisherKafkaSASLIAMSessionNameFlag)
-
-				saramaOptions = append(saramaOptions,
-					publish.WithTokenProvider(&publish.MSKAccessTokenProvider{
-						Region:      region,
-						RoleArn:     roleArn,
-						SessionName: sessionName,
-					}),
-				)
-			}
+		options = append(options, ProvideSaramaOption(saramaOptions...))
+	}
+	if schemaRegistryEnabled, _ := cmd.Flags().GetBool(publish.PublisherKafkaSchemaRegistryEnabledFlag); schemaRegistryEnabled {
+		url, _ := cmd.Flags().GetString(publish.PublisherKafkaSchemaRegistryURLFlag)
+		username, _ := cmd.Flags().GetString(publish.PublisherKafkaSchemaRegistryUsernameFlag)
+		password, _ := cmd.Flags().GetString(publish.PublisherKafkaSchemaRegistryPasswordFlag)
 
-			options = append(options, ProvideSaramaOption(saramaOptions...))
+		clientOptions := make([]schemaregistry.HTTPClientOption, 0)
+		if username != "" {
+			clientOptions = append(clientOptions, schemaregistry.WithBasicAuth(username, password))
 		}
-	default:
-		options = append(options, GoChannelModule())
+		options = append(options, KafkaSchemaRegistryModule(
+			schemaregistry.NewCachedClient(schemaregistry.NewHTTPClient(url, clientOptions...)),
+		))
 	}
+
 	return fx.Options(options...)
 }
@@ -2,13 +2,20 @@ package messagingfx_test
 
 import (
 	"context"
-	"os"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	wNats "github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/alicebob/miniredis/v2"
 	natsServer "github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/propagation"
@@ -19,7 +26,11 @@ import (
 
 	"github.com/formancehq/go-libs/v5/pkg/fx/messagingfx"
 	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/batch"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/schemaregistry"
+	topicmapper "github.com/formancehq/go-libs/v5/pkg/messaging/publish/topicmap"
 	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	"github.com/formancehq/go-libs/v5/pkg/testing/platform/schemaregistrytesting"
 )
 
 func TestModule(t *testing.T) {
@@ -51,7 +62,7 @@ func TestModule(t *testing.T) {
 					Host:      "0.0.0.0",
 					Port:      4322,
 					JetStream: true,
-					StoreDir:  os.TempDir(),
+					StoreDir:  t.TempDir(),
 				})
 				require.NoError(t, err)
 
@@ -67,6 +78,40 @@ func TestModule(t *testing.T) {
 			topicMapping: map[string]string{},
 			topic:        "topic",
 		},
+		{
+			name: "nats with partitioned subjects",
+			setup: func(t *testing.T) fx.Option {
+				server, err := natsServer.NewServer(&natsServer.Options{
+					Host:      "0.0.0.0",
+					Port:      4324,
+					JetStream: true,
+					StoreDir:  t.TempDir(),
+				})
+				require.NoError(t, err)
+
+				server.Start()
+				require.Eventually(t, server.Running, 3*time.Second, 10*time.Millisecond)
+
+				t.Cleanup(server.Shutdown)
+
+				return fx.Options(
+					messagingfx.NatsModule("nats://127.0.0.1:4324", "testing", true, nats.Name("example")),
+					messagingfx.NatsPartitionedSubjectsModule(),
+				)
+			},
+			topicMapping: map[string]string{},
+			topic:        "topic",
+		},
+		{
+			name: "redis",
+			setup: func(t *testing.T) fx.Option {
+				server := miniredis.RunT(t)
+
+				return messagingfx.RedisStreamModule("redis://"+server.Addr(), "testing", "", nil)
+			},
+			topicMapping: map[string]string{},
+			topic:        "topic",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -107,7 +152,7 @@ func TestModule(t *testing.T) {
 				span.End()
 			})
 			require.True(t, trace.SpanFromContext(ctx).SpanContext().IsValid())
-			msg := publish.NewMessage(ctx, publish.EventMessage{})
+			msg := publish.NewMessage(publish.ContextWithPartitionKey(ctx, "users:001"), publish.EventMessage{})
 			require.NoError(t, publisher.Publish(tc.topic, msg))
 
 			select {
@@ -117,9 +162,307 @@ func TestModule(t *testing.T) {
 				require.NotNil(t, event)
 				require.NotNil(t, ctx)
 				require.True(t, span.SpanContext().IsValid())
+				require.Equal(t, "users:001", publish.PartitionKey(msg))
 			case <-time.After(10 * time.Second):
 				t.Fatal("timeout waiting message")
 			}
 		})
 	}
 }
+
+func TestNatsPartitionedSubjectsModuleUsesASingleSubscriber(t *testing.T) {
+	t.Parallel()
+
+	var config wNats.SubscriberConfig
+	app := fxtest.New(t,
+		fx.NopLogger,
+		fx.Supply(wNats.SubscriberConfig{SubscribersCount: 100}),
+		messagingfx.NatsPartitionedSubjectsModule(),
+		fx.Populate(&config),
+	)
+	app.RequireStart()
+	defer app.RequireStop()
+
+	require.Equal(t, 1, config.SubscribersCount)
+}
+
+func TestBatchingModule(t *testing.T) {
+	t.Parallel()
+
+	var (
+		publisher      *topicmapper.TopicMapperPublisherDecorator
+		router         *message.Router
+		messageHandled = make(chan *message.Message, 10)
+	)
+	options := []fx.Option{
+		messagingfx.Module(map[string]string{}),
+		messagingfx.GoChannelModule(),
+		messagingfx.BatchingModule(
+			batch.WithCompression(batch.CompressionZstd),
+			batch.WithMaxMessages(10),
+		),
+		fx.Populate(&publisher, &router),
+		fx.Supply(fx.Annotate(logging.Testing(), fx.As(new(logging.Logger)))),
+		fx.Invoke(func(r *message.Router, subscriber message.Subscriber) {
+			r.AddNoPublisherHandler("testing", "topic", subscriber, func(msg *message.Message) error {
+				messageHandled <- msg
+				return nil
+			})
+		}),
+	}
+	if !testing.Verbose() {
+		options = append(options, fx.NopLogger)
+	}
+	app := fxtest.New(t, options...)
+	app.RequireStart()
+	defer app.RequireStop()
+
+	<-router.Running()
+
+	messages := make([]*message.Message, 0, 10)
+	for range 10 {
+		messages = append(messages, publish.NewMessage(context.TODO(), publish.EventMessage{Type: "TEST"}))
+	}
+	require.NoError(t, publisher.Publish("topic", messages...))
+
+	for i := range 10 {
+		select {
+		case msg := <-messageHandled:
+			require.Equal(t, messages[i].UUID, msg.UUID)
+			_, event, err := publish.UnmarshalMessage(msg)
+			require.NoError(t, err)
+			require.Equal(t, "TEST", event.Type)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting message")
+		}
+	}
+}
+
+func TestBatchingModuleSendsPendingBatchesOnStop(t *testing.T) {
+	t.Parallel()
+
+	var (
+		publisher      *topicmapper.TopicMapperPublisherDecorator
+		router         *message.Router
+		messageHandled = make(chan *message.Message, 1)
+	)
+	options := []fx.Option{
+		messagingfx.Module(map[string]string{}),
+		messagingfx.GoChannelModule(),
+		messagingfx.BatchingModule(
+			batch.WithMaxMessages(10),
+			batch.WithMaxDelay(time.Hour),
+		),
+		fx.Populate(&publisher, &router),
+		fx.Supply(fx.Annotate(logging.Testing(), fx.As(new(logging.Logger)))),
+		fx.Invoke(func(r *message.Router, subscriber message.Subscriber) {
+			r.AddNoPublisherHandler("testing", "topic", subscriber, func(msg *message.Message) error {
+				messageHandled <- msg
+				return nil
+			})
+		}),
+	}
+	if !testing.Verbose() {
+		options = append(options, fx.NopLogger)
+	}
+	app := fxtest.New(t, options...)
+	app.RequireStart()
+
+	<-router.Running()
+
+	msg := publish.NewMessage(context.TODO(), publish.EventMessage{Type: "TEST"})
+	published := make(chan error, 1)
+	go func() {
+		published <- publisher.Publish("topic", msg)
+	}()
+
+	// The batch waits for more messages
+	select {
+	case <-messageHandled:
+		t.Fatal("batch sent before its delay")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	app.RequireStop()
+	select {
+	case err := <-published:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("pending batch not sent on stop")
+	}
+	select {
+	case handled := <-messageHandled:
+		require.Equal(t, msg.UUID, handled.UUID)
+	default:
+		t.Fatal("pending batch not sent on stop")
+	}
+}
+
+func TestBatchingFromFlags(t *testing.T) {
+	t.Parallel()
+
+	cmd := &cobra.Command{}
+	publish.AddFlags("testing", cmd.Flags())
+	require.NoError(t, cmd.Flags().Parse([]string{
+		"--" + publish.PublisherBatchingEnabledFlag,
+		"--" + publish.PublisherCompressionFlag, string(batch.CompressionGzip),
+	}))
+
+	var (
+		publisher message.Publisher
+		channel   *gochannel.GoChannel
+	)
+	options := []fx.Option{
+		messagingfx.PublishModuleFromFlags(cmd, false),
+		fx.Populate(&publisher, &channel),
+		fx.Supply(fx.Annotate(logging.Testing(), fx.As(new(logging.Logger)))),
+	}
+	if !testing.Verbose() {
+		options = append(options, fx.NopLogger)
+	}
+	app := fxtest.New(t, options...)
+	app.RequireStart()
+	defer app.RequireStop()
+
+	sent, err := channel.Subscribe(context.TODO(), "topic")
+	require.NoError(t, err)
+
+	messages := make([]*message.Message, 0, 3)
+	for range 3 {
+		messages = append(messages, publish.NewMessage(context.TODO(), publish.EventMessage{}))
+	}
+	// The go channel blocks the publisher until the message is acked
+	published := make(chan error, 1)
+	go func() {
+		published <- publisher.Publish("topic", messages...)
+	}()
+
+	// The backend receives a single batch
+	select {
+	case msg := <-sent:
+		require.Equal(t, "3", msg.Metadata.Get(batch.BatchMetadataKey))
+		require.Equal(t, string(batch.CompressionGzip), msg.Metadata.Get(batch.ContentEncodingMetadataKey))
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting batch")
+	}
+	require.NoError(t, <-published)
+}
+
+func TestBatchingWithSchemaRegistryFromFlags(t *testing.T) {
+	t.Parallel()
+
+	cmd := &cobra.Command{}
+	publish.AddFlags("testing", cmd.Flags())
+	require.NoError(t, cmd.Flags().Parse([]string{
+		"--" + publish.PublisherBatchingEnabledFlag,
+		"--" + publish.PublisherKafkaSchemaRegistryEnabledFlag,
+	}))
+
+	require.Panics(t, func() {
+		messagingfx.PublishModuleFromFlags(cmd, false)
+	})
+}
+
+func TestRoutingFromFlags(t *testing.T) {
+	t.Parallel()
+
+	server, err := natsServer.NewServer(&natsServer.Options{
+		Host:      "0.0.0.0",
+		Port:      4323,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	server.Start()
+	require.Eventually(t, server.Running, 3*time.Second, 10*time.Millisecond)
+	t.Cleanup(server.Shutdown)
+
+	httpReceived := make(chan struct{}, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpReceived <- struct{}{}
+	}))
+	t.Cleanup(httpServer.Close)
+
+	cmd := &cobra.Command{}
+	publish.AddFlags("testing", cmd.Flags())
+	require.NoError(t, cmd.Flags().Parse([]string{
+		"--" + publish.PublisherNatsURLFlag, "nats://127.0.0.1:4323",
+		"--" + publish.PublisherRoutingFlag, "http://*:http",
+		"--" + publish.PublisherRoutingFlag, "*:nats",
+	}))
+
+	var (
+		publisher      message.Publisher
+		router         *message.Router
+		messageHandled = make(chan *message.Message, 1)
+	)
+	options := []fx.Option{
+		messagingfx.PublishModuleFromFlags(cmd, false),
+		fx.Populate(&publisher, &router),
+		fx.Supply(fx.Annotate(logging.Testing(), fx.As(new(logging.Logger)))),
+		fx.Invoke(func(r *message.Router, subscriber message.Subscriber) {
+			r.AddNoPublisherHandler("testing", "topic", subscriber, func(msg *message.Message) error {
+				messageHandled <- msg
+				return nil
+			})
+		}),
+	}
+	if !testing.Verbose() {
+		options = append(options, fx.NopLogger)
+	}
+	app := fxtest.New(t, options...)
+	app.RequireStart()
+	defer app.RequireStop()
+
+	<-router.Running()
+
+	require.NoError(t, publisher.Publish("topic", publish.NewMessage(context.TODO(), publish.EventMessage{})))
+	select {
+	case <-messageHandled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting nats message")
+	}
+
+	require.NoError(t, publisher.Publish(httpServer.URL, publish.NewMessage(context.TODO(), publish.EventMessage{})))
+	select {
+	case <-httpReceived:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting http message")
+	}
+}
+
+func TestKafkaSchemaRegistryModule(t *testing.T) {
+	t.Parallel()
+
+	server := schemaregistrytesting.NewServer(t)
+
+	var (
+		marshaler   kafka.Marshaler
+		unmarshaler kafka.Unmarshaler
+	)
+	options := []fx.Option{
+		fx.Supply(fx.Annotate(kafka.DefaultMarshaler{}, fx.As(new(kafka.Marshaler)))),
+		fx.Supply(fx.Annotate(kafka.DefaultMarshaler{}, fx.As(new(kafka.Unmarshaler)))),
+		messagingfx.KafkaSchemaRegistryModule(schemaregistry.NewHTTPClient(server.URL)),
+		fx.Populate(&marshaler, &unmarshaler),
+	}
+	if !testing.Verbose() {
+		options = append(options, fx.NopLogger)
+	}
+	app := fxtest.New(t, options...)
+	app.RequireStart()
+	defer app.RequireStop()
+
+	msg := publish.NewMessage(logging.TestingContext(), publish.EventMessage{Type: "TEST"})
+	kafkaMsg, err := marshaler.Marshal("topic", msg)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]int{"topic-value": {1}}, server.Subjects())
+
+	value, err := kafkaMsg.Value.Encode()
+	require.NoError(t, err)
+	unmarshaled, err := unmarshaler.Unmarshal(&sarama.ConsumerMessage{Value: value})
+	require.NoError(t, err)
+	require.Equal(t, msg.Payload, unmarshaled.Payload)
+	require.Equal(t, "1", unmarshaled.Metadata.Get(schemaregistry.SchemaIDMetadataKey))
+}
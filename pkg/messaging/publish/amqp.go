@@ -0,0 +1,15 @@
+package publish
+
+import (
+	"github.com/ThreeDotsLabs/watermill"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/amqp"
+)
+
+func NewAMQPPublisher(logger watermill.LoggerAdapter, config amqp.Config) (*amqp.Publisher, error) {
+	return amqp.NewPublisher(config, logger)
+}
+
+func NewAMQPSubscriber(logger watermill.LoggerAdapter, config amqp.Config) (*amqp.Subscriber, error) {
+	return amqp.NewSubscriber(config, logger)
+}
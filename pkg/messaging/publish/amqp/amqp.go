@@ -0,0 +1,144 @@
+// Package amqp publishes and consumes watermill messages on an AMQP 0.9.1 broker, like RabbitMQ.
+//
+// Each topic is an exchange. Subscribers consume a queue bound to the exchange of the topic:
+// subscribers sharing a queue group share the queue of the group, so each message is handled once per group.
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrClosed = errors.New("amqp connection closed")
+
+type Config struct {
+	URL string
+	// ExchangeType is the type of the exchanges declared for the topics, fanout by default
+	ExchangeType string
+	// QueueGroup is the prefix of the queue names, without group each subscriber gets its own temporary queue
+	QueueGroup string
+	// Prefetch is the number of messages delivered to a subscriber before being acked
+	Prefetch int
+	// ReconnectDelay is the delay between two connection attempts of a subscriber
+	ReconnectDelay time.Duration
+	// RequeueDelay is the delay before a nacked message is requeued, the broker redelivering it immediately
+	RequeueDelay time.Duration
+}
+
+func (c Config) Validate() error {
+	if c.URL == "" {
+		return errors.New("missing amqp url")
+	}
+	switch c.ExchangeType {
+	case "", amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeDirect:
+		return nil
+	default:
+		return fmt.Errorf("unknown exchange type '%s'", c.ExchangeType)
+	}
+}
+
+func (c *Config) setDefaults() {
+	if c.ExchangeType == "" {
+		c.ExchangeType = amqp.ExchangeFanout
+	}
+	if c.Prefetch == 0 {
+		c.Prefetch = 10
+	}
+	if c.ReconnectDelay == 0 {
+		c.ReconnectDelay = time.Second
+	}
+	if c.RequeueDelay == 0 {
+		c.RequeueDelay = time.Second
+	}
+}
+
+// queueName returns the name of the queue consumed for a topic, empty for a temporary queue named by the broker
+func (c Config) queueName(topic string) string {
+	if c.QueueGroup == "" {
+		return ""
+	}
+	return c.QueueGroup + "." + topic
+}
+
+// connection dials the broker lazily, and again once the connection is lost
+type connection struct {
+	url string
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	closed bool
+}
+
+func (c *connection) channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to amqp broker: %w", err)
+		}
+		c.conn = conn
+	}
+
+	return c.conn.Channel()
+}
+
+func (c *connection) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// bindingKey returns the key binding the queues to the exchange of a topic, messages being published with the topic as routing key
+func (c Config) bindingKey(topic string) string {
+	if c.ExchangeType == amqp.ExchangeTopic {
+		return "#"
+	}
+	return topic
+}
+
+func declareExchange(ch *amqp.Channel, config Config, topic string) error {
+	if err := ch.ExchangeDeclare(topic, config.ExchangeType, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declaring exchange '%s': %w", topic, err)
+	}
+	return nil
+}
+
+func marshal(msg *message.Message) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Metadata {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		MessageId:    msg.UUID,
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Body:         msg.Payload,
+	}
+}
+
+func unmarshal(delivery amqp.Delivery) *message.Message {
+	msg := message.NewMessage(delivery.MessageId, delivery.Body)
+	for k, v := range delivery.Headers {
+		if s, ok := v.(string); ok {
+			msg.Metadata.Set(k, s)
+		} else {
+			msg.Metadata.Set(k, fmt.Sprint(v))
+		}
+	}
+	return msg
+}
@@ -0,0 +1,146 @@
+package amqp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/amqp"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	"github.com/formancehq/go-libs/v5/pkg/testing/docker"
+	"github.com/formancehq/go-libs/v5/pkg/testing/platform/rabbitmqtesting"
+	"github.com/formancehq/go-libs/v5/pkg/testing/utils"
+)
+
+var srv *rabbitmqtesting.Server
+
+func TestMain(m *testing.M) {
+	utils.WithTestMain(func(t *utils.TestingTForMain) int {
+		srv = rabbitmqtesting.CreateServer(t, docker.NewPool(t, logging.Testing()))
+
+		return m.Run()
+	})
+}
+
+func newPubSub(t *testing.T, config amqp.Config) (*amqp.Publisher, *amqp.Subscriber) {
+	t.Helper()
+
+	config.URL = srv.URL
+	if config.QueueGroup == "" {
+		config.QueueGroup = uuid.NewString()
+	}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NopLogger{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, publisher.Close())
+	})
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NopLogger{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, subscriber.Close())
+	})
+
+	return publisher, subscriber
+}
+
+func receive(t *testing.T, messages <-chan *message.Message) *message.Message {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "timeout waiting message")
+		return nil
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	publisher, subscriber := newPubSub(t, amqp.Config{})
+	topic := uuid.NewString()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sent := []*message.Message{
+		message.NewMessage(uuid.NewString(), []byte("1")),
+		message.NewMessage(uuid.NewString(), []byte("2")),
+	}
+	sent[0].Metadata.Set("partition-key", "users:001")
+	require.NoError(t, publisher.Publish(topic, sent...))
+
+	for _, expected := range sent {
+		msg := receive(t, messages)
+		require.Equal(t, expected.UUID, msg.UUID)
+		require.Equal(t, expected.Payload, msg.Payload)
+		require.Equal(t, expected.Metadata, msg.Metadata)
+		msg.Ack()
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	const requeueDelay = 500 * time.Millisecond
+
+	publisher, subscriber := newPubSub(t, amqp.Config{
+		RequeueDelay: requeueDelay,
+	})
+	topic := uuid.NewString()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sent := message.NewMessage(uuid.NewString(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sent))
+
+	msg := receive(t, messages)
+	nackedAt := time.Now()
+	msg.Nack()
+
+	msg = receive(t, messages)
+	require.Equal(t, sent.UUID, msg.UUID)
+	require.GreaterOrEqual(t, time.Since(nackedAt), requeueDelay, "nacked messages must not be redelivered immediately")
+	msg.Ack()
+}
+
+func TestReconnect(t *testing.T) {
+	publisher, subscriber := newPubSub(t, amqp.Config{
+		ReconnectDelay: 100 * time.Millisecond,
+	})
+	topic := uuid.NewString()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.Publish(topic, message.NewMessage(uuid.NewString(), []byte("before"))))
+	receive(t, messages).Ack()
+
+	require.Eventually(t, func() bool {
+		return srv.CloseConnections(t) > 0
+	}, 30*time.Second, time.Second)
+
+	// The publisher opens a new connection, and the subscriber consumes the queue again
+	sent := message.NewMessage(uuid.NewString(), []byte("after"))
+	require.Eventually(t, func() bool {
+		return publisher.Publish(topic, sent) == nil
+	}, 10*time.Second, 100*time.Millisecond)
+
+	msg := receive(t, messages)
+	require.Equal(t, sent.UUID, msg.UUID)
+	msg.Ack()
+}
+
+func TestPublisherClose(t *testing.T) {
+	publisher, _ := newPubSub(t, amqp.Config{})
+	topic := uuid.NewString()
+
+	require.NoError(t, publisher.Publish(topic, message.NewMessage(uuid.NewString(), []byte("payload"))))
+	require.NoError(t, publisher.Close())
+	require.ErrorIs(t, publisher.Publish(topic, message.NewMessage(uuid.NewString(), []byte("payload"))), amqp.ErrClosed)
+}
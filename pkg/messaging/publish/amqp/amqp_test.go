@@ -0,0 +1,47 @@
+package amqp
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	t.Parallel()
+
+	msg := message.NewMessage("uuid", []byte("payload"))
+	msg.Metadata.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	publishing := marshal(msg)
+	require.Equal(t, amqp.Persistent, publishing.DeliveryMode)
+
+	received := unmarshal(amqp.Delivery{
+		MessageId: publishing.MessageId,
+		Headers:   publishing.Headers,
+		Body:      publishing.Body,
+	})
+	require.Equal(t, msg.UUID, received.UUID)
+	require.Equal(t, msg.Payload, received.Payload)
+	require.Equal(t, msg.Metadata, received.Metadata)
+}
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+
+	require.Error(t, Config{}.Validate())
+	require.Error(t, Config{URL: "amqp://localhost", ExchangeType: "unknown"}.Validate())
+
+	config := Config{URL: "amqp://localhost"}
+	require.NoError(t, config.Validate())
+	config.setDefaults()
+	require.Equal(t, amqp.ExchangeFanout, config.ExchangeType)
+	require.Equal(t, "ledger", config.bindingKey("ledger"))
+	require.Empty(t, config.queueName("ledger"))
+
+	config.ExchangeType = amqp.ExchangeTopic
+	config.QueueGroup = "payments"
+	require.Equal(t, "#", config.bindingKey("ledger"))
+	require.Equal(t, "payments.ledger", config.queueName("ledger"))
+}
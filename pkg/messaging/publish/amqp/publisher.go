@@ -0,0 +1,124 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher publishes messages to the exchanges of their topic, and waits for the confirmation of the broker.
+type Publisher struct {
+	config     Config
+	logger     watermill.LoggerAdapter
+	connection *connection
+
+	mu        sync.Mutex
+	channel   *amqp.Channel
+	exchanges map[string]struct{}
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+var _ message.Publisher = (*Publisher)(nil)
+
+func NewPublisher(config Config, logger watermill.LoggerAdapter) (*Publisher, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.setDefaults()
+
+	return &Publisher{
+		config: config,
+		logger: logger,
+		connection: &connection{
+			url: config.URL,
+		},
+		closing: make(chan struct{}),
+	}, nil
+}
+
+func (p *Publisher) Publish(topic string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closing:
+		return ErrClosed
+	default:
+	}
+
+	for _, msg := range messages {
+		if err := p.publish(msg.Context(), topic, msg); err != nil {
+			// The channel is unusable after an error, open a new one on the next publish
+			if p.channel != nil {
+				_ = p.channel.Close()
+				p.channel = nil
+			}
+			return err
+		}
+		p.logger.Trace("Message published", watermill.LogFields{
+			"message_uuid": msg.UUID,
+			"topic":        topic,
+		})
+	}
+
+	return nil
+}
+
+// publish must be called with the lock held
+func (p *Publisher) publish(ctx context.Context, topic string, msg *message.Message) error {
+	if p.channel == nil || p.channel.IsClosed() {
+		ch, err := p.connection.channel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			_ = ch.Close()
+			return fmt.Errorf("enabling publisher confirms: %w", err)
+		}
+		p.channel = ch
+		p.exchanges = make(map[string]struct{})
+	}
+
+	if _, ok := p.exchanges[topic]; !ok {
+		if err := declareExchange(p.channel, p.config, topic); err != nil {
+			return err
+		}
+		p.exchanges[topic] = struct{}{}
+	}
+
+	confirmation, err := p.channel.PublishWithDeferredConfirmWithContext(ctx, topic, topic, false, false, marshal(msg))
+	if err != nil {
+		return fmt.Errorf("publishing message %s: %w", msg.UUID, err)
+	}
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("waiting confirmation of message %s: %w", msg.UUID, ctx.Err())
+	case <-p.closing:
+		return fmt.Errorf("waiting confirmation of message %s: %w", msg.UUID, ErrClosed)
+	case <-confirmation.Done():
+	}
+	if !confirmation.Acked() {
+		return fmt.Errorf("message %s rejected by the broker", msg.UUID)
+	}
+
+	return nil
+}
+
+// Close closes the connection without waiting for the pending publishes, which return ErrClosed.
+func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+
+	if err := p.connection.close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
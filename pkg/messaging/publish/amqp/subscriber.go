@@ -0,0 +1,199 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Subscriber consumes the queues bound to the exchanges of the topics.
+// Nacked messages are requeued after Config.RequeueDelay, and the subscriptions are restored when the connection is lost.
+type Subscriber struct {
+	config     Config
+	logger     watermill.LoggerAdapter
+	connection *connection
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ message.Subscriber = (*Subscriber)(nil)
+
+func NewSubscriber(config Config, logger watermill.LoggerAdapter) (*Subscriber, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.setDefaults()
+
+	return &Subscriber{
+		config: config,
+		logger: logger,
+		connection: &connection{
+			url: config.URL,
+		},
+		closing: make(chan struct{}),
+	}, nil
+}
+
+func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	select {
+	case <-s.closing:
+		return nil, ErrClosed
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Fail fast on the first connection, later ones are retried
+	ch, deliveries, err := s.consume(ctx, topic)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	logFields := watermill.LogFields{
+		"topic": topic,
+	}
+	out := make(chan *message.Message)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(out)
+		defer cancel()
+
+		for {
+			err := s.handleDeliveries(ctx, deliveries, out)
+			_ = ch.Close()
+			if err != nil {
+				// The context is done
+				return
+			}
+
+			s.logger.Info("Consumer channel closed, reconnecting", logFields)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.config.ReconnectDelay):
+				}
+
+				ch, deliveries, err = s.consume(ctx, topic)
+				if err == nil {
+					break
+				}
+				s.logger.Error("Unable to consume topic", err, logFields)
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (s *Subscriber) consume(ctx context.Context, topic string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	ch, err := s.connection.channel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deliveries, err := func() (<-chan amqp.Delivery, error) {
+		if err := declareExchange(ch, s.config, topic); err != nil {
+			return nil, err
+		}
+
+		queueName := s.config.queueName(topic)
+		temporary := queueName == ""
+		queue, err := ch.QueueDeclare(queueName, !temporary, temporary, temporary, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("declaring queue '%s': %w", queueName, err)
+		}
+		if err := ch.QueueBind(queue.Name, s.config.bindingKey(topic), topic, false, nil); err != nil {
+			return nil, fmt.Errorf("binding queue '%s' to exchange '%s': %w", queue.Name, topic, err)
+		}
+		if err := ch.Qos(s.config.Prefetch, 0, false); err != nil {
+			return nil, fmt.Errorf("configuring prefetch: %w", err)
+		}
+
+		return ch.ConsumeWithContext(ctx, queue.Name, "", false, false, false, false, nil)
+	}()
+	if err != nil {
+		_ = ch.Close()
+		return nil, nil, err
+	}
+
+	return ch, deliveries, nil
+}
+
+// handleDeliveries returns nil when the deliveries channel is closed by the broker, and the context error when it is done
+func (s *Subscriber) handleDeliveries(ctx context.Context, deliveries <-chan amqp.Delivery, out chan<- *message.Message) error {
+	for {
+		var (
+			delivery amqp.Delivery
+			ok       bool
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case delivery, ok = <-deliveries:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return nil
+			}
+		}
+
+		msg := unmarshal(delivery)
+		msg.SetContext(ctx)
+
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+			_ = delivery.Nack(false, true)
+			return ctx.Err()
+		}
+
+		select {
+		case <-msg.Acked():
+			if err := delivery.Ack(false); err != nil {
+				s.logger.Error("Unable to ack message", err, watermill.LogFields{"message_uuid": msg.UUID})
+			}
+		case <-msg.Nacked():
+			// The next deliveries are handled meanwhile, within the prefetch limit.
+			// If the channel is closed before, the broker requeues the message anyway.
+			time.AfterFunc(s.config.RequeueDelay, func() {
+				if err := delivery.Nack(false, true); err != nil && !errors.Is(err, amqp.ErrClosed) {
+					s.logger.Error("Unable to nack message", err, watermill.LogFields{"message_uuid": msg.UUID})
+				}
+			})
+		case <-ctx.Done():
+			_ = delivery.Nack(false, true)
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	s.wg.Wait()
+
+	if err := s.connection.close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+)
+
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages []*message.Message
+	closed   bool
+}
+
+func (p *recordingPublisher) Publish(_ string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *recordingPublisher) sent() []*message.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*message.Message{}, p.messages...)
+}
+
+type channelSubscriber struct {
+	ch chan *message.Message
+}
+
+func (s channelSubscriber) Subscribe(context.Context, string) (<-chan *message.Message, error) {
+	return s.ch, nil
+}
+
+func (s channelSubscriber) Close() error {
+	return nil
+}
+
+func newMessages(n int) []*message.Message {
+	ret := make([]*message.Message, 0, n)
+	for i := range n {
+		msg := message.NewMessage(fmt.Sprintf("uuid-%d", i), []byte(fmt.Sprintf(`{"type":"COMMITTED_TRANSACTIONS","payload":{"id":%d}}`, i)))
+		msg.Metadata.Set("index", fmt.Sprint(i))
+		ret = append(ret, msg)
+	}
+	return ret
+}
+
+// receive decodes the sent messages with a SubscriberDecorator, acking all of them
+func receive(t *testing.T, sent []*message.Message) []*message.Message {
+	ch := make(chan *message.Message, len(sent))
+	for _, msg := range sent {
+		ch <- msg.Copy()
+	}
+	close(ch)
+
+	out, err := NewSubscriberDecorator(channelSubscriber{ch: ch}).Subscribe(context.Background(), "test")
+	require.NoError(t, err)
+
+	ret := make([]*message.Message, 0)
+	for msg := range out {
+		msg.Ack()
+		ret = append(ret, msg)
+	}
+	return ret
+}
+
+func requireSameMessages(t *testing.T, expected, actual []*message.Message) {
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		require.Equal(t, expected[i].UUID, actual[i].UUID)
+		require.Equal(t, expected[i].Payload, actual[i].Payload)
+		require.Equal(t, expected[i].Metadata, actual[i].Metadata)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			t.Parallel()
+
+			recorder := &recordingPublisher{}
+			publisher := NewPublisherDecorator(recorder,
+				WithCompression(compression),
+				WithMaxMessages(4),
+				WithMaxDelay(10*time.Millisecond),
+			)
+
+			messages := newMessages(10)
+			require.NoError(t, publisher.Publish("test", messages...))
+
+			// Two full batches and one sent after the delay
+			sent := recorder.sent()
+			require.Len(t, sent, 3)
+			for i, expectedCount := range []string{"4", "4", "2"} {
+				require.Equal(t, expectedCount, sent[i].Metadata.Get(BatchMetadataKey))
+				require.Equal(t, string(compression), sent[i].Metadata.Get(ContentEncodingMetadataKey))
+			}
+
+			requireSameMessages(t, messages, receive(t, sent))
+		})
+	}
+}
+
+func TestBatchUUIDIsStable(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder, WithMaxMessages(2))
+
+	// The same messages sent again in a batch keep its UUID
+	messages := newMessages(3)
+	require.NoError(t, publisher.Publish("test", messages[:2]...))
+	require.NoError(t, publisher.Publish("test", messages[:2]...))
+	require.NoError(t, publisher.Publish("test", messages[1:]...))
+
+	sent := recorder.sent()
+	require.Len(t, sent, 3)
+	require.Equal(t, sent[0].UUID, sent[1].UUID)
+	require.NotEqual(t, sent[0].UUID, sent[2].UUID)
+}
+
+func TestBatchingPartitionKeys(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder,
+		WithMaxMessages(10),
+		WithMaxDelay(10*time.Millisecond),
+	)
+
+	messages := newMessages(5)
+	for i, key := range []string{"users:001", "users:002", "users:001", "users:002", ""} {
+		if key != "" {
+			publish.WithPartitionKey(messages[i], key)
+		}
+	}
+	require.NoError(t, publisher.Publish("test", messages...))
+
+	// One batch per partition key, the message without key being sent alone
+	marshaler := publish.NewKafkaPartitionKeyMarshaler(kafka.DefaultMarshaler{})
+	byKey := make(map[string][]*message.Message)
+	for _, msg := range recorder.sent() {
+		key := publish.PartitionKey(msg)
+		byKey[key] = append(byKey[key], msg)
+
+		producerMessage, err := marshaler.Marshal("test", msg)
+		require.NoError(t, err)
+		if key == "" {
+			require.Nil(t, producerMessage.Key)
+		} else {
+			require.Equal(t, sarama.StringEncoder(key), producerMessage.Key)
+		}
+	}
+	require.Len(t, byKey, 3)
+	requireSameMessages(t, []*message.Message{messages[0], messages[2]}, receive(t, byKey["users:001"]))
+	requireSameMessages(t, []*message.Message{messages[1], messages[3]}, receive(t, byKey["users:002"]))
+	requireSameMessages(t, []*message.Message{messages[4]}, receive(t, byKey[""]))
+}
+
+func TestBatchingConcurrentPublishers(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder,
+		WithCompression(CompressionZstd),
+		WithMaxDelay(50*time.Millisecond),
+	)
+
+	messages := newMessages(20)
+	wg := sync.WaitGroup{}
+	for _, msg := range messages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, publisher.Publish("test", msg))
+		}()
+	}
+	wg.Wait()
+
+	sent := recorder.sent()
+	require.Less(t, len(sent), len(messages))
+	require.Len(t, receive(t, sent), len(messages))
+}
+
+func TestCompressionWithoutBatching(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder,
+		WithCompression(CompressionGzip),
+		WithMaxMessages(1),
+	)
+
+	messages := newMessages(2)
+	require.NoError(t, publisher.Publish("test", messages...))
+
+	sent := recorder.sent()
+	require.Len(t, sent, 2)
+	for i, msg := range sent {
+		require.Equal(t, messages[i].UUID, msg.UUID)
+		require.Equal(t, "gzip", msg.Metadata.Get(ContentEncodingMetadataKey))
+		require.Empty(t, msg.Metadata.Get(BatchMetadataKey))
+		require.NotEqual(t, messages[i].Payload, msg.Payload)
+	}
+
+	requireSameMessages(t, messages, receive(t, sent))
+}
+
+func TestBatchingMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder,
+		WithMaxDelay(10*time.Millisecond),
+		WithMaxBytes(1000),
+	)
+
+	messages := make([]*message.Message, 0, 5)
+	for i := range 5 {
+		payload := make([]byte, 300)
+		_, _ = rand.Read(payload)
+		messages = append(messages, message.NewMessage(fmt.Sprint(i), payload))
+	}
+	require.NoError(t, publisher.Publish("test", messages...))
+
+	sent := recorder.sent()
+	require.Greater(t, len(sent), 1)
+	for _, msg := range sent {
+		require.LessOrEqual(t, messageSize(msg), 1000)
+	}
+	requireSameMessages(t, messages, receive(t, sent))
+
+	tooLarge := message.NewMessage("too-large", make([]byte, 2000))
+	_, _ = rand.Read(tooLarge.Payload)
+	require.ErrorIs(t, publisher.Publish("test", tooLarge), ErrMessageTooLarge)
+}
+
+func TestPublisherClose(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder, WithMaxDelay(time.Hour))
+
+	published := make(chan error, 1)
+	go func() {
+		published <- publisher.Publish("test", newMessages(1)...)
+	}()
+
+	require.Eventually(t, func() bool {
+		publisher.mu.Lock()
+		defer publisher.mu.Unlock()
+		return len(publisher.pending) == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, publisher.Close())
+	require.NoError(t, <-published)
+	require.Len(t, recorder.sent(), 1)
+	// The decorated publisher is closed by its owner
+	require.False(t, recorder.closed)
+
+	require.ErrorIs(t, publisher.Publish("test", newMessages(1)...), ErrPublisherClosed)
+}
+
+func TestSubscriberAcks(t *testing.T) {
+	t.Parallel()
+
+	recorder := &recordingPublisher{}
+	publisher := NewPublisherDecorator(recorder, WithMaxMessages(3))
+	require.NoError(t, publisher.Publish("test", newMessages(3)...))
+	sent := recorder.sent()
+	require.Len(t, sent, 1)
+
+	ch := make(chan *message.Message, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, err := NewSubscriberDecorator(channelSubscriber{ch: ch}).Subscribe(ctx, "test")
+	require.NoError(t, err)
+
+	// A nacked message nacks the batch
+	nacked := sent[0].Copy()
+	ch <- nacked
+	(<-out).Ack()
+	(<-out).Nack()
+	select {
+	case <-nacked.Nacked():
+	case <-time.After(time.Second):
+		t.Fatal("batch was not nacked")
+	}
+
+	acked := sent[0].Copy()
+	ch <- acked
+	for range 3 {
+		(<-out).Ack()
+	}
+	select {
+	case <-acked.Acked():
+	case <-time.After(time.Second):
+		t.Fatal("batch was not acked")
+	}
+
+	// Messages which are not batches are forwarded as is
+	plain := message.NewMessage("plain", []byte("payload"))
+	ch <- plain
+	require.Same(t, plain, <-out)
+
+	invalid := message.NewMessage("invalid", []byte("payload"))
+	invalid.Metadata.Set(ContentEncodingMetadataKey, "gzip")
+	ch <- invalid
+	select {
+	case <-invalid.Nacked():
+	case <-time.After(time.Second):
+		t.Fatal("invalid message was not nacked")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		data, err := compress(compression, bytes.Repeat([]byte("a"), 1000))
+		require.NoError(t, err)
+
+		_, err = decompress(compression, data, 999)
+		require.Error(t, err)
+
+		decompressed, err := decompress(compression, data, 1000)
+		require.NoError(t, err)
+		require.Len(t, decompressed, 1000)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]Compression{"": CompressionNone, "none": CompressionNone, "gzip": CompressionGzip, "zstd": CompressionZstd} {
+		compression, err := ParseCompression(name)
+		require.NoError(t, err)
+		require.Equal(t, expected, compression)
+	}
+	_, err := ParseCompression("lz4")
+	require.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package batch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression parses a compression name, "none" and the empty string disable the compression.
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case CompressionNone, "none":
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return Compression(name), nil
+	default:
+		return CompressionNone, fmt.Errorf("unknown compression '%s', must be one of none, gzip or zstd", name)
+	}
+}
+
+// zstd encoders are safe for concurrent use with EncodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func compress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		buf := bytes.NewBuffer(nil)
+		writer := gzip.NewWriter(buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", compression)
+	}
+}
+
+// decompress returns an error if the decompressed data exceeds maxBytes, to protect against decompression bombs.
+func decompress(compression Compression, data []byte, maxBytes int64) ([]byte, error) {
+	var reader io.Reader
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = gzipReader.Close()
+		}()
+		reader = gzipReader
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		return nil, fmt.Errorf("unknown content encoding '%s'", compression)
+	}
+
+	ret, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(ret)) > maxBytes {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxBytes)
+	}
+	return ret, nil
+}
@@ -0,0 +1,95 @@
+package batch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// ContentEncodingMetadataKey holds the compression of the payload, if any
+	ContentEncodingMetadataKey = "content-encoding"
+	// BatchMetadataKey holds the number of messages of a batch.
+	// The payload of a batch is the encoding of its messages, see encodeBatch.
+	BatchMetadataKey = "batch"
+)
+
+const batchFormatVersion = 1
+
+var errInvalidBatch = errors.New("invalid batch")
+
+// encodeBatch encodes messages with a binary framing, each message being
+// its uuid, its metadata as JSON and its payload, prefixed with their length.
+func encodeBatch(messages []*message.Message) ([]byte, error) {
+	ret := []byte{batchFormatVersion}
+	for _, msg := range messages {
+		metadata, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range [][]byte{[]byte(msg.UUID), metadata, msg.Payload} {
+			ret = binary.AppendUvarint(ret, uint64(len(field)))
+			ret = append(ret, field...)
+		}
+	}
+	return ret, nil
+}
+
+func decodeBatch(data []byte, count int) ([]*message.Message, error) {
+	if len(data) == 0 || data[0] != batchFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported format", errInvalidBatch)
+	}
+	data = data[1:]
+
+	readField := func() ([]byte, error) {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, fmt.Errorf("%w: truncated message", errInvalidBatch)
+		}
+		field := data[n : n+int(size)]
+		data = data[n+int(size):]
+		return field, nil
+	}
+
+	ret := make([]*message.Message, 0, count)
+	for len(data) > 0 {
+		uuid, err := readField()
+		if err != nil {
+			return nil, err
+		}
+		rawMetadata, err := readField()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := readField()
+		if err != nil {
+			return nil, err
+		}
+
+		msg := message.NewMessage(string(uuid), payload)
+		if err := json.Unmarshal(rawMetadata, &msg.Metadata); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidBatch, err)
+		}
+		if msg.Metadata == nil {
+			msg.Metadata = make(message.Metadata)
+		}
+		ret = append(ret, msg)
+	}
+	if len(ret) != count {
+		return nil, fmt.Errorf("%w: expected %d messages, got %d", errInvalidBatch, count, len(ret))
+	}
+
+	return ret, nil
+}
+
+// messageSize approximates the size of a message as counted by backends, which usually include metadata.
+func messageSize(msg *message.Message) int {
+	ret := len(msg.Payload) + len(msg.UUID)
+	for k, v := range msg.Metadata {
+		ret += len(k) + len(v)
+	}
+	return ret
+}
@@ -0,0 +1,304 @@
+// Package batch reduces the number and the size of published messages.
+//
+// PublisherDecorator groups the messages published on a topic with the same partition key during a time window
+// in a single message, and compresses the payloads. SubscriberDecorator restores the original messages on the consumer side.
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+)
+
+// Size limits of the backends, metadata included
+const (
+	MaxBytesSNS   = 256 * 1024
+	MaxBytesSQS   = 256 * 1024
+	MaxBytesKafka = 1_000_000 // sarama default Producer.MaxMessageBytes
+	MaxBytesNATS  = 1024 * 1024
+	MaxBytesHTTP  = 1024 * 1024       // default request body limit of most reverse proxies
+	MaxBytesAMQP  = 128 * 1024 * 1024 // RabbitMQ default max_message_size
+	MaxBytesRedis = 512 * 1024 * 1024 // Redis default proto-max-bulk-len
+)
+
+var (
+	ErrPublisherClosed = errors.New("batch publisher closed")
+	ErrMessageTooLarge = errors.New("message exceeds the maximum size")
+)
+
+// batchKey identifies the batch of the messages of a topic sharing a partition key,
+// so the backends can still route the batches by partition key, see publish.PartitionKeyMetadataKey
+type batchKey struct {
+	topic        string
+	partitionKey string
+}
+
+type pendingBatch struct {
+	messages []*message.Message
+	size     int
+	timer    *time.Timer
+
+	done chan struct{}
+	err  error
+}
+
+// PublisherDecorator batches and compresses messages before sending them to the decorated publisher.
+// Publish blocks until the batches containing its messages are sent, and returns their error,
+// so batching pays off with concurrent publishers or when publishing several messages at once.
+type PublisherDecorator struct {
+	publisher message.Publisher
+
+	compression Compression
+	maxMessages int
+	maxDelay    time.Duration
+	maxBytes    int
+
+	mu      sync.Mutex
+	pending map[batchKey]*pendingBatch
+	closed  bool
+}
+
+var _ message.Publisher = (*PublisherDecorator)(nil)
+
+type PublisherOption func(*PublisherDecorator)
+
+// WithCompression configures the compression of payloads.
+func WithCompression(compression Compression) PublisherOption {
+	return func(p *PublisherDecorator) {
+		p.compression = compression
+	}
+}
+
+// WithMaxMessages configures the maximum number of messages of a batch. 1 disables the batching.
+func WithMaxMessages(n int) PublisherOption {
+	return func(p *PublisherDecorator) {
+		p.maxMessages = n
+	}
+}
+
+// WithMaxDelay configures how long a message can wait for a batch to fill up.
+func WithMaxDelay(d time.Duration) PublisherOption {
+	return func(p *PublisherDecorator) {
+		p.maxDelay = d
+	}
+}
+
+// WithMaxBytes configures the maximum size of sent messages, see the MaxBytes constants of the backends.
+// Batches are sent before their uncompressed size exceeds it, and split if the compression does not make them fit.
+func WithMaxBytes(n int) PublisherOption {
+	return func(p *PublisherDecorator) {
+		p.maxBytes = n
+	}
+}
+
+var defaultPublisherOptions = []PublisherOption{
+	WithMaxMessages(100),
+	WithMaxDelay(50 * time.Millisecond),
+	WithMaxBytes(MaxBytesSNS),
+}
+
+func NewPublisherDecorator(publisher message.Publisher, opts ...PublisherOption) *PublisherDecorator {
+	ret := &PublisherDecorator{
+		publisher: publisher,
+		pending:   make(map[batchKey]*pendingBatch),
+	}
+	for _, opt := range append(defaultPublisherOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+func (p *PublisherDecorator) Publish(topic string, messages ...*message.Message) error {
+	if p.maxMessages <= 1 {
+		for _, msg := range messages {
+			if err := p.send(topic, []*message.Message{msg}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		batches []*pendingBatch
+		waiting = make(map[*pendingBatch]struct{})
+		full    []*pendingBatch
+	)
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPublisherClosed
+	}
+	for _, msg := range messages {
+		size := messageSize(msg)
+		key := batchKey{
+			topic:        topic,
+			partitionKey: msg.Metadata.Get(publish.PartitionKeyMetadataKey),
+		}
+
+		batch := p.pending[key]
+		if batch != nil && batch.size+size > p.maxBytes {
+			delete(p.pending, key)
+			full = append(full, batch)
+			batch = nil
+		}
+		if batch == nil {
+			batch = p.newBatch(key)
+		}
+		if _, ok := waiting[batch]; !ok {
+			waiting[batch] = struct{}{}
+			batches = append(batches, batch)
+		}
+
+		batch.messages = append(batch.messages, msg)
+		batch.size += size
+		if len(batch.messages) >= p.maxMessages {
+			delete(p.pending, key)
+			full = append(full, batch)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, batch := range full {
+		p.flush(topic, batch)
+	}
+
+	errs := make([]error, 0)
+	for _, batch := range batches {
+		<-batch.done
+		if batch.err != nil {
+			errs = append(errs, batch.err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newBatch must be called with the lock held
+func (p *PublisherDecorator) newBatch(key batchKey) *pendingBatch {
+	batch := &pendingBatch{
+		done: make(chan struct{}),
+	}
+	batch.timer = time.AfterFunc(p.maxDelay, func() {
+		p.mu.Lock()
+		if p.pending[key] != batch {
+			// Already sent
+			p.mu.Unlock()
+			return
+		}
+		delete(p.pending, key)
+		p.mu.Unlock()
+
+		p.flush(key.topic, batch)
+	})
+	p.pending[key] = batch
+	return batch
+}
+
+// flush sends a batch removed from the pending batches
+func (p *PublisherDecorator) flush(topic string, batch *pendingBatch) {
+	batch.timer.Stop()
+	batch.err = p.send(topic, batch.messages)
+	close(batch.done)
+}
+
+func (p *PublisherDecorator) send(topic string, messages []*message.Message) error {
+	msg, err := p.encode(messages)
+	if err != nil {
+		return err
+	}
+
+	if size := messageSize(msg); size > p.maxBytes {
+		if len(messages) == 1 {
+			return fmt.Errorf("%w: message %s is %d bytes, maximum is %d", ErrMessageTooLarge, messages[0].UUID, size, p.maxBytes)
+		}
+		// The batch does not fit once encoded, send it in two parts
+		half := len(messages) / 2
+		return errors.Join(
+			p.send(topic, messages[:half]),
+			p.send(topic, messages[half:]),
+		)
+	}
+
+	return p.publisher.Publish(topic, msg)
+}
+
+func (p *PublisherDecorator) encode(messages []*message.Message) (*message.Message, error) {
+	if len(messages) == 1 {
+		// A single message is sent as is, with its payload compressed
+		msg := messages[0]
+		if p.compression == CompressionNone {
+			return msg, nil
+		}
+
+		payload, err := compress(p.compression, msg.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("compressing message %s: %w", msg.UUID, err)
+		}
+		ret := message.NewMessage(msg.UUID, payload)
+		for k, v := range msg.Metadata {
+			ret.Metadata.Set(k, v)
+		}
+		ret.Metadata.Set(ContentEncodingMetadataKey, string(p.compression))
+		ret.SetContext(msg.Context())
+		return ret, nil
+	}
+
+	data, err := encodeBatch(messages)
+	if err != nil {
+		return nil, fmt.Errorf("encoding batch: %w", err)
+	}
+	payload, err := compress(p.compression, data)
+	if err != nil {
+		return nil, fmt.Errorf("compressing batch: %w", err)
+	}
+
+	ret := message.NewMessage(batchUUID(messages), payload)
+	ret.Metadata.Set(BatchMetadataKey, strconv.Itoa(len(messages)))
+	// The messages of a batch share their partition key
+	if key := messages[0].Metadata.Get(publish.PartitionKeyMetadataKey); key != "" {
+		ret.Metadata.Set(publish.PartitionKeyMetadataKey, key)
+	}
+	if p.compression != CompressionNone {
+		ret.Metadata.Set(ContentEncodingMetadataKey, string(p.compression))
+	}
+	ret.SetContext(messages[0].Context())
+	return ret, nil
+}
+
+// batchUUID derives the UUID of a batch from the UUIDs of its messages,
+// so the same messages sent again in a batch keep its UUID.
+func batchUUID(messages []*message.Message) string {
+	uuids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		uuids = append(uuids, msg.UUID)
+	}
+	return uuid.NewSHA1(uuid.Nil, []byte(strings.Join(uuids, ","))).String()
+}
+
+// Close sends the pending batches.
+// The decorated publisher is left open, it is closed by its owner.
+func (p *PublisherDecorator) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	pending := p.pending
+	p.pending = make(map[batchKey]*pendingBatch)
+	p.mu.Unlock()
+
+	for key, batch := range pending {
+		p.flush(key.topic, batch)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SubscriberDecorator decompresses messages and splits batches sent by a PublisherDecorator.
+// Other messages are forwarded unchanged.
+//
+// The messages of a batch are forwarded one by one. The batch is acked when all its messages are acked,
+// and nacked as soon as one of them is nacked, in which case the whole batch is redelivered.
+type SubscriberDecorator struct {
+	message.Subscriber
+
+	logger   watermill.LoggerAdapter
+	maxBytes int64
+}
+
+var _ message.Subscriber = (*SubscriberDecorator)(nil)
+
+type SubscriberOption func(*SubscriberDecorator)
+
+// WithMaxDecompressedBytes limits the size of decompressed payloads.
+func WithMaxDecompressedBytes(n int64) SubscriberOption {
+	return func(s *SubscriberDecorator) {
+		s.maxBytes = n
+	}
+}
+
+// WithLogger configures the logger reporting invalid messages.
+func WithLogger(logger watermill.LoggerAdapter) SubscriberOption {
+	return func(s *SubscriberDecorator) {
+		s.logger = logger
+	}
+}
+
+var defaultSubscriberOptions = []SubscriberOption{
+	WithMaxDecompressedBytes(64 * 1024 * 1024),
+	WithLogger(watermill.NopLogger{}),
+}
+
+func NewSubscriberDecorator(subscriber message.Subscriber, opts ...SubscriberOption) *SubscriberDecorator {
+	ret := &SubscriberDecorator{
+		Subscriber: subscriber,
+	}
+	for _, opt := range append(defaultSubscriberOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+// SubscriberDecoratorFunc returns a message.SubscriberDecorator, usable with message.Router.AddSubscriberDecorators.
+func SubscriberDecoratorFunc(opts ...SubscriberOption) message.SubscriberDecorator {
+	return func(subscriber message.Subscriber) (message.Subscriber, error) {
+		return NewSubscriberDecorator(subscriber, opts...), nil
+	}
+}
+
+func (s *SubscriberDecorator) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	in, err := s.Subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *message.Message)
+	go func() {
+		defer close(out)
+
+		for msg := range in {
+			messages, err := s.decode(msg)
+			if err != nil {
+				// Redelivering the message will not fix it, but dropping it would lose data
+				s.logger.Error("Unable to decode message", err, watermill.LogFields{
+					"message_uuid": msg.UUID,
+					"topic":        topic,
+				})
+				msg.Nack()
+				continue
+			}
+
+			if !forward(ctx, msg, messages, out) {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (s *SubscriberDecorator) decode(msg *message.Message) ([]*message.Message, error) {
+	encoding := msg.Metadata.Get(ContentEncodingMetadataKey)
+	count := msg.Metadata.Get(BatchMetadataKey)
+	if encoding == "" && count == "" {
+		return []*message.Message{msg}, nil
+	}
+
+	payload, err := decompress(Compression(encoding), msg.Payload, s.maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing message: %w", err)
+	}
+
+	if count == "" {
+		ret := message.NewMessage(msg.UUID, payload)
+		for k, v := range msg.Metadata {
+			if k != ContentEncodingMetadataKey {
+				ret.Metadata.Set(k, v)
+			}
+		}
+		ret.SetContext(msg.Context())
+		return []*message.Message{ret}, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("%w: invalid count '%s'", errInvalidBatch, count)
+	}
+	messages, err := decodeBatch(payload, n)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		m.SetContext(msg.Context())
+	}
+	return messages, nil
+}
+
+// forward sends the decoded messages one by one, and acks or nacks the original message accordingly.
+// It returns false if the context is done.
+func forward(ctx context.Context, original *message.Message, messages []*message.Message, out chan<- *message.Message) bool {
+	if len(messages) == 1 && messages[0] == original {
+		select {
+		case out <- original:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for _, msg := range messages {
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+			original.Nack()
+			return false
+		}
+
+		select {
+		case <-msg.Acked():
+		case <-msg.Nacked():
+			original.Nack()
+			return true
+		case <-ctx.Done():
+			original.Nack()
+			return false
+		}
+	}
+
+	original.Ack()
+	return true
+}
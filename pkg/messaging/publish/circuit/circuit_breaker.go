@@ -10,6 +10,8 @@ import (
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/google/uuid"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
 	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
@@ -24,6 +26,10 @@ const (
 	// and waits for the "openInterval" to pass before switching to the
 	// "half-open" state.
 	StateOpen State = "open"
+	// StateHalfOpen is the state after the "openInterval". A single message,
+	// the oldest stored one or the next published one, is sent as a probe:
+	// the circuit breaker closes if it succeeds and opens again otherwise.
+	StateHalfOpen State = "half-open"
 	// StateClosed is the default state. It allows requests to pass through.
 	StateClose State = "close"
 )
@@ -51,6 +57,15 @@ type CircuitBreaker struct {
 	// to the "half-open" state.
 	openInterval      time.Duration
 	openIntervalTimer *time.Timer
+	// replayScheduled is set when messages are stored in the closed state,
+	// after failures below the thresholds, to replay them after the "openInterval",
+	// or before the next published message.
+	replayScheduled bool
+
+	failures failureCounter
+
+	meterProvider metric.MeterProvider
+	metrics       *metrics
 
 	sendChan    chan *internalMessage
 	stopChannel chan struct{}
@@ -64,13 +79,51 @@ type internalMessage struct {
 	errChan chan error
 }
 
+type Option func(*CircuitBreaker)
+
+// WithConsecutiveFailureThreshold opens the circuit breaker after n consecutive publish failures.
+// Zero disables the check.
+// Below the thresholds, a failed message is stored and replayed after the open interval,
+// or before the next published message, which is stored behind it if the replay fails, so the order is kept.
+func WithConsecutiveFailureThreshold(n int) Option {
+	return func(cb *CircuitBreaker) {
+		cb.failures.consecutiveThreshold = n
+	}
+}
+
+// WithFailureRateThreshold opens the circuit breaker when the rate of failures (between 0 and 1)
+// over the last window publishes reaches rate. The rate is only checked once window publishes have been made.
+// A zero rate disables the check.
+// Like below the consecutive failure threshold, the messages published after a failure are sent after its replay.
+func WithFailureRateThreshold(rate float64, window int) Option {
+	return func(cb *CircuitBreaker) {
+		cb.failures.rateThreshold = rate
+		cb.failures.outcomes = nil
+		if window > 0 {
+			cb.failures.outcomes = make([]bool, window)
+		}
+	}
+}
+
+// WithMeterProvider configures the meter provider used to report metrics, defaults to the global one.
+func WithMeterProvider(meterProvider metric.MeterProvider) Option {
+	return func(cb *CircuitBreaker) {
+		cb.meterProvider = meterProvider
+	}
+}
+
+var defaultOptions = []Option{
+	WithConsecutiveFailureThreshold(1),
+}
+
 func NewCircuitBreaker(
 	logger logging.Logger,
 	publisher message.Publisher,
 	store storage.Store,
 	openIntervalDuration time.Duration,
+	opts ...Option,
 ) *CircuitBreaker {
-	return &CircuitBreaker{
+	cb := &CircuitBreaker{
 		stopChannel: make(chan struct{}),
 		stopped:     make(chan struct{}),
 		logger:      logger,
@@ -85,6 +138,23 @@ func NewCircuitBreaker(
 		// no capacity, we want to block the loop if the sendChan is not consumed
 		sendChan: make(chan *internalMessage, 1),
 	}
+	for _, opt := range append(defaultOptions, opts...) {
+		opt(cb)
+	}
+	// The timer is only armed when the circuit breaker opens
+	cb.openIntervalTimer.Stop()
+
+	if cb.meterProvider == nil {
+		cb.meterProvider = otel.GetMeterProvider()
+	}
+	var err error
+	cb.metrics, err = newMetrics(cb.meterProvider, store)
+	if err != nil {
+		logger.Errorf("Failed to create circuit breaker metrics: %s", err)
+		cb.metrics, _ = newMetrics(noop.NewMeterProvider(), store)
+	}
+
+	return cb
 }
 
 func (cb *CircuitBreaker) GetState() State {
@@ -95,29 +165,77 @@ func (cb *CircuitBreaker) GetState() State {
 
 func (cb *CircuitBreaker) setState(state State) {
 	cb.stateMu.Lock()
+	previous := cb.state
 	cb.state = state
 	cb.stateMu.Unlock()
+
+	if previous != state {
+		cb.metrics.recordTransition(previous, state)
+	}
 }
 
 func (cb *CircuitBreaker) OpenState() {
 	cb.setState(StateOpen)
+	cb.failures.reset()
+	cb.replayScheduled = false
 	cb.openIntervalTimer.Reset(cb.openInterval)
 
 	cb.logger.Info("Circuit breaker switched to the open state")
 }
 
 func (cb *CircuitBreaker) HalfOpenState() {
+	cb.setState(StateHalfOpen)
 	cb.openIntervalTimer.Stop()
 	cb.logger.Info("Circuit breaker switched to the half open state")
 }
 
 func (cb *CircuitBreaker) CloseState() {
 	cb.setState(StateClose)
+	cb.failures.reset()
+	cb.replayScheduled = false
 	cb.openIntervalTimer.Stop()
 
 	cb.logger.Info("Circuit breaker switched to the close state")
 }
 
+// publishFailed records a failure in the closed state, and opens the circuit breaker if a threshold is reached.
+// Otherwise, the message is stored and a replay is scheduled.
+func (cb *CircuitBreaker) publishFailed() {
+	if cb.failures.failure() {
+		cb.logger.Info("Failed to publish the message, switching to the open state")
+		cb.OpenState()
+		return
+	}
+
+	cb.logger.Info("Failed to publish the message, scheduling a replay")
+	if !cb.replayScheduled {
+		cb.replayScheduled = true
+		cb.openIntervalTimer.Reset(cb.openInterval)
+	}
+}
+
+// probe replays the stored messages in the half-open state, the first one being the probe.
+// If there is no stored message, the circuit breaker stays in the half-open state
+// and the next published message is the probe, unless closeIfEmpty is set.
+// It returns false if the loop is stopped.
+func (cb *CircuitBreaker) probe(loopCtx context.Context, storeCtx context.Context, closeIfEmpty bool) bool {
+	replayed, err := cb.catchUpDatabase(loopCtx, storeCtx)
+	if err != nil {
+		if loopCtx.Err() != nil {
+			return false
+		}
+		// Don't switch to closed state if there was an error
+		cb.OpenState()
+		return true
+	}
+
+	if replayed > 0 || closeIfEmpty {
+		// Only switch to closed state if catchup was successful
+		cb.CloseState()
+	}
+	return true
+}
+
 func (cb *CircuitBreaker) Loop(ctx context.Context) {
 	loopCtx, cancel := context.WithCancel(ctx)
 	if !cb.startLoop(cancel) {
@@ -140,15 +258,8 @@ func (cb *CircuitBreaker) Loop(ctx context.Context) {
 
 	// Start in the half open state to fetch the messages from the database
 	cb.HalfOpenState()
-	if err := cb.catchUpDatabase(loopCtx, ctx); err != nil {
-		if loopCtx.Err() != nil {
-			return
-		}
-		cb.OpenState()
-		// Don't switch to closed state if there was an error
-	} else {
-		// Only switch to closed state if catchup was successful
-		cb.CloseState()
+	if !cb.probe(loopCtx, ctx, true) {
+		return
 	}
 
 	for {
@@ -160,20 +271,25 @@ func (cb *CircuitBreaker) Loop(ctx context.Context) {
 			return
 
 		case <-cb.openIntervalTimer.C:
-			// openInterval passed, let's switch to the half-open state
-
-			cb.HalfOpenState()
-
-			if err := cb.catchUpDatabase(loopCtx, ctx); err != nil {
-				if loopCtx.Err() != nil {
-					return
+			if cb.GetState() == StateClose {
+				// Messages were stored after failures below the thresholds, let's replay them
+				cb.replayScheduled = false
+				if _, err := cb.catchUpDatabase(loopCtx, ctx); err != nil {
+					if loopCtx.Err() != nil {
+						return
+					}
+					cb.publishFailed()
+				} else {
+					cb.failures.success()
 				}
-				cb.OpenState()
 				continue
 			}
 
-			// we successfully published the messages, let's switch to the closed state
-			cb.CloseState()
+			// openInterval passed, let's switch to the half-open state
+			cb.HalfOpenState()
+			if !cb.probe(loopCtx, ctx, false) {
+				return
+			}
 
 		case msg, ok := <-cb.sendChan:
 			if !ok {
@@ -183,27 +299,62 @@ func (cb *CircuitBreaker) Loop(ctx context.Context) {
 
 			switch cb.GetState() {
 			case StateClose:
+				if cb.replayScheduled {
+					// Messages have been stored after a failure below the thresholds,
+					// replay them first to keep the order
+					if _, err := cb.catchUpDatabase(loopCtx, ctx); err != nil {
+						if loopCtx.Err() == nil {
+							cb.publishFailed()
+						}
+
+						// queue the message behind the stored ones
+						if err := cb.insert(ctx, msg.topic, msg.msg); err != nil {
+							msg.errChan <- err
+							continue
+						}
+						break
+					}
+					cb.replayScheduled = false
+					cb.openIntervalTimer.Stop()
+				}
+
 				// We are in the closed state, send the message to the publisher
 
 				cb.logger.Info("Circular breaker is in the closed state, sending the message to the publisher")
 				err := cb.publisher.Publish(msg.topic, msg.msg)
 				if err != nil {
-					// error publishing the message, let's switch to the open state
-					cb.OpenState()
+					// error publishing the message, let's count the failure
+					cb.publishFailed()
 
-					cb.logger.Info("Failed to publish the message, switching to the open state")
 					// write the message in the database
-					err = cb.store.Insert(ctx, msg.topic, msg.msg.Payload, msg.msg.Metadata)
+					err = cb.insert(ctx, msg.topic, msg.msg)
+					if err != nil {
+						msg.errChan <- err
+						continue
+					}
+				} else {
+					cb.failures.success()
+				}
+			case StateHalfOpen:
+				// We are in the half-open state without stored messages, this message is the probe
+				cb.logger.Info("Circuit breaker is in the half open state, sending the message as probe")
+				err := cb.publisher.Publish(msg.topic, msg.msg)
+				if err != nil {
+					cb.OpenState()
+
+					err = cb.insert(ctx, msg.topic, msg.msg)
 					if err != nil {
 						msg.errChan <- err
 						continue
 					}
+				} else {
+					cb.CloseState()
 				}
 			case StateOpen:
 				// We are in the open state, write the message in the database
 				cb.logger.Info("Circuit breaker is in the open state, writing the message in the database")
 
-				err := cb.store.Insert(ctx, msg.topic, msg.msg.Payload, msg.msg.Metadata)
+				err := cb.insert(ctx, msg.topic, msg.msg)
 				if err != nil {
 					msg.errChan <- err
 					continue
@@ -215,21 +366,28 @@ func (cb *CircuitBreaker) Loop(ctx context.Context) {
 	}
 }
 
-func (cb *CircuitBreaker) catchUpDatabase(loopCtx context.Context, storeCtx context.Context) error {
+// catchUpDatabase publishes the stored messages, from the oldest, and stops on the first failure.
+// It returns the number of published messages.
+func (cb *CircuitBreaker) catchUpDatabase(loopCtx context.Context, storeCtx context.Context) (replayed int, err error) {
+	start := time.Now()
+	defer func() {
+		cb.metrics.recordReplay(storeCtx, replayed, time.Since(start), err)
+	}()
+
 	for {
 		if err := loopCtx.Err(); err != nil {
-			return err
+			return replayed, err
 		}
 
 		// fetch the oldest messages from the database
 		messages, err := cb.store.List(loopCtx)
 		if err != nil {
 			// error fetching messages, let's switch back to the open state
-			return err
+			return replayed, err
 		}
 
 		if len(messages) == 0 {
-			return nil
+			return replayed, nil
 		}
 
 		messagesToDelete := make([]uint64, 0)
@@ -242,13 +400,13 @@ func (cb *CircuitBreaker) catchUpDatabase(loopCtx context.Context, storeCtx cont
 			}
 
 			if err := storeCtx.Err(); err != nil {
-				return err
+				return replayed, err
 			}
 
 			// We need to publish the messages one by one in order to know
 			// which one failed.
 
-			message, err := newMessage(storeCtx, msg.Data, msg.Metadata)
+			message, err := newMessage(storeCtx, msg.UUID, msg.Data, msg.Metadata)
 			if err != nil {
 				publishError = err
 				break
@@ -267,16 +425,17 @@ func (cb *CircuitBreaker) catchUpDatabase(loopCtx context.Context, storeCtx cont
 			err = cb.store.Delete(storeCtx, messagesToDelete)
 			if err != nil {
 				// error deleting messages, let's switch back to the open state
-				return err
+				return replayed, err
 			}
+			replayed += len(messagesToDelete)
 		}
 
 		if publishError != nil {
 			// we failed to publish all the messages
-			return publishError
+			return replayed, publishError
 		}
 		if stopError != nil {
-			return stopError
+			return replayed, stopError
 		}
 	}
 }
@@ -340,6 +499,9 @@ func (cb *CircuitBreaker) Close() error {
 	}
 
 	cb.publisherCloseOnce.Do(func() {
+		if err := cb.metrics.close(); err != nil {
+			cb.logger.Errorf("Failed to unregister circuit breaker metrics: %s", err)
+		}
 		cb.publisherCloseErr = cb.publisher.Close()
 	})
 
@@ -375,6 +537,14 @@ func (cb *CircuitBreaker) cancelLoop() {
 	}
 }
 
+// insert stores a message, with its UUID if the store keeps it, see storage.UUIDInserter
+func (cb *CircuitBreaker) insert(ctx context.Context, topic string, msg *message.Message) error {
+	if inserter, ok := cb.store.(storage.UUIDInserter); ok {
+		return inserter.InsertWithUUID(ctx, msg.UUID, topic, msg.Payload, msg.Metadata)
+	}
+	return cb.store.Insert(ctx, topic, msg.Payload, msg.Metadata)
+}
+
 func (cb *CircuitBreaker) hasLoopStarted() bool {
 	cb.loopMu.Lock()
 	defer cb.loopMu.Unlock()
@@ -391,12 +561,16 @@ const (
 	otelContextKey = "otel-context"
 )
 
-func newMessage(ctx context.Context, data []byte, metadata map[string]string) (*message.Message, error) {
+// newMessage restores a stored message, with a new UUID if the store did not keep it
+func newMessage(ctx context.Context, id string, data []byte, metadata map[string]string) (*message.Message, error) {
 	if metadata == nil {
 		metadata = make(map[string]string)
 	}
+	if id == "" {
+		id = uuid.NewString()
+	}
 
-	msg := message.NewMessage(uuid.NewString(), data)
+	msg := message.NewMessage(id, data)
 
 	otelContext, ok := metadata[otelContextKey]
 	if ok {
@@ -415,3 +589,58 @@ func newMessage(ctx context.Context, data []byte, metadata map[string]string) (*
 
 	return msg, nil
 }
+
+// failureCounter tracks the publish failures in the closed state.
+type failureCounter struct {
+	consecutiveThreshold int
+	consecutive          int
+
+	rateThreshold float64
+	// outcomes is a ring buffer of the last publishes, true for a failure
+	outcomes    []bool
+	next        int
+	recorded    int
+	outFailures int
+}
+
+func (c *failureCounter) record(failed bool) {
+	if len(c.outcomes) == 0 {
+		return
+	}
+	if c.recorded == len(c.outcomes) && c.outcomes[c.next] {
+		c.outFailures--
+	}
+	c.outcomes[c.next] = failed
+	if failed {
+		c.outFailures++
+	}
+	c.next = (c.next + 1) % len(c.outcomes)
+	if c.recorded < len(c.outcomes) {
+		c.recorded++
+	}
+}
+
+func (c *failureCounter) success() {
+	c.consecutive = 0
+	c.record(false)
+}
+
+// failure records a failure and returns true if a threshold is reached.
+func (c *failureCounter) failure() bool {
+	c.consecutive++
+	c.record(true)
+
+	if c.consecutiveThreshold > 0 && c.consecutive >= c.consecutiveThreshold {
+		return true
+	}
+	return c.rateThreshold > 0 &&
+		c.recorded == len(c.outcomes) &&
+		float64(c.outFailures)/float64(c.recorded) >= c.rateThreshold
+}
+
+func (c *failureCounter) reset() {
+	c.consecutive = 0
+	c.next = 0
+	c.recorded = 0
+	c.outFailures = 0
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/routing"
 	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
 )
 
@@ -764,6 +766,225 @@ func TestCircuitBreakerCatchUpExtractsStoredTraceContext(t *testing.T) {
 	require.Equal(t, "00f067aa0ba902b7", spanContext.SpanID().String())
 }
 
+func TestCircuitBreakerConsecutiveFailureThreshold(t *testing.T) {
+	messages := make(chan *testMessages, 100)
+	defer close(messages)
+
+	errTest := errors.New("test")
+	underlyingPublisher := newMockPublisher(messages).WithPublishError(errTest)
+	store := newMockStore()
+	cb := NewCircuitBreaker(
+		logging.Testing(),
+		underlyingPublisher,
+		store,
+		200*time.Millisecond,
+		WithConsecutiveFailureThreshold(3),
+	)
+	defer cb.Close()
+
+	go cb.Loop(logging.TestingContext())
+
+	require.NoError(t, cb.Publish("test", message.NewMessage("1", []byte("1"))))
+	require.NoError(t, cb.Publish("test", message.NewMessage("2", []byte("2"))))
+	require.Equal(t, StateClose, cb.GetState())
+
+	// Failed messages are stored and replayed after the open interval, without opening the circuit breaker
+	storedMessages, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, storedMessages, 2)
+
+	underlyingPublisher.WithPublishError(nil)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		storedMessages, err := store.List(context.Background())
+		assert.NoError(c, err)
+		assert.Empty(c, storedMessages)
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Len(t, messages, 2)
+	require.Equal(t, StateClose, cb.GetState())
+
+	underlyingPublisher.WithPublishError(errTest)
+	for i := range 3 {
+		require.Equal(t, StateClose, cb.GetState())
+		require.NoError(t, cb.Publish("test", message.NewMessage(fmt.Sprint(i), nil)))
+	}
+	require.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestCircuitBreakerKeepsOrderBelowThreshold(t *testing.T) {
+	messages := make(chan *testMessages, 100)
+	defer close(messages)
+
+	errTest := errors.New("test")
+	underlyingPublisher := newMockPublisher(messages).WithPublishError(errTest)
+	store := newMockStore()
+	cb := NewCircuitBreaker(
+		logging.Testing(),
+		underlyingPublisher,
+		store,
+		time.Minute,
+		WithConsecutiveFailureThreshold(3),
+	)
+	defer cb.Close()
+
+	go cb.Loop(logging.TestingContext())
+
+	require.NoError(t, cb.Publish("test", message.NewMessage("1", []byte("1"))))
+
+	// The stored message is replayed before the next one
+	underlyingPublisher.WithPublishError(nil)
+	require.NoError(t, cb.Publish("test", message.NewMessage("2", []byte("2"))))
+	require.NoError(t, cb.Publish("test", message.NewMessage("3", []byte("3"))))
+	require.Equal(t, StateClose, cb.GetState())
+
+	require.Len(t, messages, 3)
+	for _, expected := range []string{"1", "2", "3"} {
+		require.Equal(t, expected, string((<-messages).msg.Payload))
+	}
+	storedMessages, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, storedMessages)
+}
+
+func TestCircuitBreakerRetriesOnlyFailedBackends(t *testing.T) {
+	messagesA := make(chan *testMessages, 100)
+	defer close(messagesA)
+	messagesB := make(chan *testMessages, 100)
+	defer close(messagesB)
+
+	errTest := errors.New("test")
+	backendA := newMockPublisher(messagesA)
+	backendB := newMockPublisher(messagesB).WithPublishError(errTest)
+	router, err := routing.NewPublisher([]routing.Backend{
+		{Name: "a", Publisher: backendA},
+		{Name: "b", Publisher: backendB},
+	}, []routing.Route{{
+		Pattern:  "*",
+		Backends: []string{"a", "b"},
+	}})
+	require.NoError(t, err)
+
+	store := newMockStore()
+	cb := NewCircuitBreaker(logging.Testing(), router, store, 100*time.Millisecond)
+	defer cb.Close()
+
+	go cb.Loop(logging.TestingContext())
+
+	require.NoError(t, cb.Publish("test", message.NewMessage("1", []byte("1"))))
+	require.Len(t, messagesA, 1)
+
+	// The stored message keeps its UUID, so its replay is only sent to the failed backend
+	backendB.WithPublishError(nil)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		storedMessages, err := store.List(context.Background())
+		assert.NoError(c, err)
+		assert.Empty(c, storedMessages)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Len(t, messagesA, 1)
+	require.Len(t, messagesB, 1)
+	require.Equal(t, "1", (<-messagesB).msg.UUID)
+}
+
+func TestCircuitBreakerFailureRateThreshold(t *testing.T) {
+	messages := make(chan *testMessages, 100)
+	defer close(messages)
+
+	errTest := errors.New("test")
+	underlyingPublisher := newMockPublisher(messages)
+	cb := NewCircuitBreaker(
+		logging.Testing(),
+		underlyingPublisher,
+		newMockStore(),
+		time.Minute,
+		WithConsecutiveFailureThreshold(0),
+		WithFailureRateThreshold(0.5, 4),
+	)
+	defer cb.Close()
+
+	go cb.Loop(logging.TestingContext())
+
+	publish := func(err error) {
+		underlyingPublisher.WithPublishError(err)
+		require.NoError(t, cb.Publish("test", message.NewMessage(uuid.NewString(), nil)))
+	}
+
+	// The rate is only checked once the window is full
+	publish(errTest)
+	publish(errTest)
+	publish(nil)
+	require.Equal(t, StateClose, cb.GetState())
+
+	// 2 failures out of the last 4 publishes
+	publish(nil)
+	require.Equal(t, StateClose, cb.GetState())
+	publish(errTest)
+	require.Equal(t, StateOpen, cb.GetState())
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	messages := make(chan *testMessages, 100)
+	defer close(messages)
+
+	errTest := errors.New("test")
+	underlyingPublisher := newMockPublisher(messages).WithPublishError(errTest)
+	// Messages are not stored, so the next published message is the probe
+	store := newMockStore().WithInsertError(errTest)
+	cb := NewCircuitBreaker(
+		logging.Testing(),
+		underlyingPublisher,
+		store,
+		10*time.Millisecond,
+	)
+	defer cb.Close()
+
+	go cb.Loop(logging.TestingContext())
+
+	require.ErrorIs(t, cb.Publish("test", message.NewMessage("1", nil)), errTest)
+	require.Equal(t, StateOpen, cb.GetState())
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, StateHalfOpen, cb.GetState())
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// The probe fails, the circuit breaker opens again
+	require.ErrorIs(t, cb.Publish("test", message.NewMessage("2", nil)), errTest)
+	require.Equal(t, StateOpen, cb.GetState())
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, StateHalfOpen, cb.GetState())
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// The probe succeeds, the circuit breaker closes
+	underlyingPublisher.WithPublishError(nil)
+	require.NoError(t, cb.Publish("test", message.NewMessage("3", nil)))
+	require.Equal(t, StateClose, cb.GetState())
+	require.Len(t, messages, 1)
+}
+
+func TestFailureCounter(t *testing.T) {
+	t.Parallel()
+
+	counter := failureCounter{
+		rateThreshold: 0.5,
+		outcomes:      make([]bool, 2),
+	}
+	require.False(t, counter.failure())
+	counter.success()
+	require.True(t, counter.failure())
+	counter.success()
+	counter.success()
+	require.True(t, counter.failure())
+
+	counter.reset()
+	require.False(t, counter.failure())
+
+	counter = failureCounter{consecutiveThreshold: 2}
+	require.False(t, counter.failure())
+	counter.success()
+	require.False(t, counter.failure())
+	require.True(t, counter.failure())
+}
+
 func requireCloseWithin(t *testing.T, circuitBreaker *CircuitBreaker) {
 	t.Helper()
 
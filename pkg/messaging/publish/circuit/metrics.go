@@ -0,0 +1,94 @@
+package circuit
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
+)
+
+const instrumentationName = "github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit"
+
+type metrics struct {
+	transitions    metric.Int64Counter
+	replayed       metric.Int64Counter
+	replayDuration metric.Float64Histogram
+
+	backlogRegistration metric.Registration
+}
+
+func newMetrics(meterProvider metric.MeterProvider, store storage.Store) (*metrics, error) {
+	meter := meterProvider.Meter(instrumentationName)
+
+	transitions, err := meter.Int64Counter("circuit_breaker.transitions",
+		metric.WithDescription("Number of state transitions of the circuit breaker"))
+	if err != nil {
+		return nil, err
+	}
+	replayed, err := meter.Int64Counter("circuit_breaker.replayed",
+		metric.WithDescription("Number of stored messages sent to the publisher"))
+	if err != nil {
+		return nil, err
+	}
+	replayDuration, err := meter.Float64Histogram("circuit_breaker.replay.duration",
+		metric.WithDescription("Duration of the replays of stored messages in seconds"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &metrics{
+		transitions:    transitions,
+		replayed:       replayed,
+		replayDuration: replayDuration,
+	}
+
+	// The backlog is read from the store on collection, so it is only available if the store can count
+	counter, ok := store.(storage.Counter)
+	if !ok {
+		return ret, nil
+	}
+
+	backlog, err := meter.Int64ObservableGauge("circuit_breaker.backlog",
+		metric.WithDescription("Number of messages stored while the circuit breaker is open"))
+	if err != nil {
+		return nil, err
+	}
+	ret.backlogRegistration, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		count, err := counter.Count(ctx)
+		if err != nil {
+			return err
+		}
+		observer.ObserveInt64(backlog, int64(count))
+		return nil
+	}, backlog)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (m *metrics) recordTransition(from, to State) {
+	m.transitions.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("from", string(from)),
+		attribute.String("to", string(to)),
+	))
+}
+
+func (m *metrics) recordReplay(ctx context.Context, replayed int, duration time.Duration, err error) {
+	m.replayed.Add(ctx, int64(replayed))
+	m.replayDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(
+		attribute.Bool("success", err == nil),
+	))
+}
+
+func (m *metrics) close() error {
+	if m.backlogRegistration == nil {
+		return nil
+	}
+	return m.backlogRegistration.Unregister()
+}
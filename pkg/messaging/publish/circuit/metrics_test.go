@@ -0,0 +1,95 @@
+package circuit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+type countingStore struct {
+	*MockStore
+}
+
+func (s countingStore) Count(ctx context.Context) (int, error) {
+	messages, err := s.List(ctx)
+	return len(messages), err
+}
+
+func collect(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	rm := metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	ret := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			ret[m.Name] = m.Data
+		}
+	}
+	return ret
+}
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+	messages := make(chan *testMessages, 100)
+	defer close(messages)
+
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	errTest := errors.New("test")
+	underlyingPublisher := newMockPublisher(messages).WithPublishError(errTest)
+	store := countingStore{MockStore: newMockStore()}
+	cb := NewCircuitBreaker(
+		logging.Testing(),
+		underlyingPublisher,
+		store,
+		10*time.Millisecond,
+		WithMeterProvider(meterProvider),
+	)
+	defer cb.Close()
+
+	go cb.Loop(logging.TestingContext())
+
+	require.NoError(t, cb.Publish("test", message.NewMessage("1", nil)))
+	require.NoError(t, cb.Publish("test", message.NewMessage("2", nil)))
+	require.Equal(t, StateOpen, cb.GetState())
+
+	metrics := collect(t, reader)
+	backlog := metrics["circuit_breaker.backlog"].(metricdata.Gauge[int64])
+	require.Len(t, backlog.DataPoints, 1)
+	require.Equal(t, int64(2), backlog.DataPoints[0].Value)
+
+	underlyingPublisher.WithPublishError(nil)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, StateClose, cb.GetState())
+	}, 2*time.Second, 5*time.Millisecond)
+
+	metrics = collect(t, reader)
+	replayed := metrics["circuit_breaker.replayed"].(metricdata.Sum[int64])
+	require.Len(t, replayed.DataPoints, 1)
+	require.Equal(t, int64(2), replayed.DataPoints[0].Value)
+
+	transitions := make(map[[2]string]int64)
+	for _, dp := range metrics["circuit_breaker.transitions"].(metricdata.Sum[int64]).DataPoints {
+		from, _ := dp.Attributes.Value(attribute.Key("from"))
+		to, _ := dp.Attributes.Value(attribute.Key("to"))
+		transitions[[2]string{from.AsString(), to.AsString()}] = dp.Value
+	}
+	require.Equal(t, int64(1), transitions[[2]string{string(StateClose), string(StateOpen)}])
+	// The circuit breaker also goes through the half-open state on start, to replay messages of previous runs
+	require.Equal(t, int64(1), transitions[[2]string{string(StateClose), string(StateHalfOpen)}])
+	require.Equal(t, int64(2), transitions[[2]string{string(StateHalfOpen), string(StateClose)}])
+	require.Positive(t, transitions[[2]string{string(StateOpen), string(StateHalfOpen)}])
+
+	backlog = collect(t, reader)["circuit_breaker.backlog"].(metricdata.Gauge[int64])
+	require.Equal(t, int64(0), backlog.DataPoints[0].Value)
+}
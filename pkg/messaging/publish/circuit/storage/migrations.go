@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/uptrace/bun"
 
@@ -23,13 +24,73 @@ func registerMigrations(migrator *migrations.Migrator, schema string) {
 				})
 			},
 		},
+		migrations.Migration{
+			Name:   "add uuid column",
+			Source: addUUIDColumn,
+			Up: func(ctx context.Context, db bun.IDB) error {
+				return db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+					_, err := tx.Exec("set search_path = ?", schema)
+					if err != nil {
+						return err
+					}
+					_, err = tx.Exec(addUUIDColumn)
+					return err
+				})
+			},
+		},
+		migrations.Migration{
+			Name:   "add sent_at column",
+			Source: addSentAtColumn,
+			Up: func(ctx context.Context, db bun.IDB) error {
+				return db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+					_, err := tx.Exec("set search_path = ?", schema)
+					if err != nil {
+						return err
+					}
+					_, err = tx.Exec(addSentAtColumn)
+					return err
+				})
+			},
+		},
 	)
 }
 
+// moveVersionsTable moves the versions table created outside of the schema by older versions of Migrate,
+// if the models table of the schema exists and the schema has no versions table yet.
+// A versions table shared by several schemas is moved to the first one migrated, the migrations being
+// idempotent, the other ones apply them again.
+func moveVersionsTable(ctx context.Context, schema string, db *bun.DB) error {
+	return db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		var move bool
+		err := tx.NewRaw(`
+			select to_regclass(?) is not null
+				and to_regclass(?) is null
+				and to_regclass(?) is not null
+		`,
+			versionsTableName,
+			fmt.Sprintf(`"%s"."%s"`, schema, versionsTableName),
+			fmt.Sprintf(`"%s"."circuit_breaker"`, schema),
+		).Scan(ctx, &move)
+		if err != nil || !move {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "alter table ? set schema ?", bun.Ident(versionsTableName), bun.Ident(schema))
+		return err
+	})
+}
+
+// Migrate creates the table of the models in the given schema.
+// The versions of the migrations are stored in the schema.
 func Migrate(ctx context.Context, schema string, db *bun.DB) error {
+	if err := moveVersionsTable(ctx, schema, db); err != nil {
+		return err
+	}
+
 	migrator := migrations.NewMigrator(
 		db,
-		migrations.WithTableName("circuit_breaker_migrations"),
+		migrations.WithSchema(schema),
+		migrations.WithTableName(versionsTableName),
 	)
 
 	registerMigrations(migrator, schema)
@@ -37,6 +98,8 @@ func Migrate(ctx context.Context, schema string, db *bun.DB) error {
 	return migrator.Up(ctx)
 }
 
+const versionsTableName = "circuit_breaker_migrations"
+
 const initialSchema = `
 CREATE TABLE IF NOT EXISTS "circuit_breaker" (
 	id bigserial NOT NULL,
@@ -49,3 +112,11 @@ CREATE TABLE IF NOT EXISTS "circuit_breaker" (
 
 CREATE INDEX IF NOT EXISTS "circuit_breaker_creation_date_idx" ON "circuit_breaker" ("created_at" ASC);
 `
+
+const addUUIDColumn = `
+ALTER TABLE "circuit_breaker" ADD COLUMN IF NOT EXISTS uuid text;
+`
+
+const addSentAtColumn = `
+ALTER TABLE "circuit_breaker" ADD COLUMN IF NOT EXISTS sent_at timestamp with time zone;
+`
@@ -13,16 +13,42 @@ type Store interface {
 	Delete(ctx context.Context, ids []uint64) error
 }
 
+// Counter is implemented by stores able to report the number of stored messages.
+type Counter interface {
+	Count(ctx context.Context) (int, error)
+}
+
+// UUIDInserter is implemented by stores able to keep the UUID of the stored messages,
+// so they are sent again with the same UUID.
+type UUIDInserter interface {
+	InsertWithUUID(ctx context.Context, uuid, topic string, data []byte, metadata map[string]string) error
+}
+
 type CircuitBreakerModel struct {
 	bun.BaseModel `bun:"circuit_breaker"`
 
-	ID        uint64            `bun:"id,pk,autoincrement"`
+	ID uint64 `bun:"id,pk,autoincrement"`
+	// UUID is the UUID of the stored message
+	UUID      string            `bun:"uuid,nullzero"`
 	CreatedAt time.Time         `bun:",notnull"`
 	Topic     string            `bun:",notnull"`
 	Data      []byte            `bun:",notnull"`
 	Metadata  map[string]string `bun:",type:jsonb"`
+	// SentAt is the date the message was sent at, it is only set by the outbox
+	SentAt *time.Time `bun:"sent_at,nullzero"`
+}
+
+// TableExpr returns the table of the models in the given schema, to be used with bun.SelectQuery.ModelTableExpr and alike.
+func TableExpr(schema string) (string, bun.Ident) {
+	return "? AS circuit_breaker", bun.Ident(schema + ".circuit_breaker")
 }
 
+var (
+	_ Store        = (*Storage)(nil)
+	_ Counter      = (*Storage)(nil)
+	_ UUIDInserter = (*Storage)(nil)
+)
+
 type Storage struct {
 	db           *bun.DB
 	schema       string
@@ -38,8 +64,13 @@ func New(schema string, db *bun.DB, storageLimit int) *Storage {
 }
 
 func (s *Storage) Insert(ctx context.Context, topic string, data []byte, metadata map[string]string) error {
+	return s.InsertWithUUID(ctx, "", topic, data, metadata)
+}
+
+func (s *Storage) InsertWithUUID(ctx context.Context, uuid, topic string, data []byte, metadata map[string]string) error {
 	_, err := s.db.NewInsert().
 		Model(&CircuitBreakerModel{
+			UUID:      uuid,
 			CreatedAt: time.Now().UTC(),
 			Topic:     topic,
 			Data:      data,
@@ -61,6 +92,12 @@ func (s *Storage) List(ctx context.Context) ([]*CircuitBreakerModel, error) {
 	return models, err
 }
 
+func (s *Storage) Count(ctx context.Context) (int, error) {
+	return s.db.NewSelect().
+		Model((*CircuitBreakerModel)(nil)).
+		Count(ctx)
+}
+
 func (s *Storage) Delete(ctx context.Context, ids []uint64) error {
 	models := make([]*CircuitBreakerModel, 0, len(ids))
 	for _, id := range ids {
@@ -106,6 +106,10 @@ func (s *MockStore) WithDeleteError(err error) *MockStore {
 }
 
 func (s *MockStore) Insert(ctx context.Context, topic string, data []byte, metadata map[string]string) error {
+	return s.InsertWithUUID(ctx, "", topic, data, metadata)
+}
+
+func (s *MockStore) InsertWithUUID(ctx context.Context, uuid, topic string, data []byte, metadata map[string]string) error {
 	if s.insertErr != nil {
 		return s.insertErr
 	}
@@ -114,6 +118,7 @@ func (s *MockStore) Insert(ctx context.Context, topic string, data []byte, metad
 	defer s.mu.Unlock()
 
 	s.messagesToSend = append(s.messagesToSend, &storage.CircuitBreakerModel{
+		UUID:      uuid,
 		CreatedAt: time.Now().UTC(),
 		Topic:     topic,
 		Data:      data,
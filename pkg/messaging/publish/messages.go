@@ -16,7 +16,7 @@ import (
 )
 
 const (
-	// NOTE: this const is also copid inside the circuit breaker package
+	// NOTE: this const is also copid inside the circuit breaker and outbox packages
 	// (to prevent a circular dependency). If you change it here, change it
 	// there as well.
 	otelContextKey = "otel-context"
@@ -55,6 +55,9 @@ func newMessage(ctx context.Context, data []byte) *message.Message {
 	msg := message.NewMessage(uuid.NewString(), data)
 	msg.SetContext(ctx)
 	msg.Metadata[otelContextKey] = string(otelContext)
+	if key := PartitionKeyFromContext(ctx); key != "" {
+		msg.Metadata[PartitionKeyMetadataKey] = key
+	}
 
 	return msg
 }
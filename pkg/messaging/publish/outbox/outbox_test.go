@@ -0,0 +1,236 @@
+package outbox_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish/outbox"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	bunconnect "github.com/formancehq/go-libs/v5/pkg/storage/bun/connect"
+	"github.com/formancehq/go-libs/v5/pkg/storage/migrations"
+)
+
+type recordingPublisher struct {
+	mu       sync.Mutex
+	err      error
+	messages []*message.Message
+}
+
+func (p *recordingPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	return nil
+}
+
+func (p *recordingPublisher) uuids() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := make([]string, 0, len(p.messages))
+	for _, msg := range p.messages {
+		ret = append(ret, msg.UUID)
+	}
+	return ret
+}
+
+func (p *recordingPublisher) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func setup(t *testing.T) (*bun.DB, string) {
+	ctx := logging.TestingContext()
+
+	db, err := bunconnect.OpenSQLDB(ctx, srv.NewDatabase(t).ConnectionOptions())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	schema := uuid.NewString()[:8]
+	require.NoError(t, outbox.Migrate(ctx, schema, db))
+
+	return db, schema
+}
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	db, schema := setup(t)
+	publisher := outbox.NewPublisher(schema, db)
+
+	// A rolled back transaction does not publish anything
+	require.Error(t, db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		require.NoError(t, publisher.WithTx(tx).Publish("topic", message.NewMessage("rolled-back", []byte("{}"))))
+		return errors.New("rollback")
+	}))
+
+	// Without transaction, messages are rejected
+	require.ErrorIs(t, publisher.Publish("topic", message.NewMessage("no-tx", []byte("{}"))), outbox.ErrMissingTx)
+
+	expected := make([]string, 0)
+	require.NoError(t, db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		for i := range 5 {
+			msg := message.NewMessage(fmt.Sprintf("msg-%d", i), []byte("{}"))
+			msg.Metadata.Set("foo", "bar")
+			msg.SetContext(outbox.ContextWithTx(ctx, tx))
+			expected = append(expected, msg.UUID)
+
+			require.NoError(t, publisher.Publish("topic", msg))
+		}
+		return nil
+	}))
+
+	recorder := &recordingPublisher{}
+	relay := outbox.NewRelay(logging.Testing(), schema, db, recorder,
+		outbox.WithPollInterval(10*time.Millisecond),
+		outbox.WithBatchSize(2),
+	)
+	go relay.Run(ctx)
+	t.Cleanup(func() {
+		require.NoError(t, relay.Close())
+	})
+
+	require.Eventually(t, func() bool {
+		return len(recorder.uuids()) == len(expected)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, expected, recorder.uuids())
+	require.Equal(t, "bar", recorder.messages[0].Metadata.Get("foo"))
+
+	// Sent messages are marked as sent
+	pending, err := db.NewSelect().
+		TableExpr(`?.circuit_breaker`, bun.Ident(schema)).
+		Where("sent_at is null").
+		Count(ctx)
+	require.NoError(t, err)
+	require.Zero(t, pending)
+}
+
+func TestOutboxRelayRetriesFailedMessages(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	db, schema := setup(t)
+
+	require.NoError(t, outbox.NewPublisher(schema, db, outbox.WithDBFallback()).Publish("topic", message.NewMessage("msg", []byte("{}"))))
+
+	recorder := &recordingPublisher{}
+	recorder.setError(errors.New("broker down"))
+
+	relay := outbox.NewRelay(logging.Testing(), schema, db, recorder, outbox.WithPollInterval(10*time.Millisecond))
+	go relay.Run(ctx)
+	t.Cleanup(func() {
+		require.NoError(t, relay.Close())
+	})
+
+	<-time.After(50 * time.Millisecond)
+	require.Empty(t, recorder.uuids())
+
+	recorder.setError(nil)
+	require.Eventually(t, func() bool {
+		return len(recorder.uuids()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOutboxConcurrentRelays(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	db, schema := setup(t)
+	publisher := outbox.NewPublisher(schema, db, outbox.WithDBFallback())
+
+	const count = 200
+	for i := range count {
+		require.NoError(t, publisher.Publish("topic", message.NewMessage(fmt.Sprintf("msg-%d", i), []byte("{}"))))
+	}
+
+	recorder := &recordingPublisher{}
+	for range 3 {
+		relay := outbox.NewRelay(logging.Testing(), schema, db, recorder,
+			outbox.WithPollInterval(10*time.Millisecond),
+			outbox.WithBatchSize(10),
+		)
+		go relay.Run(ctx)
+		t.Cleanup(func() {
+			require.NoError(t, relay.Close())
+		})
+	}
+
+	require.Eventually(t, func() bool {
+		return len(recorder.uuids()) >= count
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Each message is sent exactly once
+	<-time.After(100 * time.Millisecond)
+	require.Len(t, recorder.uuids(), count)
+	require.ElementsMatch(t, func() []string {
+		ret := make([]string, 0, count)
+		for i := range count {
+			ret = append(ret, fmt.Sprintf("msg-%d", i))
+		}
+		return ret
+	}(), recorder.uuids())
+}
+
+func TestMigrateMovesVersionsTable(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+
+	db, err := bunconnect.OpenSQLDB(ctx, srv.NewDatabase(t).ConnectionOptions())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	// Older versions stored the versions table in the search path
+	schema := uuid.NewString()[:8]
+	legacy := migrations.NewMigrator(db, migrations.WithTableName("circuit_breaker_migrations"))
+	legacy.RegisterMigrations(migrations.Migration{
+		Up: func(ctx context.Context, db bun.IDB) error {
+			_, err := db.ExecContext(ctx, `
+				create schema ?;
+				create table ?.circuit_breaker (
+					id bigserial primary key,
+					created_at timestamp with time zone not null,
+					topic text not null,
+					data bytea not null,
+					metadata jsonb
+				);
+			`, bun.Ident(schema), bun.Ident(schema))
+			return err
+		},
+	})
+	require.NoError(t, legacy.Up(ctx))
+
+	require.NoError(t, outbox.Migrate(ctx, schema, db))
+
+	var moved, left bool
+	require.NoError(t, db.NewRaw(
+		`select to_regclass(?) is not null, to_regclass('circuit_breaker_migrations') is not null`,
+		fmt.Sprintf(`"%s".circuit_breaker_migrations`, schema),
+	).Scan(ctx, &moved, &left))
+	require.True(t, moved)
+	require.False(t, left)
+}
@@ -0,0 +1,138 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/uptrace/bun"
+
+	circuitstorage "github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
+)
+
+// ErrMissingTx is returned by Publisher.Publish for a message without transaction in its context,
+// unless the publisher falls back to its database (see WithDBFallback).
+var ErrMissingTx = errors.New("no transaction to write the message to the outbox")
+
+type txKey struct{}
+
+// ContextWithTx attaches a transaction to a context.
+// Messages published through Publisher.Publish with this context (see message.Message.SetContext)
+// are written with the transaction.
+func ContextWithTx(ctx context.Context, tx bun.IDB) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+func TxFromContext(ctx context.Context) (bun.IDB, bool) {
+	tx, ok := ctx.Value(txKey{}).(bun.IDB)
+	return tx, ok
+}
+
+// Publisher writes messages to the outbox table instead of sending them.
+// Written inside the transaction of the caller, messages are only visible to the Relay,
+// and thus sent, if the transaction commits.
+type Publisher struct {
+	db         bun.IDB
+	schema     string
+	dbFallback bool
+}
+
+var _ message.Publisher = (*Publisher)(nil)
+
+type PublisherOption func(*Publisher)
+
+// WithDBFallback writes the messages published without transaction in their context outside any transaction,
+// using the database of the publisher. They are then sent even if the transaction of the caller, if any, rolls back.
+func WithDBFallback() PublisherOption {
+	return func(p *Publisher) {
+		p.dbFallback = true
+	}
+}
+
+func NewPublisher(schema string, db bun.IDB, opts ...PublisherOption) *Publisher {
+	ret := &Publisher{
+		db:     db,
+		schema: schema,
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
+
+// PublishTx writes the messages using tx.
+func (p *Publisher) PublishTx(ctx context.Context, tx bun.IDB, topic string, messages ...*message.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	models := make([]*circuitstorage.CircuitBreakerModel, 0, len(messages))
+	for _, msg := range messages {
+		data := msg.Payload
+		if data == nil {
+			data = []byte{}
+		}
+		models = append(models, &circuitstorage.CircuitBreakerModel{
+			UUID:      msg.UUID,
+			CreatedAt: time.Now().UTC(),
+			Topic:     topic,
+			Data:      data,
+			Metadata:  msg.Metadata,
+		})
+	}
+
+	_, err := tx.NewInsert().
+		Model(&models).
+		ModelTableExpr(circuitstorage.TableExpr(p.schema)).
+		Exec(ctx)
+
+	return err
+}
+
+// Publish implements message.Publisher.
+// Each message is written with the transaction attached to its context (see ContextWithTx).
+// A message without transaction is rejected with ErrMissingTx, unless the publisher is configured WithDBFallback.
+func (p *Publisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		tx, ok := TxFromContext(msg.Context())
+		if !ok {
+			if !p.dbFallback {
+				return ErrMissingTx
+			}
+			tx = p.db
+		}
+		if err := p.PublishTx(msg.Context(), tx, topic, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithTx returns a message.Publisher writing messages with tx.
+func (p *Publisher) WithTx(tx bun.IDB) message.Publisher {
+	return &txPublisher{
+		publisher: p,
+		tx:        tx,
+	}
+}
+
+func (p *Publisher) Close() error {
+	return nil
+}
+
+type txPublisher struct {
+	publisher *Publisher
+	tx        bun.IDB
+}
+
+func (p *txPublisher) Publish(topic string, messages ...*message.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	return p.publisher.PublishTx(messages[0].Context(), p.tx, topic, messages...)
+}
+
+func (p *txPublisher) Close() error {
+	return nil
+}
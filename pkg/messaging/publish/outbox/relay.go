@@ -0,0 +1,236 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/uptrace/bun"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	circuitstorage "github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+// Relay sends the messages written by a Publisher, in insertion order, and marks them as sent.
+//
+// Several relays can run on the same table: each batch is sent while holding a transaction level
+// advisory lock on the schema, so a single relay sends at a time and the order is kept across batches.
+// Messages are delivered at least once: a relay stopped between the sending of a message and
+// the commit of the batch sends it again.
+type Relay struct {
+	logger    logging.Logger
+	db        *bun.DB
+	schema    string
+	publisher message.Publisher
+
+	pollInterval time.Duration
+	batchSize    int
+	retention    time.Duration
+
+	started     atomic.Bool
+	stopOnce    sync.Once
+	stopChannel chan struct{}
+	stopped     chan struct{}
+}
+
+type RelayOption func(*Relay)
+
+// WithPollInterval configures the interval between two checks for new messages.
+func WithPollInterval(interval time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.pollInterval = interval
+	}
+}
+
+// WithBatchSize configures the number of messages locked and sent at once.
+func WithBatchSize(size int) RelayOption {
+	return func(r *Relay) {
+		r.batchSize = size
+	}
+}
+
+// WithRetention configures how long sent messages are kept, zero keeps them forever.
+func WithRetention(retention time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.retention = retention
+	}
+}
+
+var defaultRelayOptions = []RelayOption{
+	WithPollInterval(time.Second),
+	WithBatchSize(100),
+	WithRetention(24 * time.Hour),
+}
+
+func NewRelay(logger logging.Logger, schema string, db *bun.DB, publisher message.Publisher, opts ...RelayOption) *Relay {
+	ret := &Relay{
+		logger:      logger,
+		db:          db,
+		schema:      schema,
+		publisher:   publisher,
+		stopChannel: make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	for _, opt := range append(defaultRelayOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+// Run sends pending messages until the context is canceled or the relay is closed.
+func (r *Relay) Run(ctx context.Context) {
+	if !r.started.CompareAndSwap(false, true) {
+		return
+	}
+	defer close(r.stopped)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stopChannel:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.relay(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Errorf("failed to relay outbox messages: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) relay(ctx context.Context) error {
+	for {
+		sent, err := r.relayBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if sent < r.batchSize {
+			break
+		}
+	}
+
+	if r.retention > 0 {
+		_, err := r.db.NewDelete().
+			Model((*circuitstorage.CircuitBreakerModel)(nil)).
+			ModelTableExpr(circuitstorage.TableExpr(r.schema)).
+			Where("sent_at < ?", time.Now().Add(-r.retention)).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relayBatch sends a batch of pending messages, and returns the number of sent messages.
+// Nothing is sent if another relay holds the lock of the schema.
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	var (
+		sent         int
+		publishError error
+	)
+	err := r.db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+		locked := false
+		if err := tx.NewRaw("select pg_try_advisory_xact_lock(hashtext(?))", "outbox:"+r.schema).Scan(ctx, &locked); err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		messages := make([]*circuitstorage.CircuitBreakerModel, 0)
+		err := tx.NewSelect().
+			Model(&messages).
+			ModelTableExpr(circuitstorage.TableExpr(r.schema)).
+			Where("sent_at is null").
+			Order("id").
+			Limit(r.batchSize).
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]uint64, 0, len(messages))
+		for _, msg := range messages {
+			if publishError = r.publisher.Publish(msg.Topic, newMessage(ctx, msg)); publishError != nil {
+				break
+			}
+			ids = append(ids, msg.ID)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		// Mark the sent messages even if a later one failed, so they are not sent again
+		_, err = tx.NewUpdate().
+			Model((*circuitstorage.CircuitBreakerModel)(nil)).
+			ModelTableExpr(circuitstorage.TableExpr(r.schema)).
+			Set("sent_at = ?", time.Now().UTC()).
+			Where("id in (?)", bun.In(ids)).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		sent = len(ids)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return sent, publishError
+}
+
+// Close stops the relay, and waits for the batch being sent, if any.
+func (r *Relay) Close() error {
+	r.stopOnce.Do(func() {
+		close(r.stopChannel)
+	})
+	if r.started.Load() {
+		<-r.stopped
+	}
+	return nil
+}
+
+const (
+	// NOTE: this const is also copied inside the publish package, keep them in sync.
+	otelContextKey = "otel-context"
+)
+
+func newMessage(ctx context.Context, msg *circuitstorage.CircuitBreakerModel) *message.Message {
+	ret := message.NewMessage(msg.UUID, msg.Data)
+
+	if otelContext, ok := msg.Metadata[otelContextKey]; ok {
+		carrier := propagation.MapCarrier{}
+		if err := json.Unmarshal([]byte(otelContext), &carrier); err == nil {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+		}
+	}
+
+	ret.SetContext(ctx)
+	for k, v := range msg.Metadata {
+		ret.Metadata.Set(k, v)
+	}
+
+	return ret
+}
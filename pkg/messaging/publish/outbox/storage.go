@@ -0,0 +1,16 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+
+	circuitstorage "github.com/formancehq/go-libs/v5/pkg/messaging/publish/circuit/storage"
+)
+
+// Migrate creates the table of the outbox in the given schema.
+// The outbox stores its messages like the circuit breaker (see circuitstorage.Migrate),
+// so the schema must not be shared with a circuit breaker.
+func Migrate(ctx context.Context, schema string, db *bun.DB) error {
+	return circuitstorage.Migrate(ctx, schema, db)
+}
@@ -0,0 +1,129 @@
+package publish
+
+import (
+	"context"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-aws/sns"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	wNats "github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	snsservice "github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/nats-io/nats.go"
+)
+
+// PartitionKeyMetadataKey is the metadata holding the partition key of a message.
+// Messages sharing a partition key are delivered in order by the backends supporting it:
+// on the same partition with Kafka, in the same message group with SNS FIFO topics,
+// and on the same subject with NATS when the subjects are partitioned.
+const PartitionKeyMetadataKey = "partition-key"
+
+type partitionKeyContextKey struct{}
+
+// ContextWithPartitionKey makes NewMessage set the partition key of the messages created with the context.
+func ContextWithPartitionKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, partitionKeyContextKey{}, key)
+}
+
+func PartitionKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(partitionKeyContextKey{}).(string)
+	return key
+}
+
+// WithPartitionKey sets the partition key of the message, and returns it.
+func WithPartitionKey(msg *message.Message, key string) *message.Message {
+	msg.Metadata.Set(PartitionKeyMetadataKey, key)
+	return msg
+}
+
+func PartitionKey(msg *message.Message) string {
+	return msg.Metadata.Get(PartitionKeyMetadataKey)
+}
+
+// KafkaPartitionKeyMarshaler uses the partition key of the messages as key of the kafka messages,
+// so the hash partitioner sends them to the same partition.
+// Messages without partition key are marshaled by the underlying marshaler only.
+type KafkaPartitionKeyMarshaler struct {
+	kafka.Marshaler
+}
+
+var _ kafka.Marshaler = KafkaPartitionKeyMarshaler{}
+
+func NewKafkaPartitionKeyMarshaler(marshaler kafka.Marshaler) KafkaPartitionKeyMarshaler {
+	return KafkaPartitionKeyMarshaler{
+		Marshaler: marshaler,
+	}
+}
+
+func (m KafkaPartitionKeyMarshaler) Marshal(topic string, msg *message.Message) (*sarama.ProducerMessage, error) {
+	ret, err := m.Marshaler.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+	if key := PartitionKey(msg); key != "" {
+		ret.Key = sarama.StringEncoder(key)
+	}
+	return ret, nil
+}
+
+// NatsPartitionedSubjectMarshaler publishes the messages of a topic on the subject "<topic>.<partition key>",
+// or "<topic>._" for messages without partition key.
+// It must be used with NatsPartitionedSubjectCalculator, so the streams and the subscribers cover all the subjects of a topic.
+type NatsPartitionedSubjectMarshaler struct {
+	wNats.NATSMarshaler
+}
+
+var _ wNats.MarshalerUnmarshaler = (*NatsPartitionedSubjectMarshaler)(nil)
+
+func (m *NatsPartitionedSubjectMarshaler) Marshal(topic string, msg *message.Message) (*nats.Msg, error) {
+	ret, err := m.NATSMarshaler.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+	ret.Subject = NatsPartitionedSubject(topic, PartitionKey(msg))
+	return ret, nil
+}
+
+var natsSubjectReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_", "\r", "_", "\n", "_")
+
+// NatsPartitionedSubject returns the subject of the messages of a topic with the given partition key.
+// Characters which are not allowed in subject tokens are replaced by underscores.
+func NatsPartitionedSubject(topic, key string) string {
+	if key == "" {
+		return topic + "._"
+	}
+	return topic + "." + natsSubjectReplacer.Replace(key)
+}
+
+func NatsPartitionedSubjectCalculator(queueGroupPrefix, topic string) *wNats.SubjectDetail {
+	return &wNats.SubjectDetail{
+		Primary:    topic + ".>",
+		QueueGroup: queueGroupPrefix,
+	}
+}
+
+// SNSPartitionKeyMarshaler uses the partition key of the messages as message group id on FIFO topics.
+// The message UUID is used as deduplication id, unless the metadata already defines one.
+type SNSPartitionKeyMarshaler struct {
+	sns.DefaultMarshalerUnmarshaler
+}
+
+var _ sns.Marshaler = SNSPartitionKeyMarshaler{}
+
+func (m SNSPartitionKeyMarshaler) Marshal(topicArn sns.TopicArn, msg *message.Message) *snsservice.PublishInput {
+	ret := m.DefaultMarshalerUnmarshaler.Marshal(topicArn, msg)
+
+	// Standard topics reject message group ids
+	if !strings.HasSuffix(string(topicArn), ".fifo") {
+		return ret
+	}
+	if key := PartitionKey(msg); key != "" && ret.MessageGroupId == nil {
+		ret.MessageGroupId = aws.String(key)
+	}
+	if ret.MessageDeduplicationId == nil {
+		ret.MessageDeduplicationId = aws.String(msg.UUID)
+	}
+	return ret
+}
@@ -0,0 +1,78 @@
+package publish
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-aws/sns"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+func TestPartitionKeyFromContext(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.ContextWithLogger(context.Background(), logging.NopZap())
+	require.Empty(t, PartitionKey(NewMessage(ctx, EventMessage{})))
+
+	msg := NewMessage(ContextWithPartitionKey(ctx, "users:001"), EventMessage{})
+	require.Equal(t, "users:001", PartitionKey(msg))
+
+	require.Equal(t, "users:002", PartitionKey(WithPartitionKey(msg, "users:002")))
+}
+
+func TestKafkaPartitionKeyMarshaler(t *testing.T) {
+	t.Parallel()
+
+	marshaler := NewKafkaPartitionKeyMarshaler(kafka.DefaultMarshaler{})
+
+	kafkaMsg, err := marshaler.Marshal("topic", WithPartitionKey(message.NewMessage("1", nil), "users:001"))
+	require.NoError(t, err)
+	require.Equal(t, sarama.StringEncoder("users:001"), kafkaMsg.Key)
+
+	kafkaMsg, err = marshaler.Marshal("topic", message.NewMessage("2", nil))
+	require.NoError(t, err)
+	require.Nil(t, kafkaMsg.Key, "messages without partition key must be spread on the partitions")
+}
+
+func TestNatsPartitionedSubjectMarshaler(t *testing.T) {
+	t.Parallel()
+
+	marshaler := &NatsPartitionedSubjectMarshaler{}
+
+	natsMsg, err := marshaler.Marshal("ledger", WithPartitionKey(message.NewMessage("1", nil), "accounts.users:001"))
+	require.NoError(t, err)
+	require.Equal(t, "ledger.accounts_users:001", natsMsg.Subject)
+
+	natsMsg, err = marshaler.Marshal("ledger", message.NewMessage("2", nil))
+	require.NoError(t, err)
+	require.Equal(t, "ledger._", natsMsg.Subject)
+
+	msg, err := marshaler.Unmarshal(natsMsg)
+	require.NoError(t, err)
+	require.Equal(t, "2", msg.UUID)
+
+	require.Equal(t, "ledger.>", NatsPartitionedSubjectCalculator("group", "ledger").Primary)
+}
+
+func TestSNSPartitionKeyMarshaler(t *testing.T) {
+	t.Parallel()
+
+	msg := WithPartitionKey(message.NewMessage("1", nil), "users:001")
+
+	input := SNSPartitionKeyMarshaler{}.Marshal("arn:aws:sns:us-east-1:000000000000:ledger.fifo", msg)
+	require.Equal(t, "users:001", *input.MessageGroupId)
+	require.Equal(t, "1", *input.MessageDeduplicationId)
+
+	msg.Metadata.Set(sns.MessageGroupIdMetadataField, "explicit")
+	input = SNSPartitionKeyMarshaler{}.Marshal("arn:aws:sns:us-east-1:000000000000:ledger.fifo", msg)
+	require.Equal(t, "explicit", *input.MessageGroupId)
+
+	input = SNSPartitionKeyMarshaler{}.Marshal("arn:aws:sns:us-east-1:000000000000:ledger", WithPartitionKey(message.NewMessage("2", nil), "users:001"))
+	require.Nil(t, input.MessageGroupId)
+	require.Nil(t, input.MessageDeduplicationId)
+}
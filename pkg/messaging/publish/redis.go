@@ -0,0 +1,27 @@
+package publish
+
+import (
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/redis/go-redis/v9"
+)
+
+func NewRedisClient(url string) (redis.UniversalClient, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+	return redis.NewClient(options), nil
+}
+
+func NewRedisStreamPublisher(client redis.UniversalClient, logger watermill.LoggerAdapter, config redisstream.PublisherConfig) (*redisstream.Publisher, error) {
+	config.Client = client
+	return redisstream.NewPublisher(config, logger)
+}
+
+func NewRedisStreamSubscriber(client redis.UniversalClient, logger watermill.LoggerAdapter, config redisstream.SubscriberConfig) (*redisstream.Subscriber, error) {
+	config.Client = client
+	return redisstream.NewSubscriber(config, logger)
+}
@@ -0,0 +1,375 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	invopop "github.com/invopop/jsonschema"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/queue"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+// Upcaster migrates the payload of an event from a version to the next one.
+type Upcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+type eventKey struct {
+	eventType string
+	version   string
+}
+
+type eventRegistration struct {
+	eventKey
+	goType    reflect.Type
+	schema    *jsonschema.Schema
+	rawSchema []byte
+}
+
+type upcaster struct {
+	to string
+	fn Upcaster
+}
+
+// Registry associates event types and versions with Go types and JSON schemas.
+// Payloads are validated against the schema when published with NewTypedMessage and when decoded with Decode.
+type Registry struct {
+	mu            sync.RWMutex
+	registrations map[eventKey]*eventRegistration
+	goTypes       map[reflect.Type]*eventRegistration
+	upcasters     map[eventKey]upcaster
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		registrations: make(map[eventKey]*eventRegistration),
+		goTypes:       make(map[reflect.Type]*eventRegistration),
+		upcasters:     make(map[eventKey]upcaster),
+	}
+}
+
+// Register associates an event type and version with the Go type T.
+// schema is a JSON Schema document validating the payload. If nil, it is generated from T.
+// A Go type can only be registered once, as it designates the event when publishing.
+func Register[T any](r *Registry, eventType, version string, schema []byte) error {
+	goType := reflect.TypeFor[T]()
+	if schema == nil {
+		var err error
+		schema, err = json.Marshal(invopop.Reflect(new(T)))
+		if err != nil {
+			return fmt.Errorf("generating schema of event %s/%s: %w", eventType, version, err)
+		}
+	}
+
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return fmt.Errorf("reading schema of event %s/%s: %w", eventType, version, err)
+	}
+	location := fmt.Sprintf("urn:event:%s:%s", eventType, version)
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(location, doc); err != nil {
+		return fmt.Errorf("reading schema of event %s/%s: %w", eventType, version, err)
+	}
+	compiled, err := compiler.Compile(location)
+	if err != nil {
+		return fmt.Errorf("compiling schema of event %s/%s: %w", eventType, version, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := eventKey{eventType: eventType, version: version}
+	if _, ok := r.registrations[key]; ok {
+		return fmt.Errorf("event %s/%s already registered", eventType, version)
+	}
+	if existing, ok := r.goTypes[goType]; ok {
+		return fmt.Errorf("type %s already registered for event %s/%s", goType, existing.eventType, existing.version)
+	}
+
+	registration := &eventRegistration{
+		eventKey:  key,
+		goType:    goType,
+		schema:    compiled,
+		rawSchema: schema,
+	}
+	r.registrations[key] = registration
+	r.goTypes[goType] = registration
+
+	return nil
+}
+
+// RegisterUpcaster registers a migration of the payload of an event from a version to another.
+// Upcasters are chained when decoding, until reaching a version without upcaster.
+// The source version does not need to be registered, but its payload is validated if it is.
+func (r *Registry) RegisterUpcaster(eventType, from, to string, fn Upcaster) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := eventKey{eventType: eventType, version: from}
+	if _, ok := r.upcasters[key]; ok {
+		return fmt.Errorf("upcaster already registered for event %s/%s", eventType, from)
+	}
+	// Prevent cycles, which would make decoding loop forever
+	for version := to; ; {
+		if version == from {
+			return fmt.Errorf("upcaster from %s to %s creates a cycle for event %s", from, to, eventType)
+		}
+		next, ok := r.upcasters[eventKey{eventType: eventType, version: version}]
+		if !ok {
+			break
+		}
+		version = next.to
+	}
+
+	r.upcasters[key] = upcaster{
+		to: to,
+		fn: fn,
+	}
+	return nil
+}
+
+// Schema returns the JSON schema of the payload of an event.
+func (r *Registry) Schema(eventType, version string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	registration, ok := r.registrations[eventKey{eventType: eventType, version: version}]
+	if !ok {
+		return nil, ErrUnknownEvent{Type: eventType, Version: version}
+	}
+	return registration.rawSchema, nil
+}
+
+func (r *Registry) registrationOf(goType reflect.Type) (*eventRegistration, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	registration, ok := r.goTypes[goType]
+	if !ok {
+		return nil, fmt.Errorf("type %s is not registered", goType)
+	}
+	return registration, nil
+}
+
+// Decode unmarshals an event, upcasts its payload to the latest version and validates it.
+// The Payload of the returned event has the Go type registered for its type and version,
+// and Version is the version after upcast.
+func (r *Registry) Decode(data []byte) (*EventMessage, error) {
+	raw := struct {
+		EventMessage
+		Payload json.RawMessage `json:"payload"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal event message: %w", err)
+	}
+	ev := raw.EventMessage
+	payload := raw.Payload
+
+	// Upcasters are user code, so they run without holding the lock
+	for _, step := range r.decodeChain(ev.Type, ev.Version) {
+		if step.registration != nil {
+			if err := step.registration.validate(payload); err != nil {
+				return nil, err
+			}
+		}
+
+		if step.upcaster != nil {
+			var err error
+			payload, err = step.upcaster.fn(payload)
+			if err != nil {
+				return nil, fmt.Errorf("upcasting event %s from version %s to %s: %w", ev.Type, ev.Version, step.upcaster.to, err)
+			}
+			ev.Version = step.upcaster.to
+			continue
+		}
+
+		if step.registration == nil {
+			return nil, ErrUnknownEvent{Type: ev.Type, Version: ev.Version}
+		}
+
+		value := reflect.New(step.registration.goType)
+		if err := json.Unmarshal(payload, value.Interface()); err != nil {
+			return nil, ErrInvalidEvent{Type: ev.Type, Version: ev.Version, Err: err}
+		}
+		ev.Payload = value.Elem().Interface()
+	}
+
+	return &ev, nil
+}
+
+// decodeStep is a version of an event met when decoding it, with its registration and upcaster if any
+type decodeStep struct {
+	registration *eventRegistration
+	upcaster     *upcaster
+}
+
+// decodeChain returns the versions an event goes through when decoded, from the given version to the last upcast one.
+func (r *Registry) decodeChain(eventType, version string) []decodeStep {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	steps := make([]decodeStep, 0, 1)
+	// The registration checks prevent cycles, so the chain is at most as long as the upcasters
+	for range len(r.upcasters) + 1 {
+		key := eventKey{eventType: eventType, version: version}
+		step := decodeStep{
+			registration: r.registrations[key],
+		}
+		upcaster, ok := r.upcasters[key]
+		if !ok {
+			return append(steps, step)
+		}
+		step.upcaster = &upcaster
+		steps = append(steps, step)
+		version = upcaster.to
+	}
+
+	panic("unreachable")
+}
+
+func (r *eventRegistration) validate(payload json.RawMessage) error {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		return ErrInvalidEvent{Type: r.eventType, Version: r.version, Err: err}
+	}
+	if err := r.schema.Validate(doc); err != nil {
+		return ErrInvalidEvent{Type: r.eventType, Version: r.version, Err: err}
+	}
+	return nil
+}
+
+type TypedEventMessage[T any] struct {
+	IdempotencyKey string
+	Date           time.Time
+	App            string
+	Payload        T
+}
+
+// NewTypedMessage creates a message for the event registered with the Go type T.
+// The payload is validated against the schema of the event.
+func NewTypedMessage[T any](ctx context.Context, registry *Registry, m TypedEventMessage[T]) (*message.Message, error) {
+	registration, err := registry.registrationOf(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(m.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+	if err := registration.validate(payload); err != nil {
+		return nil, err
+	}
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	return NewMessageWithError(ctx, EventMessage{
+		IdempotencyKey: m.IdempotencyKey,
+		Date:           date,
+		App:            m.App,
+		Version:        registration.version,
+		Type:           registration.eventType,
+		Payload:        json.RawMessage(payload),
+	})
+}
+
+// Dispatcher decodes events with a Registry and calls the handler registered for their Go type.
+// Events without handler are ignored. Events which cannot be decoded, like unknown and invalid events
+// rejected with ErrUnknownEvent and ErrInvalidEvent, would fail again if retried,
+// so their errors are marked with queue.Permanent.
+type Dispatcher struct {
+	registry *Registry
+	handlers map[reflect.Type]func(ctx context.Context, ev EventMessage) error
+}
+
+func NewDispatcher(registry *Registry) *Dispatcher {
+	return &Dispatcher{
+		registry: registry,
+		handlers: make(map[reflect.Type]func(ctx context.Context, ev EventMessage) error),
+	}
+}
+
+// HandleEvent registers the handler of the event registered with the Go type T.
+// It must be called before dispatching messages.
+func HandleEvent[T any](d *Dispatcher, fn func(ctx context.Context, ev EventMessage, payload T) error) error {
+	goType := reflect.TypeFor[T]()
+	if _, err := d.registry.registrationOf(goType); err != nil {
+		return err
+	}
+	if _, ok := d.handlers[goType]; ok {
+		return fmt.Errorf("handler already registered for type %s", goType)
+	}
+
+	d.handlers[goType] = func(ctx context.Context, ev EventMessage) error {
+		return fn(ctx, ev, ev.Payload.(T))
+	}
+	return nil
+}
+
+// Handle decodes and dispatches an event.
+// Its signature matches queue.CallbackFn.
+func (d *Dispatcher) Handle(ctx context.Context, _ map[string]string, data []byte) error {
+	ev, err := d.registry.Decode(data)
+	if err != nil {
+		return queue.Permanent(err)
+	}
+
+	handler, ok := d.handlers[reflect.TypeOf(ev.Payload)]
+	if !ok {
+		logging.FromContext(ctx).
+			WithField("type", ev.Type).
+			WithField("version", ev.Version).
+			Debugf("no handler for event, skipping")
+		return nil
+	}
+
+	return handler(ctx, *ev)
+}
+
+// HandleMessage decodes and dispatches the event of a watermill message.
+// Its signature matches message.NoPublishHandlerFunc.
+func (d *Dispatcher) HandleMessage(msg *message.Message) error {
+	return d.Handle(msg.Context(), msg.Metadata, msg.Payload)
+}
+
+type ErrUnknownEvent struct {
+	Type    string
+	Version string
+}
+
+func (e ErrUnknownEvent) Error() string {
+	return fmt.Sprintf("unknown event %s/%s", e.Type, e.Version)
+}
+
+func (e ErrUnknownEvent) Is(err error) bool {
+	_, ok := err.(ErrUnknownEvent)
+	return ok
+}
+
+type ErrInvalidEvent struct {
+	Type    string
+	Version string
+	Err     error
+}
+
+func (e ErrInvalidEvent) Error() string {
+	return fmt.Sprintf("invalid event %s/%s: %s", e.Type, e.Version, e.Err)
+}
+
+func (e ErrInvalidEvent) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrInvalidEvent) Is(err error) bool {
+	_, ok := err.(ErrInvalidEvent)
+	return ok
+}
@@ -0,0 +1,223 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/queue"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+type accountCreatedV1 struct {
+	Address string `json:"address"`
+}
+
+type accountCreatedV2 struct {
+	Address  string            `json:"address"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+const accountCreatedV2Schema = `{
+	"type": "object",
+	"required": ["address", "metadata"],
+	"properties": {
+		"address": {"type": "string", "minLength": 1},
+		"metadata": {"type": "object", "additionalProperties": {"type": "string"}}
+	}
+}`
+
+func newTestRegistry(t *testing.T) *Registry {
+	registry := NewRegistry()
+	require.NoError(t, Register[accountCreatedV1](registry, "ACCOUNT_CREATED", "v1", nil))
+	require.NoError(t, Register[accountCreatedV2](registry, "ACCOUNT_CREATED", "v2", []byte(accountCreatedV2Schema)))
+	require.NoError(t, registry.RegisterUpcaster("ACCOUNT_CREATED", "v1", "v2", func(payload json.RawMessage) (json.RawMessage, error) {
+		v1 := accountCreatedV1{}
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(accountCreatedV2{
+			Address:  v1.Address,
+			Metadata: map[string]string{},
+		})
+	}))
+	return registry
+}
+
+func TestRegistryRegister(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+	require.Error(t, Register[struct{}](registry, "ACCOUNT_CREATED", "v1", nil), "duplicated version")
+	require.Error(t, Register[accountCreatedV1](registry, "ACCOUNT_CREATED", "v3", nil), "duplicated go type")
+	require.Error(t, Register[struct{}](registry, "OTHER", "v1", []byte(`{"type": 1}`)), "invalid schema")
+	require.Error(t, Register[struct{}](registry, "OTHER", "v1", []byte(`{`)), "invalid json")
+
+	require.Error(t, registry.RegisterUpcaster("ACCOUNT_CREATED", "v1", "v3", nil), "duplicated upcaster")
+	require.Error(t, registry.RegisterUpcaster("ACCOUNT_CREATED", "v2", "v1", nil), "cycle")
+}
+
+func TestTypedMessage(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.ContextWithLogger(context.Background(), logging.NopZap())
+	registry := newTestRegistry(t)
+
+	msg, err := NewTypedMessage(ctx, registry, TypedEventMessage[accountCreatedV2]{
+		IdempotencyKey: "key",
+		App:            "ledger",
+		Payload: accountCreatedV2{
+			Address:  "world",
+			Metadata: map[string]string{"foo": "bar"},
+		},
+	})
+	require.NoError(t, err)
+
+	ev, err := registry.Decode(msg.Payload)
+	require.NoError(t, err)
+	require.Equal(t, "ACCOUNT_CREATED", ev.Type)
+	require.Equal(t, "v2", ev.Version)
+	require.Equal(t, "key", ev.IdempotencyKey)
+	require.Equal(t, "ledger", ev.App)
+	require.False(t, ev.Date.IsZero())
+	require.Equal(t, accountCreatedV2{
+		Address:  "world",
+		Metadata: map[string]string{"foo": "bar"},
+	}, ev.Payload)
+
+	_, err = NewTypedMessage(ctx, registry, TypedEventMessage[accountCreatedV2]{
+		Payload: accountCreatedV2{},
+	})
+	require.ErrorIs(t, err, ErrInvalidEvent{})
+
+	_, err = NewTypedMessage(ctx, registry, TypedEventMessage[struct{}]{})
+	require.Error(t, err)
+}
+
+func TestRegistryDecode(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+
+	type testCase struct {
+		name            string
+		event           string
+		expectedVersion string
+		expectedPayload any
+		expectedError   error
+	}
+	for _, tc := range []testCase{
+		{
+			name:            "current version",
+			event:           `{"type": "ACCOUNT_CREATED", "version": "v2", "payload": {"address": "world", "metadata": {}}}`,
+			expectedVersion: "v2",
+			expectedPayload: accountCreatedV2{Address: "world", Metadata: map[string]string{}},
+		},
+		{
+			name:            "upcast",
+			event:           `{"type": "ACCOUNT_CREATED", "version": "v1", "payload": {"address": "world"}}`,
+			expectedVersion: "v2",
+			expectedPayload: accountCreatedV2{Address: "world", Metadata: map[string]string{}},
+		},
+		{
+			name:          "unknown type",
+			event:         `{"type": "ACCOUNT_DELETED", "version": "v1", "payload": {}}`,
+			expectedError: ErrUnknownEvent{},
+		},
+		{
+			name:          "unknown version",
+			event:         `{"type": "ACCOUNT_CREATED", "version": "v3", "payload": {}}`,
+			expectedError: ErrUnknownEvent{},
+		},
+		{
+			name:          "invalid payload",
+			event:         `{"type": "ACCOUNT_CREATED", "version": "v2", "payload": {"address": 1, "metadata": {}}}`,
+			expectedError: ErrInvalidEvent{},
+		},
+		{
+			name:          "invalid payload before upcast",
+			event:         `{"type": "ACCOUNT_CREATED", "version": "v1", "payload": {}}`,
+			expectedError: ErrInvalidEvent{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ev, err := registry.Decode([]byte(tc.event))
+			if tc.expectedError != nil {
+				require.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedVersion, ev.Version)
+			require.Equal(t, tc.expectedPayload, ev.Payload)
+		})
+	}
+}
+
+func TestRegistryDecodeUpcasterUsingRegistry(t *testing.T) {
+	t.Parallel()
+
+	// Upcasters do not run under the lock of the registry, so they can use it
+	registry := NewRegistry()
+	require.NoError(t, Register[accountCreatedV2](registry, "ACCOUNT_CREATED", "v2", []byte(accountCreatedV2Schema)))
+	require.NoError(t, registry.RegisterUpcaster("ACCOUNT_CREATED", "v1", "v2", func(payload json.RawMessage) (json.RawMessage, error) {
+		if err := registry.RegisterUpcaster("OTHER", "v1", "v2", func(payload json.RawMessage) (json.RawMessage, error) {
+			return payload, nil
+		}); err != nil {
+			return nil, err
+		}
+		return json.RawMessage(`{"address": "world", "metadata": {}}`), nil
+	}))
+
+	ev, err := registry.Decode([]byte(`{"type": "ACCOUNT_CREATED", "version": "v1", "payload": {}}`))
+	require.NoError(t, err)
+	require.Equal(t, accountCreatedV2{Address: "world", Metadata: map[string]string{}}, ev.Payload)
+}
+
+func TestDispatcher(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.ContextWithLogger(context.Background(), logging.NopZap())
+	registry := newTestRegistry(t)
+	require.NoError(t, Register[struct{}](registry, "IGNORED", "v1", nil))
+
+	var received []accountCreatedV2
+	dispatcher := NewDispatcher(registry)
+	require.NoError(t, HandleEvent(dispatcher, func(ctx context.Context, ev EventMessage, payload accountCreatedV2) error {
+		received = append(received, payload)
+		return nil
+	}))
+	require.Error(t, HandleEvent(dispatcher, func(ctx context.Context, ev EventMessage, payload accountCreatedV2) error {
+		return nil
+	}), "duplicated handler")
+	require.Error(t, HandleEvent(dispatcher, func(ctx context.Context, ev EventMessage, payload string) error {
+		return nil
+	}), "unregistered type")
+
+	for _, event := range []EventMessage{
+		{Type: "ACCOUNT_CREATED", Version: "v1", Date: time.Now(), Payload: accountCreatedV1{Address: "a"}},
+		{Type: "ACCOUNT_CREATED", Version: "v2", Date: time.Now(), Payload: accountCreatedV2{Address: "b", Metadata: map[string]string{}}},
+		{Type: "IGNORED", Version: "v1", Date: time.Now(), Payload: struct{}{}},
+	} {
+		data, err := json.Marshal(event)
+		require.NoError(t, err)
+		require.NoError(t, dispatcher.Handle(ctx, nil, data))
+	}
+
+	// Events which cannot be decoded are not retried
+	err := dispatcher.Handle(ctx, nil, []byte(`{"type": "UNKNOWN", "version": "v1"}`))
+	require.ErrorIs(t, err, ErrUnknownEvent{})
+	require.True(t, queue.IsPermanent(err))
+
+	err = dispatcher.Handle(ctx, nil, []byte(`{"type": "ACCOUNT_CREATED", "version": "v2", "payload": {"address": 1, "metadata": {}}}`))
+	require.ErrorIs(t, err, ErrInvalidEvent{})
+	require.True(t, queue.IsPermanent(err))
+	require.Equal(t, []accountCreatedV2{
+		{Address: "a", Metadata: map[string]string{}},
+		{Address: "b", Metadata: map[string]string{}},
+	}, received)
+}
@@ -0,0 +1,286 @@
+// Package routing sends the messages of a topic to one or more publishers, selected by topic patterns.
+package routing
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+type ErrNoRoute struct {
+	Topic string
+}
+
+func (e ErrNoRoute) Error() string {
+	return fmt.Sprintf("no route for topic '%s'", e.Topic)
+}
+
+func (e ErrNoRoute) Is(err error) bool {
+	_, ok := err.(ErrNoRoute)
+	return ok
+}
+
+// ErrBackend is returned for each backend failing to publish, joined with the errors of the other backends.
+type ErrBackend struct {
+	Backend string
+	Err     error
+}
+
+func (e ErrBackend) Error() string {
+	return fmt.Sprintf("publishing to backend '%s': %s", e.Backend, e.Err)
+}
+
+func (e ErrBackend) Is(err error) bool {
+	_, ok := err.(ErrBackend)
+	return ok
+}
+
+func (e ErrBackend) Unwrap() error {
+	return e.Err
+}
+
+// Route sends the topics matching Pattern to the named backends.
+// In patterns, "*" matches any sequence of characters, so "*" alone matches any topic.
+type Route struct {
+	Pattern  string
+	Backends []string
+}
+
+// ParseRoute parses a route formatted as "pattern:backend1,backend2".
+// The pattern can contain colons, as in SNS topic ARNs.
+func ParseRoute(s string) (Route, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return Route{}, fmt.Errorf("unable to parse route '%s', must be a pattern and a list of backends, separated by a colon", s)
+	}
+	pattern, backends := s[:i], s[i+1:]
+
+	ret := Route{
+		Pattern: pattern,
+	}
+	for _, backend := range strings.Split(backends, ",") {
+		backend = strings.TrimSpace(backend)
+		if backend == "" {
+			return Route{}, fmt.Errorf("unable to parse route '%s', empty backend name", s)
+		}
+		ret.Backends = append(ret.Backends, backend)
+	}
+	return ret, nil
+}
+
+func (r Route) match(topic string) bool {
+	parts := strings.Split(r.Pattern, "*")
+	if len(parts) == 1 {
+		return topic == r.Pattern
+	}
+
+	if !strings.HasPrefix(topic, parts[0]) {
+		return false
+	}
+	topic = topic[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(topic, part)
+		if i < 0 {
+			return false
+		}
+		topic = topic[i+len(part):]
+	}
+	return strings.HasSuffix(topic, parts[len(parts)-1])
+}
+
+type Backend struct {
+	Name      string
+	Publisher message.Publisher
+}
+
+// DefaultTrackedMessages is the default number of partially delivered messages remembered by a Publisher
+const DefaultTrackedMessages = 10_000
+
+// Publisher sends the messages of a topic to the backends of the first matching route.
+//
+// Backends are published to one after the other, each one receiving its own copy of the messages,
+// and a failing backend does not prevent publishing to the next ones.
+// The Publisher remembers the backends which accepted a message failing on other backends,
+// so publishing it again, like the circuit breaker and the outbox do, only sends it to the backends which failed.
+// The delivery is tracked in memory by message UUID: a message published again after a restart,
+// or after being evicted by more recent failures, is sent to all its backends.
+// The circuit breaker keeps the UUIDs with stores implementing circuitstorage.UUIDInserter, like circuitstorage.Storage.
+// Batches (see batch.PublisherDecorator) are tracked by their own UUID: messages published again in another batch,
+// which is the case of the messages replayed one by one by the circuit breaker and the outbox, are sent to all the backends.
+type Publisher struct {
+	backends map[string]message.Publisher
+	routes   []Route
+
+	mu         sync.Mutex
+	maxTracked int
+	delivered  map[string]*list.Element
+	order      *list.List
+}
+
+var _ message.Publisher = (*Publisher)(nil)
+
+// delivery holds the backends which accepted a message
+type delivery struct {
+	uuid     string
+	backends map[string]struct{}
+}
+
+type PublisherOption func(*Publisher)
+
+// WithTrackedMessages configures the number of partially delivered messages remembered, see Publisher.
+// 0 disables the tracking.
+func WithTrackedMessages(n int) PublisherOption {
+	return func(p *Publisher) {
+		p.maxTracked = n
+	}
+}
+
+var defaultPublisherOptions = []PublisherOption{
+	WithTrackedMessages(DefaultTrackedMessages),
+}
+
+func NewPublisher(backends []Backend, routes []Route, opts ...PublisherOption) (*Publisher, error) {
+	ret := &Publisher{
+		backends:  make(map[string]message.Publisher, len(backends)),
+		routes:    routes,
+		delivered: make(map[string]*list.Element),
+		order:     list.New(),
+	}
+	for _, opt := range append(defaultPublisherOptions, opts...) {
+		opt(ret)
+	}
+	if ret.maxTracked < 0 {
+		return nil, fmt.Errorf("invalid number of tracked messages: %d", ret.maxTracked)
+	}
+	for _, backend := range backends {
+		if _, ok := ret.backends[backend.Name]; ok {
+			return nil, fmt.Errorf("backend '%s' registered twice", backend.Name)
+		}
+		ret.backends[backend.Name] = backend.Publisher
+	}
+	for _, route := range routes {
+		if route.Pattern == "" {
+			return nil, errors.New("route with an empty pattern")
+		}
+		if len(route.Backends) == 0 {
+			return nil, fmt.Errorf("route '%s' has no backend", route.Pattern)
+		}
+		for _, backend := range route.Backends {
+			if _, ok := ret.backends[backend]; !ok {
+				return nil, fmt.Errorf("route '%s' uses unknown backend '%s'", route.Pattern, backend)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Backends returns the names of the backends the topic is routed to.
+func (p *Publisher) Backends(topic string) []string {
+	for _, route := range p.routes {
+		if route.match(topic) {
+			return route.Backends
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) Publish(topic string, messages ...*message.Message) error {
+	backends := p.Backends(topic)
+	if len(backends) == 0 {
+		return ErrNoRoute{Topic: topic}
+	}
+	if len(backends) == 1 {
+		if err := p.backends[backends[0]].Publish(topic, messages...); err != nil {
+			return ErrBackend{Backend: backends[0], Err: err}
+		}
+		return nil
+	}
+
+	errs := make([]error, 0)
+	for _, backend := range backends {
+		// Publishers can modify the messages (metadata, acks), so each one receives its own copy
+		copies := make([]*message.Message, 0, len(messages))
+		for _, msg := range messages {
+			if p.isDelivered(msg.UUID, backend) {
+				continue
+			}
+			cp := msg.Copy()
+			cp.SetContext(msg.Context())
+			copies = append(copies, cp)
+		}
+		if len(copies) == 0 {
+			continue
+		}
+
+		if err := p.backends[backend].Publish(topic, copies...); err != nil {
+			errs = append(errs, ErrBackend{Backend: backend, Err: err})
+			continue
+		}
+		for _, msg := range copies {
+			p.setDelivered(msg.UUID, backend)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// All the backends accepted the messages
+	for _, msg := range messages {
+		p.forget(msg.UUID)
+	}
+	return nil
+}
+
+func (p *Publisher) isDelivered(uuid, backend string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	element, ok := p.delivered[uuid]
+	if !ok {
+		return false
+	}
+	_, ok = element.Value.(*delivery).backends[backend]
+	return ok
+}
+
+func (p *Publisher) setDelivered(uuid, backend string) {
+	if p.maxTracked == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if element, ok := p.delivered[uuid]; ok {
+		element.Value.(*delivery).backends[backend] = struct{}{}
+		return
+	}
+	p.delivered[uuid] = p.order.PushBack(&delivery{
+		uuid:     uuid,
+		backends: map[string]struct{}{backend: {}},
+	})
+	if p.order.Len() > p.maxTracked {
+		oldest := p.order.Front()
+		p.order.Remove(oldest)
+		delete(p.delivered, oldest.Value.(*delivery).uuid)
+	}
+}
+
+func (p *Publisher) forget(uuid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if element, ok := p.delivered[uuid]; ok {
+		p.order.Remove(element)
+		delete(p.delivered, uuid)
+	}
+}
+
+// Close does nothing: the backends are owned, and closed, by the code which created them.
+func (p *Publisher) Close() error {
+	return nil
+}
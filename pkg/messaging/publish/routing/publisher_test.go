@@ -0,0 +1,198 @@
+package routing
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages map[string][]*message.Message
+	err      error
+	closed   bool
+}
+
+func (p *recordingPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if p.messages == nil {
+		p.messages = make(map[string][]*message.Message)
+	}
+	p.messages[topic] = append(p.messages[topic], messages...)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func (p *recordingPublisher) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func TestParseRoute(t *testing.T) {
+	t.Parallel()
+
+	route, err := ParseRoute("ledger.*:nats, kafka")
+	require.NoError(t, err)
+	require.Equal(t, Route{Pattern: "ledger.*", Backends: []string{"nats", "kafka"}}, route)
+
+	route, err = ParseRoute("arn:aws:sns:eu-west-1:123456789012:*:sns")
+	require.NoError(t, err)
+	require.Equal(t, Route{Pattern: "arn:aws:sns:eu-west-1:123456789012:*", Backends: []string{"sns"}}, route)
+
+	for _, invalid := range []string{"", "ledger", "ledger:", ":nats", "ledger:nats,"} {
+		_, err := ParseRoute(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	t.Parallel()
+
+	for pattern, topics := range map[string]map[string]bool{
+		"*":                 {"ledger": true, "": true, "http://localhost/hook": true},
+		"ledger":            {"ledger": true, "ledger.v2": false, "payments": false},
+		"ledger.*":          {"ledger.v2": true, "ledger.": true, "ledger": false},
+		"*.v2":              {"ledger.v2": true, "ledger.v2.x": false},
+		"ledger.*.accounts": {"ledger.v2.accounts": true, "ledger.accounts": false},
+		"a*b*c":             {"abc": true, "aXbYc": true, "aXcYb": false, "ab": false},
+	} {
+		for topic, expected := range topics {
+			require.Equal(t, expected, Route{Pattern: pattern}.match(topic), "%s / %s", pattern, topic)
+		}
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	t.Parallel()
+
+	nats := &recordingPublisher{}
+	kafka := &recordingPublisher{}
+	sns := &recordingPublisher{}
+
+	publisher, err := NewPublisher([]Backend{
+		{Name: "nats", Publisher: nats},
+		{Name: "kafka", Publisher: kafka},
+		{Name: "sns", Publisher: sns},
+	}, []Route{
+		{Pattern: "payments", Backends: []string{"sns"}},
+		{Pattern: "*", Backends: []string{"nats", "kafka"}},
+	})
+	require.NoError(t, err)
+
+	msg := message.NewMessage("1", []byte("payload"))
+	require.NoError(t, publisher.Publish("ledger", msg))
+	require.Len(t, nats.messages["ledger"], 1)
+	require.Len(t, kafka.messages["ledger"], 1)
+	require.Empty(t, sns.messages)
+	require.NotSame(t, nats.messages["ledger"][0], kafka.messages["ledger"][0])
+	require.Equal(t, msg.UUID, kafka.messages["ledger"][0].UUID)
+
+	require.NoError(t, publisher.Publish("payments", message.NewMessage("2", []byte("payload"))))
+	require.Len(t, sns.messages["payments"], 1)
+	require.Empty(t, nats.messages["payments"])
+
+	require.Equal(t, []string{"sns"}, publisher.Backends("payments"))
+}
+
+func TestPublisherErrors(t *testing.T) {
+	t.Parallel()
+
+	failure := errors.New("broker unavailable")
+	nats := &recordingPublisher{err: failure}
+	kafka := &recordingPublisher{}
+
+	publisher, err := NewPublisher([]Backend{
+		{Name: "nats", Publisher: nats},
+		{Name: "kafka", Publisher: kafka},
+	}, []Route{
+		{Pattern: "ledger", Backends: []string{"nats", "kafka"}},
+	})
+	require.NoError(t, err)
+
+	err = publisher.Publish("ledger", message.NewMessage("1", []byte("payload")))
+	require.ErrorIs(t, err, failure)
+	backendErr := ErrBackend{}
+	require.ErrorAs(t, err, &backendErr)
+	require.Equal(t, "nats", backendErr.Backend)
+	require.Len(t, kafka.messages["ledger"], 1, "a failing backend must not prevent publishing to the others")
+
+	require.ErrorIs(t, publisher.Publish("other", message.NewMessage("2", []byte("payload"))), ErrNoRoute{})
+
+	_, err = NewPublisher([]Backend{{Name: "nats", Publisher: nats}}, []Route{{Pattern: "*", Backends: []string{"kafka"}}})
+	require.Error(t, err, "unknown backend")
+	_, err = NewPublisher([]Backend{{Name: "nats", Publisher: nats}, {Name: "nats", Publisher: kafka}}, nil)
+	require.Error(t, err, "duplicated backend")
+}
+
+func TestPublisherRetry(t *testing.T) {
+	t.Parallel()
+
+	failure := errors.New("broker unavailable")
+	nats := &recordingPublisher{}
+	kafka := &recordingPublisher{err: failure}
+
+	publisher, err := NewPublisher([]Backend{
+		{Name: "nats", Publisher: nats},
+		{Name: "kafka", Publisher: kafka},
+	}, []Route{
+		{Pattern: "ledger", Backends: []string{"nats", "kafka"}},
+	})
+	require.NoError(t, err)
+
+	msg := message.NewMessage("1", []byte("payload"))
+	require.ErrorIs(t, publisher.Publish("ledger", msg), failure)
+	require.ErrorIs(t, publisher.Publish("ledger", msg), failure)
+	require.Len(t, nats.messages["ledger"], 1, "a message must not be sent again to the backends which accepted it")
+
+	kafka.setErr(nil)
+	require.NoError(t, publisher.Publish("ledger", msg))
+	require.Len(t, nats.messages["ledger"], 1)
+	require.Len(t, kafka.messages["ledger"], 1)
+
+	// Once delivered to all its backends, the message is forgotten
+	require.NoError(t, publisher.Publish("ledger", msg))
+	require.Len(t, nats.messages["ledger"], 2)
+	require.Len(t, kafka.messages["ledger"], 2)
+
+	require.NoError(t, publisher.Close())
+	require.False(t, nats.closed, "the backends are closed by their owners")
+}
+
+func TestPublisherTrackedMessages(t *testing.T) {
+	t.Parallel()
+
+	failure := errors.New("broker unavailable")
+	nats := &recordingPublisher{}
+	kafka := &recordingPublisher{err: failure}
+
+	publisher, err := NewPublisher([]Backend{
+		{Name: "nats", Publisher: nats},
+		{Name: "kafka", Publisher: kafka},
+	}, []Route{
+		{Pattern: "ledger", Backends: []string{"nats", "kafka"}},
+	}, WithTrackedMessages(1))
+	require.NoError(t, err)
+
+	first := message.NewMessage("1", []byte("payload"))
+	require.ErrorIs(t, publisher.Publish("ledger", first), failure)
+	require.ErrorIs(t, publisher.Publish("ledger", message.NewMessage("2", []byte("payload"))), failure)
+
+	// The first message was evicted by the second one
+	require.ErrorIs(t, publisher.Publish("ledger", first), failure)
+	require.Len(t, nats.messages["ledger"], 3)
+
+	_, err = NewPublisher(nil, nil, WithTrackedMessages(-1))
+	require.Error(t, err)
+}
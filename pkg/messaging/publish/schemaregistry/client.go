@@ -0,0 +1,243 @@
+// Package schemaregistry encodes kafka messages in the wire format of Confluent compatible schema registries:
+// a magic byte, the ID of the schema registered for the payload, then the payload.
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type SchemaType string
+
+const (
+	SchemaTypeAvro     SchemaType = "AVRO"
+	SchemaTypeProtobuf SchemaType = "PROTOBUF"
+	SchemaTypeJSON     SchemaType = "JSON"
+)
+
+type Schema struct {
+	Type   SchemaType
+	Schema string
+	// Name is the record name of the schema, used in the subject name if not empty
+	Name string
+}
+
+// ErrRegistry is returned when the schema registry rejects a request
+type ErrRegistry struct {
+	StatusCode int
+	Code       int
+	Message    string
+}
+
+func (e ErrRegistry) Error() string {
+	return fmt.Sprintf("schema registry error %d (status %d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+func (e ErrRegistry) Is(err error) bool {
+	_, ok := err.(ErrRegistry)
+	return ok
+}
+
+// Client registers and retrieves schemas.
+type Client interface {
+	// Register registers the schema under the subject if it is not already, and returns its ID
+	Register(ctx context.Context, subject string, schema Schema) (int, error)
+	SchemaByID(ctx context.Context, id int) (Schema, error)
+}
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+type HTTPClient struct {
+	url        string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+var _ Client = (*HTTPClient)(nil)
+
+type HTTPClientOption func(*HTTPClient)
+
+func WithBasicAuth(username, password string) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.username = username
+		c.password = password
+	}
+}
+
+func WithHTTPClient(httpClient *http.Client) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.httpClient = httpClient
+	}
+}
+
+var defaultHTTPClientOptions = []HTTPClientOption{
+	WithHTTPClient(http.DefaultClient),
+}
+
+func NewHTTPClient(url string, opts ...HTTPClientOption) *HTTPClient {
+	ret := &HTTPClient{
+		url: strings.TrimSuffix(url, "/"),
+	}
+	for _, opt := range append(defaultHTTPClientOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+type schemaPayload struct {
+	Schema     string     `json:"schema"`
+	SchemaType SchemaType `json:"schemaType,omitempty"`
+}
+
+func (c *HTTPClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	payload := schemaPayload{
+		Schema: schema.Schema,
+	}
+	// AVRO is the default type, omitted for compatibility with older registries
+	if schema.Type != SchemaTypeAvro {
+		payload.SchemaType = schema.Type
+	}
+
+	ret := struct {
+		ID int `json:"id"`
+	}{}
+	if err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", payload, &ret); err != nil {
+		return 0, fmt.Errorf("registering schema of subject '%s': %w", subject, err)
+	}
+	return ret.ID, nil
+}
+
+func (c *HTTPClient) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	ret := schemaPayload{}
+	if err := c.do(ctx, http.MethodGet, "/schemas/ids/"+strconv.Itoa(id), nil, &ret); err != nil {
+		return Schema{}, fmt.Errorf("fetching schema %d: %w", id, err)
+	}
+	if ret.SchemaType == "" {
+		ret.SchemaType = SchemaTypeAvro
+	}
+	return Schema{
+		Type:   ret.SchemaType,
+		Schema: ret.Schema,
+	}, nil
+}
+
+func (c *HTTPClient) do(ctx context.Context, method, path string, body, ret any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+
+	if rsp.StatusCode >= http.StatusBadRequest {
+		registryErr := ErrRegistry{}
+		_ = json.NewDecoder(rsp.Body).Decode(&struct {
+			Code    *int    `json:"error_code"`
+			Message *string `json:"message"`
+		}{
+			Code:    &registryErr.Code,
+			Message: &registryErr.Message,
+		})
+		registryErr.StatusCode = rsp.StatusCode
+		return registryErr
+	}
+
+	return json.NewDecoder(rsp.Body).Decode(ret)
+}
+
+type registration struct {
+	subject string
+	schema  Schema
+}
+
+// CachedClient caches the schemas and the IDs returned by a Client.
+// Schemas are immutable once registered, so entries never expire.
+type CachedClient struct {
+	client Client
+
+	mu      sync.RWMutex
+	ids     map[registration]int
+	schemas map[int]Schema
+}
+
+var _ Client = (*CachedClient)(nil)
+
+func NewCachedClient(client Client) *CachedClient {
+	return &CachedClient{
+		client:  client,
+		ids:     make(map[registration]int),
+		schemas: make(map[int]Schema),
+	}
+}
+
+func (c *CachedClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	key := registration{subject: subject, schema: schema}
+
+	c.mu.RLock()
+	id, ok := c.ids[key]
+	c.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := c.client.Register(ctx, subject, schema)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[key] = id
+	c.schemas[id] = Schema{Type: schema.Type, Schema: schema.Schema}
+	return id, nil
+}
+
+func (c *CachedClient) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	c.mu.RLock()
+	schema, ok := c.schemas[id]
+	c.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	schema, err := c.client.SchemaByID(ctx, id)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas[id] = schema
+	return schema, nil
+}
@@ -0,0 +1,218 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	invopop "github.com/invopop/jsonschema"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+)
+
+const (
+	magicByte  = 0
+	headerSize = 5
+
+	// SchemaIDMetadataKey is the metadata holding the schema ID of the unmarshaled messages
+	SchemaIDMetadataKey = "schema-id"
+)
+
+var ErrInvalidWireFormat = errors.New("invalid schema registry wire format")
+
+// SchemaResolver returns the schema of the payload of a message.
+type SchemaResolver func(topic string, msg *message.Message) (Schema, error)
+
+// StaticSchema resolves the same schema for all messages.
+func StaticSchema(schema Schema) SchemaResolver {
+	return func(string, *message.Message) (Schema, error) {
+		return schema, nil
+	}
+}
+
+// EventMessageSchema is the JSON schema of publish.EventMessage, used when payloads have no specific schema.
+func EventMessageSchema() Schema {
+	data, err := eventMessageSchema(nil)
+	if err != nil {
+		panic(err)
+	}
+	return Schema{
+		Type:   SchemaTypeJSON,
+		Schema: string(data),
+	}
+}
+
+// eventMessageSchema returns the schema of publish.EventMessage, with the given schema for the payload if any
+func eventMessageSchema(payload json.RawMessage) ([]byte, error) {
+	reflector := &invopop.Reflector{DoNotReference: true}
+	schema := reflector.Reflect(&publish.EventMessage{})
+	if len(payload) == 0 {
+		return json.Marshal(schema)
+	}
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]any{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	ret["properties"].(map[string]any)["payload"] = payload
+	return json.Marshal(ret)
+}
+
+// RegistryResolver resolves the JSON schema of the events, with the schema of their payload registered in the publish.Registry.
+// The schema is named after the event type, so each event type gets its own subject.
+func RegistryResolver(registry *publish.Registry) SchemaResolver {
+	return func(_ string, msg *message.Message) (Schema, error) {
+		ev := publish.EventMessage{}
+		if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+			return Schema{}, fmt.Errorf("reading event of message %s: %w", msg.UUID, err)
+		}
+		payloadSchema, err := registry.Schema(ev.Type, ev.Version)
+		if err != nil {
+			return Schema{}, err
+		}
+		schema, err := eventMessageSchema(payloadSchema)
+		if err != nil {
+			return Schema{}, err
+		}
+		return Schema{
+			Type:   SchemaTypeJSON,
+			Schema: string(schema),
+			Name:   ev.Type,
+		}, nil
+	}
+}
+
+// Subject returns the subject of a schema on a topic:
+// "<topic>-<name>" for named schemas, "<topic>-value" otherwise.
+func Subject(topic string, schema Schema) string {
+	if schema.Name != "" {
+		return topic + "-" + schema.Name
+	}
+	return topic + "-value"
+}
+
+// Marshaler registers the schemas of the payloads, and prefixes the payloads with the schema IDs.
+// Payloads must already be encoded in the format of their schema.
+type Marshaler struct {
+	marshaler kafka.Marshaler
+	client    Client
+	resolver  SchemaResolver
+}
+
+var _ kafka.Marshaler = (*Marshaler)(nil)
+
+// NewMarshaler wraps a kafka.Marshaler, which builds the kafka message before its payload is prefixed.
+// The client should be a CachedClient, as the schema of each message is registered.
+func NewMarshaler(marshaler kafka.Marshaler, client Client, resolver SchemaResolver) *Marshaler {
+	return &Marshaler{
+		marshaler: marshaler,
+		client:    client,
+		resolver:  resolver,
+	}
+}
+
+func (m *Marshaler) Marshal(topic string, msg *message.Message) (*sarama.ProducerMessage, error) {
+	schema, err := m.resolver(topic, msg)
+	if err != nil {
+		return nil, fmt.Errorf("resolving schema of message %s: %w", msg.UUID, err)
+	}
+	id, err := m.client.Register(msg.Context(), Subject(topic, schema), schema)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := m.marshaler.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+	ret.Value = sarama.ByteEncoder(encode(id, schema.Type, msg.Payload))
+	return ret, nil
+}
+
+// Unmarshaler strips the schema ID prefix from the payloads, after checking the schema exists.
+// The schema ID is available in the SchemaIDMetadataKey metadata.
+// Payloads without prefix, published before the schema registry was enabled, are unmarshaled as is.
+type Unmarshaler struct {
+	unmarshaler kafka.Unmarshaler
+	client      Client
+}
+
+var _ kafka.Unmarshaler = (*Unmarshaler)(nil)
+
+func NewUnmarshaler(unmarshaler kafka.Unmarshaler, client Client) *Unmarshaler {
+	return &Unmarshaler{
+		unmarshaler: unmarshaler,
+		client:      client,
+	}
+}
+
+func (u *Unmarshaler) Unmarshal(kafkaMsg *sarama.ConsumerMessage) (*message.Message, error) {
+	if len(kafkaMsg.Value) == 0 || kafkaMsg.Value[0] != magicByte {
+		return u.unmarshaler.Unmarshal(kafkaMsg)
+	}
+	if len(kafkaMsg.Value) < headerSize {
+		return nil, fmt.Errorf("%w: payload of %d bytes", ErrInvalidWireFormat, len(kafkaMsg.Value))
+	}
+
+	id := int(binary.BigEndian.Uint32(kafkaMsg.Value[1:headerSize]))
+	// Kafka unmarshalers have no context
+	schema, err := u.client.SchemaByID(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decode(schema.Type, kafkaMsg.Value[headerSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := *kafkaMsg
+	stripped.Value = payload
+	ret, err := u.unmarshaler.Unmarshal(&stripped)
+	if err != nil {
+		return nil, err
+	}
+	ret.Metadata.Set(SchemaIDMetadataKey, strconv.Itoa(id))
+	return ret, nil
+}
+
+func encode(id int, schemaType SchemaType, payload []byte) []byte {
+	ret := make([]byte, headerSize, headerSize+1+len(payload))
+	ret[0] = magicByte
+	binary.BigEndian.PutUint32(ret[1:], uint32(id))
+	if schemaType == SchemaTypeProtobuf {
+		// Index of the message in the schema, the first one, encoded as an empty list
+		ret = append(ret, 0)
+	}
+	return append(ret, payload...)
+}
+
+// decode strips the protobuf message indexes
+func decode(schemaType SchemaType, data []byte) ([]byte, error) {
+	if schemaType != SchemaTypeProtobuf {
+		return data, nil
+	}
+
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return nil, fmt.Errorf("%w: invalid protobuf message indexes", ErrInvalidWireFormat)
+	}
+	data = data[n:]
+	for range count {
+		_, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: invalid protobuf message indexes", ErrInvalidWireFormat)
+		}
+		data = data[n:]
+	}
+	return data, nil
+}
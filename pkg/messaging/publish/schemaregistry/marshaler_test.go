@@ -0,0 +1,158 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	"github.com/formancehq/go-libs/v5/pkg/testing/platform/schemaregistrytesting"
+)
+
+func toConsumerMessage(t *testing.T, msg *sarama.ProducerMessage) *sarama.ConsumerMessage {
+	t.Helper()
+
+	value, err := msg.Value.Encode()
+	require.NoError(t, err)
+
+	headers := make([]*sarama.RecordHeader, 0, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers = append(headers, &header)
+	}
+
+	return &sarama.ConsumerMessage{
+		Topic:   msg.Topic,
+		Value:   value,
+		Headers: headers,
+	}
+}
+
+func TestMarshaler(t *testing.T) {
+	t.Parallel()
+
+	for _, schemaType := range []SchemaType{SchemaTypeJSON, SchemaTypeProtobuf} {
+		t.Run(string(schemaType), func(t *testing.T) {
+			t.Parallel()
+
+			server := schemaregistrytesting.NewServer(t)
+			client := NewCachedClient(NewHTTPClient(server.URL))
+			schema := Schema{
+				Type:   schemaType,
+				Schema: `{"type": "object"}`,
+			}
+
+			marshaler := NewMarshaler(kafka.DefaultMarshaler{}, client, StaticSchema(schema))
+			unmarshaler := NewUnmarshaler(kafka.DefaultMarshaler{}, NewCachedClient(NewHTTPClient(server.URL)))
+
+			msg := message.NewMessage("1", []byte(`{"id": 1}`))
+			msg.Metadata.Set("foo", "bar")
+
+			kafkaMsg, err := marshaler.Marshal("ledger", msg)
+			require.NoError(t, err)
+			require.Equal(t, map[string][]int{"ledger-value": {1}}, server.Subjects())
+
+			consumerMsg := toConsumerMessage(t, kafkaMsg)
+			require.Equal(t, byte(magicByte), consumerMsg.Value[0])
+			require.Equal(t, []byte{0, 0, 0, 1}, consumerMsg.Value[1:headerSize])
+
+			unmarshaled, err := unmarshaler.Unmarshal(consumerMsg)
+			require.NoError(t, err)
+			require.Equal(t, "1", unmarshaled.UUID)
+			require.Equal(t, "bar", unmarshaled.Metadata.Get("foo"))
+			require.Equal(t, "1", unmarshaled.Metadata.Get(SchemaIDMetadataKey))
+			require.JSONEq(t, `{"id": 1}`, string(unmarshaled.Payload))
+
+			// The schema is registered and fetched only once
+			requests := server.Requests()
+			_, err = marshaler.Marshal("ledger", message.NewMessage("2", []byte(`{"id": 2}`)))
+			require.NoError(t, err)
+			_, err = unmarshaler.Unmarshal(consumerMsg)
+			require.NoError(t, err)
+			require.Equal(t, requests, server.Requests())
+		})
+	}
+}
+
+func TestUnmarshalerWithoutSchemaID(t *testing.T) {
+	t.Parallel()
+
+	server := schemaregistrytesting.NewServer(t)
+	unmarshaler := NewUnmarshaler(kafka.DefaultMarshaler{}, NewHTTPClient(server.URL))
+
+	kafkaMsg, err := kafka.DefaultMarshaler{}.Marshal("ledger", message.NewMessage("1", []byte(`{"id": 1}`)))
+	require.NoError(t, err)
+
+	unmarshaled, err := unmarshaler.Unmarshal(toConsumerMessage(t, kafkaMsg))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id": 1}`, string(unmarshaled.Payload))
+	require.Empty(t, unmarshaled.Metadata.Get(SchemaIDMetadataKey))
+	require.Zero(t, server.Requests())
+}
+
+func TestUnmarshalerErrors(t *testing.T) {
+	t.Parallel()
+
+	server := schemaregistrytesting.NewServer(t)
+	unmarshaler := NewUnmarshaler(kafka.DefaultMarshaler{}, NewHTTPClient(server.URL))
+
+	_, err := unmarshaler.Unmarshal(&sarama.ConsumerMessage{Value: []byte{0, 0, 1}})
+	require.ErrorIs(t, err, ErrInvalidWireFormat)
+
+	_, err = unmarshaler.Unmarshal(&sarama.ConsumerMessage{Value: encode(42, SchemaTypeJSON, []byte(`{}`))})
+	registryErr := ErrRegistry{}
+	require.ErrorAs(t, err, &registryErr)
+	require.Equal(t, 40403, registryErr.Code)
+}
+
+func TestRegistryResolver(t *testing.T) {
+	t.Parallel()
+
+	type accountCreated struct {
+		ID string `json:"id"`
+	}
+
+	registry := publish.NewRegistry()
+	require.NoError(t, publish.Register[accountCreated](registry, "ACCOUNT_CREATED", "v1", []byte(`{
+		"type": "object",
+		"required": ["id"],
+		"properties": {"id": {"type": "string"}}
+	}`)))
+
+	server := schemaregistrytesting.NewServer(t)
+	marshaler := NewMarshaler(kafka.DefaultMarshaler{}, NewHTTPClient(server.URL), RegistryResolver(registry))
+
+	payload, err := json.Marshal(publish.EventMessage{
+		Type:    "ACCOUNT_CREATED",
+		Version: "v1",
+		Payload: accountCreated{ID: "1"},
+	})
+	require.NoError(t, err)
+
+	_, err = marshaler.Marshal("ledger", message.NewMessage("1", payload))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]int{"ledger-ACCOUNT_CREATED": {1}}, server.Subjects())
+
+	schema, err := NewHTTPClient(server.URL).SchemaByID(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, SchemaTypeJSON, schema.Type)
+
+	registered := struct {
+		Properties struct {
+			Payload struct {
+				Required []string `json:"required"`
+			} `json:"payload"`
+		} `json:"properties"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(schema.Schema), &registered))
+	require.Equal(t, []string{"id"}, registered.Properties.Payload.Required)
+
+	payload, err = json.Marshal(publish.EventMessage{Type: "UNKNOWN", Version: "v1"})
+	require.NoError(t, err)
+	_, err = marshaler.Marshal("ledger", message.NewMessage("2", payload))
+	require.ErrorIs(t, err, publish.ErrUnknownEvent{})
+}
@@ -30,5 +30,6 @@ func NewSnsPublisher(ctx context.Context, logger watermill.LoggerAdapter, config
 		TopicResolver:               topicResolver,
 		AWSConfig:                   config,
 		OptFns:                      optFns,
+		Marshaler:                   SNSPartitionKeyMarshaler{},
 	}, logger)
 }
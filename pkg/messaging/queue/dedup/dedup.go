@@ -0,0 +1,166 @@
+// Package dedup skips messages already processed by a consumer.
+//
+// Messages are identified by a key, by default the idempotency key of the publish.EventMessage they carry,
+// namespaced by the name of the consumer.
+// Before calling the handler, the key is claimed in a Store: a key completed less than the TTL ago is a
+// duplicate and is acknowledged without calling the handler, a key claimed by another worker is
+// rejected with ErrInProgress so the message is redelivered later.
+package dedup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/queue"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+var (
+	// ErrDuplicate is returned by Store.Claim when the key has already been processed.
+	ErrDuplicate = errors.New("message already processed")
+	// ErrInProgress is returned when the key is being processed by another worker.
+	// Deduplicator.Process marks it with queue.Redeliver, so a queue listener redelivers the message without counting an attempt.
+	ErrInProgress = errors.New("message is being processed by another worker")
+)
+
+// KeyFunc extracts the deduplication key of a message.
+// An empty key disables the deduplication for the message.
+type KeyFunc func(metadata map[string]string, payload []byte) (string, error)
+
+// IdempotencyKey reads the idempotency key of the publish.EventMessage contained in the payload.
+func IdempotencyKey(_ map[string]string, payload []byte) (string, error) {
+	ev := publish.EventMessage{}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return "", fmt.Errorf("unmarshal event message: %w", err)
+	}
+	return ev.IdempotencyKey, nil
+}
+
+var _ KeyFunc = IdempotencyKey
+
+// MetadataKey reads the deduplication key from the given metadata entry.
+func MetadataKey(name string) KeyFunc {
+	return func(metadata map[string]string, _ []byte) (string, error) {
+		return metadata[name], nil
+	}
+}
+
+type Deduplicator struct {
+	consumer string
+	store    Store
+	keyFunc  KeyFunc
+	ttl      time.Duration
+	lease    time.Duration
+}
+
+type Option func(*Deduplicator)
+
+// WithKeyFunc configures how keys are extracted from messages, defaults to IdempotencyKey.
+func WithKeyFunc(fn KeyFunc) Option {
+	return func(d *Deduplicator) {
+		d.keyFunc = fn
+	}
+}
+
+// WithTTL configures how long a processed key is remembered.
+func WithTTL(ttl time.Duration) Option {
+	return func(d *Deduplicator) {
+		d.ttl = ttl
+	}
+}
+
+// WithLease configures how long a key stays claimed by a worker.
+// If the worker dies without completing or releasing the key, another worker can claim it after the lease.
+// It should be longer than the callback deadline of the listener.
+func WithLease(lease time.Duration) Option {
+	return func(d *Deduplicator) {
+		d.lease = lease
+	}
+}
+
+var defaultOptions = []Option{
+	WithKeyFunc(IdempotencyKey),
+	WithTTL(24 * time.Hour),
+	WithLease(5 * time.Minute),
+}
+
+// New creates a Deduplicator recording the keys of the given consumer in store.
+// The consumer name must be stable across restarts and distinct for each consumer of the same messages,
+// otherwise a consumer would skip the messages processed by another.
+func New(consumer string, store Store, opts ...Option) *Deduplicator {
+	ret := &Deduplicator{
+		consumer: consumer,
+		store:    store,
+	}
+	for _, opt := range append(defaultOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+// Process calls fn unless the message has already been processed.
+// The key is released if fn fails, so the message can be processed again when redelivered.
+// If the message is being processed by another worker, the returned error wraps ErrInProgress and is marked with queue.Redeliver.
+func (d *Deduplicator) Process(ctx context.Context, metadata map[string]string, payload []byte, fn func(ctx context.Context) error) error {
+	key, err := d.keyFunc(metadata, payload)
+	if err != nil {
+		return fmt.Errorf("extracting deduplication key: %w", err)
+	}
+	if key == "" {
+		return fn(ctx)
+	}
+
+	switch err := d.store.Claim(ctx, d.consumer, key, d.lease); {
+	case errors.Is(err, ErrDuplicate):
+		logging.FromContext(ctx).WithField("key", key).Debugf("skipping duplicated message")
+		return nil
+	case errors.Is(err, ErrInProgress):
+		return queue.Redeliver(err)
+	case err != nil:
+		return fmt.Errorf("claiming deduplication key %s: %w", key, err)
+	}
+
+	if err := fn(ctx); err != nil {
+		// The handler error is the one to report, the key will be claimable again after the lease anyway
+		if releaseErr := d.store.Release(context.WithoutCancel(ctx), d.consumer, key); releaseErr != nil {
+			logging.FromContext(ctx).WithField("key", key).Errorf("releasing deduplication key: %s", releaseErr)
+		}
+		return err
+	}
+
+	if err := d.store.Complete(context.WithoutCancel(ctx), d.consumer, key, d.ttl); err != nil {
+		return fmt.Errorf("completing deduplication key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Callback wraps a queue.CallbackFn.
+func (d *Deduplicator) Callback(fn queue.CallbackFn) queue.CallbackFn {
+	return func(ctx context.Context, metadata map[string]string, payload []byte) error {
+		return d.Process(ctx, metadata, payload, func(ctx context.Context) error {
+			return fn(ctx, metadata, payload)
+		})
+	}
+}
+
+// Middleware is a watermill message.HandlerMiddleware.
+// Duplicated messages produce no message.
+func (d *Deduplicator) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		var produced []*message.Message
+		err := d.Process(msg.Context(), msg.Metadata, msg.Payload, func(context.Context) error {
+			var err error
+			produced, err = h(msg)
+			return err
+		})
+		return produced, err
+	}
+}
+
+var _ message.HandlerMiddleware = (*Deduplicator)(nil).Middleware
@@ -0,0 +1,176 @@
+package dedup_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/publish"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/queue"
+	"github.com/formancehq/go-libs/v5/pkg/messaging/queue/dedup"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+)
+
+func eventPayload(t *testing.T, idempotencyKey string) []byte {
+	data, err := json.Marshal(publish.EventMessage{
+		IdempotencyKey: idempotencyKey,
+		Type:           "TEST",
+		Payload:        map[string]any{"foo": "bar"},
+	})
+	require.NoError(t, err)
+	return data
+}
+
+func TestCallback(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	deduplicator := dedup.New("consumer", dedup.NewMemoryStore())
+
+	calls := 0
+	callback := deduplicator.Callback(func(ctx context.Context, metadata map[string]string, msg []byte) error {
+		calls++
+		return nil
+	})
+
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key1")))
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key1")))
+	require.Equal(t, 1, calls)
+
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key2")))
+	require.Equal(t, 2, calls)
+
+	// Messages without key are always processed
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "")))
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "")))
+	require.Equal(t, 4, calls)
+
+	require.Error(t, callback(ctx, nil, []byte("not json")))
+	require.Equal(t, 4, calls)
+}
+
+func TestCallbackFailureReleasesKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	deduplicator := dedup.New("consumer", dedup.NewMemoryStore())
+
+	expectedErr := errors.New("failure")
+	calls := 0
+	callback := deduplicator.Callback(func(ctx context.Context, metadata map[string]string, msg []byte) error {
+		calls++
+		if calls == 1 {
+			return expectedErr
+		}
+		return nil
+	})
+
+	require.ErrorIs(t, callback(ctx, nil, eventPayload(t, "key")), expectedErr)
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key")))
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key")))
+	require.Equal(t, 2, calls)
+}
+
+func TestCallbackTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	deduplicator := dedup.New("consumer", dedup.NewMemoryStore(), dedup.WithTTL(10*time.Millisecond))
+
+	calls := 0
+	callback := deduplicator.Callback(func(ctx context.Context, metadata map[string]string, msg []byte) error {
+		calls++
+		return nil
+	})
+
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key")))
+	<-time.After(20 * time.Millisecond)
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key")))
+	require.Equal(t, 2, calls)
+}
+
+func TestCallbackConcurrentWorkers(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	deduplicator := dedup.New("consumer", dedup.NewMemoryStore())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	callback := deduplicator.Callback(func(ctx context.Context, metadata map[string]string, msg []byte) error {
+		calls.Add(1)
+		close(started)
+		<-release
+		return nil
+	})
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		require.NoError(t, callback(ctx, nil, eventPayload(t, "key")))
+	}()
+
+	<-started
+	err := callback(ctx, nil, eventPayload(t, "key"))
+	require.ErrorIs(t, err, dedup.ErrInProgress)
+	require.True(t, queue.IsRedeliver(err))
+	close(release)
+	wg.Wait()
+
+	require.NoError(t, callback(ctx, nil, eventPayload(t, "key")))
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestConsumers(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	store := dedup.NewMemoryStore()
+
+	calls := 0
+	callback := func(ctx context.Context, metadata map[string]string, msg []byte) error {
+		calls++
+		return nil
+	}
+	first := dedup.New("first", store).Callback(callback)
+	second := dedup.New("second", store).Callback(callback)
+
+	// Each consumer processes the message once
+	for _, fn := range []queue.CallbackFn{first, second, first, second} {
+		require.NoError(t, fn(ctx, nil, eventPayload(t, "key")))
+	}
+	require.Equal(t, 2, calls)
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	deduplicator := dedup.New("consumer", dedup.NewMemoryStore(), dedup.WithKeyFunc(dedup.MetadataKey("dedup-key")))
+
+	calls := 0
+	handler := deduplicator.Middleware(func(msg *message.Message) ([]*message.Message, error) {
+		calls++
+		return []*message.Message{message.NewMessage("produced", nil)}, nil
+	})
+
+	msg := message.NewMessage("uuid", []byte("payload"))
+	msg.Metadata["dedup-key"] = "key"
+
+	produced, err := handler(msg)
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+
+	produced, err = handler(msg)
+	require.NoError(t, err)
+	require.Empty(t, produced)
+	require.Equal(t, 1, calls)
+}
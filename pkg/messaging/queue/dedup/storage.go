@@ -0,0 +1,164 @@
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"github.com/formancehq/go-libs/v5/pkg/storage/migrations"
+)
+
+type Key struct {
+	bun.BaseModel `bun:"deduplication,alias:deduplication"`
+
+	Consumer  string    `bun:"consumer,pk"`
+	Key       string    `bun:"key,pk"`
+	Completed bool      `bun:"completed,notnull"`
+	ExpiresAt time.Time `bun:"expires_at,notnull"`
+}
+
+func tableExpr(schema string) (string, bun.Ident) {
+	return "? AS deduplication", bun.Ident(schema + ".deduplication")
+}
+
+// BunStore is a Store persisting keys in the deduplication table, see Migrate.
+// Claims rely on the primary key of the table, so concurrent workers, even on different hosts,
+// cannot claim the same key.
+type BunStore struct {
+	db     bun.IDB
+	schema string
+}
+
+var _ Store = (*BunStore)(nil)
+
+func NewBunStore(schema string, db bun.IDB) *BunStore {
+	return &BunStore{
+		db:     db,
+		schema: schema,
+	}
+}
+
+func (s *BunStore) Claim(ctx context.Context, consumer, key string, lease time.Duration) error {
+	now := time.Now().UTC()
+	ret, err := s.db.NewInsert().
+		Model(&Key{
+			Consumer:  consumer,
+			Key:       key,
+			ExpiresAt: now.Add(lease),
+		}).
+		ModelTableExpr(tableExpr(s.schema)).
+		// Take over expired keys, whether completed or claimed by a worker which died
+		On("conflict (consumer, key) do update").
+		Set("completed = false").
+		Set("expires_at = excluded.expires_at").
+		Where("deduplication.expires_at <= ?", now).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if inserted, err := ret.RowsAffected(); err != nil {
+		return err
+	} else if inserted > 0 {
+		return nil
+	}
+
+	existing := &Key{}
+	err = s.db.NewSelect().
+		Model(existing).
+		ModelTableExpr(tableExpr(s.schema)).
+		Where("consumer = ?", consumer).
+		Where("key = ?", key).
+		Scan(ctx)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// Released in the meantime
+		return ErrInProgress
+	case err != nil:
+		return err
+	case existing.Completed:
+		return ErrDuplicate
+	default:
+		return ErrInProgress
+	}
+}
+
+func (s *BunStore) Complete(ctx context.Context, consumer, key string, ttl time.Duration) error {
+	_, err := s.db.NewUpdate().
+		ModelTableExpr(tableExpr(s.schema)).
+		Set("completed = true").
+		Set("expires_at = ?", time.Now().UTC().Add(ttl)).
+		Where("consumer = ?", consumer).
+		Where("key = ?", key).
+		Exec(ctx)
+	return err
+}
+
+func (s *BunStore) Release(ctx context.Context, consumer, key string) error {
+	_, err := s.db.NewDelete().
+		ModelTableExpr(tableExpr(s.schema)).
+		Where("consumer = ?", consumer).
+		Where("key = ?", key).
+		Where("not completed").
+		Exec(ctx)
+	return err
+}
+
+// DeleteExpired removes expired keys.
+// Expired keys are ignored and overwritten by claims, so this only keeps the table small.
+func (s *BunStore) DeleteExpired(ctx context.Context) (int64, error) {
+	ret, err := s.db.NewDelete().
+		ModelTableExpr(tableExpr(s.schema)).
+		Where("expires_at <= ?", time.Now().UTC()).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return ret.RowsAffected()
+}
+
+func registerMigrations(migrator *migrations.Migrator, schema string) {
+	migrator.RegisterMigrations(
+		migrations.Migration{
+			Name:   "create deduplication table",
+			Source: initialSchema,
+			Up: func(ctx context.Context, db bun.IDB) error {
+				return db.RunInTx(ctx, &sql.TxOptions{}, func(ctx context.Context, tx bun.Tx) error {
+					_, err := tx.Exec("set search_path = ?", schema)
+					if err != nil {
+						return err
+					}
+					_, err = tx.Exec(initialSchema)
+					return err
+				})
+			},
+		},
+	)
+}
+
+// Migrate creates the deduplication table in the given schema.
+func Migrate(ctx context.Context, schema string, db *bun.DB) error {
+	migrator := migrations.NewMigrator(
+		db,
+		migrations.WithSchema(schema),
+		migrations.WithTableName("deduplication_migrations"),
+	)
+
+	registerMigrations(migrator, schema)
+
+	return migrator.Up(ctx)
+}
+
+const initialSchema = `
+CREATE TABLE IF NOT EXISTS "deduplication" (
+	consumer text NOT NULL,
+	key text NOT NULL,
+	completed boolean NOT NULL DEFAULT false,
+	expires_at timestamp with time zone NOT NULL,
+	PRIMARY KEY ("consumer", "key")
+);
+
+CREATE INDEX IF NOT EXISTS "deduplication_expires_at_idx" ON "deduplication" ("expires_at");
+`
@@ -0,0 +1,94 @@
+package dedup_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/messaging/queue/dedup"
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	bunconnect "github.com/formancehq/go-libs/v5/pkg/storage/bun/connect"
+)
+
+func newBunStore(t *testing.T) *dedup.BunStore {
+	ctx := logging.TestingContext()
+
+	db, err := bunconnect.OpenSQLDB(ctx, srv.NewDatabase(t).ConnectionOptions())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	schema := uuid.NewString()[:8]
+	require.NoError(t, dedup.Migrate(ctx, schema, db))
+
+	return dedup.NewBunStore(schema, db)
+}
+
+func TestBunStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	store := newBunStore(t)
+
+	require.NoError(t, store.Claim(ctx, "consumer", "key", time.Minute))
+	require.ErrorIs(t, store.Claim(ctx, "consumer", "key", time.Minute), dedup.ErrInProgress)
+
+	// Released keys can be claimed again
+	require.NoError(t, store.Release(ctx, "consumer", "key"))
+	require.NoError(t, store.Claim(ctx, "consumer", "key", time.Minute))
+
+	require.NoError(t, store.Complete(ctx, "consumer", "key", time.Minute))
+	require.ErrorIs(t, store.Claim(ctx, "consumer", "key", time.Minute), dedup.ErrDuplicate)
+
+	// Completed keys are not released
+	require.NoError(t, store.Release(ctx, "consumer", "key"))
+	require.ErrorIs(t, store.Claim(ctx, "consumer", "key", time.Minute), dedup.ErrDuplicate)
+
+	// Expired claims and keys can be claimed again
+	require.NoError(t, store.Claim(ctx, "consumer", "expired-claim", -time.Second))
+	require.NoError(t, store.Claim(ctx, "consumer", "expired-claim", time.Minute))
+
+	require.NoError(t, store.Claim(ctx, "consumer", "expired-key", time.Minute))
+	require.NoError(t, store.Complete(ctx, "consumer", "expired-key", -time.Second))
+	require.NoError(t, store.Claim(ctx, "consumer", "expired-key", time.Minute))
+
+	require.NoError(t, store.Claim(ctx, "consumer", "to-delete", time.Minute))
+	require.NoError(t, store.Complete(ctx, "consumer", "to-delete", -time.Second))
+	// Keys are namespaced by consumer
+	require.NoError(t, store.Claim(ctx, "other", "key", time.Minute))
+	require.NoError(t, store.Complete(ctx, "other", "key", time.Minute))
+
+	deleted, err := store.DeleteExpired(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+}
+
+func TestBunStoreConcurrentClaims(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	store := newBunStore(t)
+
+	var claimed atomic.Int32
+	wg := sync.WaitGroup{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Claim(ctx, "consumer", "key", time.Minute)
+			if err == nil {
+				claimed.Add(1)
+				return
+			}
+			require.ErrorIs(t, err, dedup.ErrInProgress)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), claimed.Load())
+}
@@ -0,0 +1,96 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store records the keys of processed messages.
+// Keys are namespaced by consumer: consumers processing the same messages record their keys separately.
+// Implementations must be safe for concurrent use, including from several processes for shared stores.
+type Store interface {
+	// Claim reserves the key of the consumer for the lease duration.
+	// It returns ErrDuplicate if the key has been completed and has not expired,
+	// and ErrInProgress if the key is already claimed.
+	Claim(ctx context.Context, consumer, key string, lease time.Duration) error
+	// Complete marks a claimed key of the consumer as processed for the ttl duration.
+	Complete(ctx context.Context, consumer, key string, ttl time.Duration) error
+	// Release removes the claim on a key of the consumer which has not been completed.
+	Release(ctx context.Context, consumer, key string) error
+}
+
+type memoryKey struct {
+	consumer string
+	key      string
+}
+
+type memoryEntry struct {
+	completed bool
+	expiresAt time.Time
+}
+
+// MemoryStore is a Store keeping keys in memory.
+// It only deduplicates messages received by the same process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[memoryKey]memoryEntry
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[memoryKey]memoryEntry),
+	}
+}
+
+func (s *MemoryStore) Claim(_ context.Context, consumer, key string, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entryKey := memoryKey{consumer: consumer, key: key}
+	if entry, ok := s.entries[entryKey]; ok && entry.expiresAt.After(now) {
+		if entry.completed {
+			return ErrDuplicate
+		}
+		return ErrInProgress
+	}
+
+	// Expired entries are only removed when claimed again, so clean them up from time to time
+	if len(s.entries) > 0 && len(s.entries)%1000 == 0 {
+		for k, entry := range s.entries {
+			if !entry.expiresAt.After(now) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	s.entries[entryKey] = memoryEntry{
+		expiresAt: now.Add(lease),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Complete(_ context.Context, consumer, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[memoryKey{consumer: consumer, key: key}] = memoryEntry{
+		completed: true,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Release(_ context.Context, consumer, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entryKey := memoryKey{consumer: consumer, key: key}
+	if entry, ok := s.entries[entryKey]; ok && !entry.completed {
+		delete(s.entries, entryKey)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -41,6 +42,15 @@ type listener struct {
 	callbackDeadline time.Duration // timeout for a single message, 0 == no deadline
 	callbackFn       CallbackFn
 
+	maxAttempts       int // 0 == no retry
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	backoffJitter     float64
+	visibilityTimeout time.Duration // 0 == no visibility timeout
+
+	deadLetterPublisher message.Publisher // nil == no dead letter
+	deadLetterTopic     string
+
 	// channel that blocks until all workers are stopped
 	done chan struct{}
 }
@@ -51,7 +61,10 @@ func NewListener(
 	optFns ...func(*ListenerOptions),
 ) (Listener, error) {
 	opts := ListenerOptions{
-		WorkerCount: defaultWorkerCount,
+		WorkerCount:    defaultWorkerCount,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		BackoffJitter:  defaultBackoffJitter,
 	}
 	for _, fn := range optFns {
 		if fn == nil {
@@ -65,16 +78,42 @@ func NewListener(
 	if callbackFn == nil {
 		return nil, fmt.Errorf("callback function cannot be nil")
 	}
+	if opts.MaxAttempts < 0 {
+		return nil, fmt.Errorf("maxAttempts cannot be negative")
+	}
+	if opts.InitialBackoff < 0 || opts.MaxBackoff < opts.InitialBackoff {
+		return nil, fmt.Errorf("backoff must be positive and initial backoff cannot exceed max backoff")
+	}
+	if opts.BackoffJitter < 0 || opts.BackoffJitter > 1 {
+		return nil, fmt.Errorf("backoff jitter must be between 0 and 1")
+	}
+	if opts.VisibilityTimeout < 0 {
+		return nil, fmt.Errorf("visibility timeout cannot be negative")
+	}
+	if opts.VisibilityTimeout > 0 && opts.MaxAttempts > 1 && opts.MaxBackoff >= opts.VisibilityTimeout {
+		return nil, fmt.Errorf("max backoff must be below the visibility timeout")
+	}
+	if opts.DeadLetterPublisher != nil && opts.DeadLetterTopic == "" {
+		return nil, fmt.Errorf("dead letter topic cannot be empty")
+	}
 
 	return &listener{
-		wg:               &sync.WaitGroup{},
-		mux:              &sync.Mutex{},
-		logger:           logger,
-		callbackFn:       callbackFn,
-		name:             opts.Name,
-		workerCount:      opts.WorkerCount,
-		callbackDeadline: opts.CallbackDeadline,
-		done:             make(chan struct{}),
+		wg:                &sync.WaitGroup{},
+		mux:               &sync.Mutex{},
+		logger:            logger,
+		callbackFn:        callbackFn,
+		name:              opts.Name,
+		workerCount:       opts.WorkerCount,
+		callbackDeadline:  opts.CallbackDeadline,
+		maxAttempts:       opts.MaxAttempts,
+		initialBackoff:    opts.InitialBackoff,
+		maxBackoff:        opts.MaxBackoff,
+		backoffJitter:     opts.BackoffJitter,
+		visibilityTimeout: opts.VisibilityTimeout,
+		done:              make(chan struct{}),
+
+		deadLetterPublisher: opts.DeadLetterPublisher,
+		deadLetterTopic:     opts.DeadLetterTopic,
 	}, nil
 }
 
@@ -143,14 +182,81 @@ func (l *listener) startWorker(ctx context.Context, messages <-chan *message.Mes
 				l.logger.WithField("listenerName", l.name).Errorf("received nil message from subscriber")
 				continue
 			}
-			// workers are protected from context cancel to ensure we tell sqs to delete messages we've processed
-			detachedCtx := context.WithoutCancel(ctx)
-			l.handleMessage(detachedCtx, msg)
+			l.handleMessage(ctx, msg)
 		}
 	}
 }
 
+// handleMessage calls the callback until it succeeds, fails with a permanent error or exhausts its attempts.
+// The attempts are counted for each delivery: brokers redeliver messages without the metadata set by the listener,
+// so deliveries have to be bounded by the broker (e.g. SQS redrive policy, JetStream MaxDeliver).
+// ctx is only used to interrupt backoffs: workers are protected from context cancel
+// to ensure we tell sqs to delete messages we've processed
 func (l *listener) handleMessage(ctx context.Context, msg *message.Message) {
+	logger := l.logger.WithField("messageUuid", msg.UUID).WithField("listenerName", l.name)
+
+	var err error
+	receivedAt := time.Now()
+	attempt := 0
+	for {
+		attempt++
+		msg.Metadata[AttemptsMetadataKey] = strconv.Itoa(attempt)
+
+		err = l.processMessage(context.WithoutCancel(ctx), msg)
+		if err == nil {
+			// delete message from queue
+			msg.Ack()
+			return
+		}
+		if IsRedeliver(err) {
+			logger.WithField("err", err.Error()).Debugf("queue listener leaving message to redelivery")
+			msg.Nack()
+			return
+		}
+		if IsPermanent(err) || attempt >= l.maxAttempts {
+			break
+		}
+
+		delay := l.backoff(attempt)
+		logger := logger.WithField("err", err.Error()).WithField("attempt", attempt)
+		if l.visibilityTimeout > 0 && time.Since(receivedAt)+delay+l.callbackDeadline >= l.visibilityTimeout {
+			// the queue would deliver the message again while it is retried, let it redeliver it instead
+			logger.Debugf("queue listener leaving message to redelivery before its visibility timeout")
+			msg.Nack()
+			return
+		}
+		logger.Debugf("queue listener retrying message")
+		if !l.wait(ctx, delay) {
+			// the listener is stopping, let the subscriber redeliver the message
+			msg.Nack()
+			return
+		}
+	}
+
+	logger = logger.WithField("err", err.Error()).WithField("attempt", attempt)
+	if l.maxAttempts == 0 && !IsPermanent(err) {
+		// retries are left to the subscriber
+		logger.Errorf("queue listener failed to process message")
+		msg.Nack()
+		return
+	}
+	if l.deadLetterPublisher == nil {
+		// never drop a message, the broker is left to bound its redeliveries
+		logger.Errorf("queue listener failed to process message, leaving it to redelivery as there is no dead letter")
+		msg.Nack()
+		return
+	}
+
+	if dlErr := l.deadLetter(context.WithoutCancel(ctx), msg, attempt, err); dlErr != nil {
+		logger.WithField("deadLetterErr", dlErr.Error()).Errorf("queue listener failed to dead-letter message")
+		msg.Nack()
+		return
+	}
+	logger.WithField("deadLetterTopic", l.deadLetterTopic).Errorf("queue listener sent message to dead letter")
+	msg.Ack()
+}
+
+func (l *listener) processMessage(ctx context.Context, msg *message.Message) error {
 	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Metadata))
 	logger := l.logger.WithContext(ctx)
 	ctx = logging.ContextWithLogger(ctx, logger)
@@ -165,15 +271,5 @@ func (l *listener) handleMessage(ctx context.Context, msg *message.Message) {
 		WithField("listenerName", l.name).
 		WithField("callbackDeadline", l.callbackDeadline.String()).
 		Debugf("queue listener handling message")
-	err := l.callbackFn(ctx, msg.Metadata, msg.Payload)
-	if err != nil {
-		logger.WithField("messageUuid", msg.UUID).
-			WithField("listenerName", l.name).
-			WithField("err", err.Error()).
-			Errorf("queue listener failed to process message")
-		msg.Nack()
-		return
-	}
-	// delete message from queue
-	msg.Ack()
+	return l.callbackFn(ctx, msg.Metadata, msg.Payload)
 }
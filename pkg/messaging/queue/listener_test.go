@@ -3,12 +3,16 @@ package queue_test
 import (
 	"bytes"
 	"context" //nolint: gosec
+	"errors"
 	"fmt"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -203,6 +207,387 @@ func TestCallbackDeadlineForcesCancels(t *testing.T) {
 	<-listener.Done()
 }
 
+func TestNewListenerInvalidRetryOptions(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error { return nil }
+
+	for _, opt := range []func(*queue.ListenerOptions){
+		queue.WithMaxAttempts(-1),
+		queue.WithBackoff(time.Second, time.Millisecond),
+		queue.WithBackoffJitter(2),
+		queue.WithDeadLetter(gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{}), ""),
+	} {
+		listener, err := queue.NewListener(logger, callback, opt)
+		require.Error(t, err)
+		assert.Nil(t, listener)
+	}
+}
+
+func TestListenerRetriesUntilSuccess(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	var attempts atomic.Int32
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		if attempts.Add(1) < 3 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}
+
+	listener, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(3),
+		queue.WithBackoff(time.Millisecond, 5*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+		t.Fatal("message was nacked")
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not acked")
+	}
+	assert.Equal(t, int32(3), attempts.Load())
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerDeadLetter(t *testing.T) {
+	type testCase struct {
+		name             string
+		maxAttempts      int
+		err              error
+		expectedAttempts int
+	}
+	for _, tc := range []testCase{
+		{name: "attempts exhausted", maxAttempts: 3, err: errors.New("temporary failure"), expectedAttempts: 3},
+		{name: "permanent error", maxAttempts: 3, err: queue.Permanent(errors.New("invalid payload")), expectedAttempts: 1},
+		{name: "permanent error without retry", err: queue.Permanent(errors.New("invalid payload")), expectedAttempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+			pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 1}, watermill.NopLogger{})
+			t.Cleanup(func() {
+				require.NoError(t, pubSub.Close())
+			})
+			deadLetters, err := pubSub.Subscribe(context.Background(), "dead-letter")
+			require.NoError(t, err)
+
+			var attempts atomic.Int32
+			callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+				attempts.Add(1)
+				return tc.err
+			}
+
+			listener, err := queue.NewListener(logger, callback,
+				queue.WithName("test"),
+				queue.WithMaxAttempts(tc.maxAttempts),
+				queue.WithBackoff(time.Millisecond, 5*time.Millisecond),
+				queue.WithDeadLetter(pubSub, "dead-letter"),
+			)
+			require.NoError(t, err)
+
+			ch := make(chan *message.Message, 1)
+			msg := message.NewMessage("test-uuid", []byte("test-payload"))
+			msg.Metadata["foo"] = "bar"
+			ch <- msg
+
+			ctx, cancel := context.WithCancel(context.Background())
+			listener.Listen(ctx, ch)
+
+			select {
+			case deadLetter := <-deadLetters:
+				deadLetter.Ack()
+				assert.Equal(t, "test-uuid", deadLetter.UUID)
+				assert.Equal(t, []byte("test-payload"), []byte(deadLetter.Payload))
+				assert.Equal(t, "bar", deadLetter.Metadata["foo"])
+				assert.Equal(t, tc.err.Error(), deadLetter.Metadata[queue.DeadLetterErrorMetadataKey])
+				assert.Equal(t, fmt.Sprint(tc.expectedAttempts), deadLetter.Metadata[queue.DeadLetterAttemptsMetadataKey])
+				assert.Equal(t, "test", deadLetter.Metadata[queue.DeadLetterListenerMetadataKey])
+			case <-time.After(2 * time.Second):
+				t.Fatal("message was not dead-lettered")
+			}
+
+			select {
+			case <-msg.Acked():
+			case <-msg.Nacked():
+				t.Fatal("dead-lettered message was nacked")
+			case <-time.After(2 * time.Second):
+				t.Fatal("dead-lettered message was not acked")
+			}
+			assert.Equal(t, int32(tc.expectedAttempts), attempts.Load())
+
+			cancel()
+			<-listener.Done()
+		})
+	}
+}
+
+func TestListenerNacksWithoutDeadLetter(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	var attempts atomic.Int32
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		attempts.Add(1)
+		return errors.New("temporary failure")
+	}
+
+	listener, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(2),
+		queue.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	// The message is never dropped, its redeliveries are bounded by the broker
+	select {
+	case <-msg.Nacked():
+	case <-msg.Acked():
+		t.Fatal("message was acked")
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not nacked")
+	}
+	assert.Equal(t, int32(2), attempts.Load())
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerNacksWithoutRetry(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		return errors.New("temporary failure")
+	}
+
+	listener, err := queue.NewListener(logger, callback)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	select {
+	case <-msg.Nacked():
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not nacked")
+	}
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerNacksPermanentErrorWithoutDeadLetter(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		return queue.Permanent(errors.New("unknown event"))
+	}
+
+	listener, err := queue.NewListener(logger, callback)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	select {
+	case <-msg.Nacked():
+	case <-msg.Acked():
+		t.Fatal("message was acked")
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not nacked")
+	}
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerCountsAttemptsPerDelivery(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 1}, watermill.NopLogger{})
+	t.Cleanup(func() {
+		require.NoError(t, pubSub.Close())
+	})
+	deadLetters, err := pubSub.Subscribe(context.Background(), "dead-letter")
+	require.NoError(t, err)
+
+	var attempts atomic.Int32
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		attempts.Add(1)
+		return errors.New("temporary failure")
+	}
+
+	listener, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(3),
+		queue.WithBackoff(time.Millisecond, time.Millisecond),
+		queue.WithDeadLetter(pubSub, "dead-letter"),
+	)
+	require.NoError(t, err)
+
+	// The metadata of a previous delivery is ignored
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	msg.Metadata[queue.AttemptsMetadataKey] = "2"
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	select {
+	case deadLetter := <-deadLetters:
+		deadLetter.Ack()
+		assert.Equal(t, "3", deadLetter.Metadata[queue.DeadLetterAttemptsMetadataKey])
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not dead-lettered")
+	}
+	assert.Equal(t, int32(3), attempts.Load())
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerRedeliver(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	var attempts atomic.Int32
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		attempts.Add(1)
+		return queue.Redeliver(errors.New("in progress"))
+	}
+
+	listener, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(3),
+		queue.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	// The message is redelivered without retry
+	select {
+	case <-msg.Nacked():
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not nacked")
+	}
+	assert.Equal(t, int32(1), attempts.Load())
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerVisibilityTimeout(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	var attempts atomic.Int32
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		attempts.Add(1)
+		return errors.New("temporary failure")
+	}
+
+	_, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(3),
+		queue.WithBackoff(time.Millisecond, time.Second),
+		queue.WithVisibilityTimeout(time.Second),
+	)
+	require.Error(t, err)
+
+	listener, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(3),
+		queue.WithBackoff(40*time.Millisecond, 40*time.Millisecond),
+		queue.WithCallbackDeadline(20*time.Millisecond),
+		queue.WithVisibilityTimeout(50*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+
+	// The backoff would outlive the visibility timeout, the message is left to the redelivery
+	select {
+	case <-msg.Nacked():
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not nacked")
+	}
+	assert.Equal(t, int32(1), attempts.Load())
+	assert.Equal(t, "1", msg.Metadata[queue.AttemptsMetadataKey])
+
+	cancel()
+	<-listener.Done()
+}
+
+func TestListenerStopInterruptsBackoff(t *testing.T) {
+	logger := logging.NewDefaultLogger(os.Stderr, true, true, false)
+
+	called := make(chan struct{}, 1)
+	callback := func(ctx context.Context, meta map[string]string, msg []byte) error {
+		called <- struct{}{}
+		return errors.New("temporary failure")
+	}
+
+	listener, err := queue.NewListener(logger, callback,
+		queue.WithMaxAttempts(2),
+		queue.WithBackoff(time.Hour, time.Hour),
+	)
+	require.NoError(t, err)
+
+	ch := make(chan *message.Message, 1)
+	msg := message.NewMessage("test-uuid", []byte("test-payload"))
+	ch <- msg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener.Listen(ctx, ch)
+	<-called
+	cancel()
+
+	select {
+	case <-msg.Nacked():
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not nacked on stop")
+	}
+	requireClosed(t, listener.Done())
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("invalid payload")
+	require.Nil(t, queue.Permanent(nil))
+	require.False(t, queue.IsPermanent(err))
+	require.True(t, queue.IsPermanent(queue.Permanent(err)))
+	require.True(t, queue.IsPermanent(fmt.Errorf("wrapped: %w", queue.Permanent(err))))
+	require.ErrorIs(t, queue.Permanent(err), err)
+}
+
 func requireClosed(t *testing.T, ch <-chan struct{}) {
 	t.Helper()
 
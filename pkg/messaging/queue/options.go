@@ -1,11 +1,25 @@
 package queue
 
-import "time"
+import (
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
 
 type ListenerOptions struct {
 	Name             string
 	WorkerCount      int
 	CallbackDeadline time.Duration
+
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	BackoffJitter  float64
+
+	VisibilityTimeout time.Duration
+
+	DeadLetterPublisher message.Publisher
+	DeadLetterTopic     string
 }
 
 // name may appear in logs making debugging easier
@@ -29,3 +43,49 @@ func WithCallbackDeadline(d time.Duration) func(*ListenerOptions) {
 		o.CallbackDeadline = d
 	}
 }
+
+// maximum number of times the callback is called for a single delivery of a message
+// failed attempts are retried in process, the worker waiting for the configured backoff between them
+// messages failing on the last attempt are sent to the dead letter if any, or nacked otherwise
+// defaults to 0, which disables retries: failed messages are nacked and redelivered by the subscriber
+func WithMaxAttempts(n int) func(*ListenerOptions) {
+	return func(o *ListenerOptions) {
+		o.MaxAttempts = n
+	}
+}
+
+// delay before the first retry, doubled on each following retry up to max
+// defaults to 100ms and 10s
+func WithBackoff(initial, max time.Duration) func(*ListenerOptions) {
+	return func(o *ListenerOptions) {
+		o.InitialBackoff = initial
+		o.MaxBackoff = max
+	}
+}
+
+// visibility timeout of the queue, after which a message being processed is delivered again
+// in-process retries stop before it expires, leaving the message to the redelivery, and the max backoff must be below it
+// defaults to 0, for queues without visibility timeout
+func WithVisibilityTimeout(d time.Duration) func(*ListenerOptions) {
+	return func(o *ListenerOptions) {
+		o.VisibilityTimeout = d
+	}
+}
+
+// randomization factor applied to the backoff, between 0 and 1
+// a factor of 0.2 gives delays between 80% and 120% of the computed backoff, defaults to 0.2
+func WithBackoffJitter(jitter float64) func(*ListenerOptions) {
+	return func(o *ListenerOptions) {
+		o.BackoffJitter = jitter
+	}
+}
+
+// publisher and topic receiving messages which failed on the last attempt or with a permanent error
+// the error and the attempt count are added to the message metadata, see DeadLetterErrorMetadataKey
+// without dead letter, such messages are nacked, and their redeliveries have to be bounded by the broker
+func WithDeadLetter(publisher message.Publisher, topic string) func(*ListenerOptions) {
+	return func(o *ListenerOptions) {
+		o.DeadLetterPublisher = publisher
+		o.DeadLetterTopic = topic
+	}
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// AttemptsMetadataKey holds the number of attempts made to process a message during its current delivery, including the current one
+const AttemptsMetadataKey = "queue-attempts"
+
+const (
+	// DeadLetterErrorMetadataKey holds the error returned by the last attempt
+	DeadLetterErrorMetadataKey = "dead-letter-error"
+	// DeadLetterAttemptsMetadataKey holds the number of attempts made before dead-lettering the message
+	DeadLetterAttemptsMetadataKey = "dead-letter-attempts"
+	// DeadLetterListenerMetadataKey holds the name of the listener which dead-lettered the message
+	DeadLetterListenerMetadataKey = "dead-letter-listener"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+	defaultBackoffJitter  = 0.2
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error returned by a CallbackFn as not retryable:
+// the message is dead-lettered on the first failure.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether any error in err's chain has been marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+type redeliverError struct {
+	err error
+}
+
+func (e *redeliverError) Error() string {
+	return e.err.Error()
+}
+
+func (e *redeliverError) Unwrap() error {
+	return e.err
+}
+
+// Redeliver marks an error returned by a CallbackFn as a request to process the message later,
+// for example because another worker is processing it:
+// the message is nacked right away, without counting the attempt nor retrying it in process.
+func Redeliver(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redeliverError{err: err}
+}
+
+// IsRedeliver reports whether any error in err's chain has been marked with Redeliver.
+func IsRedeliver(err error) bool {
+	var redeliver *redeliverError
+	return errors.As(err, &redeliver)
+}
+
+// backoff returns the delay to wait after the given attempt (starting at 1).
+// The delay doubles on each attempt up to maxBackoff, and is randomized by +/- jitter.
+func (l *listener) backoff(attempt int) time.Duration {
+	delay := l.initialBackoff
+	for i := 1; i < attempt && delay < l.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > l.maxBackoff {
+		delay = l.maxBackoff
+	}
+	if l.backoffJitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * l.backoffJitter * float64(delay))
+	}
+	return delay
+}
+
+// wait blocks for the given delay, and returns false if the listener is stopped before.
+func (l *listener) wait(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (l *listener) deadLetter(ctx context.Context, msg *message.Message, attempts int, err error) error {
+	dlMsg := message.NewMessage(msg.UUID, msg.Payload)
+	for k, v := range msg.Metadata {
+		dlMsg.Metadata[k] = v
+	}
+	dlMsg.Metadata[DeadLetterErrorMetadataKey] = err.Error()
+	dlMsg.Metadata[DeadLetterAttemptsMetadataKey] = strconv.Itoa(attempts)
+	if l.name != "" {
+		dlMsg.Metadata[DeadLetterListenerMetadataKey] = l.name
+	}
+	dlMsg.SetContext(ctx)
+
+	if err := l.deadLetterPublisher.Publish(l.deadLetterTopic, dlMsg); err != nil {
+		return fmt.Errorf("publishing message to dead letter topic %s: %w", l.deadLetterTopic, err)
+	}
+	return nil
+}
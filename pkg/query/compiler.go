@@ -0,0 +1,390 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+type FieldType string
+
+const (
+	FieldTypeString  FieldType = "string"
+	FieldTypeNumeric FieldType = "numeric"
+	FieldTypeBoolean FieldType = "boolean"
+	FieldTypeDate    FieldType = "date"
+	// FieldTypeMap is a JSON object of string values (like metadata), queried with `name[key]`.
+	FieldTypeMap FieldType = "map"
+	// FieldTypeArray is a JSON array, queried with $contains.
+	FieldTypeArray FieldType = "array"
+)
+
+var defaultOperators = map[FieldType][]string{
+	FieldTypeString:  {"$match", "$ne", "$like", "$ilike", "$startsWith", "$regex", "$in", "$nin", "$exists"},
+	FieldTypeNumeric: {"$match", "$ne", "$gt", "$gte", "$lt", "$lte", "$between", "$in", "$nin", "$exists"},
+	FieldTypeBoolean: {"$match", "$ne", "$exists"},
+	FieldTypeDate:    {"$match", "$ne", "$gt", "$gte", "$lt", "$lte", "$between", "$in", "$nin", "$exists"},
+	FieldTypeMap:     {"$match", "$ne", "$like", "$ilike", "$startsWith", "$regex", "$in", "$nin", "$exists", "$contains"},
+	FieldTypeArray:   {"$contains", "$exists"},
+}
+
+// Field declares a key accepted by a Compiler.
+type Field struct {
+	// Name is the key used in query expressions.
+	Name string
+	// Column is the SQL column, defaults to Name.
+	Column string
+	Type   FieldType
+	// JSONPath targets a value nested inside a JSON column.
+	JSONPath []string
+	// Operators restricts the accepted operators, defaults to every operator supported by Type.
+	Operators []string
+}
+
+var mapKeyRegexp = regexp.MustCompile(`^([^\[\]]+)\[(.+)]$`)
+
+// Compiler is a Context translating expressions on a registry of fields to parameterized SQL.
+// Keys, operators and values are all checked against the registry, so expressions coming
+// from clients can be compiled safely.
+type Compiler struct {
+	dialect Dialect
+	fields  map[string]Field
+}
+
+var _ Context = (*Compiler)(nil)
+
+func NewCompiler(dialect Dialect, fields ...Field) (*Compiler, error) {
+	ret := &Compiler{
+		dialect: dialect,
+		fields:  make(map[string]Field, len(fields)),
+	}
+	for _, field := range fields {
+		if field.Name == "" {
+			return nil, errors.New("field name is required")
+		}
+		if _, ok := ret.fields[field.Name]; ok {
+			return nil, fmt.Errorf("duplicate field %q", field.Name)
+		}
+		operators, ok := defaultOperators[field.Type]
+		if !ok {
+			return nil, fmt.Errorf("field %q: unknown type %q", field.Name, field.Type)
+		}
+		for _, operator := range field.Operators {
+			if !slices.Contains(operators, operator) {
+				return nil, fmt.Errorf("field %q: operator %s is not supported on type %s", field.Name, operator, field.Type)
+			}
+		}
+		if field.Operators == nil {
+			field.Operators = operators
+		}
+		if field.Column == "" {
+			field.Column = field.Name
+		}
+		ret.fields[field.Name] = field
+	}
+
+	return ret, nil
+}
+
+func (c *Compiler) resolve(key string) (Field, string, error) {
+	if field, ok := c.fields[key]; ok {
+		return field, "", nil
+	}
+	if matches := mapKeyRegexp.FindStringSubmatch(key); matches != nil {
+		if field, ok := c.fields[matches[1]]; ok && field.Type == FieldTypeMap {
+			return field, matches[2], nil
+		}
+	}
+	return Field{}, "", ErrUnknownField{Key: key}
+}
+
+func (c *Compiler) BuildMatcher(key, operator string, value any) (string, []any, error) {
+	field, subKey, err := c.resolve(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if !slices.Contains(field.Operators, operator) {
+		return "", nil, ErrOperatorNotAllowed{Key: key, Operator: operator}
+	}
+
+	invalidValue := func(expected string) error {
+		return ErrInvalidValue{Key: key, Operator: operator, Expected: expected, Value: value}
+	}
+
+	switch field.Type {
+	case FieldTypeMap:
+		return c.buildMapMatcher(field, subKey, operator, value, invalidValue)
+	case FieldTypeArray:
+		column, columnArgs := c.column(field)
+		if operator == "$exists" {
+			exists, ok := value.(bool)
+			if !ok {
+				return "", nil, invalidValue("boolean")
+			}
+			return isNull(column, !exists), columnArgs, nil
+		}
+		if reflect.ValueOf(value).Kind() != reflect.Slice {
+			return "", nil, invalidValue("array")
+		}
+		return c.contains(field, value)
+	}
+
+	column, columnArgs := c.column(field)
+	return c.buildScalarMatcher(field.Type, column, columnArgs, operator, value, invalidValue)
+}
+
+func (c *Compiler) buildScalarMatcher(fieldType FieldType, column string, columnArgs []any, operator string, value any, invalidValue func(string) error) (string, []any, error) {
+	switch operator {
+	case "$exists":
+		exists, ok := value.(bool)
+		if !ok {
+			return "", nil, invalidValue("boolean")
+		}
+		return isNull(column, !exists), columnArgs, nil
+	case "$in", "$nin":
+		values, ok := convertSlice(fieldType, value)
+		if !ok {
+			return "", nil, invalidValue("array of " + string(fieldType))
+		}
+		return in(column, columnArgs, values, operator == "$nin")
+	case "$between":
+		values, ok := convertSlice(fieldType, value)
+		if !ok || len(values) != 2 {
+			return "", nil, invalidValue("array of two " + string(fieldType))
+		}
+		return column + " BETWEEN ? AND ?", append(columnArgs, values...), nil
+	case "$match", "$ne":
+		if value == nil {
+			return isNull(column, operator == "$match"), columnArgs, nil
+		}
+	case "$startsWith":
+		prefix, ok := value.(string)
+		if !ok {
+			return "", nil, invalidValue(string(FieldTypeString))
+		}
+		return column + " LIKE ?", append(columnArgs, likeEscaper.Replace(prefix)+"%"), nil
+	}
+
+	v, ok := convertValue(fieldType, value)
+	if !ok {
+		return "", nil, invalidValue(string(fieldType))
+	}
+
+	return fmt.Sprintf("%s %s ?", column, c.dialect.Operator(operator)), append(columnArgs, v), nil
+}
+
+func (c *Compiler) buildMapMatcher(field Field, subKey, operator string, value any, invalidValue func(string) error) (string, []any, error) {
+	column := c.dialect.QuoteIdent(field.Column)
+
+	switch operator {
+	case "$exists":
+		switch value := value.(type) {
+		case bool:
+			if subKey == "" {
+				return "", nil, invalidValue("key name")
+			}
+			expr, args := c.dialect.JSONExtract(column, subPath(field, subKey), false)
+			return isNull(expr, !value), args, nil
+		case string:
+			if subKey != "" {
+				return "", nil, invalidValue("boolean")
+			}
+			expr, args := c.dialect.JSONExtract(column, subPath(field, value), false)
+			return isNull(expr, false), args, nil
+		default:
+			return "", nil, invalidValue("key name or boolean")
+		}
+	case "$contains":
+		if subKey != "" {
+			return "", nil, ErrOperatorNotAllowed{Key: field.Name + "[" + subKey + "]", Operator: operator}
+		}
+		if _, ok := value.(map[string]any); !ok {
+			return "", nil, invalidValue("object")
+		}
+		return c.contains(field, value)
+	}
+
+	if subKey == "" {
+		return "", nil, ErrUnknownField{Key: field.Name}
+	}
+
+	if operator == "$match" && len(field.JSONPath) == 0 {
+		v, ok := value.(string)
+		if !ok {
+			return "", nil, invalidValue(string(FieldTypeString))
+		}
+		// Containment can use a GIN index on the column
+		data, err := json.Marshal(map[string]string{subKey: v})
+		if err != nil {
+			return "", nil, err
+		}
+		return c.dialect.JSONContains(column), []any{string(data)}, nil
+	}
+
+	expr, args := c.dialect.JSONExtract(column, subPath(field, subKey), true)
+	return c.buildScalarMatcher(FieldTypeString, expr, args, operator, value, invalidValue)
+}
+
+func (c *Compiler) contains(field Field, value any) (string, []any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	column := c.dialect.QuoteIdent(field.Column)
+	if len(field.JSONPath) == 0 {
+		return c.dialect.JSONContains(column), []any{string(data)}, nil
+	}
+	expr, args := c.dialect.JSONExtract(column, field.JSONPath, false)
+	return c.dialect.JSONContains(expr), append(args, string(data)), nil
+}
+
+func (c *Compiler) column(field Field) (string, []any) {
+	column := c.dialect.QuoteIdent(field.Column)
+	if len(field.JSONPath) == 0 {
+		return column, nil
+	}
+
+	expr, args := c.dialect.JSONExtract(column, field.JSONPath, true)
+	return c.dialect.Cast(expr, field.Type), args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func isNull(expr string, null bool) string {
+	if null {
+		return expr + " IS NULL"
+	}
+	return expr + " IS NOT NULL"
+}
+
+func in(expr string, args []any, values []any, negate bool) (string, []any, error) {
+	operator := "IN"
+	if negate {
+		operator = "NOT IN"
+	}
+	if len(values) == 0 {
+		if negate {
+			return "1 = 1", nil, nil
+		}
+		return "1 = 0", nil, nil
+	}
+	return fmt.Sprintf("%s %s (%s)", expr, operator, strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")),
+		append(args, values...), nil
+}
+
+func convertSlice(fieldType FieldType, value any) ([]any, bool) {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice {
+		return nil, false
+	}
+	ret := make([]any, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		v, ok := convertValue(fieldType, rv.Index(i).Interface())
+		if !ok {
+			return nil, false
+		}
+		ret = append(ret, v)
+	}
+	return ret, true
+}
+
+func convertValue(fieldType FieldType, value any) (any, bool) {
+	switch fieldType {
+	case FieldTypeString:
+		v, ok := value.(string)
+		return v, ok
+	case FieldTypeBoolean:
+		v, ok := value.(bool)
+		return v, ok
+	case FieldTypeNumeric:
+		switch v := value.(type) {
+		case *big.Int:
+			return v, v != nil
+		case big.Int:
+			return &v, true
+		case int:
+			return big.NewInt(int64(v)), true
+		case int32:
+			return big.NewInt(int64(v)), true
+		case int64:
+			return big.NewInt(v), true
+		case uint64:
+			return new(big.Int).SetUint64(v), true
+		case Decimal:
+			_, err := ParseDecimal(string(v))
+			return v, err == nil
+		case float64:
+			// Rejects NaN and infinities
+			ret, err := ParseDecimal(string(NewDecimal(v)))
+			return ret, err == nil
+		case float32:
+			ret, err := ParseDecimal(string(NewDecimal(float64(v))))
+			return ret, err == nil
+		}
+	case FieldTypeDate:
+		switch v := value.(type) {
+		case Date:
+			return v.Time, true
+		case time.Time:
+			return v, true
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, v)
+			return t, err == nil
+		}
+	}
+	return nil, false
+}
+
+func subPath(field Field, key string) []string {
+	return append(slices.Clone(field.JSONPath), key)
+}
+
+type ErrUnknownField struct {
+	Key string
+}
+
+func (e ErrUnknownField) Error() string {
+	return fmt.Sprintf("unknown key '%s'", e.Key)
+}
+
+func (e ErrUnknownField) Is(err error) bool {
+	_, ok := err.(ErrUnknownField)
+	return ok
+}
+
+type ErrOperatorNotAllowed struct {
+	Key      string
+	Operator string
+}
+
+func (e ErrOperatorNotAllowed) Error() string {
+	return fmt.Sprintf("operator '%s' is not allowed on key '%s'", e.Operator, e.Key)
+}
+
+func (e ErrOperatorNotAllowed) Is(err error) bool {
+	_, ok := err.(ErrOperatorNotAllowed)
+	return ok
+}
+
+type ErrInvalidValue struct {
+	Key      string
+	Operator string
+	Expected string
+	Value    any
+}
+
+func (e ErrInvalidValue) Error() string {
+	return fmt.Sprintf("invalid value for operator '%s' on key '%s': expected %s, got %T", e.Operator, e.Key, e.Expected, e.Value)
+}
+
+func (e ErrInvalidValue) Is(err error) bool {
+	_, ok := err.(ErrInvalidValue)
+	return ok
+}
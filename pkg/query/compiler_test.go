@@ -0,0 +1,313 @@
+package query
+
+import (
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompiler(t *testing.T) {
+	t.Parallel()
+
+	compiler, err := NewCompiler(Postgres,
+		Field{Name: "address", Type: FieldTypeString},
+		Field{Name: "amount", Type: FieldTypeNumeric, Operators: []string{"$match", "$gt", "$lt"}},
+		Field{Name: "reverted", Column: "is_reverted", Type: FieldTypeBoolean},
+		Field{Name: "timestamp", Column: "inserted_at", Type: FieldTypeDate},
+		Field{Name: "metadata", Type: FieldTypeMap},
+		Field{Name: "reference", Column: "data", Type: FieldTypeString, JSONPath: []string{"payment", "reference"}},
+		Field{Name: "total", Column: "data", Type: FieldTypeNumeric, JSONPath: []string{"total"}},
+		Field{Name: "tags", Type: FieldTypeArray},
+	)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Round(time.Microsecond)
+
+	type testCase struct {
+		name          string
+		builder       Builder
+		expectedQuery string
+		expectedArgs  []any
+		expectedError error
+	}
+	testCases := []testCase{
+		{
+			name:          "match string",
+			builder:       Match("address", "world"),
+			expectedQuery: `"address" = ?`,
+			expectedArgs:  []any{"world"},
+		},
+		{
+			name:          "match null",
+			builder:       Match("address", nil),
+			expectedQuery: `"address" IS NULL`,
+			expectedArgs:  []any{},
+		},
+		{
+			name:          "like",
+			builder:       Like("address", "users:%"),
+			expectedQuery: `"address" LIKE ?`,
+			expectedArgs:  []any{"users:%"},
+		},
+		{
+			name:          "in",
+			builder:       In("address", []any{"a", "b"}),
+			expectedQuery: `"address" IN (?, ?)`,
+			expectedArgs:  []any{"a", "b"},
+		},
+		{
+			name:          "empty in",
+			builder:       In("address", []any{}),
+			expectedQuery: `1 = 0`,
+			expectedArgs:  []any{},
+		},
+		{
+			name:          "exists",
+			builder:       Exists("address", false),
+			expectedQuery: `"address" IS NULL`,
+			expectedArgs:  []any{},
+		},
+		{
+			name:          "numeric comparison",
+			builder:       Gt("amount", 100),
+			expectedQuery: `"amount" > ?`,
+			expectedArgs:  []any{big.NewInt(100)},
+		},
+		{
+			name:          "boolean with column",
+			builder:       Match("reverted", true),
+			expectedQuery: `"is_reverted" = ?`,
+			expectedArgs:  []any{true},
+		},
+		{
+			name:          "date",
+			builder:       Lte("timestamp", now.Format(time.RFC3339Nano)),
+			expectedQuery: `"inserted_at" <= ?`,
+			expectedArgs:  []any{now},
+		},
+		{
+			name:          "metadata match",
+			builder:       Match("metadata[foo]", "bar"),
+			expectedQuery: `"metadata" @> ?::jsonb`,
+			expectedArgs:  []any{`{"foo":"bar"}`},
+		},
+		{
+			name:          "metadata exists by name",
+			builder:       Exists("metadata", "foo"),
+			expectedQuery: `("metadata" -> ?) IS NOT NULL`,
+			expectedArgs:  []any{"foo"},
+		},
+		{
+			name:          "metadata exists by key",
+			builder:       Exists("metadata[foo]", false),
+			expectedQuery: `("metadata" -> ?) IS NULL`,
+			expectedArgs:  []any{"foo"},
+		},
+		{
+			name:          "metadata like",
+			builder:       Like("metadata[foo]", "b%"),
+			expectedQuery: `("metadata" ->> ?) LIKE ?`,
+			expectedArgs:  []any{"foo", "b%"},
+		},
+		{
+			name:          "json path",
+			builder:       Match("reference", "ref"),
+			expectedQuery: `("data" -> ? ->> ?) = ?`,
+			expectedArgs:  []any{"payment", "reference", "ref"},
+		},
+		{
+			name:          "operator restricted by registry",
+			builder:       Gte("amount", big.NewInt(10)),
+			expectedError: ErrOperatorNotAllowed{},
+		},
+		{
+			name:          "json path numeric",
+			builder:       Lt("total", big.NewInt(10)),
+			expectedQuery: `(("data" ->> ?))::numeric < ?`,
+			expectedArgs:  []any{"total", big.NewInt(10)},
+		},
+		{
+			name: "nested",
+			builder: And(
+				Match("metadata[foo]", "bar"),
+				Not(Or(Match("address", "world"), Gt("amount", 0))),
+			),
+			expectedQuery: `("metadata" @> ?::jsonb) and (not (("address" = ?) or ("amount" > ?)))`,
+			expectedArgs:  []any{`{"foo":"bar"}`, "world", big.NewInt(0)},
+		},
+		{
+			name:          "ne",
+			builder:       Ne("address", "world"),
+			expectedQuery: `"address" <> ?`,
+			expectedArgs:  []any{"world"},
+		},
+		{
+			name:          "ne null",
+			builder:       Ne("address", nil),
+			expectedQuery: `"address" IS NOT NULL`,
+			expectedArgs:  []any{},
+		},
+		{
+			name:          "nin",
+			builder:       Nin("address", []any{"a", "b"}),
+			expectedQuery: `"address" NOT IN (?, ?)`,
+			expectedArgs:  []any{"a", "b"},
+		},
+		{
+			name:          "empty nin",
+			builder:       Nin("address", []any{}),
+			expectedQuery: `1 = 1`,
+			expectedArgs:  []any{},
+		},
+		{
+			name:          "between dates",
+			builder:       Between("timestamp", NewDate(now), now.Format(time.RFC3339Nano)),
+			expectedQuery: `"inserted_at" BETWEEN ? AND ?`,
+			expectedArgs:  []any{now, now},
+		},
+		{
+			name:          "ilike",
+			builder:       ILike("address", "USERS:%"),
+			expectedQuery: `"address" ILIKE ?`,
+			expectedArgs:  []any{"USERS:%"},
+		},
+		{
+			name:          "starts with",
+			builder:       StartsWith("address", `users_100%`),
+			expectedQuery: `"address" LIKE ?`,
+			expectedArgs:  []any{`users\_100\%%`},
+		},
+		{
+			name:          "regex on metadata",
+			builder:       Regex("metadata[foo]", "^b"),
+			expectedQuery: `("metadata" ->> ?) ~ ?`,
+			expectedArgs:  []any{"foo", "^b"},
+		},
+		{
+			name:          "metadata ne",
+			builder:       Ne("metadata[foo]", "bar"),
+			expectedQuery: `("metadata" ->> ?) <> ?`,
+			expectedArgs:  []any{"foo", "bar"},
+		},
+		{
+			name:          "metadata contains",
+			builder:       Contains("metadata", map[string]any{"foo": "bar"}),
+			expectedQuery: `"metadata" @> ?::jsonb`,
+			expectedArgs:  []any{`{"foo":"bar"}`},
+		},
+		{
+			name:          "array contains",
+			builder:       Contains("tags", []any{"a"}),
+			expectedQuery: `"tags" @> ?::jsonb`,
+			expectedArgs:  []any{`["a"]`},
+		},
+		{
+			name:          "decimal",
+			builder:       Lt("total", Decimal("10.5")),
+			expectedQuery: `(("data" ->> ?))::numeric < ?`,
+			expectedArgs:  []any{"total", Decimal("10.5")},
+		},
+		{
+			name:          "float",
+			builder:       Gt("amount", 0.5),
+			expectedQuery: `"amount" > ?`,
+			expectedArgs:  []any{Decimal("0.5")},
+		},
+		{
+			name:          "NaN",
+			builder:       Gt("amount", math.NaN()),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "infinity",
+			builder:       Gt("amount", math.Inf(1)),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "invalid decimal",
+			builder:       Gt("amount", Decimal("1/3")),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "invalid between",
+			builder:       Between("total", "a", "b"),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "contains on scalar",
+			builder:       Contains("address", []any{"a"}),
+			expectedError: ErrOperatorNotAllowed{},
+		},
+		{
+			name:          "unknown field",
+			builder:       Match("password", "x"),
+			expectedError: ErrUnknownField{},
+		},
+		{
+			name:          "map key on scalar field",
+			builder:       Match("address[foo]", "x"),
+			expectedError: ErrUnknownField{},
+		},
+		{
+			name:          "operator not allowed",
+			builder:       Like("amount", "1%"),
+			expectedError: ErrOperatorNotAllowed{},
+		},
+		{
+			name:          "invalid value type",
+			builder:       Match("address", 10),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "invalid in item",
+			builder:       In("address", []any{"a", true}),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "invalid date",
+			builder:       Gt("timestamp", "yesterday"),
+			expectedError: ErrInvalidValue{},
+		},
+		{
+			name:          "metadata with non string value",
+			builder:       Match("metadata[foo]", big.NewInt(1)),
+			expectedError: ErrInvalidValue{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			query, args, err := tc.builder.Build(compiler)
+			if tc.expectedError != nil {
+				require.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedQuery, query)
+			if len(tc.expectedArgs) == 0 {
+				require.Empty(t, args)
+			} else {
+				require.Equal(t, tc.expectedArgs, args)
+			}
+		})
+	}
+}
+
+func TestNewCompilerErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, fields := range [][]Field{
+		{{Name: ""}},
+		{{Name: "a", Type: FieldTypeString}, {Name: "a", Type: FieldTypeString}},
+		{{Name: "a", Type: "unknown"}},
+		{{Name: "a", Type: FieldTypeBoolean, Operators: []string{"$gt"}}},
+	} {
+		_, err := NewCompiler(Postgres, fields...)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,87 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect renders the SQL fragments the Compiler cannot express in a portable way.
+// Returned fragments use `?` placeholders, as expected by bun.
+type Dialect interface {
+	// QuoteIdent quotes a column name.
+	QuoteIdent(name string) string
+	// JSONExtract returns an expression reading the given path inside a JSON column,
+	// as text if asText is true, or as a JSON value otherwise.
+	JSONExtract(column string, path []string, asText bool) (string, []any)
+	// JSONContains returns an expression checking if a JSON column contains the JSON document
+	// passed as its single argument.
+	JSONContains(column string) string
+	// Operator returns the SQL binary operator for a comparison operator of the DSL.
+	Operator(operator string) string
+	// Cast converts a text expression (as returned by JSONExtract) to the given type.
+	Cast(expr string, fieldType FieldType) string
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) QuoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+func (postgresDialect) JSONExtract(column string, path []string, asText bool) (string, []any) {
+	if len(path) == 0 {
+		return column, nil
+	}
+
+	expr := column
+	args := make([]any, 0, len(path))
+	for i, segment := range path {
+		operator := "->"
+		if asText && i == len(path)-1 {
+			operator = "->>"
+		}
+		expr = fmt.Sprintf("%s %s ?", expr, operator)
+		args = append(args, segment)
+	}
+	return "(" + expr + ")", args
+}
+
+func (postgresDialect) JSONContains(column string) string {
+	return column + " @> ?::jsonb"
+}
+
+var postgresOperators = map[string]string{
+	"$match": "=",
+	"$ne":    "<>",
+	"$like":  "LIKE",
+	"$ilike": "ILIKE",
+	"$regex": "~",
+	"$gte":   ">=",
+	"$gt":    ">",
+	"$lte":   "<=",
+	"$lt":    "<",
+}
+
+func (postgresDialect) Operator(operator string) string {
+	return postgresOperators[operator]
+}
+
+func (postgresDialect) Cast(expr string, fieldType FieldType) string {
+	switch fieldType {
+	case FieldTypeNumeric:
+		return "(" + expr + ")::numeric"
+	case FieldTypeBoolean:
+		return "(" + expr + ")::boolean"
+	case FieldTypeDate:
+		return "(" + expr + ")::timestamp"
+	default:
+		return expr
+	}
+}
+
+// Postgres is the Dialect for PostgreSQL.
+var Postgres Dialect = postgresDialect{}
@@ -0,0 +1,646 @@
+package query
+
+import (
+	"container/list"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// truth is a SQL boolean: comparisons involving NULL are unknown,
+// and unknown is propagated by `and`, `or` and `not` like in SQL.
+type truth int8
+
+const (
+	truthFalse truth = iota
+	truthTrue
+	truthUnknown
+)
+
+func truthOf(v bool) truth {
+	if v {
+		return truthTrue
+	}
+	return truthFalse
+}
+
+func (t truth) not() truth {
+	switch t {
+	case truthTrue:
+		return truthFalse
+	case truthFalse:
+		return truthTrue
+	default:
+		return truthUnknown
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Evaluator evaluates expressions against Go values instead of compiling them to SQL.
+// Keys are resolved on maps with string keys (like metadata.Metadata) and on structs, using the
+// configured tag (`json` by default). Nested values are reached with dots (`account.address`)
+// and map entries with brackets (`metadata[foo]`).
+//
+// Operators follow the SQL semantics: a missing or nil value is NULL, and an expression
+// evaluating to NULL does not match, even when negated.
+type Evaluator struct {
+	tag      string
+	patterns *patternCache
+}
+
+type EvaluatorOption func(*Evaluator)
+
+// WithTag configures the struct tag used to resolve keys on structs.
+func WithTag(tag string) EvaluatorOption {
+	return func(e *Evaluator) {
+		e.tag = tag
+	}
+}
+
+// WithPatternCacheSize configures how many compiled LIKE and regex patterns are kept, the least recently used being evicted.
+// A size of zero compiles the patterns on each evaluation.
+func WithPatternCacheSize(size int) EvaluatorOption {
+	return func(e *Evaluator) {
+		e.patterns = newPatternCache(size)
+	}
+}
+
+var defaultEvaluatorOptions = []EvaluatorOption{
+	WithTag("json"),
+	WithPatternCacheSize(256),
+}
+
+func NewEvaluator(opts ...EvaluatorOption) *Evaluator {
+	ret := &Evaluator{}
+	for _, opt := range append(defaultEvaluatorOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+var defaultEvaluator = NewEvaluator()
+
+// Evaluate reports whether target matches the expression, using the default Evaluator.
+func Evaluate(builder Builder, target any) (bool, error) {
+	return defaultEvaluator.Evaluate(builder, target)
+}
+
+// Evaluate reports whether target matches the expression.
+// A nil expression matches everything.
+func (e *Evaluator) Evaluate(builder Builder, target any) (bool, error) {
+	if builder == nil {
+		return true, nil
+	}
+	ret, err := e.evaluate(builder, reflect.ValueOf(target))
+	if err != nil {
+		return false, err
+	}
+	return ret == truthTrue, nil
+}
+
+func (e *Evaluator) evaluate(builder Builder, target reflect.Value) (truth, error) {
+	switch builder := builder.(type) {
+	case *set:
+		// An empty set matches everything, with both operators, as it is built to `1 = 1`
+		if len(builder.items) == 0 {
+			return truthTrue, nil
+		}
+
+		ret := truthOf(builder.operator == "and")
+		for _, item := range builder.items {
+			v, err := e.evaluate(item, target)
+			if err != nil {
+				return truthFalse, err
+			}
+			switch {
+			case builder.operator == "and" && v == truthFalse, builder.operator == "or" && v == truthTrue:
+				return v, nil
+			case v == truthUnknown:
+				ret = truthUnknown
+			}
+		}
+		return ret, nil
+	case *not:
+		v, err := e.evaluate(builder.expression, target)
+		if err != nil {
+			return truthFalse, err
+		}
+		return v.not(), nil
+	case *keyValue:
+		return e.evaluateKeyValue(builder, target)
+	default:
+		return truthFalse, fmt.Errorf("unexpected expression type %T", builder)
+	}
+}
+
+func (e *Evaluator) evaluateKeyValue(kv *keyValue, target reflect.Value) (truth, error) {
+	invalidValue := func(expected string) error {
+		return ErrInvalidValue{Key: kv.key, Operator: kv.operator, Expected: expected, Value: kv.value}
+	}
+
+	path, subKey := kv.key, ""
+	if matches := mapKeyRegexp.FindStringSubmatch(kv.key); matches != nil {
+		path, subKey = matches[1], matches[2]
+	}
+
+	found, err := e.lookup(target, path, kv.key)
+	if err != nil {
+		return truthFalse, err
+	}
+
+	if kv.operator == "$exists" {
+		if name, ok := kv.value.(string); ok && subKey == "" {
+			_, exists := mapEntry(found, name)
+			return truthOf(exists), nil
+		}
+	}
+
+	if subKey != "" {
+		var exists bool
+		found, exists = mapEntry(found, subKey)
+		// Like the Compiler, which uses JSON containment for this case
+		if !exists && kv.operator == "$match" && kv.value != nil {
+			return truthFalse, nil
+		}
+	}
+
+	value := normalize(found)
+
+	switch kv.operator {
+	case "$exists":
+		exists, ok := kv.value.(bool)
+		if !ok {
+			return truthFalse, invalidValue("boolean")
+		}
+		return truthOf((value != nil) == exists), nil
+	case "$match", "$ne":
+		if kv.value == nil {
+			return truthOf((value == nil) == (kv.operator == "$match")), nil
+		}
+	case "$contains":
+		if value == nil {
+			return truthUnknown, nil
+		}
+		return truthOf(contains(value, normalize(kv.value))), nil
+	case "$in", "$nin":
+		return e.in(kv, value, invalidValue)
+	}
+
+	if value == nil {
+		return truthUnknown, nil
+	}
+
+	switch kv.operator {
+	case "$like", "$ilike", "$regex", "$startsWith":
+		pattern, ok := kv.value.(string)
+		if !ok {
+			return truthFalse, invalidValue("string")
+		}
+		s, ok := value.(string)
+		if !ok {
+			return truthFalse, invalidValue("a pattern applicable to " + typeName(value))
+		}
+		if kv.operator == "$startsWith" {
+			return truthOf(strings.HasPrefix(s, pattern)), nil
+		}
+		re, err := e.pattern(kv.operator, pattern)
+		if err != nil {
+			return truthFalse, invalidValue("valid pattern")
+		}
+		return truthOf(re.MatchString(s)), nil
+	case "$between":
+		bounds, ok := kv.value.([]any)
+		if !ok || len(bounds) != 2 {
+			return truthFalse, invalidValue("array of two " + typeName(value))
+		}
+		low, err := compare(value, normalize(bounds[0]))
+		if err != nil {
+			return truthFalse, invalidValue(typeName(value))
+		}
+		high, err := compare(value, normalize(bounds[1]))
+		if err != nil {
+			return truthFalse, invalidValue(typeName(value))
+		}
+		return truthOf(low >= 0 && high <= 0), nil
+	}
+
+	cmp, err := compare(value, normalize(kv.value))
+	if err != nil {
+		return truthFalse, invalidValue(typeName(value))
+	}
+	switch kv.operator {
+	case "$match":
+		return truthOf(cmp == 0), nil
+	case "$ne":
+		return truthOf(cmp != 0), nil
+	case "$gt":
+		return truthOf(cmp > 0), nil
+	case "$gte":
+		return truthOf(cmp >= 0), nil
+	case "$lt":
+		return truthOf(cmp < 0), nil
+	case "$lte":
+		return truthOf(cmp <= 0), nil
+	default:
+		return truthFalse, fmt.Errorf("unexpected operator %s", kv.operator)
+	}
+}
+
+func (e *Evaluator) in(kv *keyValue, value any, invalidValue func(string) error) (truth, error) {
+	rv := reflect.ValueOf(kv.value)
+	if rv.Kind() != reflect.Slice {
+		return truthFalse, invalidValue("array")
+	}
+	// Like the Compiler, which renders empty lists as constants
+	if rv.Len() == 0 {
+		return truthOf(kv.operator == "$nin"), nil
+	}
+
+	ret := truthFalse
+	if value == nil {
+		ret = truthUnknown
+	}
+	for i := 0; i < rv.Len() && value != nil; i++ {
+		item := normalize(rv.Index(i).Interface())
+		if item == nil {
+			ret = truthUnknown
+			continue
+		}
+		cmp, err := compare(value, item)
+		if err != nil {
+			return truthFalse, invalidValue("array of " + typeName(value))
+		}
+		if cmp == 0 {
+			ret = truthTrue
+			break
+		}
+	}
+
+	if kv.operator == "$nin" {
+		return ret.not(), nil
+	}
+	return ret, nil
+}
+
+func (e *Evaluator) pattern(operator, pattern string) (*regexp.Regexp, error) {
+	cacheKey := operator + ":" + pattern
+	if re, ok := e.patterns.get(cacheKey); ok {
+		return re, nil
+	}
+
+	expr := pattern
+	switch operator {
+	case "$like":
+		expr = likeToRegexp(pattern)
+	case "$ilike":
+		expr = "(?i)" + likeToRegexp(pattern)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	e.patterns.add(cacheKey, re)
+
+	return re, nil
+}
+
+// patternCache is a least recently used cache of compiled patterns, as the patterns come from user input
+type patternCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type patternCacheEntry struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func newPatternCache(size int) *patternCache {
+	return &patternCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *patternCache) get(key string) (*regexp.Regexp, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*patternCacheEntry).re, true
+}
+
+func (c *patternCache) add(key string, re *regexp.Regexp) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&patternCacheEntry{key: key, re: re})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*patternCacheEntry).key)
+	}
+}
+
+// likeToRegexp converts a LIKE pattern, where `%` matches any sequence, `_` any character
+// and `\` escapes the next character.
+func likeToRegexp(pattern string) string {
+	ret := strings.Builder{}
+	ret.WriteString("(?s)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			ret.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			ret.WriteString(".*")
+		case r == '_':
+			ret.WriteString(".")
+		default:
+			ret.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	ret.WriteString("$")
+	return ret.String()
+}
+
+// lookup resolves a dotted path on target.
+// A missing map entry or a nil pointer is returned as an invalid value, ie. NULL.
+func (e *Evaluator) lookup(target reflect.Value, path, key string) (reflect.Value, error) {
+	for _, segment := range strings.Split(path, ".") {
+		target = indirect(target)
+		if !target.IsValid() {
+			return target, nil
+		}
+		switch target.Kind() {
+		case reflect.Map:
+			target, _ = mapEntry(target, segment)
+		case reflect.Struct:
+			field, ok := e.structField(target, segment)
+			if !ok {
+				return reflect.Value{}, ErrUnknownField{Key: key}
+			}
+			target = field
+		default:
+			return reflect.Value{}, ErrUnknownField{Key: key}
+		}
+	}
+	return target, nil
+}
+
+func (e *Evaluator) structField(target reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tagName, _, _ := strings.Cut(field.Tag.Get(e.tag), ",")
+		if tagName == "-" {
+			continue
+		}
+		if field.Anonymous && tagName == "" {
+			embedded := indirect(target.Field(i))
+			if embedded.IsValid() && embedded.Kind() == reflect.Struct {
+				if ret, ok := e.structField(embedded, name); ok {
+					return ret, true
+				}
+			}
+			continue
+		}
+		if tagName == name || (tagName == "" && strings.EqualFold(field.Name, name)) {
+			return target.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func mapEntry(target reflect.Value, key string) (reflect.Value, bool) {
+	target = indirect(target)
+	if !target.IsValid() || target.Kind() != reflect.Map || target.Type().Key().Kind() != reflect.String {
+		return reflect.Value{}, false
+	}
+	ret := target.MapIndex(reflect.ValueOf(key).Convert(target.Type().Key()))
+	return ret, ret.IsValid()
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// normalize converts a value to one of nil, string, bool, *big.Rat, time.Time,
+// []any and map[string]any, so values of different Go types can be compared.
+func normalize(v any) any {
+	rv, ok := v.(reflect.Value)
+	if !ok {
+		rv = reflect.ValueOf(v)
+	}
+	rv = indirect(rv)
+	if !rv.IsValid() || !rv.CanInterface() {
+		return nil
+	}
+
+	switch v := rv.Interface().(type) {
+	case big.Int:
+		return new(big.Rat).SetInt(&v)
+	case Decimal:
+		return v.Rat()
+	case json.Number:
+		if ret, ok := new(big.Rat).SetString(v.String()); ok {
+			return ret
+		}
+		return v.String()
+	case time.Time:
+		return v
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Rat).SetInt64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Rat).SetUint64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		if ret := new(big.Rat).SetFloat64(rv.Float()); ret != nil {
+			return ret
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		ret := make([]any, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			ret = append(ret, normalize(rv.Index(i)))
+		}
+		return ret
+	case reflect.Map:
+		if rv.IsNil() || rv.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		ret := make(map[string]any, rv.Len())
+		for iter := rv.MapRange(); iter.Next(); {
+			ret[iter.Key().String()] = normalize(iter.Value())
+		}
+		return ret
+	case reflect.Struct:
+		// Wrappers of time.Time, like Date or time.Time of the types package
+		if rv.NumField() > 0 && rv.Type().Field(0).Anonymous && rv.Type().Field(0).Type == timeType {
+			return rv.Field(0).Interface()
+		}
+	}
+
+	if valuer, ok := rv.Interface().(driver.Valuer); ok {
+		if v, err := valuer.Value(); err == nil {
+			return normalize(v)
+		}
+	}
+
+	return rv.Interface()
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return string(FieldTypeString)
+	case bool:
+		return string(FieldTypeBoolean)
+	case *big.Rat:
+		return string(FieldTypeNumeric)
+	case time.Time:
+		return string(FieldTypeDate)
+	case []any:
+		return string(FieldTypeArray)
+	case map[string]any:
+		return string(FieldTypeMap)
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// compare compares two normalized values of the same type.
+// Strings are compared to dates by parsing them, like Postgres does with date literals.
+func compare(a, b any) (int, error) {
+	switch a := a.(type) {
+	case string:
+		switch b := b.(type) {
+		case string:
+			return strings.Compare(a, b), nil
+		case time.Time:
+			t, err := time.Parse(time.RFC3339Nano, a)
+			if err != nil {
+				return 0, err
+			}
+			return t.Compare(b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, nil
+			case b:
+				return -1, nil
+			default:
+				return 1, nil
+			}
+		}
+	case *big.Rat:
+		if b, ok := b.(*big.Rat); ok {
+			return a.Cmp(b), nil
+		}
+	case time.Time:
+		switch b := b.(type) {
+		case time.Time:
+			return a.Compare(b), nil
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, b)
+			if err != nil {
+				return 0, err
+			}
+			return a.Compare(t), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
+
+// contains follows the Postgres JSON containment (`@>`) rules.
+func contains(container, contained any) bool {
+	switch contained := contained.(type) {
+	case map[string]any:
+		container, ok := container.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, value := range contained {
+			v, ok := container[key]
+			if !ok || !contains(v, value) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		container, ok := container.([]any)
+		if !ok {
+			return false
+		}
+		for _, value := range contained {
+			found := false
+			for _, v := range container {
+				if contains(v, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case nil:
+		return container == nil
+	default:
+		if _, ok := container.([]any); ok {
+			// A scalar is contained by an array holding it
+			return contains(container, []any{contained})
+		}
+		cmp, err := compare(container, contained)
+		return err == nil && cmp == 0
+	}
+}
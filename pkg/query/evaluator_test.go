@@ -0,0 +1,192 @@
+package query
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/formancehq/go-libs/v5/pkg/types/metadata"
+	libtime "github.com/formancehq/go-libs/v5/pkg/types/time"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+
+	type Posting struct {
+		Source string   `json:"source"`
+		Amount *big.Int `json:"amount"`
+	}
+	type Base struct {
+		ID uint64 `json:"id"`
+	}
+	type Transaction struct {
+		Base
+		Reference  *string           `json:"reference,omitempty"`
+		Posting    Posting           `json:"posting"`
+		Metadata   metadata.Metadata `json:"metadata"`
+		Timestamp  libtime.Time      `json:"timestamp"`
+		Reverted   bool              `json:"reverted"`
+		Tags       []string          `json:"tags"`
+		Rate       float64           `json:"rate"`
+		Secret     string            `json:"-"`
+		Untagged   string
+		unexported string
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tx := Transaction{
+		Base:      Base{ID: 1},
+		Posting:   Posting{Source: "users:001", Amount: big.NewInt(100)},
+		Metadata:  metadata.Metadata{"foo": "bar", "under_score": "100%"},
+		Timestamp: libtime.New(now),
+		Tags:      []string{"a", "b"},
+		Rate:      0.5,
+		Untagged:  "value",
+	}
+
+	type testCase struct {
+		name          string
+		builder       Builder
+		target        any
+		expected      bool
+		expectedError error
+	}
+	testCases := []testCase{
+		{name: "nil expression", builder: nil, target: tx, expected: true},
+		{name: "embedded field", builder: Match("id", 1), target: tx, expected: true},
+		{name: "nested field", builder: Match("posting.source", "users:001"), target: &tx, expected: true},
+		{name: "big int", builder: Gt("posting.amount", big.NewInt(99)), target: tx, expected: true},
+		{name: "big int and decimal", builder: Lt("posting.amount", Decimal("100.5")), target: tx, expected: true},
+		{name: "float", builder: Match("rate", Decimal("0.5")), target: tx, expected: true},
+		{name: "between", builder: Between("posting.amount", 100, 200), target: tx, expected: true},
+		{name: "not between", builder: Between("posting.amount", 101, 200), target: tx, expected: false},
+		{name: "metadata", builder: Match("metadata[foo]", "bar"), target: tx, expected: true},
+		{name: "missing metadata", builder: Match("metadata[baz]", "bar"), target: tx, expected: false},
+		{name: "negated missing metadata", builder: Not(Match("metadata[baz]", "bar")), target: tx, expected: true},
+		{name: "metadata exists by name", builder: Exists("metadata", "foo"), target: tx, expected: true},
+		{name: "metadata exists by key", builder: Exists("metadata[baz]", false), target: tx, expected: true},
+		{name: "like", builder: Like("posting.source", "users:%"), target: tx, expected: true},
+		{name: "like single character", builder: Like("posting.source", "users:00_"), target: tx, expected: true},
+		{name: "like is anchored", builder: Like("posting.source", "users"), target: tx, expected: false},
+		{name: "like is case sensitive", builder: Like("posting.source", "USERS:%"), target: tx, expected: false},
+		{name: "like escape", builder: Like("metadata[under_score]", `100\%`), target: tx, expected: true},
+		{name: "like escape mismatch", builder: Like("metadata[foo]", `b\%`), target: tx, expected: false},
+		{name: "like regexp characters", builder: Like("posting.source", "users.001"), target: tx, expected: false},
+		{name: "ilike", builder: ILike("posting.source", "USERS:%"), target: tx, expected: true},
+		{name: "starts with", builder: StartsWith("metadata[under_score]", "100%"), target: tx, expected: true},
+		{name: "regex", builder: Regex("posting.source", "^users:[0-9]+$"), target: tx, expected: true},
+		{name: "ne", builder: Ne("posting.source", "world"), target: tx, expected: true},
+		{name: "in", builder: In("posting.source", []any{"world", "users:001"}), target: tx, expected: true},
+		{name: "nin", builder: Nin("posting.source", []any{"world"}), target: tx, expected: true},
+		{name: "in with null", builder: Not(In("posting.source", []any{"world", nil})), target: tx, expected: false},
+		{name: "empty nin", builder: Nin("reference", []any{}), target: tx, expected: true},
+		{name: "date", builder: Gte("timestamp", NewDate(now)), target: tx, expected: true},
+		{name: "date as string", builder: Lt("timestamp", "2024-01-02T00:00:00Z"), target: tx, expected: true},
+		{name: "boolean", builder: Match("reverted", false), target: tx, expected: true},
+		{name: "array contains", builder: Contains("tags", []any{"b"}), target: tx, expected: true},
+		{name: "array not contains", builder: Contains("tags", []any{"b", "c"}), target: tx, expected: false},
+		{name: "metadata contains", builder: Contains("metadata", map[string]any{"foo": "bar"}), target: tx, expected: true},
+		{name: "null is null", builder: Match("reference", nil), target: tx, expected: true},
+		{name: "null exists", builder: Exists("reference", true), target: tx, expected: false},
+		{name: "null comparison", builder: Match("reference", "ref"), target: tx, expected: false},
+		{name: "negated null comparison", builder: Not(Match("reference", "ref")), target: tx, expected: false},
+		{name: "null in or", builder: Or(Match("reference", "ref"), Match("reverted", false)), target: tx, expected: true},
+		{name: "null in and", builder: Not(And(Match("reference", "ref"), Match("reverted", true))), target: tx, expected: true},
+		{name: "untagged field", builder: Match("untagged", "value"), target: tx, expected: true},
+		{name: "map target", builder: And(Match("a", "b"), Gt("n", 1)), target: map[string]any{"a": "b", "n": 2}, expected: true},
+		{name: "nested map target", builder: Match("account.address", "world"), target: map[string]any{"account": map[string]any{"address": "world"}}, expected: true},
+		{name: "metadata target", builder: Match("foo", "bar"), target: metadata.Metadata{"foo": "bar"}, expected: true},
+		{name: "parsed expression", builder: mustParseText(t, `posting.amount > 10 and not exists(reference)`), target: tx, expected: true},
+		{name: "ignored field", builder: Match("secret", "x"), target: tx, expectedError: ErrUnknownField{}},
+		{name: "unexported field", builder: Match("unexported", "x"), target: tx, expectedError: ErrUnknownField{}},
+		{name: "unknown field", builder: Match("unknown", "x"), target: tx, expectedError: ErrUnknownField{}},
+		{name: "type mismatch", builder: Gt("posting.source", 10), target: tx, expectedError: ErrInvalidValue{}},
+		{name: "like on number", builder: Like("posting.amount", "1%"), target: tx, expectedError: ErrInvalidValue{}},
+		{name: "invalid regex", builder: Regex("posting.source", "("), target: tx, expectedError: ErrInvalidValue{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ret, err := Evaluate(tc.builder, tc.target)
+			if tc.expectedError != nil {
+				require.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ret)
+		})
+	}
+}
+
+func TestEvaluateWithTag(t *testing.T) {
+	t.Parallel()
+
+	type Account struct {
+		Address string `bun:"address" json:"addr"`
+	}
+
+	ret, err := NewEvaluator(WithTag("bun")).Evaluate(Match("address", "world"), Account{Address: "world"})
+	require.NoError(t, err)
+	require.True(t, ret)
+}
+
+func TestEvaluateEmptySets(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		json          string
+		expectedQuery string
+		expected      bool
+	}
+	// The evaluator must agree with the SQL built from the expression
+	for _, tc := range []testCase{
+		{json: `{"$and": []}`, expectedQuery: "1 = 1", expected: true},
+		{json: `{"$or": []}`, expectedQuery: "1 = 1", expected: true},
+		{json: `{"$not": {"$or": []}}`, expectedQuery: "not (1 = 1)", expected: false},
+		{json: `{"$or": [{"$match": {"a": "c"}}, {"$or": []}]}`, expectedQuery: "(a = ?) or (1 = 1)", expected: true},
+	} {
+		builder, err := ParseJSON(tc.json)
+		require.NoError(t, err)
+
+		query, _, err := builder.Build(ContextFn(func(key, operator string, value any) (string, []any, error) {
+			return fmt.Sprintf("%s %s ?", key, DefaultComparisonOperatorsMapping[operator]), []any{value}, nil
+		}))
+		require.NoError(t, err)
+		require.Equal(t, tc.expectedQuery, query, tc.json)
+
+		ret, err := Evaluate(builder, map[string]any{"a": "b"})
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, ret, tc.json)
+	}
+}
+
+func TestEvaluatePatternCache(t *testing.T) {
+	t.Parallel()
+
+	evaluator := NewEvaluator(WithPatternCacheSize(2))
+	for _, pattern := range []string{"a%", "b%", "a%", "c%"} {
+		_, err := evaluator.Evaluate(Like("name", pattern), map[string]any{"name": "abc"})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, evaluator.patterns.order.Len())
+	_, ok := evaluator.patterns.get("$like:b%")
+	require.False(t, ok)
+	_, ok = evaluator.patterns.get("$like:a%")
+	require.True(t, ok)
+
+	evaluator = NewEvaluator(WithPatternCacheSize(0))
+	ret, err := evaluator.Evaluate(Like("name", "a%"), map[string]any{"name": "abc"})
+	require.NoError(t, err)
+	require.True(t, ret)
+	require.Zero(t, evaluator.patterns.order.Len())
+}
+
+func mustParseText(t *testing.T, text string) Builder {
+	builder, err := ParseText(text)
+	require.NoError(t, err)
+	return builder
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"math/big"
 	"strings"
 )
 
@@ -204,6 +203,62 @@ func In(key string, value any) *keyValue {
 	}
 }
 
+func Ne(key string, value any) *keyValue {
+	return &keyValue{
+		operator: "$ne",
+		key:      key,
+		value:    value,
+	}
+}
+
+func Nin(key string, value any) *keyValue {
+	return &keyValue{
+		operator: "$nin",
+		key:      key,
+		value:    value,
+	}
+}
+
+func Between(key string, low, high any) *keyValue {
+	return &keyValue{
+		operator: "$between",
+		key:      key,
+		value:    []any{low, high},
+	}
+}
+
+func ILike(key string, value any) *keyValue {
+	return &keyValue{
+		operator: "$ilike",
+		key:      key,
+		value:    value,
+	}
+}
+
+func StartsWith(key string, value any) *keyValue {
+	return &keyValue{
+		operator: "$startsWith",
+		key:      key,
+		value:    value,
+	}
+}
+
+func Contains(key string, value any) *keyValue {
+	return &keyValue{
+		operator: "$contains",
+		key:      key,
+		value:    value,
+	}
+}
+
+func Regex(key string, value any) *keyValue {
+	return &keyValue{
+		operator: "$regex",
+		key:      key,
+		value:    value,
+	}
+}
+
 func singleKey(m map[string]any) (string, any, error) {
 	switch {
 	case len(m) == 0:
@@ -257,6 +312,11 @@ func parseKeyValue(operator string, m any) (keyValue, error) {
 		}
 		kv.key = key
 		kv.value = value
+		if operator == "$between" {
+			if bounds, ok := value.([]any); !ok || len(bounds) != 2 {
+				return kv, fmt.Errorf("expected an array of two bounds")
+			}
+		}
 		return kv, nil
 	default:
 		return kv, fmt.Errorf("unexpected type %T", m)
@@ -290,7 +350,8 @@ func mapMapToExpression(m map[string]any) (Builder, error) {
 			return nil, fmt.Errorf("parsing $and: %w", err)
 		}
 		return &and, nil
-	case "$match", "$gte", "$lte", "$gt", "$lt", "$exists", "$like", "$in":
+	case "$match", "$gte", "$lte", "$gt", "$lt", "$exists", "$like", "$in",
+		"$ne", "$nin", "$between", "$ilike", "$startsWith", "$contains", "$regex":
 		match, err := parseKeyValue(operator, value)
 		if err != nil {
 			return nil, fmt.Errorf("parsing %s: %w", operator, err)
@@ -332,7 +393,8 @@ func ParseJSON(data string) (Builder, error) {
 	return mapMapToExpression(m)
 }
 
-// Decode a json value using `big.Int`s as numbers
+// Decode a json value using `big.Int`s as integers, `Decimal`s as other numbers,
+// and `Date`s for typed date literals
 func decodeWithBigInt(data []byte) (any, error) {
 	dec := json.NewDecoder(bytes.NewReader(data))
 	dec.UseNumber()
@@ -345,11 +407,14 @@ func decodeWithBigInt(data []byte) (any, error) {
 	return convertJsonNumbersToBigInt(v)
 }
 
-// Convert `json.Number`s to `big.Int`s recursively
+// Convert `json.Number`s to `big.Int`s or `Decimal`s, and date literals to `Date`s recursively
 func convertJsonNumbersToBigInt(v any) (any, error) {
 	var err error
 	switch val := v.(type) {
 	case map[string]any:
+		if date, ok := val[dateLiteralKey]; ok && len(val) == 1 {
+			return parseDateLiteral(date)
+		}
 		for k, vv := range val {
 			val[k], err = convertJsonNumbersToBigInt(vv)
 			if err != nil {
@@ -366,10 +431,7 @@ func convertJsonNumbersToBigInt(v any) (any, error) {
 		}
 		return val, nil
 	case json.Number:
-		if bigint, ok := new(big.Int).SetString(val.String(), 10); ok {
-			return bigint, nil
-		}
-		return nil, fmt.Errorf("provided json number was not an integer")
+		return parseNumber(val.String())
 	default:
 		return val, nil
 	}
@@ -1,9 +1,11 @@
 package query
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -58,3 +60,126 @@ func TestParseExpression(t *testing.T) {
 		[]any{"A", "B"},
 	}, args)
 }
+
+func TestParseExtendedOperators(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		json     string
+		expected Builder
+	}
+	testCases := []testCase{
+		{
+			name:     "ne",
+			json:     `{"$ne": {"account": "world"}}`,
+			expected: Ne("account", "world"),
+		},
+		{
+			name:     "nin",
+			json:     `{"$nin": {"account": ["A", "B"]}}`,
+			expected: Nin("account", []any{"A", "B"}),
+		},
+		{
+			name:     "between",
+			json:     `{"$between": {"amount": [10, 20.5]}}`,
+			expected: Between("amount", big.NewInt(10), Decimal("20.5")),
+		},
+		{
+			name:     "ilike",
+			json:     `{"$ilike": {"name": "john%"}}`,
+			expected: ILike("name", "john%"),
+		},
+		{
+			name:     "startsWith",
+			json:     `{"$startsWith": {"address": "users:"}}`,
+			expected: StartsWith("address", "users:"),
+		},
+		{
+			name:     "contains",
+			json:     `{"$contains": {"metadata": {"foo": "bar"}}}`,
+			expected: Contains("metadata", map[string]any{"foo": "bar"}),
+		},
+		{
+			name:     "regex",
+			json:     `{"$regex": {"address": "^users:[0-9]+$"}}`,
+			expected: Regex("address", "^users:[0-9]+$"),
+		},
+		{
+			name:     "decimal",
+			json:     `{"$gt": {"rate": 0.000000000000000000001}}`,
+			expected: Gt("rate", Decimal("0.000000000000000000001")),
+		},
+		{
+			name:     "date",
+			json:     `{"$lt": {"timestamp": {"$date": "2024-01-02T03:04:05.123456Z"}}}`,
+			expected: Lt("timestamp", NewDate(time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC))),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			expr, err := ParseJSON(tc.json)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, expr)
+
+			// Round trip
+			data, err := json.Marshal(expr)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.json, string(data))
+
+			reparsed, err := ParseJSON(string(data))
+			require.NoError(t, err)
+			require.Equal(t, expr, reparsed)
+
+			// Walk
+			walked := 0
+			require.NoError(t, And(expr).Walk(func(operator string, key string, value *any) error {
+				walked++
+				require.Equal(t, tc.expected.(*keyValue).operator, operator)
+				require.Equal(t, tc.expected.(*keyValue).key, key)
+				return nil
+			}))
+			require.Equal(t, 1, walked)
+		})
+	}
+}
+
+func TestParseInvalidBetween(t *testing.T) {
+	t.Parallel()
+
+	for _, data := range []string{
+		`{"$between": {"amount": 10}}`,
+		`{"$between": {"amount": [10]}}`,
+		`{"$between": {"amount": [10, 20, 30]}}`,
+	} {
+		_, err := ParseJSON(data)
+		require.Error(t, err)
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	t.Parallel()
+
+	for input, expected := range map[string]Decimal{
+		"10.5":     "10.5",
+		"-0.25":    "-0.25",
+		"1e3":      "1000",
+		"1.5E+2":   "150",
+		"12.5e-3":  "0.0125",
+		"-1.25e1":  "-12.5",
+		"0.05e2":   "5",
+		"1.50e-21": "0.00000000000000000000150",
+	} {
+		d, err := ParseDecimal(input)
+		require.NoError(t, err, input)
+		require.Equal(t, expected, d, input)
+	}
+
+	for _, input := range []string{"1/3", "NaN", "Inf", "-Inf", "", ".5", "1.", "0x10", "+1", "1e1001", "1 "} {
+		_, err := ParseDecimal(input)
+		require.Error(t, err, input)
+	}
+}
@@ -18,6 +18,15 @@ func FuzzParseJSON(f *testing.F) {
 	f.Add(`{"$gt": {"balance": 100}}`)
 	f.Add(`{"$gte": {"balance": 288230376151711747}}`)
 	f.Add(`{"$exists": {"metadata": true}}`)
+	f.Add(`{"$ne": {"account": "world"}}`)
+	f.Add(`{"$nin": {"account": ["A", "B"]}}`)
+	f.Add(`{"$between": {"balance": [0, 10.5]}}`)
+	f.Add(`{"$ilike": {"name": "JOHN%"}}`)
+	f.Add(`{"$startsWith": {"account": "users:"}}`)
+	f.Add(`{"$contains": {"metadata": {"foo": "bar"}}}`)
+	f.Add(`{"$regex": {"account": "^users:"}}`)
+	f.Add(`{"$gt": {"rate": 1.5e-3}}`)
+	f.Add(`{"$lt": {"timestamp": {"$date": "2024-01-01T00:00:00Z"}}}`)
 
 	// Nested
 	f.Add(`{"$and": [{"$or": [{"$match": {"a": "1"}}, {"$match": {"b": "2"}}]}, {"$not": {"$match": {"c": "3"}}}]}`)
@@ -69,3 +78,30 @@ func FuzzParseJSON(f *testing.F) {
 		}
 	})
 }
+
+func FuzzParseText(f *testing.F) {
+	f.Add(`metadata[foo] = "bar" and (amount > 100 or not exists(reference))`)
+	f.Add(`a != 1 or b in ["x", "y"] and c not in []`)
+	f.Add(`amount between -1 and 10.5`)
+	f.Add(`address like "users:%" and address ilike "U%" and address ~ "^u" and address startsWith "u"`)
+	f.Add(`metadata contains {"foo": ["bar", null, true]}`)
+	f.Add(`timestamp < date("2024-01-01T00:00:00Z")`)
+	f.Add("`odd key` = 1e3")
+	f.Add(`or()`)
+	f.Add(`not (a = 1`)
+	f.Add(`a = "`)
+	f.Add(``)
+
+	f.Fuzz(func(t *testing.T, data string) {
+		builder, err := ParseText(data)
+		if err != nil || builder == nil {
+			return
+		}
+
+		// Rendering must be parsable again
+		rendered := Format(builder)
+		if _, err := ParseText(rendered); err != nil {
+			t.Fatalf("round-trip parse failed: %q rendered as %q, reparse error: %v", data, rendered, err)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package query
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dateLiteralKey = "$date"
+
+// maxDecimalExponent bounds the exponent of the decimals written in scientific notation, which are expanded when parsed
+const maxDecimalExponent = 1000
+
+var decimalRegexp = regexp.MustCompile(`^(-?)([0-9]+)(?:\.([0-9]+))?(?:[eE]([+-]?[0-9]+))?$`)
+
+// Decimal is a non-integer number literal.
+// It keeps the literal text, so it marshals back unchanged and without precision loss.
+type Decimal string
+
+func NewDecimal(v float64) Decimal {
+	return Decimal(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// ParseDecimal parses a decimal number, like `-12.5` or `1.25e-3`.
+// The scientific notation is expanded, so the decimal is always written in plain notation.
+// Fractions, infinities and NaN are rejected.
+func ParseDecimal(v string) (Decimal, error) {
+	matches := decimalRegexp.FindStringSubmatch(v)
+	if matches == nil {
+		return "", fmt.Errorf("invalid decimal %q", v)
+	}
+	if matches[4] == "" {
+		return Decimal(v), nil
+	}
+
+	exponent, err := strconv.Atoi(matches[4])
+	if err != nil || exponent > maxDecimalExponent || exponent < -maxDecimalExponent {
+		return "", fmt.Errorf("invalid decimal %q: exponent out of range", v)
+	}
+
+	sign, integer, fraction := matches[1], matches[2], matches[3]
+	digits := integer + fraction
+	point := len(integer) + exponent
+	switch {
+	case point <= 0:
+		integer, fraction = "0", strings.Repeat("0", -point)+digits
+	case point >= len(digits):
+		integer, fraction = digits+strings.Repeat("0", point-len(digits)), ""
+	default:
+		integer, fraction = digits[:point], digits[point:]
+	}
+	integer = strings.TrimLeft(integer, "0")
+	if integer == "" {
+		integer = "0"
+	}
+
+	if fraction == "" {
+		return Decimal(sign + integer), nil
+	}
+	return Decimal(sign + integer + "." + fraction), nil
+}
+
+// parseNumber parses a number literal, as an integer when its plain notation has no fractional part
+func parseNumber(v string) (any, error) {
+	d, err := ParseDecimal(v)
+	if err != nil {
+		return nil, err
+	}
+	if ret, ok := new(big.Int).SetString(string(d), 10); ok {
+		return ret, nil
+	}
+	return d, nil
+}
+
+// Rat returns the exact value of the decimal.
+func (d Decimal) Rat() *big.Rat {
+	ret, ok := new(big.Rat).SetString(string(d))
+	if !ok {
+		return new(big.Rat)
+	}
+	return ret
+}
+
+func (d Decimal) String() string {
+	return string(d)
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if _, err := ParseDecimal(string(d)); err != nil {
+		return nil, err
+	}
+	return []byte(d), nil
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return string(d), nil
+}
+
+// Date is a typed date literal, written `{"$date": "2006-01-02T15:04:05Z"}` in JSON expressions.
+// Unlike a plain string, it is known to be a date without any knowledge of the queried field.
+type Date struct {
+	time.Time
+}
+
+func NewDate(t time.Time) Date {
+	return Date{Time: t}
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		dateLiteralKey: d.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+func (d Date) Value() (driver.Value, error) {
+	return d.Time, nil
+}
+
+func parseDateLiteral(v any) (Date, error) {
+	s, ok := v.(string)
+	if !ok {
+		return Date{}, fmt.Errorf("unexpected type %T for %s literal", v, dateLiteralKey)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return Date{}, fmt.Errorf("parsing %s literal: %w", dateLiteralKey, err)
+	}
+	return Date{Time: t}, nil
+}
@@ -0,0 +1,588 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The text syntax is a compact, shell friendly equivalent of the JSON syntax:
+//
+//	metadata[foo] = "bar" and (amount > 100 or not exists(reference))
+//
+// Comparisons are written `key <operator> value` with the operators:
+//
+//	=  !=  >  >=  <  <=  like  ilike  ~  in  not in  between .. and ..  startsWith  contains
+//
+// `exists(key)` tests for a key, `not` negates an expression, and `and` binds tighter than `or`.
+// Values are JSON-like: "strings", numbers, true, false, null, [lists] and {"objects": ...},
+// plus date("2006-01-02T15:04:05Z") for typed dates.
+// Keys which are not made of letters, digits, `_` and `.` (with an optional `[...]` suffix)
+// must be quoted with backticks, backticks being doubled inside quoted keys.
+
+var textOperators = map[string]string{
+	"$match":      "=",
+	"$ne":         "!=",
+	"$gt":         ">",
+	"$gte":        ">=",
+	"$lt":         "<",
+	"$lte":        "<=",
+	"$like":       "like",
+	"$ilike":      "ilike",
+	"$regex":      "~",
+	"$in":         "in",
+	"$nin":        "not in",
+	"$between":    "between",
+	"$startsWith": "startsWith",
+	"$contains":   "contains",
+}
+
+func textOperator(v string) (string, bool) {
+	for operator, text := range textOperators {
+		if strings.EqualFold(text, v) {
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+// ErrSyntax reports a syntax error at a byte offset of a text expression.
+type ErrSyntax struct {
+	Offset  int
+	Message string
+}
+
+func (e ErrSyntax) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Offset, e.Message)
+}
+
+func (e ErrSyntax) Is(err error) bool {
+	_, ok := err.(ErrSyntax)
+	return ok
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenKey
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+type token struct {
+	kind   tokenKind
+	value  string
+	offset int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.value)
+}
+
+func (t token) is(keyword string) bool {
+	return (t.kind == tokenIdent || t.kind == tokenPunct) && strings.EqualFold(t.value, keyword)
+}
+
+// Longest first, so `>=` is not read as `>`
+var punctuations = []string{">=", "<=", "!=", "=", ">", "<", "~", "(", ")", "[", "]", "{", "}", ",", ":"}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+}
+
+func tokenize(data string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRuneInString(data[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '"':
+			end := i + 1
+			for ; end < len(data) && data[end] != '"'; end++ {
+				if data[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(data) {
+				return nil, ErrSyntax{Offset: i, Message: "unterminated string"}
+			}
+			value, err := strconv.Unquote(data[i : end+1])
+			if err != nil {
+				return nil, ErrSyntax{Offset: i, Message: "invalid string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value, offset: i})
+			i = end + 1
+		case r == '`':
+			key := strings.Builder{}
+			end := i + 1
+			for {
+				next := strings.IndexByte(data[end:], '`')
+				if next < 0 {
+					return nil, ErrSyntax{Offset: i, Message: "unterminated quoted key"}
+				}
+				key.WriteString(data[end : end+next+1])
+				end += next + 1
+				// A doubled backtick is part of the key
+				if end < len(data) && data[end] == '`' {
+					end++
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, token{kind: tokenKey, value: strings.TrimSuffix(key.String(), "`"), offset: i})
+			i = end
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(data) && data[i+1] >= '0' && data[i+1] <= '9'):
+			end := i + 1
+			for end < len(data) && strings.ContainsRune("0123456789.eE+-", rune(data[end])) {
+				if (data[end] == '+' || data[end] == '-') && data[end-1] != 'e' && data[end-1] != 'E' {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: data[i:end], offset: i})
+			i = end
+		case isIdentRune(r):
+			end := i
+			for end < len(data) {
+				r, size := utf8.DecodeRuneInString(data[end:])
+				if !isIdentRune(r) {
+					break
+				}
+				end += size
+			}
+			// A bracket right after an identifier is part of the key, like in `metadata[foo]`
+			if end < len(data) && data[end] == '[' {
+				closing := strings.IndexByte(data[end:], ']')
+				if closing < 0 {
+					return nil, ErrSyntax{Offset: end, Message: "unterminated '['"}
+				}
+				end += closing + 1
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: data[i:end], offset: i})
+			i = end
+		default:
+			punct := ""
+			for _, candidate := range punctuations {
+				if strings.HasPrefix(data[i:], candidate) {
+					punct = candidate
+					break
+				}
+			}
+			if punct == "" {
+				return nil, ErrSyntax{Offset: i, Message: fmt.Sprintf("unexpected character %q", r)}
+			}
+			tokens = append(tokens, token{kind: tokenPunct, value: punct, offset: i})
+			i += len(punct)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, offset: len(data)}), nil
+}
+
+type textParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *textParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *textParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *textParser) errorf(t token, format string, args ...any) error {
+	return ErrSyntax{Offset: t.offset, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *textParser) expect(value string) error {
+	if t := p.next(); !t.is(value) {
+		return p.errorf(t, "expected %q, found %s", value, t)
+	}
+	return nil
+}
+
+func (p *textParser) parseOr() (Builder, error) {
+	return p.parseSet("or", p.parseAnd)
+}
+
+func (p *textParser) parseAnd() (Builder, error) {
+	return p.parseSet("and", p.parseUnary)
+}
+
+func (p *textParser) parseSet(operator string, parseItem func() (Builder, error)) (Builder, error) {
+	item, err := parseItem()
+	if err != nil {
+		return nil, err
+	}
+	items := []Builder{item}
+	for p.peek().is(operator) {
+		p.next()
+		item, err := parseItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(items) == 1 {
+		return items[0], nil
+	}
+	return &set{operator: operator, items: items}, nil
+}
+
+func (p *textParser) parseUnary() (Builder, error) {
+	if p.peek().is("not") {
+		p.next()
+		expression, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(expression), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *textParser) parsePrimary() (Builder, error) {
+	t := p.peek()
+	switch {
+	case t.is("("):
+		p.next()
+		expression, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expression, nil
+	case (t.is("and") || t.is("or")) && p.tokens[p.pos+1].is("("):
+		// Empty sets, as rendered by String()
+		p.next()
+		p.next()
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &set{operator: strings.ToLower(t.value)}, nil
+	case t.is("exists") && p.tokens[p.pos+1].is("("):
+		p.next()
+		p.next()
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		var value any = true
+		if p.peek().is(",") {
+			p.next()
+			value, err = p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return Exists(key, value), nil
+	}
+
+	key, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+
+	t = p.next()
+	operator := t.value
+	if t.is("not") {
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		operator = "not in"
+	}
+	dslOperator, ok := textOperator(operator)
+	if (t.kind != tokenIdent && t.kind != tokenPunct) || !ok {
+		return nil, p.errorf(t, "expected an operator, found %s", t)
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if dslOperator == "$between" {
+		if err := p.expect("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		value = []any{value, high}
+	}
+
+	return &keyValue{
+		operator: dslOperator,
+		key:      key,
+		value:    value,
+	}, nil
+}
+
+func (p *textParser) parseKey() (string, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenKey:
+		return t.value, nil
+	case t.kind == tokenIdent && !isTextKeyword(t.value):
+		return t.value, nil
+	default:
+		return "", p.errorf(t, "expected a key, found %s", t)
+	}
+}
+
+func (p *textParser) parseValue() (any, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return t.value, nil
+	case tokenNumber:
+		v, err := parseNumber(t.value)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t)
+		}
+		return v, nil
+	case tokenIdent:
+		switch {
+		case t.is("true"):
+			return true, nil
+		case t.is("false"):
+			return false, nil
+		case t.is("null"):
+			return nil, nil
+		case t.is("date"):
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			s := p.next()
+			if s.kind != tokenString {
+				return nil, p.errorf(s, "expected a date string, found %s", s)
+			}
+			date, err := time.Parse(time.RFC3339Nano, s.value)
+			if err != nil {
+				return nil, p.errorf(s, "invalid date %s", s)
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return NewDate(date), nil
+		}
+	case tokenPunct:
+		switch t.value {
+		case "[":
+			ret := make([]any, 0)
+			if p.peek().is("]") {
+				p.next()
+				return ret, nil
+			}
+			for {
+				v, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, v)
+				if p.peek().is(",") {
+					p.next()
+					continue
+				}
+				if err := p.expect("]"); err != nil {
+					return nil, err
+				}
+				return ret, nil
+			}
+		case "{":
+			ret := make(map[string]any)
+			if p.peek().is("}") {
+				p.next()
+				return ret, nil
+			}
+			for {
+				k := p.next()
+				if k.kind != tokenString {
+					return nil, p.errorf(k, "expected a string key, found %s", k)
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				ret[k.value] = v
+				if p.peek().is(",") {
+					p.next()
+					continue
+				}
+				if err := p.expect("}"); err != nil {
+					return nil, err
+				}
+				return ret, nil
+			}
+		}
+	}
+	return nil, p.errorf(t, "expected a value, found %s", t)
+}
+
+var textKeywords = []string{"and", "or", "not", "true", "false", "null", "exists", "date"}
+
+func isTextKeyword(v string) bool {
+	return slices.Contains(textKeywords, strings.ToLower(v))
+}
+
+// ParseText parses an expression written in the text syntax.
+// It produces the same Builder as ParseJSON would for the equivalent JSON expression.
+func ParseText(data string) (Builder, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	tokens, err := tokenize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &textParser{tokens: tokens}
+	ret, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	return ret, nil
+}
+
+var plainKeyRegexp = regexp.MustCompile(`^[\pL\pN_.]+(\[[^\]]*])?$`)
+
+func formatKey(key string) string {
+	if plainKeyRegexp.MatchString(key) && !isTextKeyword(key) && !unicode.IsDigit([]rune(key)[0]) {
+		return key
+	}
+	return "`" + strings.ReplaceAll(key, "`", "``") + "`"
+}
+
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case *big.Int:
+		return v.String()
+	case Decimal:
+		return string(v)
+	case float64:
+		return string(NewDecimal(v))
+	case float32:
+		return string(NewDecimal(float64(v)))
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v)
+	case Date:
+		return fmt.Sprintf("date(%s)", strconv.Quote(v.UTC().Format(time.RFC3339Nano)))
+	case time.Time:
+		return formatValue(NewDate(v))
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, formatValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		items := make([]string, 0, len(v))
+		for _, key := range keys {
+			items = append(items, strconv.Quote(key)+": "+formatValue(v[key]))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+// Format renders an expression with the text syntax, see ParseText.
+// The builders of the package are all rendered, other ones are rendered with their fmt.Stringer implementation if any.
+func Format(b Builder) string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprint(b)
+}
+
+func formatOperand(b Builder) string {
+	if _, ok := b.(*set); ok {
+		return "(" + Format(b) + ")"
+	}
+	return Format(b)
+}
+
+// String renders the expression with the text syntax, see ParseText.
+func (set set) String() string {
+	if len(set.items) == 0 {
+		return set.operator + "()"
+	}
+	items := make([]string, 0, len(set.items))
+	for _, item := range set.items {
+		items = append(items, formatOperand(item))
+	}
+	return strings.Join(items, " "+set.operator+" ")
+}
+
+// String renders the expression with the text syntax, see ParseText.
+func (kv keyValue) String() string {
+	key := formatKey(kv.key)
+	switch kv.operator {
+	case "$exists":
+		if v, ok := kv.value.(bool); ok && v {
+			return fmt.Sprintf("exists(%s)", key)
+		}
+		return fmt.Sprintf("exists(%s, %s)", key, formatValue(kv.value))
+	case "$between":
+		if bounds, ok := kv.value.([]any); ok && len(bounds) == 2 {
+			return fmt.Sprintf("%s between %s and %s", key, formatValue(bounds[0]), formatValue(bounds[1]))
+		}
+	}
+	if text, ok := textOperators[kv.operator]; ok {
+		return fmt.Sprintf("%s %s %s", key, text, formatValue(kv.value))
+	}
+	return fmt.Sprintf("%s %s %s", key, kv.operator, formatValue(kv.value))
+}
+
+// String renders the expression with the text syntax, see ParseText.
+func (not not) String() string {
+	return "not " + formatOperand(not.expression)
+}
@@ -0,0 +1,172 @@
+package query
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseText(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		text string
+		json string
+	}
+	testCases := []testCase{
+		{
+			text: `metadata[foo] = "bar" and (amount > 100 or not exists(reference))`,
+			json: `{"$and": [
+				{"$match": {"metadata[foo]": "bar"}},
+				{"$or": [{"$gt": {"amount": 100}}, {"$not": {"$exists": {"reference": true}}}]}
+			]}`,
+		},
+		{
+			text: `a = 1 or b = 2 and c = 3`,
+			json: `{"$or": [{"$match": {"a": 1}}, {"$and": [{"$match": {"b": 2}}, {"$match": {"c": 3}}]}]}`,
+		},
+		{
+			text: `(a = 1 and b = 2) and c = 3`,
+			json: `{"$and": [{"$and": [{"$match": {"a": 1}}, {"$match": {"b": 2}}]}, {"$match": {"c": 3}}]}`,
+		},
+		{
+			text: `address != "world" AND address like "users:%" and address ILIKE "USERS:%" and address ~ "^users:"`,
+			json: `{"$and": [
+				{"$ne": {"address": "world"}},
+				{"$like": {"address": "users:%"}},
+				{"$ilike": {"address": "USERS:%"}},
+				{"$regex": {"address": "^users:"}}
+			]}`,
+		},
+		{
+			text: `address in ["a", "b"] and address not in [] and address startsWith "users:"`,
+			json: `{"$and": [
+				{"$in": {"address": ["a", "b"]}},
+				{"$nin": {"address": []}},
+				{"$startsWith": {"address": "users:"}}
+			]}`,
+		},
+		{
+			text: `amount between -1 and 10.5 and amount >= 0 and amount <= 1e3 and amount < 288230376151711747`,
+			json: `{"$and": [
+				{"$between": {"amount": [-1, 10.5]}},
+				{"$gte": {"amount": 0}},
+				{"$lte": {"amount": 1e3}},
+				{"$lt": {"amount": 288230376151711747}}
+			]}`,
+		},
+		{
+			text: `metadata contains {"foo": "bar", "nested": [true, null]} and exists(metadata, "foo")`,
+			json: `{"$and": [
+				{"$contains": {"metadata": {"foo": "bar", "nested": [true, null]}}},
+				{"$exists": {"metadata": "foo"}}
+			]}`,
+		},
+		{
+			text: `timestamp < date("2024-01-01T00:00:00Z") and reverted = false`,
+			json: `{"$and": [
+				{"$lt": {"timestamp": {"$date": "2024-01-01T00:00:00Z"}}},
+				{"$match": {"reverted": false}}
+			]}`,
+		},
+		{
+			text: "`odd key` = \"escaped \\\"quote\\\"\" and balance[USD/2] > 0",
+			json: `{"$and": [{"$match": {"odd key": "escaped \"quote\""}}, {"$gt": {"balance[USD/2]": 0}}]}`,
+		},
+		{
+			text: `not not a = "b"`,
+			json: `{"$not": {"$not": {"$match": {"a": "b"}}}}`,
+		},
+		{
+			text: `and()`,
+			json: `{"$and": []}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.text, func(t *testing.T) {
+			t.Parallel()
+
+			expected, err := ParseJSON(tc.json)
+			require.NoError(t, err)
+
+			builder, err := ParseText(tc.text)
+			require.NoError(t, err)
+			require.Equal(t, expected, builder)
+
+			// Rendering and parsing back must give the same expression
+			reparsed, err := ParseText(Format(builder))
+			require.NoError(t, err)
+			require.Equal(t, expected, reparsed)
+		})
+	}
+}
+
+func TestParseTextErrors(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		text           string
+		expectedOffset int
+	}
+	testCases := []testCase{
+		{text: `a = `, expectedOffset: 4},
+		{text: `a == 1`, expectedOffset: 3},
+		{text: `a = "b`, expectedOffset: 4},
+		{text: `(a = 1`, expectedOffset: 6},
+		{text: `a = 1 b = 2`, expectedOffset: 6},
+		{text: `a is 1`, expectedOffset: 2},
+		{text: `and = 1`, expectedOffset: 0},
+		{text: `a between 1 or 2`, expectedOffset: 12},
+		{text: `a = date("yesterday")`, expectedOffset: 9},
+		{text: `a = 1 & b = 2`, expectedOffset: 6},
+		{text: `a = {b: 1}`, expectedOffset: 5},
+		{text: "`a = 1", expectedOffset: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.text, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ParseText(tc.text)
+			require.ErrorIs(t, err, ErrSyntax{})
+			require.Equal(t, tc.expectedOffset, err.(ErrSyntax).Offset)
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	builder := And(
+		Match("metadata[foo]", "bar"),
+		Or(Gt("amount", big.NewInt(100)), Not(Exists("reference", true))),
+		Between("timestamp", date, NewDate(date)),
+		In("id", []any{1, 2.5}),
+		Not(Or()),
+		Exists("and", false),
+	)
+	require.Equal(t,
+		`metadata[foo] = "bar" and (amount > 100 or not exists(reference)) and `+
+			`timestamp between date("2024-01-01T00:00:00Z") and date("2024-01-01T00:00:00Z") and `+
+			"id in [1, 2.5] and not (or()) and exists(`and`, false)",
+		Format(builder),
+	)
+}
+
+func TestFormatQuotedKeys(t *testing.T) {
+	t.Parallel()
+
+	for _, key := range []string{"a b", "a`b", "`", "``a``", "and"} {
+		builder := Match(key, "value")
+		reparsed, err := ParseText(Format(builder))
+		require.NoError(t, err, Format(builder))
+		require.Equal(t, builder, reparsed, Format(builder))
+	}
+
+	_, err := ParseText("`a``b = 1")
+	require.Error(t, err)
+}
@@ -0,0 +1,203 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Validator checks expressions before they are built, so expressions coming from clients
+// cannot generate arbitrarily large SQL queries.
+type Validator struct {
+	maxDepth    int
+	maxNodes    int
+	maxInValues int
+	operators   map[string][]string
+}
+
+type ValidatorOption func(*Validator)
+
+// WithMaxDepth limits the nesting of $and, $or and $not. Zero disables the check.
+func WithMaxDepth(depth int) ValidatorOption {
+	return func(v *Validator) {
+		v.maxDepth = depth
+	}
+}
+
+// WithMaxNodes limits the number of nodes (operators and comparisons). Zero disables the check.
+func WithMaxNodes(nodes int) ValidatorOption {
+	return func(v *Validator) {
+		v.maxNodes = nodes
+	}
+}
+
+// WithMaxInValues limits the number of values of $in and $nin. Zero disables the check.
+func WithMaxInValues(values int) ValidatorOption {
+	return func(v *Validator) {
+		v.maxInValues = values
+	}
+}
+
+// WithAllowedOperators restricts the operators accepted on a key.
+// A rule on a map key (like `metadata`) also applies to its entries (like `metadata[foo]`).
+// Keys without rule accept any operator.
+func WithAllowedOperators(key string, operators ...string) ValidatorOption {
+	return func(v *Validator) {
+		v.operators[key] = operators
+	}
+}
+
+var defaultValidatorOptions = []ValidatorOption{
+	WithMaxDepth(10),
+	WithMaxNodes(100),
+	WithMaxInValues(1000),
+}
+
+func NewValidator(opts ...ValidatorOption) *Validator {
+	ret := &Validator{
+		operators: make(map[string][]string),
+	}
+	for _, opt := range append(defaultValidatorOptions, opts...) {
+		opt(ret)
+	}
+	return ret
+}
+
+// Validate returns an error if the expression exceeds one of the configured limits.
+func (v *Validator) Validate(builder Builder) error {
+	if builder == nil {
+		return nil
+	}
+	nodes := 0
+	return v.validate(builder, 1, &nodes)
+}
+
+func (v *Validator) validate(builder Builder, depth int, nodes *int) error {
+	*nodes++
+	if v.maxNodes > 0 && *nodes > v.maxNodes {
+		return ErrLimitExceeded{Limit: LimitNodes, Max: v.maxNodes}
+	}
+	if v.maxDepth > 0 && depth > v.maxDepth {
+		return ErrLimitExceeded{Limit: LimitDepth, Max: v.maxDepth}
+	}
+
+	switch builder := builder.(type) {
+	case *set:
+		for _, item := range builder.items {
+			if err := v.validate(item, depth+1, nodes); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *not:
+		return v.validate(builder.expression, depth+1, nodes)
+	case *keyValue:
+		return v.validateKeyValue(builder)
+	default:
+		return fmt.Errorf("unexpected expression type %T", builder)
+	}
+}
+
+func (v *Validator) validateKeyValue(kv *keyValue) error {
+	operators, ok := v.operators[kv.key]
+	if !ok {
+		if matches := mapKeyRegexp.FindStringSubmatch(kv.key); matches != nil {
+			operators, ok = v.operators[matches[1]]
+		}
+	}
+	if ok && !slices.Contains(operators, kv.operator) {
+		return ErrOperatorNotAllowed{Key: kv.key, Operator: kv.operator}
+	}
+
+	if kv.operator == "$in" || kv.operator == "$nin" {
+		if rv := reflect.ValueOf(kv.value); rv.Kind() == reflect.Slice && v.maxInValues > 0 && rv.Len() > v.maxInValues {
+			return ErrLimitExceeded{Limit: LimitInValues, Max: v.maxInValues, Key: kv.key}
+		}
+	}
+
+	return nil
+}
+
+// Normalize returns an equivalent, simpler expression:
+//   - nested $and (resp. $or) are merged into their parent $and (resp. $or), unless they are empty
+//   - $and and $or with a single item are replaced by the item
+//   - double negations are removed
+//   - duplicated values of $in and $nin are removed
+//
+// Empty $and and $or are kept, as both match everything (see Evaluator).
+// The given expression is not modified.
+func Normalize(builder Builder) Builder {
+	switch builder := builder.(type) {
+	case *set:
+		var items []Builder
+		for _, item := range builder.items {
+			item = Normalize(item)
+			if sub, ok := item.(*set); ok && sub.operator == builder.operator && len(sub.items) > 0 {
+				items = append(items, sub.items...)
+				continue
+			}
+			items = append(items, item)
+		}
+		if len(items) == 1 {
+			return items[0]
+		}
+		return &set{
+			operator: builder.operator,
+			items:    items,
+		}
+	case *not:
+		expression := Normalize(builder.expression)
+		if sub, ok := expression.(*not); ok {
+			return sub.expression
+		}
+		return Not(expression)
+	case *keyValue:
+		ret := *builder
+		if values, ok := builder.value.([]any); ok && (builder.operator == "$in" || builder.operator == "$nin") {
+			ret.value = dedupe(values)
+		}
+		return &ret
+	default:
+		return builder
+	}
+}
+
+func dedupe(values []any) []any {
+	seen := make(map[string]struct{}, len(values))
+	ret := make([]any, 0, len(values))
+	for _, value := range values {
+		// The text representation distinguishes types, so "1" and 1 are kept
+		key := formatValue(value)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		ret = append(ret, value)
+	}
+	return ret
+}
+
+const (
+	LimitDepth    = "depth"
+	LimitNodes    = "nodes"
+	LimitInValues = "$in values"
+)
+
+type ErrLimitExceeded struct {
+	Limit string
+	Max   int
+	// Key is set for limits on a single comparison
+	Key string
+}
+
+func (e ErrLimitExceeded) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("expression exceeds the maximum of %d %s on key '%s'", e.Max, e.Limit, e.Key)
+	}
+	return fmt.Sprintf("expression exceeds the maximum of %d %s", e.Max, e.Limit)
+}
+
+func (e ErrLimitExceeded) Is(err error) bool {
+	_, ok := err.(ErrLimitExceeded)
+	return ok
+}
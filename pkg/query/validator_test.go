@@ -0,0 +1,181 @@
+package query
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	nested := Builder(Match("a", "b"))
+	for range 10 {
+		nested = Not(nested)
+	}
+	manyItems := make([]Builder, 0, 100)
+	for range 100 {
+		manyItems = append(manyItems, Match("a", "b"))
+	}
+	manyValues := make([]any, 0, 1001)
+	for i := range 1001 {
+		manyValues = append(manyValues, i)
+	}
+
+	type testCase struct {
+		name          string
+		builder       Builder
+		options       []ValidatorOption
+		expectedError error
+	}
+	testCases := []testCase{
+		{name: "nil", builder: nil},
+		{name: "simple", builder: And(Match("a", "b"), Not(In("c", []any{1, 2})))},
+		{name: "too deep", builder: nested, expectedError: ErrLimitExceeded{Limit: LimitDepth}},
+		{name: "depth disabled", builder: nested, options: []ValidatorOption{WithMaxDepth(0)}},
+		{name: "too many nodes", builder: Or(manyItems...), expectedError: ErrLimitExceeded{Limit: LimitNodes}},
+		{name: "custom nodes", builder: Or(manyItems...), options: []ValidatorOption{WithMaxNodes(101)}},
+		{name: "too many $in values", builder: In("a", manyValues), expectedError: ErrLimitExceeded{Limit: LimitInValues}},
+		{name: "too many $nin values", builder: Nin("a", manyValues), expectedError: ErrLimitExceeded{Limit: LimitInValues}},
+		{
+			name:    "allowed operator",
+			builder: Gt("amount", 0),
+			options: []ValidatorOption{WithAllowedOperators("amount", "$gt", "$lt")},
+		},
+		{
+			name:          "operator not allowed",
+			builder:       Or(Match("address", "world"), Like("amount", "1%")),
+			options:       []ValidatorOption{WithAllowedOperators("amount", "$gt", "$lt")},
+			expectedError: ErrOperatorNotAllowed{},
+		},
+		{
+			name:          "operator not allowed on map entry",
+			builder:       Regex("metadata[foo]", ".*"),
+			options:       []ValidatorOption{WithAllowedOperators("metadata", "$match")},
+			expectedError: ErrOperatorNotAllowed{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := NewValidator(tc.options...).Validate(tc.builder)
+			if tc.expectedError != nil {
+				require.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		builder  Builder
+		expected Builder
+	}
+	testCases := []testCase{
+		{
+			name:     "flatten",
+			builder:  And(Match("a", 1), And(Match("b", 2), And(Match("c", 3))), Or(Match("d", 4), Or(Match("e", 5)))),
+			expected: And(Match("a", 1), Match("b", 2), Match("c", 3), Or(Match("d", 4), Match("e", 5))),
+		},
+		{
+			name:     "single item",
+			builder:  Or(And(Match("a", 1))),
+			expected: Match("a", 1),
+		},
+		{
+			name:     "double negation",
+			builder:  Not(Not(Not(Match("a", 1)))),
+			expected: Not(Match("a", 1)),
+		},
+		{
+			name:     "double negation of set",
+			builder:  And(Match("a", 1), Not(Not(And(Match("b", 2))))),
+			expected: And(Match("a", 1), Match("b", 2)),
+		},
+		{
+			name:     "dedupe in",
+			builder:  In("a", []any{"x", "y", "x", big.NewInt(1), "1", big.NewInt(1)}),
+			expected: In("a", []any{"x", "y", big.NewInt(1), "1"}),
+		},
+		{
+			name:     "dedupe nin",
+			builder:  Not(Nin("a", []any{1, 1})),
+			expected: Not(Nin("a", []any{1})),
+		},
+		{
+			name:     "empty set",
+			builder:  And(),
+			expected: And(),
+		},
+		{
+			name:     "nested empty set",
+			builder:  Or(Match("a", 1), Or(Match("b", 2), Or())),
+			expected: Or(Match("a", 1), Match("b", 2), Or()),
+		},
+		{
+			name:     "single empty set",
+			builder:  And(Or()),
+			expected: Or(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			original := Format(tc.builder)
+			require.Equal(t, tc.expected, Normalize(tc.builder))
+			require.Equal(t, original, Format(tc.builder))
+		})
+	}
+}
+
+func TestNormalizeEquivalence(t *testing.T) {
+	t.Parallel()
+
+	build := func(builder Builder) string {
+		query, _, err := builder.Build(ContextFn(func(key, operator string, value any) (string, []any, error) {
+			return fmt.Sprintf("%s %s ?", key, DefaultComparisonOperatorsMapping[operator]), []any{value}, nil
+		}))
+		require.NoError(t, err)
+		return query
+	}
+
+	for _, builder := range []Builder{
+		Or(Match("a", 1), Or()),
+		And(Match("a", 1), And()),
+		Or(Match("a", 1), And(Or(), Match("b", 1))),
+		Not(Or(Match("a", 1), Or(Or(), Match("b", 1)))),
+		And(Or(Match("a", 1), Or(Match("b", 1), Match("c", 1))), And(Not(And()), Match("c", 2))),
+	} {
+		normalized := Normalize(builder)
+
+		// Flattening only removes parentheses from the built SQL
+		stripParentheses := strings.NewReplacer("(", "", ")", "")
+		require.Equal(t, stripParentheses.Replace(build(builder)), stripParentheses.Replace(build(normalized)), Format(builder))
+
+		for _, target := range []map[string]any{
+			{"a": 1, "b": 1, "c": 1},
+			{"a": 1, "b": 2, "c": 2},
+			{"a": 2, "b": 1, "c": 2},
+			{"a": 2, "b": 2, "c": 1},
+			{"a": 2, "b": 2, "c": 2},
+		} {
+			expected, err := Evaluate(builder, target)
+			require.NoError(t, err)
+			ret, err := Evaluate(normalized, target)
+			require.NoError(t, err)
+			require.Equal(t, expected, ret, "%s on %v", builder, target)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/uptrace/bun"
+
+	bunconnect "github.com/formancehq/go-libs/v5/pkg/storage/bun/connect"
+	"github.com/formancehq/go-libs/v5/pkg/storage/migrations"
+)
+
+const (
+	OutputFlag = "output"
+	DryRunFlag = "dry-run"
+	ToFlag     = "to"
+	PhaseFlag  = "phase"
+
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// MigratorFactory creates the migrator of a service, with its migrations registered.
+type MigratorFactory func(cmd *cobra.Command, db *bun.DB) (*migrations.Migrator, error)
+
+// FromMigrations creates a migrator configured by the migrator flags, with the given migrations registered.
+func FromMigrations(ms ...migrations.Migration) MigratorFactory {
+	return func(cmd *cobra.Command, db *bun.DB) (*migrations.Migrator, error) {
+		return migrations.NewMigrator(db, migrations.MigrationOptionsFromFlags(cmd.Flags())...).
+			RegisterMigrations(ms...), nil
+	}
+}
+
+// NewCommand creates a migrate command applying the pending migrations,
+// with the subcommands status, up, up-to, down, verify and plan.
+func NewCommand(factory MigratorFactory, options ...func(command *cobra.Command)) *cobra.Command {
+	ret := &cobra.Command{
+		Use:   "migrate",
+		Short: "Run migrations",
+		RunE:  withMigrator(factory, up),
+	}
+	ret.AddCommand(
+		&cobra.Command{
+			Use:   "status",
+			Short: "Show the state of the migrations",
+			Args:  cobra.NoArgs,
+			RunE:  withMigrator(factory, status),
+		},
+		newUpCommand(factory),
+		&cobra.Command{
+			Use:   "up-to <version>",
+			Short: "Apply the pending migrations up to a version",
+			Args:  cobra.ExactArgs(1),
+			RunE:  withMigrator(factory, upTo),
+		},
+		newDownCommand(factory),
+		&cobra.Command{
+			Use:   "verify",
+			Short: "Check the applied migrations have not been modified",
+			Args:  cobra.NoArgs,
+			RunE:  withMigrator(factory, verify),
+		},
+		newPlanCommand(factory),
+	)
+	for _, option := range options {
+		option(ret)
+	}
+	bunconnect.AddFlags(ret.PersistentFlags())
+	migrations.AddFlags(ret.PersistentFlags())
+	ret.PersistentFlags().String(OutputFlag, OutputTable, "Output format, table or json")
+	return ret
+}
+
+func newUpCommand(factory MigratorFactory) *cobra.Command {
+	ret := &cobra.Command{
+		Use:   "up",
+		Short: "Apply the pending migrations",
+		Args:  cobra.NoArgs,
+		RunE:  withMigrator(factory, up),
+	}
+	ret.Flags().String(PhaseFlag, "", "Only apply the migrations of a phase, pre-deploy or post-deploy")
+	return ret
+}
+
+func newDownCommand(factory MigratorFactory) *cobra.Command {
+	ret := &cobra.Command{
+		Use:   "down",
+		Short: "Roll back the last applied migration",
+		Args:  cobra.NoArgs,
+		RunE:  withMigrator(factory, down),
+	}
+	ret.Flags().Int(ToFlag, -1, "Roll back the migrations until this version is the last applied one (0 rolls back all migrations)")
+	return ret
+}
+
+func newPlanCommand(factory MigratorFactory) *cobra.Command {
+	ret := &cobra.Command{
+		Use:   "plan",
+		Short: "Show the migrations up would apply",
+		Args:  cobra.NoArgs,
+		RunE:  withMigrator(factory, plan),
+	}
+	ret.Flags().Bool(DryRunFlag, false, "Also show the SQL of the migrations")
+	ret.Flags().String(PhaseFlag, "", "Only show the migrations of a phase, pre-deploy or post-deploy")
+	return ret
+}
+
+func withMigrator(factory MigratorFactory, fn func(cmd *cobra.Command, args []string, migrator *migrations.Migrator) error) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString(OutputFlag)
+		if output != OutputTable && output != OutputJSON {
+			return fmt.Errorf("invalid output format '%s'", output)
+		}
+
+		return Run(cmd, args, func(cmd *cobra.Command, args []string, db *bun.DB) error {
+			migrator, err := factory(cmd, db)
+			if err != nil {
+				return err
+			}
+			return fn(cmd, args, migrator)
+		})
+	}
+}
+
+func status(cmd *cobra.Command, _ []string, migrator *migrations.Migrator) error {
+	infos, err := migrator.GetMigrations(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	return write(cmd, infos, func(w io.Writer) {
+		_, _ = fmt.Fprintln(w, "VERSION\tNAME\tPHASE\tSTATE\tDATE\tPROGRESS")
+		for _, info := range infos {
+			date, progress := "", ""
+			if !info.Date.IsZero() {
+				date = info.Date.Format("2006-01-02 15:04:05")
+			}
+			if info.Progress != nil {
+				progress = fmt.Sprintf("%d%%", *info.Progress)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Version, info.Name, info.Phase, info.State, date, progress)
+		}
+	})
+}
+
+func up(cmd *cobra.Command, _ []string, migrator *migrations.Migrator) error {
+	// The root command has no phase flag
+	if phase, _ := cmd.Flags().GetString(PhaseFlag); phase != "" {
+		return migrator.UpPhase(cmd.Context(), migrations.Phase(phase))
+	}
+	return migrator.Up(cmd.Context())
+}
+
+func upTo(cmd *cobra.Command, args []string, migrator *migrations.Migrator) error {
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid version '%s': %w", args[0], err)
+	}
+	return migrator.UpTo(cmd.Context(), version)
+}
+
+func down(cmd *cobra.Command, _ []string, migrator *migrations.Migrator) error {
+	to, _ := cmd.Flags().GetInt(ToFlag)
+	if to >= 0 {
+		return migrator.DownTo(cmd.Context(), to)
+	}
+
+	err := migrator.DownByOne(cmd.Context())
+	if errors.Is(err, migrations.ErrNothingToRollback) {
+		_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Nothing to roll back")
+		return nil
+	}
+	return err
+}
+
+func verify(cmd *cobra.Command, _ []string, migrator *migrations.Migrator) error {
+	drifts, err := migrator.Verify(cmd.Context())
+	if err != nil {
+		return err
+	}
+	if drifts == nil {
+		drifts = []migrations.Drift{}
+	}
+
+	if err := write(cmd, drifts, func(w io.Writer) {
+		if len(drifts) == 0 {
+			_, _ = fmt.Fprintln(w, "No drift detected")
+			return
+		}
+		_, _ = fmt.Fprintln(w, "VERSION\tKIND\tAPPLIED NAME\tNAME")
+		for _, drift := range drifts {
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", drift.Version, drift.Kind, drift.AppliedName, drift.Name)
+		}
+	}); err != nil {
+		return err
+	}
+
+	diverged := make([]migrations.Drift, 0, len(drifts))
+	for _, drift := range drifts {
+		if drift.Diverged() {
+			diverged = append(diverged, drift)
+		}
+	}
+	if len(diverged) > 0 {
+		return migrations.ErrHistoryDiverged{Drifts: diverged}
+	}
+	return nil
+}
+
+type plannedMigration struct {
+	Version string           `json:"version"`
+	Name    string           `json:"name"`
+	Phase   migrations.Phase `json:"phase"`
+	State   string           `json:"state"`
+	Source  string           `json:"source,omitempty"`
+}
+
+func plan(cmd *cobra.Command, _ []string, migrator *migrations.Migrator) error {
+	infos, err := migrator.GetMigrations(cmd.Context())
+	if err != nil {
+		return err
+	}
+	dryRun, _ := cmd.Flags().GetBool(DryRunFlag)
+	phase, _ := cmd.Flags().GetString(PhaseFlag)
+	if phase != "" {
+		if err := migrations.Phase(phase).Validate(); err != nil {
+			return err
+		}
+	}
+
+	registered := migrator.Migrations()
+	planned := make([]plannedMigration, 0)
+	for i, info := range infos {
+		if info.State == "DONE" || (phase != "" && info.Phase != migrations.Phase(phase)) {
+			continue
+		}
+		migration := plannedMigration{
+			Version: info.Version,
+			Name:    info.Name,
+			Phase:   info.Phase,
+			State:   info.State,
+		}
+		if dryRun {
+			migration.Source = registered[i].Source
+		}
+		planned = append(planned, migration)
+	}
+
+	output, _ := cmd.Flags().GetString(OutputFlag)
+	if dryRun && output == OutputTable {
+		if len(planned) == 0 {
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), "Already up to date")
+		}
+		// Sources are printed as is, out of the table
+		for _, migration := range planned {
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "-- %s: %s (%s, %s)\n%s\n\n", migration.Version, migration.Name, migration.Phase, migration.State, migration.Source)
+		}
+		return nil
+	}
+
+	return write(cmd, planned, func(w io.Writer) {
+		if len(planned) == 0 {
+			_, _ = fmt.Fprintln(w, "Already up to date")
+			return
+		}
+		_, _ = fmt.Fprintln(w, "VERSION\tNAME\tPHASE\tSTATE")
+		for _, migration := range planned {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", migration.Version, migration.Name, migration.Phase, migration.State)
+		}
+	})
+}
+
+// write prints v as JSON, or as a table with writeTable, depending on the output flag
+func write(cmd *cobra.Command, v any, writeTable func(w io.Writer)) error {
+	output, _ := cmd.Flags().GetString(OutputFlag)
+	if output == OutputJSON {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	writeTable(w)
+	return w.Flush()
+}
@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	bunconnect "github.com/formancehq/go-libs/v5/pkg/storage/bun/connect"
+	"github.com/formancehq/go-libs/v5/pkg/storage/migrations"
+	"github.com/formancehq/go-libs/v5/pkg/testing/docker"
+	"github.com/formancehq/go-libs/v5/pkg/testing/platform/pgtesting"
+)
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+	dockerPool := docker.NewPool(t, logging.Testing())
+	srv := pgtesting.CreatePostgresServer(t, dockerPool)
+
+	ms, err := migrations.LoadMigrations(fstest.MapFS{
+		"1_create_accounts.sql":      {Data: []byte("create table accounts (id int primary key);")},
+		"1_create_accounts.down.sql": {Data: []byte("drop table accounts;")},
+		"2_add_name.sql":             {Data: []byte("alter table accounts add column name text;")},
+		"2_add_name.down.sql":        {Data: []byte("alter table accounts drop column name;")},
+		"3_index_name.sql":           {Data: []byte(migrations.NoTxDirective + "\ncreate index concurrently accounts_name on accounts (name);")},
+		"3_index_name.down.sql":      {Data: []byte(migrations.NoTxDirective + "\ndrop index concurrently accounts_name;")},
+	}, ".")
+	require.NoError(t, err)
+
+	execute := func(args ...string) string {
+		t.Helper()
+
+		output := bytes.NewBuffer(nil)
+		cmd := NewCommand(FromMigrations(ms...))
+		cmd.SetOut(output)
+		cmd.SetArgs(append(args, "--"+bunconnect.PostgresURIFlag, srv.GetDatabaseDSN("commands")))
+		require.NoError(t, cmd.ExecuteContext(logging.TestingContext()))
+
+		return output.String()
+	}
+	status := func() []migrations.Info {
+		t.Helper()
+
+		infos := make([]migrations.Info, 0)
+		require.NoError(t, json.Unmarshal([]byte(execute("status", "--"+OutputFlag, OutputJSON)), &infos))
+		return infos
+	}
+	states := func() []string {
+		t.Helper()
+
+		ret := make([]string, 0)
+		for _, info := range status() {
+			ret = append(ret, info.State)
+		}
+		return ret
+	}
+
+	require.Equal(t, []string{"TO DO", "TO DO", "TO DO"}, states())
+	require.Contains(t, execute("plan", "--"+DryRunFlag), "create table accounts")
+
+	execute("up-to", "2")
+	require.Equal(t, []string{"DONE", "DONE", "TO DO"}, states())
+
+	planned := make([]plannedMigration, 0)
+	require.NoError(t, json.Unmarshal([]byte(execute("plan", "--"+OutputFlag, OutputJSON)), &planned))
+	require.Equal(t, []plannedMigration{{Version: "3", Name: "index_name", Phase: migrations.PhasePreDeploy, State: "TO DO"}}, planned)
+
+	execute("up")
+	require.Equal(t, []string{"DONE", "DONE", "DONE"}, states())
+	require.Contains(t, execute("plan"), "Already up to date")
+	require.Contains(t, execute("verify"), "No drift detected")
+
+	execute("down", "--"+ToFlag, "1")
+	require.Equal(t, []string{"DONE", "ROLLED BACK", "ROLLED BACK"}, states())
+
+	// Migrating without subcommand applies the pending migrations
+	execute()
+	require.Equal(t, []string{"DONE", "DONE", "DONE"}, states())
+}
@@ -8,6 +8,9 @@ type Cursor[T any] struct {
 	Previous string `json:"previous,omitempty"`
 	Next     string `json:"next,omitempty"`
 	Data     []T    `json:"data"`
+	// Total is only set when the query asked for a count, see CountMode.
+	Total           *uint64 `json:"total,omitempty"`
+	TotalIsEstimate bool    `json:"totalIsEstimate,omitempty"`
 }
 
 func MapCursor[FROM any, TO any](cursor *Cursor[FROM], mapper func(FROM) TO) *Cursor[TO] {
@@ -17,5 +20,8 @@ func MapCursor[FROM any, TO any](cursor *Cursor[FROM], mapper func(FROM) TO) *Cu
 		Previous: cursor.Previous,
 		Next:     cursor.Next,
 		Data:     collectionutils.Map(cursor.Data, mapper),
+
+		Total:           cursor.Total,
+		TotalIsEstimate: cursor.TotalIsEstimate,
 	}
 }
@@ -0,0 +1,284 @@
+package paginate
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CursorFormatV1 prefixes signed cursors: "v1.<key id>.<payload>.<signature>".
+	CursorFormatV1 = "v1"
+
+	cursorSeparator = "."
+
+	payloadPlain     byte = 'p'
+	payloadEncrypted byte = 'e'
+)
+
+var (
+	ErrInvalidCursorSignature = errors.New("invalid cursor signature")
+	ErrUnknownCursorKey       = errors.New("unknown cursor key")
+	ErrUnsupportedCursor      = errors.New("unsupported cursor format")
+	ErrCursorExpired          = errors.New("cursor expired")
+)
+
+// CursorKey is a secret used to sign (and optionally encrypt) cursors.
+// The ID is embedded in every cursor so a Keyring can pick the right secret on decode.
+type CursorKey struct {
+	ID     string
+	Secret []byte
+}
+
+type KeyringOption func(*Keyring)
+
+// WithCursorEncryption encrypts cursor payloads with AES-GCM in addition to signing them,
+// so clients cannot read filters embedded in cursors.
+func WithCursorEncryption() KeyringOption {
+	return func(keyring *Keyring) {
+		keyring.encrypt = true
+	}
+}
+
+// WithCursorTTL makes cursors expire after the given duration.
+func WithCursorTTL(ttl time.Duration) KeyringOption {
+	return func(keyring *Keyring) {
+		keyring.ttl = ttl
+	}
+}
+
+// WithLegacyCursors accepts unsigned cursors on decode.
+// It is meant to be enabled temporarily while rolling out signing, so cursors
+// issued before the rollout keep working.
+func WithLegacyCursors() KeyringOption {
+	return func(keyring *Keyring) {
+		keyring.acceptLegacy = true
+	}
+}
+
+func withCursorClock(clock func() time.Time) KeyringOption {
+	return func(keyring *Keyring) {
+		keyring.now = clock
+	}
+}
+
+// Keyring signs cursors with its first key, and verifies them with any of its keys.
+// To rotate, prepend the new key and keep the old ones until issued cursors are no longer in use.
+type Keyring struct {
+	keys         []CursorKey
+	encrypt      bool
+	ttl          time.Duration
+	acceptLegacy bool
+	now          func() time.Time
+}
+
+func NewKeyring(keys []CursorKey, opts ...KeyringOption) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring must contain at least one key")
+	}
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, cursorSeparator) {
+			return nil, fmt.Errorf("invalid cursor key id %q", key.ID)
+		}
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("cursor key %q: secret must be at least 32 bytes", key.ID)
+		}
+		if _, ok := seen[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate cursor key id %q", key.ID)
+		}
+		seen[key.ID] = struct{}{}
+	}
+
+	ret := &Keyring{
+		keys: keys,
+		now:  time.Now,
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return ret, nil
+}
+
+type cursorEnvelope struct {
+	ExpiresAt int64           `json:"exp,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (k *Keyring) Encode(data []byte) (string, error) {
+	key := k.keys[0]
+
+	envelope := cursorEnvelope{
+		Data: data,
+	}
+	if k.ttl > 0 {
+		envelope.ExpiresAt = k.now().Add(k.ttl).Unix()
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	if k.encrypt {
+		payload, err = seal(deriveKey(key.Secret, "encryption"), payload)
+		if err != nil {
+			return "", err
+		}
+		payload = append([]byte{payloadEncrypted}, payload...)
+	} else {
+		payload = append([]byte{payloadPlain}, payload...)
+	}
+
+	header := CursorFormatV1 + cursorSeparator + key.ID + cursorSeparator + base64.RawURLEncoding.EncodeToString(payload)
+	signature := sign(deriveKey(key.Secret, "signing"), header)
+
+	return header + cursorSeparator + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (k *Keyring) Decode(cursor string) ([]byte, error) {
+	data, _, err := k.decode(cursor)
+	return data, err
+}
+
+// decode also reports whether the cursor was signed, legacy cursors being accepted unsigned
+func (k *Keyring) decode(cursor string) ([]byte, bool, error) {
+	parts := strings.Split(cursor, cursorSeparator)
+	if len(parts) != 4 || parts[0] != CursorFormatV1 {
+		if k.acceptLegacy && !strings.Contains(cursor, cursorSeparator) {
+			data, err := base64.RawURLEncoding.DecodeString(cursor)
+			return data, false, err
+		}
+		return nil, false, ErrUnsupportedCursor
+	}
+
+	var key *CursorKey
+	for i := range k.keys {
+		if k.keys[i].ID == parts[1] {
+			key = &k.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, false, ErrUnknownCursorKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, false, ErrInvalidCursorSignature
+	}
+	header := strings.Join(parts[:3], cursorSeparator)
+	if !hmac.Equal(signature, sign(deriveKey(key.Secret, "signing"), header)) {
+		return nil, false, ErrInvalidCursorSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Encryption is detected from the payload rather than the current configuration,
+	// so toggling it does not invalidate cursors already issued.
+	if len(payload) == 0 {
+		return nil, false, ErrUnsupportedCursor
+	}
+	switch payload[0] {
+	case payloadPlain:
+		payload = payload[1:]
+	case payloadEncrypted:
+		payload, err = open(deriveKey(key.Secret, "encryption"), payload[1:])
+		if err != nil {
+			return nil, false, err
+		}
+	default:
+		return nil, false, ErrUnsupportedCursor
+	}
+
+	envelope := cursorEnvelope{}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return nil, false, err
+	}
+	if envelope.ExpiresAt != 0 && k.now().Unix() > envelope.ExpiresAt {
+		return nil, false, ErrCursorExpired
+	}
+
+	return envelope.Data, true, nil
+}
+
+func deriveKey(secret []byte, usage string) []byte {
+	return sign(secret, "cursor-"+usage)
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("invalid encrypted cursor")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type cursorOptions struct {
+	keyring *Keyring
+}
+
+// CursorOption configures how cursors are encoded and decoded.
+type CursorOption func(*cursorOptions)
+
+// WithCursorKeyring signs cursors with the keyring, and only accepts cursors it signed (see WithLegacyCursors).
+// A nil keyring keeps plain, unsigned cursors.
+func WithCursorKeyring(keyring *Keyring) CursorOption {
+	return func(options *cursorOptions) {
+		options.keyring = keyring
+	}
+}
+
+func newCursorOptions(opts ...CursorOption) cursorOptions {
+	ret := cursorOptions{}
+	for _, opt := range opts {
+		opt(&ret)
+	}
+	return ret
+}
+
+// keyringQuery is implemented by the paginated queries, which sign the cursors of their pages with their keyring
+type keyringQuery interface {
+	cursorKeyring() *Keyring
+	setCursorKeyring(keyring *Keyring)
+}
@@ -0,0 +1,184 @@
+package paginate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	oldKey := CursorKey{ID: "old", Secret: bytes.Repeat([]byte("a"), 32)}
+	newKey := CursorKey{ID: "new", Secret: bytes.Repeat([]byte("b"), 32)}
+	payload := []byte(`{"pageSize":15,"column":"id"}`)
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+
+		for _, opts := range [][]KeyringOption{
+			nil,
+			{WithCursorEncryption()},
+		} {
+			keyring, err := NewKeyring([]CursorKey{newKey}, opts...)
+			require.NoError(t, err)
+
+			cursor, err := keyring.Encode(payload)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(cursor, CursorFormatV1+".new."))
+
+			decoded, err := keyring.Decode(cursor)
+			require.NoError(t, err)
+			require.JSONEq(t, string(payload), string(decoded))
+		}
+	})
+
+	t.Run("encrypted payload is opaque", func(t *testing.T) {
+		t.Parallel()
+
+		keyring, err := NewKeyring([]CursorKey{newKey}, WithCursorEncryption())
+		require.NoError(t, err)
+
+		cursor, err := keyring.Encode(payload)
+		require.NoError(t, err)
+
+		raw, err := base64.RawURLEncoding.DecodeString(strings.Split(cursor, ".")[2])
+		require.NoError(t, err)
+		require.NotContains(t, string(raw), "pageSize")
+	})
+
+	t.Run("tampered cursor", func(t *testing.T) {
+		t.Parallel()
+
+		keyring, err := NewKeyring([]CursorKey{newKey})
+		require.NoError(t, err)
+
+		cursor, err := keyring.Encode(payload)
+		require.NoError(t, err)
+
+		parts := strings.Split(cursor, ".")
+		parts[2] = base64.RawURLEncoding.EncodeToString(append([]byte{payloadPlain}, []byte(`{"data":{"pageSize":1000,"column":"id"}}`)...))
+
+		_, err = keyring.Decode(strings.Join(parts, "."))
+		require.ErrorIs(t, err, ErrInvalidCursorSignature)
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		t.Parallel()
+
+		before, err := NewKeyring([]CursorKey{oldKey})
+		require.NoError(t, err)
+		cursor, err := before.Encode(payload)
+		require.NoError(t, err)
+
+		after, err := NewKeyring([]CursorKey{newKey, oldKey})
+		require.NoError(t, err)
+		decoded, err := after.Decode(cursor)
+		require.NoError(t, err)
+		require.JSONEq(t, string(payload), string(decoded))
+
+		retired, err := NewKeyring([]CursorKey{newKey})
+		require.NoError(t, err)
+		_, err = retired.Decode(cursor)
+		require.ErrorIs(t, err, ErrUnknownCursorKey)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Now()
+		keyring, err := NewKeyring([]CursorKey{newKey}, WithCursorTTL(time.Minute), withCursorClock(func() time.Time {
+			return now
+		}))
+		require.NoError(t, err)
+
+		cursor, err := keyring.Encode(payload)
+		require.NoError(t, err)
+
+		_, err = keyring.Decode(cursor)
+		require.NoError(t, err)
+
+		now = now.Add(2 * time.Minute)
+		_, err = keyring.Decode(cursor)
+		require.ErrorIs(t, err, ErrCursorExpired)
+	})
+
+	t.Run("legacy cursors", func(t *testing.T) {
+		t.Parallel()
+
+		legacy := base64.RawURLEncoding.EncodeToString(payload)
+
+		keyring, err := NewKeyring([]CursorKey{newKey})
+		require.NoError(t, err)
+		_, err = keyring.Decode(legacy)
+		require.ErrorIs(t, err, ErrUnsupportedCursor)
+
+		keyring, err = NewKeyring([]CursorKey{newKey}, WithLegacyCursors())
+		require.NoError(t, err)
+		decoded, err := keyring.Decode(legacy)
+		require.NoError(t, err)
+		require.JSONEq(t, string(payload), string(decoded))
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		t.Parallel()
+
+		for _, keys := range [][]CursorKey{
+			nil,
+			{{ID: "", Secret: newKey.Secret}},
+			{{ID: "a.b", Secret: newKey.Secret}},
+			{{ID: "short", Secret: []byte("secret")}},
+			{newKey, newKey},
+		} {
+			_, err := NewKeyring(keys)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestExtractWithKeyring(t *testing.T) {
+	t.Parallel()
+
+	keyring, err := NewKeyring([]CursorKey{{ID: "k1", Secret: bytes.Repeat([]byte("a"), 32)}})
+	require.NoError(t, err)
+
+	query := ColumnPaginatedQuery[any]{
+		PageSize:     15,
+		Column:       "id",
+		PaginationID: big.NewInt(10),
+		Keyring:      keyring,
+	}
+	cursor := query.EncodeAsCursor()
+	require.True(t, strings.HasPrefix(cursor, CursorFormatV1+"."))
+
+	r := httptest.NewRequest("GET", "/?cursor="+cursor, nil)
+	extracted, err := Extract[ColumnPaginatedQuery[any]](r, nil, WithCursorKeyring(keyring))
+	require.NoError(t, err)
+	require.Equal(t, query, *extracted)
+
+	// Without the keyring, the signed cursor is not understood
+	_, err = Extract[ColumnPaginatedQuery[any]](r, nil)
+	require.Equal(t, ErrInvalidCursor, err)
+
+	tampered := EncodeCursor(ColumnPaginatedQuery[any]{
+		PageSize: 1000,
+		Column:   "id",
+	}, WithCursorKeyring(keyring))
+	r = httptest.NewRequest("GET", "/?cursor="+strings.Replace(cursor, strings.Split(cursor, ".")[2], strings.Split(tampered, ".")[2], 1), nil)
+	_, err = Extract[ColumnPaginatedQuery[any]](r, nil, WithCursorKeyring(keyring))
+	// The cause is not returned to the client
+	require.Equal(t, ErrInvalidCursor, err)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	extracted, err = Extract[ColumnPaginatedQuery[any]](r, func() (*ColumnPaginatedQuery[any], error) {
+		return &ColumnPaginatedQuery[any]{PageSize: 15}, nil
+	}, WithCursorKeyring(keyring))
+	require.NoError(t, err)
+	require.Same(t, keyring, extracted.Keyring)
+}
@@ -22,10 +22,18 @@ func Iterate[T any, Q any](ctx context.Context, q Q, iterator func(ctx context.C
 			break
 		}
 
+		var keyring *Keyring
+		if kq, ok := any(q).(interface{ cursorKeyring() *Keyring }); ok {
+			keyring = kq.cursorKeyring()
+		}
+
 		newQuery := reflect.New(reflect.TypeOf(q))
-		if err := UnmarshalCursor(cursor.Next, newQuery.Interface()); err != nil {
+		if err := UnmarshalCursor(cursor.Next, newQuery.Interface(), WithCursorKeyring(keyring)); err != nil {
 			return fmt.Errorf("paginating next request: %w", err)
 		}
+		if kq, ok := newQuery.Interface().(keyringQuery); ok {
+			kq.setCursorKeyring(keyring)
+		}
 
 		q = newQuery.Elem().Interface().(Q)
 	}
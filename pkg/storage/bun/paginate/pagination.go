@@ -4,10 +4,13 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"math/big"
 	"net/http"
 	"strconv"
+
+	"github.com/uptrace/bun"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
 )
 
 const (
@@ -23,6 +26,7 @@ const (
 
 var (
 	ErrInvalidPageSize = errors.New("invalid 'pageSize' query param")
+	ErrInvalidCursor   = errors.New("invalid 'cursor' query param")
 )
 
 type Order int
@@ -49,10 +53,42 @@ type ColumnPaginatedQuery[OPTIONS any] struct {
 	Order        Order    `json:"order"`
 	Options      OPTIONS  `json:"filters"`
 	Reverse      bool     `json:"reverse"`
+
+	// Count asks for the total number of rows matching the query to be reported in the cursor.
+	// With a keyring, it is only kept from signed cursors (see WithCursorKeyring), so that clients cannot turn it on.
+	Count CountMode `json:"count,omitempty"`
+	// Conn runs the statement estimating the total with CountEstimated, and must be the connection
+	// or the transaction the page query is built on. The database of the page query is used when nil.
+	Conn bun.IConn `json:"-"`
+
+	// TieBreakers enables composite keyset pagination on Column followed by these columns.
+	// The last one must be unique (typically the primary key), and all of them must be non-null.
+	// In this mode, PaginationKey and BottomKey replace PaginationID and Bottom.
+	TieBreakers   []PaginationColumn `json:"tieBreakers,omitempty"`
+	PaginationKey []KeyValue         `json:"paginationKey,omitempty"`
+	BottomKey     []KeyValue         `json:"bottomKey,omitempty"`
+
+	// Keyring signs the cursors of the pages, see WithCursorKeyring.
+	Keyring *Keyring `json:"-"`
 }
 
 func (q *ColumnPaginatedQuery[PAYLOAD]) EncodeAsCursor() string {
-	return encodeCursor(q)
+	if q == nil {
+		return ""
+	}
+	return EncodeCursor(*q, WithCursorKeyring(q.Keyring))
+}
+
+func (q ColumnPaginatedQuery[PAYLOAD]) cursorKeyring() *Keyring {
+	return q.Keyring
+}
+
+func (q *ColumnPaginatedQuery[PAYLOAD]) setCursorKeyring(keyring *Keyring) {
+	q.Keyring = keyring
+}
+
+func (q *ColumnPaginatedQuery[PAYLOAD]) setCount(mode CountMode) {
+	q.Count = mode
 }
 
 func (a *ColumnPaginatedQuery[PAYLOAD]) WithPageSize(pageSize uint64) *ColumnPaginatedQuery[PAYLOAD] {
@@ -69,15 +105,67 @@ func (a *ColumnPaginatedQuery[PAYLOAD]) WithColumn(column string) *ColumnPaginat
 	return a
 }
 
+func (a *ColumnPaginatedQuery[PAYLOAD]) WithCount(mode CountMode) *ColumnPaginatedQuery[PAYLOAD] {
+	a.Count = mode
+
+	return a
+}
+
+func (a *ColumnPaginatedQuery[PAYLOAD]) WithKeyring(keyring *Keyring) *ColumnPaginatedQuery[PAYLOAD] {
+	a.Keyring = keyring
+
+	return a
+}
+
+func (a *ColumnPaginatedQuery[PAYLOAD]) WithConn(conn bun.IConn) *ColumnPaginatedQuery[PAYLOAD] {
+	a.Conn = conn
+
+	return a
+}
+
+func (a *ColumnPaginatedQuery[PAYLOAD]) WithTieBreaker(column string, order Order) *ColumnPaginatedQuery[PAYLOAD] {
+	a.TieBreakers = append(a.TieBreakers, PaginationColumn{
+		Name:  column,
+		Order: order,
+	})
+
+	return a
+}
+
 type OffsetPaginatedQuery[OPTIONS any] struct {
 	Offset   uint64  `json:"offset"`
 	Order    Order   `json:"order"`
 	PageSize uint64  `json:"pageSize"`
 	Options  OPTIONS `json:"filters"`
+
+	// Count asks for the total number of rows matching the query to be reported in the cursor.
+	// With a keyring, it is only kept from signed cursors (see WithCursorKeyring), so that clients cannot turn it on.
+	Count CountMode `json:"count,omitempty"`
+	// Conn runs the statement estimating the total with CountEstimated, and must be the connection
+	// or the transaction the page query is built on. The database of the page query is used when nil.
+	Conn bun.IConn `json:"-"`
+
+	// Keyring signs the cursors of the pages, see WithCursorKeyring.
+	Keyring *Keyring `json:"-"`
 }
 
 func (q *OffsetPaginatedQuery[PAYLOAD]) EncodeAsCursor() string {
-	return encodeCursor(q)
+	if q == nil {
+		return ""
+	}
+	return EncodeCursor(*q, WithCursorKeyring(q.Keyring))
+}
+
+func (q OffsetPaginatedQuery[PAYLOAD]) cursorKeyring() *Keyring {
+	return q.Keyring
+}
+
+func (q *OffsetPaginatedQuery[PAYLOAD]) setCursorKeyring(keyring *Keyring) {
+	q.Keyring = keyring
+}
+
+func (q *OffsetPaginatedQuery[PAYLOAD]) setCount(mode CountMode) {
+	q.Count = mode
 }
 
 func (a *OffsetPaginatedQuery[PAYLOAD]) WithPageSize(pageSize uint64) *OffsetPaginatedQuery[PAYLOAD] {
@@ -88,23 +176,51 @@ func (a *OffsetPaginatedQuery[PAYLOAD]) WithPageSize(pageSize uint64) *OffsetPag
 	return a
 }
 
-func encodeCursor[T any](v *T) string {
-	if v == nil {
-		return ""
-	}
-	return EncodeCursor(*v)
+func (a *OffsetPaginatedQuery[PAYLOAD]) WithCount(mode CountMode) *OffsetPaginatedQuery[PAYLOAD] {
+	a.Count = mode
+
+	return a
+}
+
+func (a *OffsetPaginatedQuery[PAYLOAD]) WithKeyring(keyring *Keyring) *OffsetPaginatedQuery[PAYLOAD] {
+	a.Keyring = keyring
+
+	return a
 }
 
-func EncodeCursor[T any](v T) string {
+func (a *OffsetPaginatedQuery[PAYLOAD]) WithConn(conn bun.IConn) *OffsetPaginatedQuery[PAYLOAD] {
+	a.Conn = conn
+
+	return a
+}
+
+func EncodeCursor[T any](v T, opts ...CursorOption) string {
 	data, err := json.Marshal(v)
 	if err != nil {
 		panic(err)
 	}
+	if keyring := newCursorOptions(opts...).keyring; keyring != nil {
+		ret, err := keyring.Encode(data)
+		if err != nil {
+			panic(err)
+		}
+		return ret
+	}
 	return base64.RawURLEncoding.EncodeToString(data)
 }
 
-func UnmarshalCursor(v string, to any) error {
-	res, err := base64.RawURLEncoding.DecodeString(v)
+func UnmarshalCursor(v string, to any, opts ...CursorOption) error {
+	var (
+		res    []byte
+		signed bool
+		err    error
+	)
+	keyring := newCursorOptions(opts...).keyring
+	if keyring != nil {
+		res, signed, err = keyring.decode(v)
+	} else {
+		res, err = base64.RawURLEncoding.DecodeString(v)
+	}
 	if err != nil {
 		return err
 	}
@@ -113,6 +229,12 @@ func UnmarshalCursor(v string, to any) error {
 		return err
 	}
 
+	// Counting rows is costly, so clients must not be able to turn it on by crafting cursors.
+	// Without keyring, no cursor is signed, so the count mode is kept.
+	if q, ok := to.(countedQuery); ok && keyring != nil && !signed {
+		q.setCount(CountNone)
+	}
+
 	return nil
 }
 
@@ -167,15 +289,29 @@ func GetPageSize(r *http.Request, opts ...func(*pageSizeConfiguration)) (uint64,
 	return pageSize, nil
 }
 
-func Extract[Q any](r *http.Request, defaulter func() (*Q, error)) (*Q, error) {
-	var query Q
-	if r.URL.Query().Get(QueryKeyCursor) != "" {
-		err := UnmarshalCursor(r.URL.Query().Get(QueryKeyCursor), &query)
-		if err != nil {
-			return nil, fmt.Errorf("invalid '%s' query param", QueryKeyCursor)
+// Extract decodes the query from the cursor of the request, or creates it with defaulter when there is none.
+// Invalid cursors are reported with ErrInvalidCursor, the cause being logged rather than returned to the client.
+// When a keyring is configured with WithCursorKeyring, it is also set on the query to sign the cursors of its pages.
+func Extract[Q any](r *http.Request, defaulter func() (*Q, error), opts ...CursorOption) (*Q, error) {
+	query := new(Q)
+	if cursor := r.URL.Query().Get(QueryKeyCursor); cursor != "" {
+		if err := UnmarshalCursor(cursor, query, opts...); err != nil {
+			logging.FromContext(r.Context()).Debugf("decoding '%s' query param: %s", QueryKeyCursor, err)
+			return nil, ErrInvalidCursor
 		}
-		return &query, nil
 	} else {
-		return defaulter()
+		var err error
+		query, err = defaulter()
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	if keyring := newCursorOptions(opts...).keyring; keyring != nil {
+		if q, ok := any(query).(keyringQuery); ok {
+			q.setCursorKeyring(keyring)
+		}
+	}
+
+	return query, nil
 }
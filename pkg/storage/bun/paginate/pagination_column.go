@@ -16,6 +16,10 @@ import (
 func UsingColumn[FILTERS any, ENTITY any](ctx context.Context,
 	sb *bun.SelectQuery,
 	query ColumnPaginatedQuery[FILTERS]) (*Cursor[ENTITY], error) {
+	if len(query.TieBreakers) > 0 {
+		return usingKeyset[FILTERS, ENTITY](ctx, sb, query)
+	}
+
 	ret := make([]ENTITY, 0)
 
 	// The column comes from the client-provided cursor, so it must be validated
@@ -28,6 +32,8 @@ func UsingColumn[FILTERS any, ENTITY any](ctx context.Context,
 	}
 
 	sb = sb.Model(&ret)
+	filtered := sb.Clone()
+
 	sb = sb.Limit(int(query.PageSize) + 1) // Fetch one additional item to find the next token
 	order := query.Order
 	if query.Reverse {
@@ -53,7 +59,8 @@ func UsingColumn[FILTERS any, ENTITY any](ctx context.Context,
 		}
 	}
 
-	if err := sb.Scan(ctx); err != nil {
+	total, err := scanPage(ctx, sb, filtered, &ret, query.Count, query.Conn, false)
+	if err != nil {
 		return nil, err
 	}
 
@@ -111,6 +118,9 @@ func UsingColumn[FILTERS any, ENTITY any](ctx context.Context,
 		Previous: previous.EncodeAsCursor(),
 		Next:     next.EncodeAsCursor(),
 		Data:     ret,
+
+		Total:           total,
+		TotalIsEstimate: total != nil && query.Count == CountEstimated,
 	}, nil
 }
 
@@ -0,0 +1,184 @@
+package paginate
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/uptrace/bun"
+)
+
+// CountMode selects how the total number of rows matching a paginated query is reported.
+type CountMode string
+
+const (
+	// CountNone does not compute any total (default).
+	CountNone CountMode = ""
+	// CountExact counts the rows matching the query in the page query itself, so the total is consistent with the page.
+	// The rows are scanned column by column into the entities, so relations loaded through joins are not supported.
+	CountExact CountMode = "exact"
+	// CountEstimated reads the Postgres planner row estimate of the filtered query.
+	// It is much cheaper on large tables, but may be off by a wide margin.
+	// The estimation runs on the Conn of the paginated query, which must be set when paginating in a transaction.
+	CountEstimated CountMode = "estimated"
+)
+
+// countedQuery is implemented by the paginated queries, whose count mode is only kept from signed cursors
+type countedQuery interface {
+	setCount(mode CountMode)
+}
+
+// totalColumn holds the total of the rows matching a page query, when counting exactly.
+// Like other columns starting with an underscore, bun ignores it when scanning models.
+const totalColumn = "_paginate_total"
+
+// scanPage scans the rows of the page query sb into ret, and reports the total of the rows of filtered as asked by mode.
+// filtered is a clone of sb before its pagination clauses (where, order, limit, offset).
+// When windowed, the pagination does not filter rows out (offset pagination), so the total is counted by a window over the page query.
+// Otherwise, a window would only count the rows after the cursor, so the rows of filtered are counted by a subquery.
+// conn runs the estimation of the total, the database of sb being used when nil.
+func scanPage[T any](ctx context.Context, sb, filtered *bun.SelectQuery, ret *[]T, mode CountMode, conn bun.IConn, windowed bool) (*uint64, error) {
+	switch mode {
+	case CountNone:
+		return nil, sb.Scan(ctx)
+	case CountExact:
+		// Materializes the default columns of the model, which the total column would replace otherwise
+		sb = sb.ExcludeColumn()
+		if windowed {
+			sb = sb.ColumnExpr("count(*) over () AS ?", bun.Ident(totalColumn))
+		} else {
+			sb = sb.ColumnExpr("(SELECT count(*) FROM (?) AS filtered) AS ?", filtered, bun.Ident(totalColumn))
+		}
+
+		model := &countedModel[T]{
+			db:       sb.DB(),
+			entities: ret,
+		}
+		if err := sb.Scan(ctx, model); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if model.total != nil {
+			return model.total, nil
+		}
+
+		// An empty page does not hold the total
+		total, err := filtered.Count(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("counting rows: %w", err)
+		}
+		ret := uint64(total)
+		return &ret, nil
+	case CountEstimated:
+		if conn == nil {
+			conn = sb.DB()
+		}
+		total, err := estimate(ctx, conn, filtered)
+		if err != nil {
+			return nil, err
+		}
+		return total, sb.Scan(ctx)
+	default:
+		return nil, fmt.Errorf("invalid count mode %q", mode)
+	}
+}
+
+func estimate(ctx context.Context, conn bun.IConn, sb *bun.SelectQuery) (*uint64, error) {
+	var plan string
+	if err := conn.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+sb.String()).Scan(&plan); err != nil {
+		return nil, fmt.Errorf("estimating rows: %w", err)
+	}
+
+	explain := make([]struct {
+		Plan struct {
+			PlanRows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}, 0)
+	if err := json.Unmarshal([]byte(plan), &explain); err != nil {
+		return nil, fmt.Errorf("reading query plan: %w", err)
+	}
+	if len(explain) == 0 {
+		return nil, fmt.Errorf("reading query plan: empty plan")
+	}
+	ret := uint64(explain[0].Plan.PlanRows)
+	return &ret, nil
+}
+
+// countedModel scans the rows of a page query into entities, and the total column they hold into total
+type countedModel[T any] struct {
+	db       *bun.DB
+	entities *[]T
+	total    *uint64
+}
+
+var _ bun.Model = (*countedModel[any])(nil)
+
+func (m *countedModel[T]) Value() any {
+	return m.entities
+}
+
+func (m *countedModel[T]) ScanRows(ctx context.Context, rows *sql.Rows) (int, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return 0, err
+		}
+
+		var entity T
+		model, ok := m.db.NewSelect().Model(&entity).GetModel().(bun.TableModel)
+		if !ok {
+			return 0, fmt.Errorf("counting rows: unsupported entity %T", entity)
+		}
+		if err := model.BeforeScanRow(ctx); err != nil {
+			return 0, err
+		}
+		for i, column := range columns {
+			if column != totalColumn {
+				if err := model.ScanColumn(column, values[i]); err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			total, err := parseTotal(values[i])
+			if err != nil {
+				return 0, err
+			}
+			m.total = &total
+		}
+		if err := model.AfterScanRow(ctx); err != nil {
+			return 0, err
+		}
+
+		*m.entities = append(*m.entities, entity)
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+func parseTotal(value any) (uint64, error) {
+	switch value := value.(type) {
+	case int64:
+		return uint64(value), nil
+	case []byte:
+		return strconv.ParseUint(string(value), 10, 64)
+	case string:
+		return strconv.ParseUint(value, 10, 64)
+	default:
+		return 0, fmt.Errorf("counting rows: unexpected total %T", value)
+	}
+}
@@ -0,0 +1,139 @@
+package paginate_test
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	bunconnect "github.com/formancehq/go-libs/v5/pkg/storage/bun/connect"
+	bunpaginate "github.com/formancehq/go-libs/v5/pkg/storage/bun/paginate"
+)
+
+func TestCount(t *testing.T) {
+	t.Parallel()
+
+	database := srv.NewDatabase(t)
+	db, err := bunconnect.OpenSQLDB(logging.TestingContext(), bunconnect.ConnectionOptions{
+		DatabaseSourceName: database.ConnString(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	keyring, err := bunpaginate.NewKeyring([]bunpaginate.CursorKey{{ID: "k1", Secret: bytes.Repeat([]byte("a"), 32)}})
+	require.NoError(t, err)
+
+	type model struct {
+		ID   *bunpaginate.BigInt `bun:"id,type:numeric"`
+		Pair bool                `bun:"pair"`
+	}
+
+	// The table only exists in the transaction, so counting outside of it would fail
+	tx, err := db.BeginTx(context.Background(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = tx.Rollback()
+	})
+
+	_, err = tx.Exec(`CREATE TABLE "models" (id int, pair boolean);`)
+	require.NoError(t, err)
+
+	models := make([]model, 0)
+	for i := 0; i < 100; i++ {
+		models = append(models, model{
+			ID:   (*bunpaginate.BigInt)(big.NewInt(int64(i))),
+			Pair: i%2 == 0,
+		})
+	}
+	_, err = tx.NewInsert().Model(&models).Exec(context.Background())
+	require.NoError(t, err)
+
+	t.Run("exact", func(t *testing.T) {
+		query := bunpaginate.ColumnPaginatedQuery[bool]{
+			PageSize: 20,
+			Column:   "id",
+			Order:    bunpaginate.OrderAsc,
+			Count:    bunpaginate.CountExact,
+			Keyring:  keyring,
+		}
+
+		pages := 0
+		err := bunpaginate.Iterate(context.Background(), query,
+			func(ctx context.Context, q bunpaginate.ColumnPaginatedQuery[bool]) (*bunpaginate.Cursor[model], error) {
+				return bunpaginate.UsingColumn[bool, model](ctx, tx.NewSelect().Where("pair"), q)
+			},
+			func(cursor *bunpaginate.Cursor[model]) error {
+				pages++
+				require.NotNil(t, cursor.Total)
+				require.EqualValues(t, 50, *cursor.Total)
+				require.False(t, cursor.TotalIsEstimate)
+				return nil
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, 3, pages)
+
+		offsetCursor, err := bunpaginate.UsingOffset[bool, model](context.Background(), tx.NewSelect().Where("pair"), bunpaginate.OffsetPaginatedQuery[bool]{
+			PageSize: 20,
+			Offset:   40,
+			Count:    bunpaginate.CountExact,
+		})
+		require.NoError(t, err)
+		require.Len(t, offsetCursor.Data, 10)
+		require.EqualValues(t, 50, *offsetCursor.Total)
+
+		// Empty pages do not hold the total
+		offsetCursor, err = bunpaginate.UsingOffset[bool, model](context.Background(), tx.NewSelect().Where("pair"), bunpaginate.OffsetPaginatedQuery[bool]{
+			PageSize: 20,
+			Offset:   60,
+			Count:    bunpaginate.CountExact,
+		})
+		require.NoError(t, err)
+		require.Empty(t, offsetCursor.Data)
+		require.EqualValues(t, 50, *offsetCursor.Total)
+	})
+
+	t.Run("estimated", func(t *testing.T) {
+		cursor, err := bunpaginate.UsingColumn[bool, model](context.Background(), tx.NewSelect().Where("pair"), bunpaginate.ColumnPaginatedQuery[bool]{
+			PageSize: 20,
+			Column:   "id",
+			Order:    bunpaginate.OrderAsc,
+			Count:    bunpaginate.CountEstimated,
+			Conn:     tx,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, cursor.Total)
+		require.True(t, cursor.TotalIsEstimate)
+	})
+
+	t.Run("unsigned cursors do not count with a keyring", func(t *testing.T) {
+		cursor := bunpaginate.EncodeCursor(bunpaginate.ColumnPaginatedQuery[bool]{
+			PageSize: 20,
+			Column:   "id",
+			Count:    bunpaginate.CountExact,
+		})
+
+		// Without keyring, no cursor is signed
+		q := bunpaginate.ColumnPaginatedQuery[bool]{}
+		require.NoError(t, bunpaginate.UnmarshalCursor(cursor, &q))
+		require.Equal(t, bunpaginate.CountExact, q.Count)
+
+		legacyKeyring, err := bunpaginate.NewKeyring([]bunpaginate.CursorKey{{ID: "k1", Secret: bytes.Repeat([]byte("a"), 32)}}, bunpaginate.WithLegacyCursors())
+		require.NoError(t, err)
+		require.NoError(t, bunpaginate.UnmarshalCursor(cursor, &q, bunpaginate.WithCursorKeyring(legacyKeyring)))
+		require.Equal(t, bunpaginate.CountNone, q.Count)
+
+		signed := bunpaginate.EncodeCursor(bunpaginate.ColumnPaginatedQuery[bool]{
+			PageSize: 20,
+			Column:   "id",
+			Count:    bunpaginate.CountExact,
+		}, bunpaginate.WithCursorKeyring(keyring))
+		require.NoError(t, bunpaginate.UnmarshalCursor(signed, &q, bunpaginate.WithCursorKeyring(keyring)))
+		require.Equal(t, bunpaginate.CountExact, q.Count)
+	})
+}
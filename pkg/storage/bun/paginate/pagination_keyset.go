@@ -0,0 +1,306 @@
+package paginate
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+
+	libtime "github.com/formancehq/go-libs/v5/pkg/types/time"
+)
+
+type KeyType string
+
+const (
+	KeyTypeInt    KeyType = "int"
+	KeyTypeString KeyType = "string"
+	KeyTypeUUID   KeyType = "uuid"
+	KeyTypeTime   KeyType = "time"
+)
+
+// PaginationColumn is an additional column of a composite keyset, with its own order.
+type PaginationColumn struct {
+	Name  string `json:"name"`
+	Order Order  `json:"order"`
+}
+
+// KeyValue is a single component of a composite pagination key.
+// Values are stored in their canonical string form so they survive a round-trip through a cursor.
+type KeyValue struct {
+	Type  KeyType `json:"type"`
+	Value string  `json:"value"`
+}
+
+func (v KeyValue) sqlValue() (any, error) {
+	switch v.Type {
+	case KeyTypeInt:
+		i, ok := new(big.Int).SetString(v.Value, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid int pagination key %q", v.Value)
+		}
+		return i.String(), nil
+	case KeyTypeString:
+		return v.Value, nil
+	case KeyTypeUUID:
+		id, err := uuid.Parse(v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uuid pagination key %q: %w", v.Value, err)
+		}
+		return id.String(), nil
+	case KeyTypeTime:
+		t, err := time.Parse(time.RFC3339Nano, v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time pagination key %q: %w", v.Value, err)
+		}
+		return t.UTC(), nil
+	default:
+		return nil, fmt.Errorf("invalid pagination key type %q", v.Type)
+	}
+}
+
+func newKeyValue(v any) (KeyValue, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return KeyValue{Type: KeyTypeTime, Value: v.UTC().Round(time.Microsecond).Format(time.RFC3339Nano)}, nil
+	case *time.Time:
+		if v == nil {
+			break
+		}
+		return newKeyValue(*v)
+	case libtime.Time:
+		return newKeyValue(v.Time)
+	case *libtime.Time:
+		if v == nil {
+			break
+		}
+		return newKeyValue(v.Time)
+	case uuid.UUID:
+		return KeyValue{Type: KeyTypeUUID, Value: v.String()}, nil
+	case *uuid.UUID:
+		if v == nil {
+			break
+		}
+		return newKeyValue(*v)
+	case string:
+		return KeyValue{Type: KeyTypeString, Value: v}, nil
+	case *string:
+		if v == nil {
+			break
+		}
+		return newKeyValue(*v)
+	case *BigInt:
+		if v == nil {
+			break
+		}
+		return KeyValue{Type: KeyTypeInt, Value: v.ToMathBig().String()}, nil
+	case BigInt:
+		return newKeyValue(&v)
+	case *big.Int:
+		if v == nil {
+			break
+		}
+		return KeyValue{Type: KeyTypeInt, Value: v.String()}, nil
+	case big.Int:
+		return newKeyValue(&v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return KeyValue{Type: KeyTypeInt, Value: fmt.Sprint(v)}, nil
+	case *int:
+		if v == nil {
+			break
+		}
+		return newKeyValue(*v)
+	case *int64:
+		if v == nil {
+			break
+		}
+		return newKeyValue(*v)
+	case *uint64:
+		if v == nil {
+			break
+		}
+		return newKeyValue(*v)
+	default:
+		return KeyValue{}, fmt.Errorf("invalid pagination key, type %T not handled", v)
+	}
+
+	return KeyValue{}, fmt.Errorf("invalid pagination key, nil value")
+}
+
+func equalKeys(k1, k2 []KeyValue) bool {
+	if len(k1) != len(k2) {
+		return false
+	}
+	for i := range k1 {
+		if k1[i] != k2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type keysetColumn struct {
+	name   string
+	order  Order
+	fields []reflect.StructField
+}
+
+func usingKeyset[FILTERS any, ENTITY any](ctx context.Context,
+	sb *bun.SelectQuery,
+	query ColumnPaginatedQuery[FILTERS]) (*Cursor[ENTITY], error) {
+	ret := make([]ENTITY, 0)
+
+	// As with the single column mode, every column comes from the client-provided
+	// cursor and must be resolved against the entity before reaching SQL.
+	var v ENTITY
+	columns := make([]keysetColumn, 0, len(query.TieBreakers)+1)
+	for _, column := range append([]PaginationColumn{{
+		Name:  query.Column,
+		Order: query.Order,
+	}}, query.TieBreakers...) {
+		fields := findPaginationFieldPath(v, column.Name)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid pagination column %q", column.Name)
+		}
+		if column.Order != OrderAsc && column.Order != OrderDesc {
+			return nil, fmt.Errorf("invalid order for pagination column %q", column.Name)
+		}
+		columns = append(columns, keysetColumn{
+			name:   column.Name,
+			order:  column.Order,
+			fields: fields,
+		})
+	}
+
+	if query.PaginationKey != nil && len(query.PaginationKey) != len(columns) {
+		return nil, fmt.Errorf("invalid pagination key: expected %d values, got %d", len(columns), len(query.PaginationKey))
+	}
+
+	sb = sb.Model(&ret)
+	filtered := sb.Clone()
+
+	sb = sb.Limit(int(query.PageSize) + 1) // Fetch one additional item to find the next token
+	for _, column := range columns {
+		order := column.order
+		if query.Reverse {
+			order = order.Reverse()
+		}
+		sb = sb.OrderExpr("? ?", bun.Ident(column.name), bun.Safe(order.String()))
+	}
+
+	if query.PaginationKey != nil {
+		values := make([]any, 0, len(columns))
+		for _, key := range query.PaginationKey {
+			value, err := key.sqlValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+
+		// Reverse pages stop strictly before the current key, while forward pages start on it,
+		// mirroring the single column mode.
+		sb = sb.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			for i := range columns {
+				q = q.WhereGroup(" OR ", func(q *bun.SelectQuery) *bun.SelectQuery {
+					for j := 0; j < i; j++ {
+						q = q.Where("? = ?", bun.Ident(columns[j].name), values[j])
+					}
+					q = q.Where("? ? ?", bun.Ident(columns[i].name), bun.Safe(keysetOperator(columns[i].order, query.Reverse)), values[i])
+					return q
+				})
+			}
+			if !query.Reverse {
+				q = q.WhereGroup(" OR ", func(q *bun.SelectQuery) *bun.SelectQuery {
+					for i := range columns {
+						q = q.Where("? = ?", bun.Ident(columns[i].name), values[i])
+					}
+					return q
+				})
+			}
+			return q
+		})
+	}
+
+	total, err := scanPage(ctx, sb, filtered, &ret, query.Count, query.Conn, false)
+	if err != nil {
+		return nil, err
+	}
+
+	paginationKeys := make([][]KeyValue, 0, len(ret))
+	for _, t := range ret {
+		key := make([]KeyValue, 0, len(columns))
+		for _, column := range columns {
+			value, err := newKeyValue(reflect.ValueOf(t).FieldByName(column.fields[0].Name).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("reading pagination column %q: %w", column.name, err)
+			}
+			key = append(key, value)
+		}
+		if query.BottomKey == nil {
+			query.BottomKey = key
+		}
+		paginationKeys = append(paginationKeys, key)
+	}
+
+	hasMore := len(ret) > int(query.PageSize)
+	if hasMore {
+		ret = ret[:len(ret)-1]
+	}
+	if query.Reverse {
+		for i := 0; i < len(ret)/2; i++ {
+			ret[i], ret[len(ret)-i-1] = ret[len(ret)-i-1], ret[i]
+		}
+	}
+
+	var previous, next *ColumnPaginatedQuery[FILTERS]
+
+	if query.Reverse {
+		cp := query
+		cp.Reverse = false
+		next = &cp
+
+		if hasMore {
+			cp := query
+			cp.PaginationKey = paginationKeys[len(paginationKeys)-2]
+			previous = &cp
+		}
+	} else {
+		if hasMore {
+			cp := query
+			cp.PaginationKey = paginationKeys[len(paginationKeys)-1]
+			next = &cp
+		}
+		// The bottom key is the first row of the first page, so any other key means
+		// there are rows before the current page.
+		if query.PaginationKey != nil && !equalKeys(query.PaginationKey, query.BottomKey) {
+			cp := query
+			cp.Reverse = true
+			previous = &cp
+		}
+	}
+
+	return &Cursor[ENTITY]{
+		PageSize: int(query.PageSize),
+		HasMore:  next != nil,
+		Previous: previous.EncodeAsCursor(),
+		Next:     next.EncodeAsCursor(),
+		Data:     ret,
+
+		Total:           total,
+		TotalIsEstimate: total != nil && query.Count == CountEstimated,
+	}, nil
+}
+
+func keysetOperator(order Order, reverse bool) string {
+	if reverse {
+		order = order.Reverse()
+	}
+	if order == OrderAsc {
+		return ">"
+	}
+	return "<"
+}
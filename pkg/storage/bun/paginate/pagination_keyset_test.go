@@ -0,0 +1,192 @@
+package paginate_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	bunconnect "github.com/formancehq/go-libs/v5/pkg/storage/bun/connect"
+	bundebug "github.com/formancehq/go-libs/v5/pkg/storage/bun/debug"
+	bunpaginate "github.com/formancehq/go-libs/v5/pkg/storage/bun/paginate"
+)
+
+func TestKeysetPagination(t *testing.T) {
+	t.Parallel()
+
+	hooks := make([]bun.QueryHook, 0)
+	if testing.Verbose() {
+		hooks = append(hooks, bundebug.NewQueryHook())
+	}
+
+	database := srv.NewDatabase(t)
+	db, err := bunconnect.OpenSQLDB(logging.TestingContext(), bunconnect.ConnectionOptions{
+		DatabaseSourceName: database.ConnString(),
+	}, hooks...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	_, err = db.Exec(`
+		CREATE TABLE "keyset_models" (id uuid, name varchar, created_at timestamp);
+	`)
+	require.NoError(t, err)
+
+	type model struct {
+		bun.BaseModel `bun:"keyset_models"`
+
+		ID        uuid.UUID `bun:"id,type:uuid"`
+		Name      string    `bun:"name"`
+		CreatedAt time.Time `bun:"created_at"`
+	}
+
+	// Only 10 distinct timestamps for 100 rows, so pages always break on ties
+	now := time.Now().UTC().Round(time.Microsecond)
+	models := make([]model, 0)
+	for i := 0; i < 100; i++ {
+		models = append(models, model{
+			ID:        uuid.New(),
+			Name:      fmt.Sprintf("model-%d", i%7),
+			CreatedAt: now.Add(time.Duration(i%10) * time.Minute),
+		})
+	}
+
+	_, err = db.NewInsert().
+		Model(&models).
+		Exec(context.Background())
+	require.NoError(t, err)
+
+	ids := func(models []model) []uuid.UUID {
+		ret := make([]uuid.UUID, 0, len(models))
+		for _, m := range models {
+			ret = append(ret, m.ID)
+		}
+		return ret
+	}
+
+	type testCase struct {
+		name        string
+		column      string
+		order       bunpaginate.Order
+		tieBreakers []bunpaginate.PaginationColumn
+	}
+	testCases := []testCase{
+		{
+			name:   "timestamp asc with uuid tie-breaker",
+			column: "created_at",
+			order:  bunpaginate.OrderAsc,
+			tieBreakers: []bunpaginate.PaginationColumn{{
+				Name:  "id",
+				Order: bunpaginate.OrderAsc,
+			}},
+		},
+		{
+			name:   "timestamp desc with uuid tie-breaker",
+			column: "created_at",
+			order:  bunpaginate.OrderDesc,
+			tieBreakers: []bunpaginate.PaginationColumn{{
+				Name:  "id",
+				Order: bunpaginate.OrderDesc,
+			}},
+		},
+		{
+			name:   "mixed orders on three columns",
+			column: "name",
+			order:  bunpaginate.OrderAsc,
+			tieBreakers: []bunpaginate.PaginationColumn{
+				{
+					Name:  "created_at",
+					Order: bunpaginate.OrderDesc,
+				},
+				{
+					Name:  "id",
+					Order: bunpaginate.OrderAsc,
+				},
+			},
+		},
+	}
+
+	t.Run("invalid tie-breaker column", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := bunpaginate.UsingColumn[any, model](context.Background(), db.NewSelect(), bunpaginate.ColumnPaginatedQuery[any]{
+			PageSize: 10,
+			Column:   "created_at",
+			TieBreakers: []bunpaginate.PaginationColumn{{
+				Name: "id; DROP TABLE keyset_models--",
+			}},
+		})
+		require.ErrorContains(t, err, "invalid pagination column")
+	})
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			expected := make([]model, 0)
+			sb := db.NewSelect().Model(&expected)
+			for _, column := range append([]bunpaginate.PaginationColumn{{
+				Name:  tc.column,
+				Order: tc.order,
+			}}, tc.tieBreakers...) {
+				sb = sb.OrderExpr("? ?", bun.Ident(column.Name), bun.Safe(column.Order.String()))
+			}
+			require.NoError(t, sb.Scan(context.Background()))
+
+			query := bunpaginate.ColumnPaginatedQuery[any]{
+				PageSize:    12,
+				Column:      tc.column,
+				Order:       tc.order,
+				TieBreakers: tc.tieBreakers,
+			}
+
+			// Walk forward through all pages, keeping the cursors to walk back
+			pages := make([][]model, 0)
+			cursors := []string{""}
+			for {
+				cursor, err := bunpaginate.UsingColumn[any, model](context.Background(), db.NewSelect(), query)
+				require.NoError(t, err)
+				require.Equal(t, len(pages) > 0, cursor.Previous != "")
+				pages = append(pages, cursor.Data)
+
+				if !cursor.HasMore {
+					break
+				}
+				cursors = append(cursors, cursor.Next)
+
+				query = bunpaginate.ColumnPaginatedQuery[any]{}
+				require.NoError(t, bunpaginate.UnmarshalCursor(cursor.Next, &query))
+			}
+
+			all := make([]model, 0)
+			for _, page := range pages {
+				all = append(all, page...)
+			}
+			require.Equal(t, ids(expected), ids(all))
+
+			// Walk back from the last page using previous cursors
+			query = bunpaginate.ColumnPaginatedQuery[any]{}
+			require.NoError(t, bunpaginate.UnmarshalCursor(cursors[len(cursors)-1], &query))
+			for i := len(pages) - 1; i >= 0; i-- {
+				cursor, err := bunpaginate.UsingColumn[any, model](context.Background(), db.NewSelect(), query)
+				require.NoError(t, err)
+				require.Equal(t, ids(pages[i]), ids(cursor.Data))
+				if i == 0 {
+					require.Empty(t, cursor.Previous)
+					break
+				}
+				require.NotEmpty(t, cursor.Previous)
+
+				query = bunpaginate.ColumnPaginatedQuery[any]{}
+				require.NoError(t, bunpaginate.UnmarshalCursor(cursor.Previous, &query))
+			}
+		})
+	}
+}
@@ -15,6 +15,8 @@ func usingOffset[Q any, T any](ctx context.Context, sb *bun.SelectQuery, query O
 		sb = sb.Apply(builder)
 	}
 
+	filtered := sb.Clone()
+
 	if query.Offset > 0 {
 		sb = sb.Offset(int(query.Offset))
 	}
@@ -23,7 +25,8 @@ func usingOffset[Q any, T any](ctx context.Context, sb *bun.SelectQuery, query O
 		sb = sb.Limit(int(query.PageSize) + 1)
 	}
 
-	if err := sb.Scan(ctx); err != nil {
+	total, err := scanPage(ctx, sb, filtered, &ret, query.Count, query.Conn, true)
+	if err != nil {
 		return nil, err
 	}
 
@@ -54,6 +57,9 @@ func usingOffset[Q any, T any](ctx context.Context, sb *bun.SelectQuery, query O
 		Previous: previous.EncodeAsCursor(),
 		Next:     next.EncodeAsCursor(),
 		Data:     ret,
+
+		Total:           total,
+		TotalIsEstimate: total != nil && query.Count == CountEstimated,
 	}, nil
 }
 
@@ -178,4 +178,31 @@ func TestOffsetPagination(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("with count", func(t *testing.T) {
+		t.Parallel()
+
+		for _, mode := range []bunpaginate2.CountMode{bunpaginate2.CountExact, bunpaginate2.CountEstimated} {
+			query := db.NewSelect().Model(&models).Column("id").Where("pair = ?", true)
+			cursor, err := bunpaginate2.UsingOffset[bool, model](
+				context.Background(),
+				query,
+				bunpaginate2.OffsetPaginatedQuery[bool]{
+					PageSize: 10,
+					Count:    mode,
+				})
+			require.NoError(t, err)
+			require.Len(t, cursor.Data, 10)
+			require.NotNil(t, cursor.Total)
+			require.Equal(t, mode == bunpaginate2.CountEstimated, cursor.TotalIsEstimate)
+			if mode == bunpaginate2.CountExact {
+				require.EqualValues(t, 50, *cursor.Total)
+			}
+
+			// The count mode is only kept from signed cursors
+			q := bunpaginate2.OffsetPaginatedQuery[bool]{}
+			require.NoError(t, bunpaginate2.UnmarshalCursor(cursor.Next, &q))
+			require.Equal(t, bunpaginate2.CountNone, q.Count)
+		}
+	})
 }
@@ -0,0 +1,176 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	logging "github.com/formancehq/go-libs/v5/pkg/observe/log"
+	"github.com/formancehq/go-libs/v5/pkg/storage/postgres"
+)
+
+// ErrNotRunByMigrator is returned when the Up func of a batched migration is called outside a Migrator,
+// which owns the checkpoint of the migration.
+var ErrNotRunByMigrator = errors.New("batched migrations must be run by a migrator")
+
+// BatchFunc processes at most size rows after the checkpoint, which is empty on the first call.
+// It returns the checkpoint of the last processed row, usually its primary key, and the number of processed rows.
+// The migration is done when a batch processes no row.
+type BatchFunc func(ctx context.Context, tx bun.Tx, checkpoint string, size int) (string, int, error)
+
+// CountFunc returns the number of rows a batched migration will process, reported as its progress.
+type CountFunc func(ctx context.Context, db bun.IDB) (int, error)
+
+type batchedMigration struct {
+	fn        BatchFunc
+	count     CountFunc
+	batchSize int
+	throttle  time.Duration
+}
+
+type BatchOption func(*batchedMigration)
+
+func WithBatchSize(size int) BatchOption {
+	return func(m *batchedMigration) {
+		m.batchSize = size
+	}
+}
+
+// WithThrottle pauses between batches, to leave room to the other queries on the database.
+func WithThrottle(delay time.Duration) BatchOption {
+	return func(m *batchedMigration) {
+		m.throttle = delay
+	}
+}
+
+// WithCount reports the progress of the migration against the number of rows returned by fn.
+// The count is done once, when the migration starts for the first time.
+func WithCount(fn CountFunc) BatchOption {
+	return func(m *batchedMigration) {
+		m.count = fn
+	}
+}
+
+var defaultBatchOptions = []BatchOption{
+	WithBatchSize(1000),
+}
+
+// NewBatchedMigration creates a migration running fn until it processes no row, each batch in its own transaction.
+// The checkpoint and the number of processed rows are saved in the versions table with the batch,
+// so an interrupted migration resumes after the last committed batch.
+// When the migrator runs on a transaction, batches are committed as savepoints of that transaction.
+func NewBatchedMigration(name string, fn BatchFunc, opts ...BatchOption) Migration {
+	migration := &batchedMigration{
+		fn: fn,
+	}
+	for _, opt := range append(defaultBatchOptions, opts...) {
+		opt(migration)
+	}
+
+	return Migration{
+		Name: name,
+		Up:   migration.up,
+		kind: migrationKindBatched,
+	}
+}
+
+func (m *batchedMigration) up(ctx context.Context, db bun.IDB) error {
+	running, ok := runningMigrationFromContext(ctx)
+	if !ok {
+		return ErrNotRunByMigrator
+	}
+
+	version := &Version{}
+	if err := db.NewSelect().
+		Model(version).
+		ModelTableExpr(running.versionsTable).
+		Where("version_id = ?", running.version).
+		ColumnExpr("*").
+		Scan(ctx); err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", postgres.ResolveError(err))
+	}
+
+	if m.count != nil && version.MaxCounter == 0 {
+		count, err := m.count(ctx, db)
+		if err != nil {
+			return fmt.Errorf("failed to count rows: %w", err)
+		}
+		_, err = db.NewUpdate().
+			Model(&Version{}).
+			ModelTableExpr(running.versionsTable).
+			Where("version_id = ?", running.version).
+			Set("max_counter = ?", count).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to update max counter: %w", postgres.ResolveError(err))
+		}
+	}
+
+	checkpoint := version.Checkpoint
+	if checkpoint != "" {
+		logging.FromContext(ctx).Infof("Resuming migration %d after checkpoint %s", running.version, checkpoint)
+	}
+
+	for {
+		processed := 0
+		if err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			var err error
+			checkpoint, processed, err = m.fn(ctx, tx, checkpoint, m.batchSize)
+			if err != nil {
+				return err
+			}
+			if processed == 0 {
+				return nil
+			}
+
+			_, err = tx.NewUpdate().
+				Model(&Version{}).
+				ModelTableExpr(running.versionsTable).
+				Where("version_id = ?", running.version).
+				Set("actual_counter = coalesce(actual_counter, 0) + ?", processed).
+				Set("checkpoint = ?", checkpoint).
+				Exec(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to save checkpoint: %w", postgres.ResolveError(err))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if processed == 0 {
+			return nil
+		}
+		logging.FromContext(ctx).Debugf("Migration %d: batch of %d rows done, checkpoint %s", running.version, processed, checkpoint)
+
+		if m.throttle > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(m.throttle):
+			}
+		}
+	}
+}
+
+type runningMigrationContextKey struct{}
+
+// runningMigration identifies the row of the versions table of the migration being run
+type runningMigration struct {
+	versionsTable string
+	version       int
+}
+
+func contextWithRunningMigration(ctx context.Context, versionsTable string, version int) context.Context {
+	return context.WithValue(ctx, runningMigrationContextKey{}, runningMigration{
+		versionsTable: versionsTable,
+		version:       version,
+	})
+}
+
+func runningMigrationFromContext(ctx context.Context) (runningMigration, bool) {
+	ret, ok := ctx.Value(runningMigrationContextKey{}).(runningMigration)
+	return ret, ok
+}
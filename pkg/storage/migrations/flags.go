@@ -7,18 +7,26 @@ import (
 const (
 	MigratorTableFlag  = "migrator-table"
 	MigratorSchemaFlag = "migrator-schema"
+	MigratorStrictFlag = "migrator-strict"
 )
 
 func AddFlags(flags *pflag.FlagSet) {
 	flags.String(MigratorTableFlag, migrationTable, "Table to store the migrations")
 	flags.String(MigratorSchemaFlag, "public", "Schema to use for the migrator table")
+	flags.Bool(MigratorStrictFlag, false, "Refuse to migrate when applied migrations have been modified")
 }
 
 func MigrationOptionsFromFlags(flags *pflag.FlagSet) []Option {
 	table, _ := flags.GetString(MigratorTableFlag)
 	schema, _ := flags.GetString(MigratorSchemaFlag)
-	return []Option{
+	strict, _ := flags.GetBool(MigratorStrictFlag)
+
+	options := []Option{
 		WithTableName(table),
 		WithSchema(schema),
 	}
+	if strict {
+		options = append(options, WithStrictVerification())
+	}
+	return options
 }
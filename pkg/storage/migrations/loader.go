@@ -0,0 +1,131 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/uptrace/bun"
+)
+
+// NoTxDirective makes a SQL file run outside of a transaction, for statements like "create index concurrently".
+// As postgres runs the statements of a multi statements query in an implicit transaction,
+// such files should contain a single statement.
+const NoTxDirective = "-- +notx"
+
+// PostDeployDirective makes the migration of a SQL file run in the post-deploy phase, see Phase.
+const PostDeployDirective = "-- +post-deploy"
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)[_-](.+?)(\.up|\.down)?\.sql$`)
+
+type sqlFile struct {
+	name   string
+	source string
+}
+
+// LoadMigrations builds the migrations from the SQL files of dir, named "<number>_<name>.sql".
+// The files are applied in the order of their numbers, which must follow each other starting from 1.
+// A "<number>_<name>.down.sql" file is used to roll back the migration of the same number.
+// Directives are SQL comments on their own line: NoTxDirective and PostDeployDirective.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations directory: %w", err)
+	}
+
+	ups := make(map[int]sqlFile)
+	downs := make(map[int]sqlFile)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		matches := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			continue
+		}
+		number, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration number in file %s: %w", entry.Name(), err)
+		}
+
+		files := ups
+		if matches[3] == ".down" {
+			files = downs
+		}
+		if existing, ok := files[number]; ok {
+			return nil, fmt.Errorf("migration number %d used by files %s and %s", number, existing.name, entry.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration file %s: %w", entry.Name(), err)
+		}
+		files[number] = sqlFile{
+			name:   matches[2],
+			source: string(data),
+		}
+	}
+
+	numbers := make([]int, 0, len(ups))
+	for number := range ups {
+		numbers = append(numbers, number)
+	}
+	slices.Sort(numbers)
+	for number := range downs {
+		if _, ok := ups[number]; !ok {
+			return nil, fmt.Errorf("down migration %d has no up migration", number)
+		}
+	}
+
+	ret := make([]Migration, 0, len(numbers))
+	for i, number := range numbers {
+		if number != i+1 {
+			return nil, fmt.Errorf("missing migration %d, migrations must be numbered from 1 without gap", i+1)
+		}
+
+		up := ups[number]
+		migration := Migration{
+			Name:   up.name,
+			Up:     sqlMigrationFunc(up.source),
+			Source: up.source,
+			kind:   migrationKindSQL,
+		}
+		if hasDirective(up.source, PostDeployDirective) {
+			migration.Phase = PhasePostDeploy
+		}
+		if down, ok := downs[number]; ok {
+			migration.Down = sqlMigrationFunc(down.source)
+		}
+		ret = append(ret, migration)
+	}
+
+	return ret, nil
+}
+
+func sqlMigrationFunc(source string) func(ctx context.Context, db bun.IDB) error {
+	noTx := hasDirective(source, NoTxDirective)
+	return func(ctx context.Context, db bun.IDB) error {
+		if noTx {
+			_, err := db.ExecContext(ctx, source)
+			return err
+		}
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.ExecContext(ctx, source)
+			return err
+		})
+	}
+}
+
+func hasDirective(source, directive string) bool {
+	for _, line := range strings.Split(source, "\n") {
+		if strings.TrimSpace(line) == directive {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"migrations/0002_add_index.sql":            {Data: []byte(NoTxDirective + "\n" + PostDeployDirective + "\ncreate index concurrently accounts_name on accounts (name);")},
+		"migrations/0001_create_accounts.up.sql":   {Data: []byte("create table accounts (id int, name text);")},
+		"migrations/0001_create_accounts.down.sql": {Data: []byte("drop table accounts;")},
+		"migrations/README.md":                     {Data: []byte("not a migration")},
+	}
+
+	migrations, err := LoadMigrations(fsys, "migrations")
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+
+	require.Equal(t, "create_accounts", migrations[0].Name)
+	require.Equal(t, "create table accounts (id int, name text);", migrations[0].Source)
+	require.NotNil(t, migrations[0].Down)
+	require.False(t, hasDirective(migrations[0].Source, NoTxDirective))
+	require.Equal(t, PhasePreDeploy, migrations[0].phase())
+
+	require.Equal(t, "add_index", migrations[1].Name)
+	require.Nil(t, migrations[1].Down)
+	require.True(t, hasDirective(migrations[1].Source, NoTxDirective))
+	require.Equal(t, PhasePostDeploy, migrations[1].Phase)
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	t.Parallel()
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"gap": {
+			"1_first.sql": {Data: []byte("select 1;")},
+			"3_third.sql": {Data: []byte("select 1;")},
+		},
+		"duplicated number": {
+			"1_first.sql":  {Data: []byte("select 1;")},
+			"01_other.sql": {Data: []byte("select 1;")},
+		},
+		"down without up": {
+			"1_first.sql":       {Data: []byte("select 1;")},
+			"2_second.down.sql": {Data: []byte("select 1;")},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := LoadMigrations(fsys, ".")
+			require.Error(t, err)
+		})
+	}
+}
@@ -9,4 +9,30 @@ import (
 type Migration struct {
 	Name string
 	Up   func(ctx context.Context, db bun.IDB) error
+	// Down reverts Up, it is optional
+	Down func(ctx context.Context, db bun.IDB) error
+	// Source is the SQL (or any text) the migration runs.
+	// It is hashed with the name to detect modifications of applied migrations, see Migrator.Verify.
+	// Go and batched migrations have no source by default, so changes of their code are not detected.
+	Source string
+	// Phase defaults to PhasePreDeploy
+	Phase Phase
+
+	kind migrationKind
+}
+
+// migrationKind tells how a migration has been created, it is part of its checksum
+type migrationKind string
+
+const (
+	migrationKindGo      migrationKind = "go"
+	migrationKindSQL     migrationKind = "sql"
+	migrationKindBatched migrationKind = "batched"
+)
+
+func (m Migration) getKind() migrationKind {
+	if m.kind == "" {
+		return migrationKindGo
+	}
+	return m.kind
 }
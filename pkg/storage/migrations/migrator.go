@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -31,15 +31,21 @@ const (
 var (
 	ErrMissingVersionTable = errors.New("missing version table")
 	ErrAlreadyUpToDate     = errors.New("already up to date")
+	ErrNothingToRollback   = errors.New("nothing to rollback")
+	// ErrIrreversibleMigration is returned when rolling back a migration without Down func
+	ErrIrreversibleMigration = errors.New("migration is not reversible")
 )
 
 type Info struct {
 	Version      string     `json:"version"`
 	Name         string     `json:"name"`
+	Phase        Phase      `json:"phase"`
 	State        string     `json:"state,omitempty"`
 	Date         time.Time  `json:"date,omitempty"`
 	TerminatedAt *time.Time `json:"terminatedAt,omitempty"`
 	Progress     *int       `json:"progress,omitempty"`
+	Checkpoint   string     `json:"checkpoint,omitempty"`
+	RolledBackAt *time.Time `json:"rolledBackAt,omitempty"`
 }
 
 type Migrator struct {
@@ -48,6 +54,7 @@ type Migrator struct {
 	tableName  string
 	rootDB     bun.IDB
 	tracer     trace.Tracer
+	strict     bool
 }
 
 func (m *Migrator) GetSchema() string {
@@ -62,6 +69,11 @@ func (m *Migrator) RegisterMigrations(migrations ...Migration) *Migrator {
 	return m
 }
 
+// Migrations returns the registered migrations, the migration of version n at index n-1.
+func (m *Migrator) Migrations() []Migration {
+	return slices.Clone(m.migrations)
+}
+
 func (m *Migrator) getVersionsTable() string {
 	if m.schema != "" {
 		return fmt.Sprintf(`"%s"."%s"`, m.schema, m.tableName)
@@ -90,7 +102,12 @@ func (m *Migrator) initSchema(ctx context.Context, db bun.IDB) error {
 		alter table ` + m.tableName + `
 		add column if not exists max_counter numeric,
 		add column if not exists actual_counter numeric,
-		add column if not exists terminated_at timestamp;
+		add column if not exists terminated_at timestamp,
+		add column if not exists rolled_back_at timestamp,
+		add column if not exists name text,
+		add column if not exists checksum text,
+		add column if not exists checkpoint text,
+		add column if not exists phase text;
 
 		create unique index if not exists
 		"idx_` + m.tableName + `_version_id" on ` + m.tableName + ` (version_id);
@@ -118,32 +135,37 @@ func (m *Migrator) initSchema(ctx context.Context, db bun.IDB) error {
 	return err
 }
 
-func (m *Migrator) getLastVersion(ctx context.Context, db bun.IDB) (int, error) {
-
-	actualDB := db
-	switch db := actualDB.(type) {
+// readVersionsTable runs fn, which reads the versions table.
+// If db is a tx, fn is run in a SAVEPOINT, so the tx is still usable if the table does not exist yet.
+func readVersionsTable(ctx context.Context, db bun.IDB, fn func(db bun.IDB) error) error {
+	switch db := db.(type) {
 	case bun.Tx:
-		// If we are in a tx, create a SAVEPOINT in case the table does not exist yet
 		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
-			return 0, err
+			return err
 		}
 		defer func() {
 			// Don't need to commit the tx, we just want to return to the savepoint
 			_ = tx.Rollback()
 		}()
-		actualDB = tx
+		return fn(tx)
+	default:
+		return fn(db)
 	}
+}
 
+func (m *Migrator) getLastVersion(ctx context.Context, db bun.IDB) (int, error) {
 	version := &Version{}
-	if err := actualDB.NewSelect().
-		Model(version).
-		ModelTableExpr(m.getVersionsTable()).
-		Order("version_id DESC").
-		Limit(1).
-		Where("is_applied").
-		ColumnExpr("*").
-		Scan(ctx); err != nil {
+	if err := readVersionsTable(ctx, db, func(db bun.IDB) error {
+		return db.NewSelect().
+			Model(version).
+			ModelTableExpr(m.getVersionsTable()).
+			Order("version_id DESC").
+			Limit(1).
+			Where("is_applied").
+			ColumnExpr("*").
+			Scan(ctx)
+	}); err != nil {
 		err = postgres.ResolveError(err)
 		switch {
 		case errors.Is(err, postgres.ErrMissingTable):
@@ -161,6 +183,30 @@ func (m *Migrator) getLastVersion(ctx context.Context, db bun.IDB) (int, error)
 	return version.VersionID, nil
 }
 
+// getVersions returns the rows of the versions table of the registered migrations, by version.
+// Migrations never started have no row.
+func (m *Migrator) getVersions(ctx context.Context, db bun.IDB) (map[int]Version, error) {
+	versions := make([]Version, 0)
+	if err := readVersionsTable(ctx, db, func(db bun.IDB) error {
+		return db.NewSelect().
+			TableExpr(m.getVersionsTable()).
+			Where("version_id between 1 and ?", len(m.migrations)).
+			Scan(ctx, &versions)
+	}); err != nil {
+		err = postgres.ResolveError(err)
+		if errors.Is(err, postgres.ErrMissingTable) {
+			return nil, ErrMissingVersionTable
+		}
+		return nil, err
+	}
+
+	ret := make(map[int]Version, len(versions))
+	for _, version := range versions {
+		ret[version.VersionID] = version
+	}
+	return ret, nil
+}
+
 func (m *Migrator) GetLastVersion(ctx context.Context) (int, error) {
 	return m.getLastVersion(ctx, m.rootDB)
 }
@@ -182,72 +228,117 @@ func (m *Migrator) Up(ctx context.Context) error {
 	}
 }
 
+// UpTo applies the pending migrations until version is the last applied version.
+func (m *Migrator) UpTo(ctx context.Context, version int) error {
+	ctx, span := m.tracer.Start(ctx, "migrations.UpTo")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("schema", m.GetSchema()),
+		attribute.Int("version", version),
+	)
+
+	if version < 0 || version > len(m.migrations) {
+		return fmt.Errorf("invalid version %d", version)
+	}
+
+	for {
+		err := m.upByOne(ctx, m.rootDB, version, "")
+		if err != nil {
+			if errors.Is(err, ErrAlreadyUpToDate) {
+				return nil
+			}
+			otlp.RecordError(ctx, err)
+			return err
+		}
+	}
+}
+
 func (m *Migrator) GetMigrations(ctx context.Context) ([]Info, error) {
 	ret := make([]Info, 0, len(m.migrations))
-	versions := make([]Version, 0)
 
-	if err := m.rootDB.NewSelect().
-		TableExpr(m.getVersionsTable()).
-		Order("version_id").
-		Where("version_id >= 1").
-		Limit(len(m.migrations)).
-		Scan(ctx, &versions); err != nil {
-		return nil, postgres.ResolveError(err)
+	versions, err := m.getVersions(ctx, m.rootDB)
+	// No migration has been applied yet if the table is missing
+	if err != nil && !errors.Is(err, ErrMissingVersionTable) {
+		return nil, err
 	}
 
-	for i := 0; i < int(math.Min(float64(len(versions)), float64(len(m.migrations)))); i++ {
+	for i, migration := range m.migrations {
+		version, ok := versions[i+1]
+		if !ok {
+			ret = append(ret, Info{
+				Version: fmt.Sprint(i + 1),
+				Name:    migration.Name,
+				Phase:   migration.phase(),
+				State:   "TO DO",
+			})
+			continue
+		}
+
 		var (
 			state    string
 			progress *int
 		)
-		if versions[i].IsApplied {
+		switch {
+		case version.IsApplied:
 			state = "DONE"
-		} else {
+		case version.RolledBackAt.After(version.Timestamp):
+			// Not started again since the rollback
+			state = "ROLLED BACK"
+		default:
 			state = "PROGRESS"
-			if versions[i].MaxCounter > 0 {
-				completion := versions[i].ActualCounter * 100 / versions[i].MaxCounter
+			if version.MaxCounter > 0 {
+				completion := version.ActualCounter * 100 / version.MaxCounter
 				progress = &completion
 			}
 		}
 		ret = append(ret, Info{
-			Version: fmt.Sprint(versions[i].VersionID),
-			Name:    m.migrations[i].Name,
+			Version: fmt.Sprint(version.VersionID),
+			Name:    migration.Name,
+			Phase:   migration.phase(),
 			State:   state,
-			Date:    versions[i].Timestamp,
+			Date:    version.Timestamp,
 			TerminatedAt: func() *time.Time {
-				if versions[i].TerminatedAt.IsZero() {
+				if version.TerminatedAt.IsZero() {
 					return nil
 				}
-				return &versions[i].TerminatedAt
+				return &version.TerminatedAt
+			}(),
+			Progress:   progress,
+			Checkpoint: version.Checkpoint,
+			RolledBackAt: func() *time.Time {
+				if version.RolledBackAt.IsZero() {
+					return nil
+				}
+				return &version.RolledBackAt
 			}(),
-			Progress: progress,
-		})
-	}
-
-	for i := len(versions); i < len(m.migrations); i++ {
-		ret = append(ret, Info{
-			Version: fmt.Sprint(i),
-			Name:    m.migrations[i].Name,
-			State:   "TO DO",
 		})
 	}
 
 	return ret, nil
 }
 
+// IsUpToDate reports whether the database is ready for the registered migrations:
+// all the pre-deploy migrations are applied, post-deploy migrations may still be pending.
 func (m *Migrator) IsUpToDate(ctx context.Context) (bool, error) {
-	version, err := m.GetLastVersion(ctx)
-	if err != nil {
-		if errors.Is(err, ErrMissingVersionTable) {
+	upToDate, err := m.isPhaseUpToDate(ctx, PhasePreDeploy)
+	if err != nil || !upToDate {
+		return false, err
+	}
+
+	if err := m.checkHistory(ctx, m.rootDB); err != nil {
+		if errors.Is(err, ErrHistoryDiverged{}) {
 			return false, nil
 		}
 		return false, err
 	}
 
-	return version == len(m.migrations), nil
+	return true, nil
 }
 
-func (m *Migrator) upByOne(ctx context.Context, db bun.IDB) error {
+// withLock runs fn with the advisory lock of the versions table held, and the versions table initialized.
+// On a *bun.DB, fn is given a dedicated connection, so the session lock is released on the same connection.
+func (m *Migrator) withLock(ctx context.Context, db bun.IDB, fn func(actualDB bun.IDB) error) error {
 
 	var (
 		actualDB bun.IDB
@@ -291,58 +382,145 @@ func (m *Migrator) upByOne(ctx context.Context, db bun.IDB) error {
 		return fmt.Errorf("failed to create version table: %w", err)
 	}
 
-	lastVersion, err := m.getLastVersion(ctx, actualDB)
-	if err != nil {
-		return fmt.Errorf("failed to get last version: %w", err)
-	}
-	logging.FromContext(ctx).Debugf("Detected last version: %d", lastVersion)
+	return fn(actualDB)
+}
 
-	// At this point, there is no pending migration occurring
-	if len(m.migrations) <= lastVersion {
-		logging.FromContext(ctx).Debug("All migrations done!")
-		// no more migration to play
-		return ErrAlreadyUpToDate
-	}
+// upByOne applies the first pending migration of the phase, any phase if empty, with a version lower or equal to target.
+func (m *Migrator) upByOne(ctx context.Context, db bun.IDB, target int, phase Phase) error {
+	return m.withLock(ctx, db, func(actualDB bun.IDB) error {
+		versions, err := m.getVersions(ctx, actualDB)
+		if err != nil {
+			return fmt.Errorf("failed to get versions: %w", err)
+		}
 
-	_, err = actualDB.NewInsert().
-		Model(&Version{
-			VersionID: lastVersion + 1,
-			IsApplied: false,
-			Timestamp: time.Now(),
-		}).
-		ModelTableExpr(m.getVersionsTable()).
-		On("conflict (version_id) do nothing").
-		Exec(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to insert version: %w", postgres.ResolveError(err))
-	}
+		if err := m.checkHistory(ctx, actualDB); err != nil {
+			return err
+		}
 
-	switch conn := actualDB.(type) {
-	case bun.Conn:
-		stopMigrationProgressListener := m.startMigrationProgressListener(ctx, conn, lastVersion)
-		if stopMigrationProgressListener != nil {
-			defer stopMigrationProgressListener()
+		// At this point, there is no pending migration occurring
+		index := -1
+		for i, migration := range m.migrations[:min(target, len(m.migrations))] {
+			if !versions[i+1].IsApplied && (phase == "" || migration.phase() == phase) {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			logging.FromContext(ctx).Debug("All migrations done!")
+			// no more migration to play
+			return ErrAlreadyUpToDate
+		}
+		migration := m.migrations[index]
+
+		// The row already exists if the migration has been rolled back, or was interrupted
+		_, err = actualDB.NewInsert().
+			Model(&Version{
+				VersionID: index + 1,
+				IsApplied: false,
+				Timestamp: time.Now(),
+				Phase:     string(migration.phase()),
+			}).
+			ModelTableExpr(m.getVersionsTable()).
+			On("conflict (version_id) do update set tstamp = excluded.tstamp, phase = excluded.phase").
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to insert version: %w", postgres.ResolveError(err))
 		}
-	}
 
-	logging.FromContext(ctx).Debugf("Running migration %d: %s", lastVersion, m.migrations[lastVersion].Name)
-	if err := m.migrations[lastVersion].Up(ctx, actualDB); err != nil {
-		return fmt.Errorf("failed to run migration '%s': %w", m.migrations[lastVersion].Name, err)
-	}
+		switch conn := actualDB.(type) {
+		case bun.Conn:
+			stopMigrationProgressListener := m.startMigrationProgressListener(ctx, conn, index)
+			if stopMigrationProgressListener != nil {
+				defer stopMigrationProgressListener()
+			}
+		}
 
-	logging.FromContext(ctx).Debugf("Migration %d done", lastVersion)
-	_, err = actualDB.NewUpdate().
-		Model(&Version{}).
-		Where("version_id = ? and not is_applied", lastVersion+1).
-		Set("is_applied = true").
-		Set("terminated_at = ?", time.Now()).
-		ModelTableExpr(m.getVersionsTable()).
-		Exec(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to insert new version: %w", postgres.ResolveError(err))
-	}
+		logging.FromContext(ctx).Debugf("Running %s migration %d: %s", migration.phase(), index, migration.Name)
+		ctx := contextWithRunningMigration(ctx, m.getVersionsTable(), index+1)
+		if err := migration.Up(ctx, actualDB); err != nil {
+			return fmt.Errorf("failed to run migration '%s': %w", migration.Name, err)
+		}
 
-	return nil
+		logging.FromContext(ctx).Debugf("Migration %d done", index)
+		_, err = actualDB.NewUpdate().
+			Model(&Version{}).
+			Where("version_id = ? and not is_applied", index+1).
+			Set("is_applied = true").
+			Set("terminated_at = ?", time.Now()).
+			Set("name = ?", migration.Name).
+			Set("checksum = ?", migration.Checksum()).
+			ModelTableExpr(m.getVersionsTable()).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to insert new version: %w", postgres.ResolveError(err))
+		}
+
+		return nil
+	})
+}
+
+func (m *Migrator) downByOne(ctx context.Context, db bun.IDB, target int) error {
+	return m.withLock(ctx, db, func(actualDB bun.IDB) error {
+		lastVersion, err := m.getLastVersion(ctx, actualDB)
+		if err != nil {
+			return fmt.Errorf("failed to get last version: %w", err)
+		}
+		logging.FromContext(ctx).Debugf("Detected last version: %d", lastVersion)
+
+		if lastVersion <= target {
+			return ErrNothingToRollback
+		}
+		if lastVersion > len(m.migrations) {
+			return fmt.Errorf("version %d is not registered", lastVersion)
+		}
+
+		migration := m.migrations[lastVersion-1]
+		if migration.Down == nil {
+			return fmt.Errorf("failed to rollback migration '%s': %w", migration.Name, ErrIrreversibleMigration)
+		}
+
+		// Reset the counters, so the progress reported by the down migration starts from scratch,
+		// and the checkpoint, so a batched migration applied again starts from the beginning
+		_, err = actualDB.NewUpdate().
+			Model(&Version{}).
+			Where("version_id = ?", lastVersion).
+			Set("max_counter = null").
+			Set("actual_counter = null").
+			Set("checkpoint = null").
+			ModelTableExpr(m.getVersionsTable()).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to reset version counters: %w", postgres.ResolveError(err))
+		}
+
+		switch conn := actualDB.(type) {
+		case bun.Conn:
+			stopMigrationProgressListener := m.startMigrationProgressListener(ctx, conn, lastVersion-1)
+			if stopMigrationProgressListener != nil {
+				defer stopMigrationProgressListener()
+			}
+		}
+
+		logging.FromContext(ctx).Debugf("Rolling back migration %d: %s", lastVersion-1, migration.Name)
+		if err := migration.Down(ctx, actualDB); err != nil {
+			return fmt.Errorf("failed to rollback migration '%s': %w", migration.Name, err)
+		}
+
+		logging.FromContext(ctx).Debugf("Migration %d rolled back", lastVersion-1)
+		_, err = actualDB.NewUpdate().
+			Model(&Version{}).
+			Where("version_id = ? and is_applied", lastVersion).
+			Set("is_applied = false").
+			Set("terminated_at = null").
+			Set("rolled_back_at = ?", time.Now()).
+			ModelTableExpr(m.getVersionsTable()).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to update version: %w", postgres.ResolveError(err))
+		}
+
+		return nil
+	})
 }
 
 type migrationProgressRawConn interface {
@@ -448,7 +626,7 @@ func (m *Migrator) UpByOne(ctx context.Context) error {
 
 	span.SetAttributes(attribute.String("schema", m.GetSchema()))
 
-	err := m.upByOne(ctx, m.rootDB)
+	err := m.upByOne(ctx, m.rootDB, len(m.migrations), "")
 	if err != nil && !errors.Is(err, ErrAlreadyUpToDate) {
 		otlp.RecordError(ctx, err)
 		return err
@@ -457,6 +635,50 @@ func (m *Migrator) UpByOne(ctx context.Context) error {
 	return err
 }
 
+// DownByOne rolls back the last applied migration.
+// It returns ErrNothingToRollback if no migration is applied.
+func (m *Migrator) DownByOne(ctx context.Context) error {
+	ctx, span := m.tracer.Start(ctx, "migrations.DownByOne")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("schema", m.GetSchema()))
+
+	err := m.downByOne(ctx, m.rootDB, 0)
+	if err != nil && !errors.Is(err, ErrNothingToRollback) {
+		otlp.RecordError(ctx, err)
+		return err
+	}
+
+	return err
+}
+
+// DownTo rolls back the applied migrations, last first, until version is the last applied version.
+// Version 0 rolls back every migration.
+func (m *Migrator) DownTo(ctx context.Context, version int) error {
+	ctx, span := m.tracer.Start(ctx, "migrations.DownTo")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("schema", m.GetSchema()),
+		attribute.Int("version", version),
+	)
+
+	if version < 0 {
+		return fmt.Errorf("invalid version %d", version)
+	}
+
+	for {
+		err := m.downByOne(ctx, m.rootDB, version)
+		if err != nil {
+			if errors.Is(err, ErrNothingToRollback) {
+				return nil
+			}
+			otlp.RecordError(ctx, err)
+			return err
+		}
+	}
+}
+
 func NewMigrator(db bun.IDB, opts ...Option) *Migrator {
 	ret := &Migrator{
 		rootDB:    db,
@@ -488,6 +710,14 @@ func WithTracer(tracer trace.Tracer) Option {
 	}
 }
 
+// WithStrictVerification makes Up and UpByOne refuse to run, and IsUpToDate report false,
+// when the applied migrations diverge from the registered ones (see Verify).
+func WithStrictVerification() Option {
+	return func(m *Migrator) {
+		m.strict = true
+	}
+}
+
 var defaultOptions = []Option{
 	WithTracer(noop.Tracer{}),
 }
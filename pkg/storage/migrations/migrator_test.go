@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 
@@ -223,6 +225,350 @@ func TestTwoMigratorsSameSchema(t *testing.T) {
 	require.NoError(t, second.Up(ctx))
 }
 
+func TestMigrationsDown(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	schema := uuid.NewString()[:8]
+
+	createTable := func(name string) Migration {
+		return Migration{
+			Name: "create " + name,
+			Up: func(ctx context.Context, db bun.IDB) error {
+				_, err := db.ExecContext(ctx, `create table "`+schema+`".`+name+` (id int)`)
+				return err
+			},
+			Down: func(ctx context.Context, db bun.IDB) error {
+				_, err := db.ExecContext(ctx, `drop table "`+schema+`".`+name)
+				return err
+			},
+		}
+	}
+	tableExists := func(name string) bool {
+		exists := false
+		require.NoError(t, bunDB.NewRaw(`select exists (
+			select from information_schema.tables where table_schema = ? and table_name = ?
+		)`, schema, name).Scan(ctx, &exists))
+		return exists
+	}
+
+	migrator := NewMigrator(bunDB, WithSchema(schema))
+	migrator.RegisterMigrations(
+		Migration{
+			Name: "irreversible",
+			Up: func(ctx context.Context, db bun.IDB) error {
+				return nil
+			},
+		},
+		createTable("a"),
+		createTable("b"),
+	)
+	require.ErrorIs(t, migrator.DownByOne(ctx), ErrNothingToRollback)
+	require.NoError(t, migrator.Up(ctx))
+
+	require.NoError(t, migrator.DownByOne(ctx))
+	require.False(t, tableExists("b"))
+	require.True(t, tableExists("a"))
+
+	version, err := migrator.GetLastVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	upToDate, err := migrator.IsUpToDate(ctx)
+	require.NoError(t, err)
+	require.False(t, upToDate)
+
+	migrations, err := migrator.GetMigrations(ctx)
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+	require.Equal(t, "DONE", migrations[1].State)
+	require.Equal(t, "ROLLED BACK", migrations[2].State)
+	require.NotNil(t, migrations[2].RolledBackAt)
+	require.Nil(t, migrations[2].TerminatedAt)
+
+	// Rolled back migrations can be applied again
+	require.NoError(t, migrator.Up(ctx))
+	require.True(t, tableExists("b"))
+
+	migrations, err = migrator.GetMigrations(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "DONE", migrations[2].State)
+
+	require.NoError(t, migrator.DownTo(ctx, 1))
+	require.False(t, tableExists("a"))
+	require.False(t, tableExists("b"))
+
+	version, err = migrator.GetLastVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+
+	require.ErrorIs(t, migrator.DownTo(ctx, 0), ErrIrreversibleMigration)
+}
+
+func TestMigrationsVerify(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	options := []Option{
+		WithSchema(uuid.NewString()[:8]),
+		WithStrictVerification(),
+	}
+
+	noop := func(ctx context.Context, db bun.IDB) error {
+		return nil
+	}
+	applied := []Migration{
+		{Name: "first", Source: "create table a (id int)", Up: noop},
+		{Name: "second", Source: "create table b (id int)", Up: noop},
+		{Name: "third", Source: "create table c (id int)", Up: noop},
+		{Name: "fourth", Up: noop},
+	}
+
+	migrator := NewMigrator(bunDB, options...)
+	migrator.RegisterMigrations(applied...)
+	require.NoError(t, migrator.Up(ctx))
+
+	// Go migrations have no source to verify
+	drifts, err := migrator.Verify(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Drift{{
+		Version:         4,
+		Kind:            DriftUnverifiable,
+		AppliedName:     "fourth",
+		AppliedChecksum: applied[3].Checksum(),
+		Name:            "fourth",
+		Checksum:        applied[3].Checksum(),
+	}}, drifts)
+	require.NoError(t, migrator.Up(ctx))
+
+	diverged := NewMigrator(bunDB, options...)
+	diverged.RegisterMigrations(
+		Migration{Name: "first renamed", Source: applied[0].Source, Up: noop},
+		Migration{Name: "second", Source: "create table b (id bigint)", Up: noop},
+	)
+
+	drifts, err = diverged.Verify(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Drift{
+		{
+			Version:         1,
+			Kind:            DriftRenamed,
+			AppliedName:     "first",
+			AppliedChecksum: applied[0].Checksum(),
+			Name:            "first renamed",
+			Checksum:        diverged.migrations[0].Checksum(),
+		},
+		{
+			Version:         2,
+			Kind:            DriftModified,
+			AppliedName:     "second",
+			AppliedChecksum: applied[1].Checksum(),
+			Name:            "second",
+			Checksum:        diverged.migrations[1].Checksum(),
+		},
+		{
+			Version:         3,
+			Kind:            DriftMissing,
+			AppliedName:     "third",
+			AppliedChecksum: applied[2].Checksum(),
+		},
+		{
+			Version:         4,
+			Kind:            DriftMissing,
+			AppliedName:     "fourth",
+			AppliedChecksum: applied[3].Checksum(),
+		},
+	}, drifts)
+
+	diverged.RegisterMigrations(applied[2], Migration{Name: "fourth", Phase: PhasePostDeploy, Up: noop})
+	require.ErrorIs(t, diverged.Up(ctx), ErrHistoryDiverged{})
+
+	upToDate, err := diverged.IsUpToDate(ctx)
+	require.NoError(t, err)
+	require.False(t, upToDate)
+
+	// Without strict mode, the history is only reported
+	lenient := NewMigrator(bunDB, options[0])
+	lenient.RegisterMigrations(diverged.migrations...)
+	require.NoError(t, lenient.Up(ctx))
+}
+
+func TestMigrationChecksum(t *testing.T) {
+	t.Parallel()
+
+	noop := func(ctx context.Context, db bun.IDB) error {
+		return nil
+	}
+	migration := Migration{Name: "first", Source: "create table a (id int)", Up: noop}
+	checksums := map[string]struct{}{}
+	for _, m := range []Migration{
+		migration,
+		{Name: "first renamed", Source: migration.Source, Up: noop},
+		{Name: migration.Name, Source: migration.Source, Phase: PhasePostDeploy, Up: noop},
+		{Name: migration.Name, Source: migration.Source, Up: noop, kind: migrationKindSQL},
+		{Name: migration.Name + "create", Source: " table a (id int)", Up: noop},
+		NewBatchedMigration(migration.Name, nil),
+		{Name: migration.Name, Up: noop},
+	} {
+		checksums[m.Checksum()] = struct{}{}
+	}
+	require.Len(t, checksums, 7)
+	require.Equal(t, migration.Checksum(), Migration{Name: "first", Source: migration.Source, Phase: PhasePreDeploy}.Checksum())
+}
+
+func TestBatchedMigration(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	schema := uuid.NewString()[:8]
+
+	errInterrupted := errors.New("interrupted")
+	interrupted := false
+	batches := 0
+
+	newMigrator := func() *Migrator {
+		migrator := NewMigrator(bunDB, WithSchema(schema))
+		migrator.RegisterMigrations(
+			Migration{
+				Name: "create accounts",
+				Up: func(ctx context.Context, db bun.IDB) error {
+					_, err := db.ExecContext(ctx, `
+						create table "`+schema+`".accounts (id int primary key, migrated bool not null default false);
+						insert into "`+schema+`".accounts (id) select generate_series(1, 25);
+					`)
+					return err
+				},
+			},
+			NewBatchedMigration("migrate accounts", func(ctx context.Context, tx bun.Tx, checkpoint string, size int) (string, int, error) {
+				batches++
+				if batches == 3 && !interrupted {
+					interrupted = true
+					return "", 0, errInterrupted
+				}
+
+				from := 0
+				if checkpoint != "" {
+					from, _ = strconv.Atoi(checkpoint)
+				}
+				ids := make([]int, 0)
+				if err := tx.NewRaw(`
+					update "`+schema+`".accounts
+					set migrated = true
+					where id in (select id from "`+schema+`".accounts where id > ? order by id limit ?)
+					returning id
+				`, from, size).Scan(ctx, &ids); err != nil {
+					return "", 0, err
+				}
+				if len(ids) == 0 {
+					return checkpoint, 0, nil
+				}
+				return strconv.Itoa(slices.Max(ids)), len(ids), nil
+			},
+				WithBatchSize(10),
+				WithThrottle(time.Millisecond),
+				WithCount(func(ctx context.Context, db bun.IDB) (int, error) {
+					return db.NewSelect().TableExpr(`"` + schema + `".accounts`).Count(ctx)
+				}),
+			),
+		)
+		return migrator
+	}
+
+	migrator := newMigrator()
+	require.ErrorIs(t, migrator.Up(ctx), errInterrupted)
+
+	migrations, err := migrator.GetMigrations(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "PROGRESS", migrations[1].State)
+	require.Equal(t, "20", migrations[1].Checkpoint)
+	require.NotNil(t, migrations[1].Progress)
+	require.Equal(t, 80, *migrations[1].Progress)
+
+	// The migration resumes after the last committed batch
+	require.NoError(t, newMigrator().Up(ctx))
+	require.Equal(t, 5, batches)
+
+	migrated := 0
+	require.NoError(t, bunDB.NewRaw(`select count(*) from "`+schema+`".accounts where migrated`).Scan(ctx, &migrated))
+	require.Equal(t, 25, migrated)
+
+	migrations, err = migrator.GetMigrations(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "DONE", migrations[1].State)
+	require.Equal(t, "25", migrations[1].Checkpoint)
+
+	require.ErrorIs(t, NewBatchedMigration("outside", nil).Up(ctx, bunDB), ErrNotRunByMigrator)
+}
+
+func TestMigrationsPhases(t *testing.T) {
+	t.Parallel()
+
+	ctx := logging.TestingContext()
+	schema := uuid.NewString()[:8]
+
+	applied := make([]string, 0)
+	migration := func(name string, phase Phase) Migration {
+		return Migration{
+			Name:  name,
+			Phase: phase,
+			Up: func(ctx context.Context, db bun.IDB) error {
+				applied = append(applied, name)
+				return nil
+			},
+		}
+	}
+
+	migrator := NewMigrator(bunDB, WithSchema(schema))
+	migrator.RegisterMigrations(
+		migration("add column", ""),
+		migration("drop old column", PhasePostDeploy),
+		migration("add table", PhasePreDeploy),
+	)
+
+	upToDate, err := migrator.IsUpToDate(ctx)
+	require.NoError(t, err)
+	require.False(t, upToDate)
+
+	require.NoError(t, migrator.UpPhase(ctx, PhasePreDeploy))
+	require.Equal(t, []string{"add column", "add table"}, applied)
+
+	// The new version can run while the post-deploy migrations are pending
+	upToDate, err = migrator.IsUpToDate(ctx)
+	require.NoError(t, err)
+	require.True(t, upToDate)
+
+	upToDate, err = migrator.IsPhaseUpToDate(ctx, PhasePostDeploy)
+	require.NoError(t, err)
+	require.False(t, upToDate)
+
+	migrations, err := migrator.GetMigrations(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "DONE", migrations[0].State)
+	require.Equal(t, "TO DO", migrations[1].State)
+	require.Equal(t, PhasePostDeploy, migrations[1].Phase)
+	require.Equal(t, "DONE", migrations[2].State)
+
+	require.NoError(t, migrator.UpPhase(ctx, PhasePostDeploy))
+	require.Equal(t, []string{"add column", "add table", "drop old column"}, applied)
+
+	upToDate, err = migrator.IsPhaseUpToDate(ctx, PhasePostDeploy)
+	require.NoError(t, err)
+	require.True(t, upToDate)
+
+	phase := ""
+	require.NoError(t, bunDB.NewSelect().
+		TableExpr(`"`+schema+`".`+migrationTable).
+		Column("phase").
+		Where("version_id = 2").
+		Scan(ctx, &phase))
+	require.Equal(t, string(PhasePostDeploy), phase)
+
+	require.NoError(t, migrator.Up(ctx))
+	require.Len(t, applied, 3)
+
+	require.Error(t, migrator.UpPhase(ctx, "unknown"))
+}
+
 func TestAddFlags(t *testing.T) {
 	t.Parallel()
 
@@ -237,4 +583,9 @@ func TestAddFlags(t *testing.T) {
 	require.NoError(t, flags.Set(MigratorSchemaFlag, "test"))
 	table, _ = flags.GetString(MigratorSchemaFlag)
 	require.Equal(t, table, "test")
+
+	require.Len(t, MigrationOptionsFromFlags(flags), 2)
+	require.NoError(t, flags.Set(MigratorStrictFlag, "true"))
+	migrator := NewMigrator(nil, MigrationOptionsFromFlags(flags)...)
+	require.True(t, migrator.strict)
 }
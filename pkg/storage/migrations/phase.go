@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	otlp "github.com/formancehq/go-libs/v5/pkg/observe"
+)
+
+// Phase tells when a migration runs during a rolling deploy, see UpPhase.
+type Phase string
+
+const (
+	// PhasePreDeploy migrations expand the schema, before the new version starts.
+	// The previous version, still running, must keep working with them.
+	// It is the phase of the migrations without phase.
+	PhasePreDeploy Phase = "pre-deploy"
+	// PhasePostDeploy migrations contract the schema, once the previous version has stopped.
+	// The new version must work whether they have been applied or not.
+	PhasePostDeploy Phase = "post-deploy"
+)
+
+func (p Phase) Validate() error {
+	switch p {
+	case PhasePreDeploy, PhasePostDeploy:
+		return nil
+	default:
+		return fmt.Errorf("invalid phase '%s'", p)
+	}
+}
+
+func (m Migration) phase() Phase {
+	if m.Phase == "" {
+		return PhasePreDeploy
+	}
+	return m.Phase
+}
+
+// UpPhase applies the pending migrations of the phase, in the order of their versions.
+// Pending migrations of the other phase are skipped, so migrations may be applied out of order.
+func (m *Migrator) UpPhase(ctx context.Context, phase Phase) error {
+	ctx, span := m.tracer.Start(ctx, "migrations.UpPhase")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("schema", m.GetSchema()),
+		attribute.String("phase", string(phase)),
+	)
+
+	if err := phase.Validate(); err != nil {
+		return err
+	}
+
+	for {
+		err := m.upByOne(ctx, m.rootDB, len(m.migrations), phase)
+		if err != nil {
+			if errors.Is(err, ErrAlreadyUpToDate) {
+				return nil
+			}
+			otlp.RecordError(ctx, err)
+			return err
+		}
+	}
+}
+
+// IsPhaseUpToDate reports whether all the migrations of the phase are applied.
+func (m *Migrator) IsPhaseUpToDate(ctx context.Context, phase Phase) (bool, error) {
+	if err := phase.Validate(); err != nil {
+		return false, err
+	}
+	return m.isPhaseUpToDate(ctx, phase)
+}
+
+func (m *Migrator) isPhaseUpToDate(ctx context.Context, phase Phase) (bool, error) {
+	versions, err := m.getVersions(ctx, m.rootDB)
+	if err != nil {
+		if errors.Is(err, ErrMissingVersionTable) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for i, migration := range m.migrations {
+		if migration.phase() == phase && !versions[i+1].IsApplied {
+			return false, nil
+		}
+	}
+	return true, nil
+}
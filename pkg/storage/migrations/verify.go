@@ -0,0 +1,175 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/uptrace/bun"
+
+	"github.com/formancehq/go-libs/v5/pkg/storage/postgres"
+)
+
+// Checksum returns the hash of the migration kind, phase, name and source, stored when the migration is applied.
+func (m Migration) Checksum() string {
+	return m.checksum(m.Name)
+}
+
+func (m Migration) checksum(name string) string {
+	hash := sha256.New()
+	for _, part := range []string{string(m.getKind()), string(m.phase()), name, m.Source} {
+		// Separates the parts, so they cannot be shifted from one to another
+		_, _ = fmt.Fprintf(hash, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+type DriftKind string
+
+const (
+	// DriftRenamed is reported when an applied migration has the same source under another name
+	DriftRenamed DriftKind = "RENAMED"
+	// DriftModified is reported when the source, the kind or the phase of an applied migration has changed
+	DriftModified DriftKind = "MODIFIED"
+	// DriftMissing is reported when an applied migration is not registered anymore
+	DriftMissing DriftKind = "MISSING"
+	// DriftUnverifiable is reported when an applied migration has no source, like Go and batched migrations by default.
+	// Only its name, kind and phase are verified, so it does not make the history diverge.
+	DriftUnverifiable DriftKind = "UNVERIFIABLE"
+)
+
+// Drift describes a difference between an applied migration and the registered one.
+type Drift struct {
+	Version         int       `json:"version"`
+	Kind            DriftKind `json:"kind"`
+	AppliedName     string    `json:"appliedName"`
+	AppliedChecksum string    `json:"appliedChecksum"`
+	Name            string    `json:"name,omitempty"`
+	Checksum        string    `json:"checksum,omitempty"`
+}
+
+func (d Drift) String() string {
+	switch d.Kind {
+	case DriftRenamed:
+		return fmt.Sprintf("migration %d renamed from '%s' to '%s'", d.Version, d.AppliedName, d.Name)
+	case DriftModified:
+		return fmt.Sprintf("migration %d ('%s') modified since applied", d.Version, d.AppliedName)
+	case DriftUnverifiable:
+		return fmt.Sprintf("migration %d ('%s') has no source to verify", d.Version, d.AppliedName)
+	default:
+		return fmt.Sprintf("migration %d ('%s') is not registered anymore", d.Version, d.AppliedName)
+	}
+}
+
+type ErrHistoryDiverged struct {
+	Drifts []Drift
+}
+
+// Diverged reports whether the drift makes the history diverge
+func (d Drift) Diverged() bool {
+	return d.Kind != DriftUnverifiable
+}
+
+// divergedDrifts filters out the drifts which do not make the history diverge
+func divergedDrifts(drifts []Drift) []Drift {
+	ret := make([]Drift, 0, len(drifts))
+	for _, drift := range drifts {
+		if drift.Diverged() {
+			ret = append(ret, drift)
+		}
+	}
+	return ret
+}
+
+func (e ErrHistoryDiverged) Error() string {
+	drifts := make([]string, 0, len(e.Drifts))
+	for _, drift := range e.Drifts {
+		drifts = append(drifts, drift.String())
+	}
+	return fmt.Sprintf("migrations history has diverged: %s", strings.Join(drifts, ", "))
+}
+
+func (e ErrHistoryDiverged) Is(err error) bool {
+	_, ok := err.(ErrHistoryDiverged)
+	return ok
+}
+
+// Verify compares the applied migrations with the registered ones.
+// Migrations applied before fingerprints were recorded are not verified,
+// and the migrations without source are reported as DriftUnverifiable.
+func (m *Migrator) Verify(ctx context.Context) ([]Drift, error) {
+	ctx, span := m.tracer.Start(ctx, "migrations.Verify")
+	defer span.End()
+
+	drifts, err := m.verify(ctx, m.rootDB)
+	if err != nil && errors.Is(err, ErrMissingVersionTable) {
+		return nil, nil
+	}
+	return drifts, err
+}
+
+func (m *Migrator) verify(ctx context.Context, db bun.IDB) ([]Drift, error) {
+	versions := make([]Version, 0)
+	if err := db.NewSelect().
+		TableExpr(m.getVersionsTable()).
+		Where("version_id >= 1").
+		Where("is_applied").
+		Where("checksum is not null").
+		Order("version_id").
+		Scan(ctx, &versions); err != nil {
+		err = postgres.ResolveError(err)
+		if errors.Is(err, postgres.ErrMissingTable) {
+			return nil, ErrMissingVersionTable
+		}
+		return nil, err
+	}
+
+	drifts := make([]Drift, 0)
+	for _, version := range versions {
+		drift := Drift{
+			Version:         version.VersionID,
+			AppliedName:     version.Name,
+			AppliedChecksum: version.Checksum,
+		}
+		if version.VersionID > len(m.migrations) {
+			drift.Kind = DriftMissing
+			drifts = append(drifts, drift)
+			continue
+		}
+
+		migration := m.migrations[version.VersionID-1]
+		drift.Name = migration.Name
+		drift.Checksum = migration.Checksum()
+		switch {
+		case drift.Checksum == drift.AppliedChecksum && migration.Source == "":
+			drift.Kind = DriftUnverifiable
+		case drift.Checksum == drift.AppliedChecksum:
+			continue
+		case drift.Name != drift.AppliedName && migration.checksum(drift.AppliedName) == drift.AppliedChecksum:
+			drift.Kind = DriftRenamed
+		default:
+			drift.Kind = DriftModified
+		}
+		drifts = append(drifts, drift)
+	}
+
+	return drifts, nil
+}
+
+// checkHistory returns an ErrHistoryDiverged if the migrator is strict and the history has diverged.
+func (m *Migrator) checkHistory(ctx context.Context, db bun.IDB) error {
+	if !m.strict {
+		return nil
+	}
+	drifts, err := m.verify(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to verify migrations: %w", err)
+	}
+	if drifts := divergedDrifts(drifts); len(drifts) > 0 {
+		return ErrHistoryDiverged{Drifts: drifts}
+	}
+	return nil
+}
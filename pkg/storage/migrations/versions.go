@@ -10,4 +10,9 @@ type Version struct {
 	MaxCounter    int       `bun:"max_counter,type:numeric,nullzero"`
 	ActualCounter int       `bun:"actual_counter,type:numeric,nullzero"`
 	TerminatedAt  time.Time `bun:"terminated_at,type:timestamp,nullzero"`
+	RolledBackAt  time.Time `bun:"rolled_back_at,type:timestamp,nullzero"`
+	Name          string    `bun:"name,type:text,nullzero"`
+	Checksum      string    `bun:"checksum,type:text,nullzero"`
+	Checkpoint    string    `bun:"checkpoint,type:text,nullzero"`
+	Phase         string    `bun:"phase,type:text,nullzero"`
 }
@@ -0,0 +1,100 @@
+// Package rabbitmqtesting runs a RabbitMQ broker in a docker container.
+package rabbitmqtesting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/formancehq/go-libs/v5/pkg/testing/docker"
+)
+
+const (
+	defaultVersion = "3-management-alpine"
+	username       = "guest"
+	password       = "guest"
+)
+
+type T interface {
+	require.TestingT
+	Cleanup(func())
+}
+
+type Server struct {
+	// URL is the AMQP url of the broker
+	URL string
+	// managementURL is the url of the HTTP API of the management plugin
+	managementURL string
+}
+
+// CloseConnections closes the client connections of the broker, to test reconnections, and returns their number.
+// The management plugin lists new connections after a few seconds.
+func (s *Server) CloseConnections(t T) int {
+	connections := make([]struct {
+		Name string `json:"name"`
+	}, 0)
+	require.NoError(t, s.request(http.MethodGet, "/api/connections", &connections))
+
+	for _, connection := range connections {
+		require.NoError(t, s.request(http.MethodDelete, "/api/connections/"+url.PathEscape(connection.Name), nil))
+	}
+	return len(connections)
+}
+
+func (s *Server) request(method, path string, ret any) error {
+	req, err := http.NewRequest(method, s.managementURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, password)
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+
+	if rsp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status code %d on %s %s", rsp.StatusCode, method, path)
+	}
+	if ret == nil {
+		return nil
+	}
+	return json.NewDecoder(rsp.Body).Decode(ret)
+}
+
+func CreateServer(t T, pool *docker.Pool) *Server {
+	resource := pool.Run(docker.Configuration{
+		Timeout:            time.Minute,
+		RetryCheckInterval: time.Second,
+		RunOptions: &dockertest.RunOptions{
+			Repository: "rabbitmq",
+			Tag:        defaultVersion,
+		},
+		CheckFn: func(ctx context.Context, resource *dockertest.Resource) error {
+			conn, err := amqp.Dial(amqpURL(resource))
+			if err != nil {
+				return fmt.Errorf("connecting to broker: %w", err)
+			}
+			return conn.Close()
+		},
+	})
+
+	return &Server{
+		URL:           amqpURL(resource),
+		managementURL: fmt.Sprintf("http://127.0.0.1:%s", resource.GetPort("15672/tcp")),
+	}
+}
+
+func amqpURL(resource *dockertest.Resource) string {
+	return fmt.Sprintf("amqp://%s:%s@127.0.0.1:%s/", username, password, resource.GetPort("5672/tcp"))
+}
@@ -0,0 +1,136 @@
+// Package schemaregistrytesting runs an in-process fake of a Confluent compatible schema registry.
+package schemaregistrytesting
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stretchr/testify/require"
+)
+
+type T interface {
+	require.TestingT
+	Helper()
+	Cleanup(func())
+}
+
+type schema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+// Server implements the registration and the lookup of schemas.
+// Like a real registry, registering the same schema twice returns the same ID.
+type Server struct {
+	URL string
+
+	mu       sync.Mutex
+	schemas  []schema
+	subjects map[string][]int
+	requests int
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/subjects/") && strings.HasSuffix(r.URL.Path, "/versions"):
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		s.register(w, r, subject)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+		s.get(w, strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+	default:
+		writeError(w, http.StatusNotFound, 404, "not found")
+	}
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request, subject string) {
+	payload := schema{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Schema == "" {
+		writeError(w, http.StatusUnprocessableEntity, 42201, "invalid schema")
+		return
+	}
+
+	id := -1
+	for i, existing := range s.schemas {
+		if existing == payload {
+			id = i + 1
+			break
+		}
+	}
+	if id == -1 {
+		s.schemas = append(s.schemas, payload)
+		id = len(s.schemas)
+	}
+	for _, existing := range s.subjects[subject] {
+		if existing == id {
+			writeJSON(w, map[string]int{"id": id})
+			return
+		}
+	}
+	s.subjects[subject] = append(s.subjects[subject], id)
+
+	writeJSON(w, map[string]int{"id": id})
+}
+
+func (s *Server) get(w http.ResponseWriter, rawID string) {
+	id, err := strconv.Atoi(rawID)
+	if err != nil || id <= 0 || id > len(s.schemas) {
+		writeError(w, http.StatusNotFound, 40403, "Schema not found")
+		return
+	}
+	writeJSON(w, s.schemas[id-1])
+}
+
+// Subjects returns the IDs of the schemas registered under each subject.
+func (s *Server) Subjects() map[string][]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make(map[string][]int, len(s.subjects))
+	for subject, ids := range s.subjects {
+		ret[subject] = append([]int{}, ids...)
+	}
+	return ret
+}
+
+// Requests returns the number of requests received, to check the caching of the clients.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+func NewServer(t T) *Server {
+	t.Helper()
+
+	ret := &Server{
+		subjects: make(map[string][]int),
+	}
+	server := httptest.NewServer(ret)
+	t.Cleanup(server.Close)
+	ret.URL = server.URL
+
+	return ret
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error_code": code,
+		"message":    message,
+	})
+}
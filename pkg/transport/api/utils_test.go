@@ -373,6 +373,22 @@ func TestRenderCursor(t *testing.T) {
 	require.Equal(t, cursor.Data, response.Cursor.Data)
 }
 
+func TestRenderCursorWithTotal(t *testing.T) {
+	t.Parallel()
+
+	total := uint64(120)
+	rr := httptest.NewRecorder()
+	api.RenderCursor(rr, bunpaginate.Cursor[string]{
+		PageSize:        10,
+		Data:            []string{"item1"},
+		Total:           &total,
+		TotalIsEstimate: true,
+	})
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"cursor":{"pageSize":10,"hasMore":false,"data":["item1"],"total":120,"totalIsEstimate":true}}`, rr.Body.String())
+}
+
 func TestWriteResponse(t *testing.T) {
 	t.Parallel()
 	// Create a response recorder